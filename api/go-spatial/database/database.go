@@ -82,9 +82,16 @@ func Migrate(db *sql.DB) error {
 func CreateTables(db *sql.DB) error {
 	tables := []string{
 		createGeofencesTable(),
+		createGeofenceGeometryColumn(),
 		createDeliveryLocationsTable(),
 		createPointsOfInterestTable(),
 		createTrafficDataTable(),
+		createTrafficIngestionColumns(),
+		createTrafficReceivedColumn(),
+		createGeofencePresenceTable(),
+		createGeofenceEventsTable(),
+		createRouteHistoryTables(),
+		createDriverLocationsTable(),
 		createSpatialIndexes(),
 	}
 
@@ -155,6 +162,142 @@ func createTrafficDataTable() string {
 	);`
 }
 
+func createGeofenceGeometryColumn() string {
+	return `
+	ALTER TABLE geofences ALTER COLUMN geometry TYPE GEOMETRY(GEOMETRY, 4326);
+
+	ALTER TABLE geofences DROP CONSTRAINT IF EXISTS geofences_geometry_areal;
+	ALTER TABLE geofences ADD CONSTRAINT geofences_geometry_areal
+		CHECK (GeometryType(geometry) IN ('POLYGON', 'MULTIPOLYGON'));`
+}
+
+func createTrafficIngestionColumns() string {
+	return `
+	ALTER TABLE traffic_data ADD COLUMN IF NOT EXISTS observation_key VARCHAR(255);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_traffic_data_source_key
+		ON traffic_data (source, observation_key);`
+}
+
+func createTrafficReceivedColumn() string {
+	return `
+	ALTER TABLE traffic_data ADD COLUMN IF NOT EXISTS received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+	CREATE INDEX IF NOT EXISTS idx_traffic_data_received
+		ON traffic_data (received_at);`
+}
+
+func createGeofencePresenceTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS driver_geofence_presence (
+		driver_id VARCHAR(255) NOT NULL,
+		geofence_id UUID NOT NULL REFERENCES geofences(id) ON DELETE CASCADE,
+		inside BOOLEAN NOT NULL DEFAULT false,
+		state_since TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+		pending_inside BOOLEAN,
+		pending_since TIMESTAMP WITH TIME ZONE,
+		last_location GEOMETRY(POINT, 4326),
+		last_seen TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (driver_id, geofence_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_driver_geofence_presence_inside
+		ON driver_geofence_presence (driver_id)
+		WHERE inside = true OR pending_inside IS NOT NULL;
+
+	CREATE INDEX IF NOT EXISTS idx_driver_geofence_presence_geofence
+		ON driver_geofence_presence (geofence_id);`
+}
+
+func createGeofenceEventsTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS geofence_events (
+		id BIGSERIAL PRIMARY KEY,
+		geofence_id UUID NOT NULL,
+		geofence_name VARCHAR(255) NOT NULL,
+		driver_id VARCHAR(255) NOT NULL,
+		event_type VARCHAR(10) NOT NULL CHECK (event_type IN ('entry', 'exit')),
+		location GEOMETRY(POINT, 4326) NOT NULL,
+		dwell_seconds BIGINT,
+		occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_geofence_events_occurred_at
+		ON geofence_events (occurred_at DESC, id DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_geofence_events_driver
+		ON geofence_events (driver_id, occurred_at DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_geofence_events_geofence
+		ON geofence_events (geofence_id, occurred_at DESC);`
+}
+
+func createRouteHistoryTables() string {
+	return `
+	CREATE TABLE IF NOT EXISTS routes (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		driver_id VARCHAR(255) NOT NULL,
+		route_type VARCHAR(20) NOT NULL CHECK (route_type IN ('optimized', 'calculated')),
+		vehicle_type VARCHAR(50),
+		optimize_for VARCHAR(20),
+		waypoints JSONB NOT NULL DEFAULT '[]',
+		geometry GEOMETRY(LINESTRING, 4326),
+		total_distance FLOAT NOT NULL,
+		total_duration INT NOT NULL,
+		estimated_fuel FLOAT NOT NULL,
+		naive_distance FLOAT NOT NULL,
+		naive_duration INT NOT NULL,
+		naive_fuel FLOAT NOT NULL,
+		calculation_time_ms BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS route_traces (
+		id BIGSERIAL PRIMARY KEY,
+		route_id UUID NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+		driver_id VARCHAR(255) NOT NULL,
+		location GEOMETRY(POINT, 4326) NOT NULL,
+		speed FLOAT,
+		recorded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_routes_driver_created
+		ON routes (driver_id, created_at DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_routes_created
+		ON routes (created_at);
+
+	CREATE INDEX IF NOT EXISTS idx_routes_geometry
+		ON routes USING GIST (geometry);
+
+	CREATE INDEX IF NOT EXISTS idx_route_traces_route_recorded
+		ON route_traces (route_id, recorded_at);`
+}
+
+func createDriverLocationsTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS driver_locations (
+		id BIGSERIAL PRIMARY KEY,
+		driver_id VARCHAR(255) NOT NULL,
+		location GEOMETRY(POINT, 4326) NOT NULL,
+		altitude FLOAT,
+		accuracy FLOAT,
+		heading FLOAT,
+		speed FLOAT,
+		recorded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_driver_locations_driver_recorded
+		ON driver_locations (driver_id, recorded_at);
+
+	CREATE INDEX IF NOT EXISTS idx_driver_locations_recorded
+		ON driver_locations (recorded_at);
+
+	CREATE INDEX IF NOT EXISTS idx_driver_locations_location
+		ON driver_locations USING GIST (location);`
+}
+
 func createSpatialIndexes() string {
 	return `
 	-- Spatial indexes for high-performance spatial queries
@@ -0,0 +1,42 @@
+package geometry
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Formats a geometry can be written in by Encode
+const (
+	FormatGeoJSON  = "geojson"
+	FormatWKT      = "wkt"
+	FormatWKBHex   = "wkb-hex"
+	FormatPolyline = "polyline"
+)
+
+// ValidFormat reports whether Encode supports a format
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatGeoJSON, FormatWKT, FormatWKBHex, FormatPolyline:
+		return true
+	}
+	return false
+}
+
+// Encode writes a geometry in one of the formats, as a value to embed in a
+// JSON response: the geometry itself for GeoJSON, a string for WKT and
+// upper case WKB hex, and the result of Polylines for polyline
+func Encode(g Geometry, format string) (interface{}, error) {
+	switch format {
+	case FormatGeoJSON:
+		return g, nil
+	case FormatWKT:
+		return WKT(g), nil
+	case FormatWKBHex:
+		return strings.ToUpper(hex.EncodeToString(WKB(g))), nil
+	case FormatPolyline:
+		return Polylines(g)
+	default:
+		return nil, fmt.Errorf("unknown geometry format %q", format)
+	}
+}
@@ -0,0 +1,305 @@
+package geometry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ParseGeoJSON reads a GeoJSON geometry, Feature or FeatureCollection
+func ParseGeoJSON(data []byte) (Object, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+
+	return FromGeoJSON(value)
+}
+
+// FromGeoJSON reads GeoJSON that has already been decoded into maps and
+// slices, such as a request field of type interface{}. Numbers may be
+// float64 or json.Number.
+func FromGeoJSON(value interface{}) (Object, error) {
+	object, err := parseObject(value, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateObject(object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func parseObject(value interface{}, at string) (Object, error) {
+	members, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, pathError(at, "GeoJSON must be an object")
+	}
+
+	objectType, ok := members["type"].(string)
+	if !ok {
+		return nil, pathError(field(at, "type"), "type is required")
+	}
+
+	switch objectType {
+	case "Feature":
+		return parseFeature(members, at)
+	case "FeatureCollection":
+		features, ok := members["features"].([]interface{})
+		if !ok {
+			return nil, pathError(field(at, "features"), "features must be an array")
+		}
+		collection := FeatureCollection{Features: make([]Feature, len(features))}
+		for i, value := range features {
+			featureAt := fmt.Sprintf("%s[%d]", field(at, "features"), i)
+			members, ok := value.(map[string]interface{})
+			if !ok || members["type"] != "Feature" {
+				return nil, pathError(featureAt, "must be a Feature")
+			}
+			feature, err := parseFeature(members, featureAt)
+			if err != nil {
+				return nil, err
+			}
+			collection.Features[i] = feature
+		}
+		return collection, nil
+	default:
+		return parseGeometry(members, at)
+	}
+}
+
+func parseFeature(members map[string]interface{}, at string) (Feature, error) {
+	var feature Feature
+
+	switch id := members["id"].(type) {
+	case nil, string, float64, json.Number:
+		feature.ID = id
+	default:
+		return feature, pathError(field(at, "id"), "id must be a string or number")
+	}
+
+	switch properties := members["properties"].(type) {
+	case nil:
+	case map[string]interface{}:
+		feature.Properties = properties
+	default:
+		return feature, pathError(field(at, "properties"), "properties must be an object or null")
+	}
+
+	if value := members["geometry"]; value != nil {
+		geometryAt := field(at, "geometry")
+		geometryMembers, ok := value.(map[string]interface{})
+		if !ok {
+			return feature, pathError(geometryAt, "geometry must be an object or null")
+		}
+		geometry, err := parseGeometry(geometryMembers, geometryAt)
+		if err != nil {
+			return feature, err
+		}
+		feature.Geometry = geometry
+	}
+
+	return feature, nil
+}
+
+func parseGeometry(members map[string]interface{}, at string) (Geometry, error) {
+	geometryType, ok := members["type"].(string)
+	if !ok {
+		return nil, pathError(field(at, "type"), "type is required")
+	}
+
+	if geometryType == "GeometryCollection" {
+		values, ok := members["geometries"].([]interface{})
+		if !ok {
+			return nil, pathError(field(at, "geometries"), "geometries must be an array")
+		}
+		collection := make(GeometryCollection, len(values))
+		for i, value := range values {
+			memberAt := fmt.Sprintf("%s[%d]", field(at, "geometries"), i)
+			memberMembers, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, pathError(memberAt, "geometry must be an object")
+			}
+			member, err := parseGeometry(memberMembers, memberAt)
+			if err != nil {
+				return nil, err
+			}
+			collection[i] = member
+		}
+		return collection, nil
+	}
+
+	path := field(at, "coordinates")
+	coordinates, ok := members["coordinates"]
+	if !ok {
+		switch geometryType {
+		case "Point", "MultiPoint", "LineString", "MultiLineString", "Polygon", "MultiPolygon":
+			return nil, pathError(path, "coordinates is required")
+		}
+	}
+
+	switch geometryType {
+	case "Point":
+		position, err := parsePosition(coordinates, path)
+		return Point(position), err
+	case "MultiPoint":
+		positions, err := parsePositions(coordinates, path)
+		return MultiPoint(positions), err
+	case "LineString":
+		positions, err := parsePositions(coordinates, path)
+		return LineString(positions), err
+	case "MultiLineString":
+		lines, err := parseRings(coordinates, path)
+		return MultiLineString(lines), err
+	case "Polygon":
+		rings, err := parseRings(coordinates, path)
+		return Polygon(rings), err
+	case "MultiPolygon":
+		values, ok := coordinates.([]interface{})
+		if !ok {
+			return nil, pathError(path, "must be an array of polygons")
+		}
+		polygons := make(MultiPolygon, len(values))
+		for i, value := range values {
+			rings, err := parseRings(value, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			polygons[i] = rings
+		}
+		return polygons, nil
+	default:
+		return nil, pathError(field(at, "type"), fmt.Sprintf("unsupported GeoJSON type %q", geometryType))
+	}
+}
+
+func parsePosition(value interface{}, path string) (Position, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, pathError(path, "position must be an array of numbers")
+	}
+
+	position := make(Position, len(values))
+	for i, value := range values {
+		switch number := value.(type) {
+		case float64:
+			position[i] = number
+		case json.Number:
+			parsed, err := strconv.ParseFloat(string(number), 64)
+			if err != nil {
+				return nil, pathError(fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("invalid number %s", number))
+			}
+			position[i] = parsed
+		default:
+			return nil, pathError(fmt.Sprintf("%s[%d]", path, i), "must be a number")
+		}
+	}
+	return position, nil
+}
+
+func parsePositions(value interface{}, path string) ([]Position, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, pathError(path, "must be an array of positions")
+	}
+
+	positions := make([]Position, len(values))
+	for i, value := range values {
+		position, err := parsePosition(value, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = position
+	}
+	return positions, nil
+}
+
+func parseRings(value interface{}, path string) ([][]Position, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, pathError(path, "must be an array of position arrays")
+	}
+
+	rings := make([][]Position, len(values))
+	for i, value := range values {
+		ring, err := parsePositions(value, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		rings[i] = ring
+	}
+	return rings, nil
+}
+
+func pathError(path, message string) error {
+	if path == "" {
+		return fmt.Errorf("%s", message)
+	}
+	return fmt.Errorf("%s: %s", path, message)
+}
+
+// GeoJSON encoding
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func (g Point) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: Position(g)})
+}
+
+func (g MultiPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: nonNil([]Position(g))})
+}
+
+func (g LineString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: nonNil([]Position(g))})
+}
+
+func (g MultiLineString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: nonNil([][]Position(g))})
+}
+
+func (g Polygon) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: nonNil([][]Position(g))})
+}
+
+func (g MultiPolygon) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoJSONGeometry{Type: g.Type(), Coordinates: nonNil([][][]Position(g))})
+}
+
+func (g GeometryCollection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string     `json:"type"`
+		Geometries []Geometry `json:"geometries"`
+	}{g.Type(), nonNil([]Geometry(g))})
+}
+
+func (f Feature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string                 `json:"type"`
+		ID         interface{}            `json:"id,omitempty"`
+		Geometry   Geometry               `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}{f.Type(), f.ID, f.Geometry, f.Properties})
+}
+
+func (c FeatureCollection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string    `json:"type"`
+		Features []Feature `json:"features"`
+	}{c.Type(), nonNil(c.Features)})
+}
+
+// nonNil makes empty coordinates encode as [] rather than null
+func nonNil[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+	return values
+}
@@ -0,0 +1,326 @@
+// Package geometry reads and writes geometries as GeoJSON, WKT and WKB,
+// and writes them as encoded polylines. All
+// coordinates are WGS 84 longitude, latitude and optional altitude, kept
+// at full float64 precision.
+package geometry
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Position is a longitude, latitude and optional altitude
+type Position []float64
+
+// Object is anything a GeoJSON document can hold: a geometry, a Feature or
+// a FeatureCollection
+type Object interface {
+	// Type is the GeoJSON type name
+	Type() string
+}
+
+// Geometry is one of the seven GeoJSON geometry types
+type Geometry interface {
+	Object
+	isGeometry()
+}
+
+type Point Position
+
+type MultiPoint []Position
+
+type LineString []Position
+
+type MultiLineString [][]Position
+
+// Polygon is an exterior ring followed by any holes. Rings are closed.
+type Polygon [][]Position
+
+type MultiPolygon [][][]Position
+
+type GeometryCollection []Geometry
+
+// Feature is a geometry with properties. Geometry may be nil.
+type Feature struct {
+	ID         interface{}
+	Geometry   Geometry
+	Properties map[string]interface{}
+}
+
+type FeatureCollection struct {
+	Features []Feature
+}
+
+func (Point) Type() string              { return "Point" }
+func (MultiPoint) Type() string         { return "MultiPoint" }
+func (LineString) Type() string         { return "LineString" }
+func (MultiLineString) Type() string    { return "MultiLineString" }
+func (Polygon) Type() string            { return "Polygon" }
+func (MultiPolygon) Type() string       { return "MultiPolygon" }
+func (GeometryCollection) Type() string { return "GeometryCollection" }
+func (Feature) Type() string            { return "Feature" }
+func (FeatureCollection) Type() string  { return "FeatureCollection" }
+
+func (Point) isGeometry()              {}
+func (MultiPoint) isGeometry()         {}
+func (LineString) isGeometry()         {}
+func (MultiLineString) isGeometry()    {}
+func (Polygon) isGeometry()            {}
+func (MultiPolygon) isGeometry()       {}
+func (GeometryCollection) isGeometry() {}
+
+// Decode reads a geometry given as a WKT string, a GeoJSON string, or
+// GeoJSON already decoded into maps and slices. A Feature stands for its
+// geometry and a FeatureCollection for the collection of its features'
+// geometries.
+func Decode(value interface{}) (Geometry, error) {
+	var object Object
+	var err error
+	switch v := value.(type) {
+	case string:
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "{") {
+			object, err = ParseGeoJSON([]byte(v))
+		} else {
+			object, err = ParseWKT(v)
+		}
+	case Object:
+		object, err = v, validateObject(v)
+	default:
+		object, err = FromGeoJSON(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return AsGeometry(object)
+}
+
+// validateObject validates the geometries held by an object built in code
+func validateObject(object Object) error {
+	switch v := object.(type) {
+	case Geometry:
+		return Validate(v)
+	case Feature:
+		if v.Geometry == nil {
+			return nil
+		}
+		return validateAt(v.Geometry, "geometry")
+	case FeatureCollection:
+		for i, feature := range v.Features {
+			if feature.Geometry == nil {
+				continue
+			}
+			if err := validateAt(feature.Geometry, fmt.Sprintf("features[%d].geometry", i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AsGeometry returns the geometry an object stands for
+func AsGeometry(object Object) (Geometry, error) {
+	switch v := object.(type) {
+	case Geometry:
+		return v, nil
+	case Feature:
+		if v.Geometry == nil {
+			return nil, fmt.Errorf("feature has no geometry")
+		}
+		return v.Geometry, nil
+	case FeatureCollection:
+		collection := make(GeometryCollection, 0, len(v.Features))
+		for _, feature := range v.Features {
+			if feature.Geometry != nil {
+				collection = append(collection, feature.Geometry)
+			}
+		}
+		return collection, nil
+	default:
+		return nil, fmt.Errorf("unsupported object %T", object)
+	}
+}
+
+// Validate checks that coordinates are in range, that lines have at least
+// two positions, that polygons have a ring and that rings are closed. Errors name the
+// offending coordinates, e.g. coordinates[0][3].
+func Validate(g Geometry) error {
+	return validateAt(g, "")
+}
+
+// validateAt validates a geometry found at the given path of a document
+func validateAt(g Geometry, at string) error {
+	if err := validate(g, at); err != nil {
+		return err
+	}
+	if dimension(g) < 0 {
+		return fmt.Errorf("%s: positions mix 2 and 3 dimensions", field(at, "coordinates"))
+	}
+	return nil
+}
+
+func validate(g Geometry, at string) error {
+	path := field(at, "coordinates")
+	switch v := g.(type) {
+	case Point:
+		if len(v) == 0 {
+			return fmt.Errorf("%s: point has no position", path)
+		}
+		return validatePosition(Position(v), path)
+	case MultiPoint:
+		return validatePositions(v, path)
+	case LineString:
+		return validateLine(v, path)
+	case MultiLineString:
+		for i, line := range v {
+			if err := validateLine(line, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case Polygon:
+		return validatePolygon(v, path)
+	case MultiPolygon:
+		for i, polygon := range v {
+			if err := validatePolygon(polygon, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case GeometryCollection:
+		for i, member := range v {
+			if err := validate(member, fmt.Sprintf("%s[%d]", field(at, "geometries"), i)); err != nil {
+				return err
+			}
+		}
+	case nil:
+		if at == "" {
+			return fmt.Errorf("geometry is null")
+		}
+		return fmt.Errorf("%s: geometry is null", at)
+	}
+	return nil
+}
+
+// field is the path of a member of the object at the given path
+func field(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
+
+func validatePosition(p Position, path string) error {
+	if len(p) < 2 || len(p) > 3 {
+		return fmt.Errorf("%s: position must have 2 or 3 numbers, got %d", path, len(p))
+	}
+	for _, value := range p {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%s: position must hold finite numbers", path)
+		}
+	}
+	if p[0] < -180 || p[0] > 180 {
+		return fmt.Errorf("%s: longitude %v is outside -180 to 180", path, p[0])
+	}
+	if p[1] < -90 || p[1] > 90 {
+		return fmt.Errorf("%s: latitude %v is outside -90 to 90", path, p[1])
+	}
+	return nil
+}
+
+func validatePositions(positions []Position, path string) error {
+	for i, p := range positions {
+		if err := validatePosition(p, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLine(line []Position, path string) error {
+	if len(line) == 1 {
+		return fmt.Errorf("%s: line string must have at least 2 positions", path)
+	}
+	return validatePositions(line, path)
+}
+
+func validatePolygon(rings [][]Position, path string) error {
+	if len(rings) == 0 {
+		return fmt.Errorf("%s: polygon must have at least one ring", path)
+	}
+	for i, ring := range rings {
+		ringPath := fmt.Sprintf("%s[%d]", path, i)
+		if err := validatePositions(ring, ringPath); err != nil {
+			return err
+		}
+		if len(ring) < 4 {
+			return fmt.Errorf("%s: linear ring must have at least 4 positions, got %d", ringPath, len(ring))
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if len(first) != len(last) {
+			return fmt.Errorf("%s: linear ring must be closed", ringPath)
+		}
+		for j := range first {
+			if first[j] != last[j] {
+				return fmt.Errorf("%s: linear ring must be closed", ringPath)
+			}
+		}
+	}
+	return nil
+}
+
+// dimension is 2 or 3 when every position has that many numbers, 0 for an
+// empty geometry and -1 when they are mixed
+func dimension(g Geometry) int {
+	result := 0
+	add := func(p Position) {
+		switch {
+		case result == -1:
+		case result == 0:
+			result = len(p)
+		case result != len(p):
+			result = -1
+		}
+	}
+	eachPosition(g, add)
+	return result
+}
+
+func eachPosition(g Geometry, fn func(Position)) {
+	switch v := g.(type) {
+	case Point:
+		fn(Position(v))
+	case MultiPoint:
+		for _, p := range v {
+			fn(p)
+		}
+	case LineString:
+		for _, p := range v {
+			fn(p)
+		}
+	case MultiLineString:
+		for _, line := range v {
+			for _, p := range line {
+				fn(p)
+			}
+		}
+	case Polygon:
+		for _, ring := range v {
+			for _, p := range ring {
+				fn(p)
+			}
+		}
+	case MultiPolygon:
+		for _, polygon := range v {
+			for _, ring := range polygon {
+				for _, p := range ring {
+					fn(p)
+				}
+			}
+		}
+	case GeometryCollection:
+		for _, member := range v {
+			eachPosition(member, fn)
+		}
+	}
+}
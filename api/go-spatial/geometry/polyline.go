@@ -0,0 +1,69 @@
+package geometry
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// EncodePolyline encodes positions in Google's polyline format with five
+// decimal places. Altitudes are dropped.
+func EncodePolyline(positions []Position) string {
+	var encoded strings.Builder
+	var lastLat, lastLng int64
+	for _, p := range positions {
+		lat := int64(math.Round(p[1] * 1e5))
+		lng := int64(math.Round(p[0] * 1e5))
+		encodePolylineValue(&encoded, lat-lastLat)
+		encodePolylineValue(&encoded, lng-lastLng)
+		lastLat, lastLng = lat, lng
+	}
+	return encoded.String()
+}
+
+func encodePolylineValue(encoded *strings.Builder, value int64) {
+	shifted := value << 1
+	if value < 0 {
+		shifted = ^shifted
+	}
+	for shifted >= 0x20 {
+		encoded.WriteByte(byte((0x20 | (shifted & 0x1f)) + 63))
+		shifted >>= 5
+	}
+	encoded.WriteByte(byte(shifted + 63))
+}
+
+// Polylines encodes each line of a geometry as a polyline: a string for a
+// point, multipoint or line string, one per line or ring for multi line
+// strings and polygons, and one list of rings per polygon of a
+// multipolygon
+func Polylines(g Geometry) (interface{}, error) {
+	switch v := g.(type) {
+	case Point:
+		return EncodePolyline([]Position{Position(v)}), nil
+	case MultiPoint:
+		return EncodePolyline(v), nil
+	case LineString:
+		return EncodePolyline(v), nil
+	case MultiLineString:
+		return encodeLines(v), nil
+	case Polygon:
+		return encodeLines(v), nil
+	case MultiPolygon:
+		polygons := make([][]string, len(v))
+		for i, polygon := range v {
+			polygons[i] = encodeLines(polygon)
+		}
+		return polygons, nil
+	default:
+		return nil, fmt.Errorf("a %s cannot be encoded as polylines", g.Type())
+	}
+}
+
+func encodeLines(lines [][]Position) []string {
+	encoded := make([]string, len(lines))
+	for i, line := range lines {
+		encoded[i] = EncodePolyline(line)
+	}
+	return encoded
+}
@@ -0,0 +1,320 @@
+package geometry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// WKB geometry type codes; ISO WKB adds 1000 for Z, EWKB sets a flag
+const (
+	wkbPoint              = 1
+	wkbLineString         = 2
+	wkbPolygon            = 3
+	wkbMultiPoint         = 4
+	wkbMultiLineString    = 5
+	wkbMultiPolygon       = 6
+	wkbGeometryCollection = 7
+
+	ewkbZ    = 0x80000000
+	ewkbM    = 0x40000000
+	ewkbSRID = 0x20000000
+)
+
+// WKB writes a geometry as little-endian ISO well-known binary
+func WKB(g Geometry) []byte {
+	var b bytes.Buffer
+	writeWKB(&b, g, dimension(g) == 3)
+	return b.Bytes()
+}
+
+func writeWKB(b *bytes.Buffer, g Geometry, z bool) {
+	var code uint32
+	switch g.(type) {
+	case Point:
+		code = wkbPoint
+	case LineString:
+		code = wkbLineString
+	case Polygon:
+		code = wkbPolygon
+	case MultiPoint:
+		code = wkbMultiPoint
+	case MultiLineString:
+		code = wkbMultiLineString
+	case MultiPolygon:
+		code = wkbMultiPolygon
+	case GeometryCollection:
+		code = wkbGeometryCollection
+	}
+	if z {
+		code += 1000
+	}
+	b.WriteByte(1) // little endian
+	writeUint32(b, code)
+
+	switch v := g.(type) {
+	case Point:
+		writeWKBPosition(b, Position(v), z)
+	case LineString:
+		writeWKBPositions(b, v, z)
+	case Polygon:
+		writeWKBRings(b, v, z)
+	case MultiPoint:
+		writeUint32(b, uint32(len(v)))
+		for _, p := range v {
+			writeWKB(b, Point(p), z)
+		}
+	case MultiLineString:
+		writeUint32(b, uint32(len(v)))
+		for _, line := range v {
+			writeWKB(b, LineString(line), z)
+		}
+	case MultiPolygon:
+		writeUint32(b, uint32(len(v)))
+		for _, polygon := range v {
+			writeWKB(b, Polygon(polygon), z)
+		}
+	case GeometryCollection:
+		writeUint32(b, uint32(len(v)))
+		for _, member := range v {
+			writeWKB(b, member, z)
+		}
+	}
+}
+
+func writeUint32(b *bytes.Buffer, value uint32) {
+	binary.Write(b, binary.LittleEndian, value)
+}
+
+func writeWKBPosition(b *bytes.Buffer, p Position, z bool) {
+	binary.Write(b, binary.LittleEndian, p[0])
+	binary.Write(b, binary.LittleEndian, p[1])
+	if z {
+		binary.Write(b, binary.LittleEndian, p[2])
+	}
+}
+
+func writeWKBPositions(b *bytes.Buffer, positions []Position, z bool) {
+	writeUint32(b, uint32(len(positions)))
+	for _, p := range positions {
+		writeWKBPosition(b, p, z)
+	}
+}
+
+func writeWKBRings(b *bytes.Buffer, rings [][]Position, z bool) {
+	writeUint32(b, uint32(len(rings)))
+	for _, ring := range rings {
+		writeWKBPositions(b, ring, z)
+	}
+}
+
+// ParseWKB reads well-known binary in either byte order, as ISO WKB or as
+// PostGIS EWKB. An embedded SRID must be 4326.
+func ParseWKB(data []byte) (Geometry, error) {
+	r := &wkbReader{data: data}
+	g, err := r.geometry()
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("WKB: %d trailing bytes", len(data)-r.pos)
+	}
+	if err := Validate(g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) read(n int) ([]byte, error) {
+	if r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("WKB: unexpected end of data at offset %d", r.pos)
+	}
+	chunk := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return chunk, nil
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	chunk, err := r.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return r.order.Uint32(chunk), nil
+}
+
+// count reads a number of elements, rejecting counts the remaining data
+// cannot hold
+func (r *wkbReader) count(minSize int) (int, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return 0, err
+	}
+	if int64(n)*int64(minSize) > int64(len(r.data)-r.pos) {
+		return 0, fmt.Errorf("WKB: count %d exceeds the data at offset %d", n, r.pos-4)
+	}
+	return int(n), nil
+}
+
+func (r *wkbReader) position(z bool) (Position, error) {
+	n := 2
+	if z {
+		n = 3
+	}
+	chunk, err := r.read(8 * n)
+	if err != nil {
+		return nil, err
+	}
+	position := make(Position, n)
+	for i := range position {
+		position[i] = math.Float64frombits(r.order.Uint64(chunk[8*i:]))
+	}
+	return position, nil
+}
+
+func (r *wkbReader) positions(z bool) ([]Position, error) {
+	n, err := r.count(16)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]Position, n)
+	for i := range positions {
+		if positions[i], err = r.position(z); err != nil {
+			return nil, err
+		}
+	}
+	return positions, nil
+}
+
+func (r *wkbReader) rings(z bool) ([][]Position, error) {
+	n, err := r.count(4)
+	if err != nil {
+		return nil, err
+	}
+	rings := make([][]Position, n)
+	for i := range rings {
+		if rings[i], err = r.positions(z); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+func (r *wkbReader) geometry() (Geometry, error) {
+	start := r.pos
+	order, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+	switch order[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("WKB: invalid byte order %d at offset %d", order[0], start)
+	}
+
+	code, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	z := code&ewkbZ != 0
+	if code&ewkbM != 0 {
+		return nil, fmt.Errorf("WKB: measured (M) coordinates are not supported")
+	}
+	if code&ewkbSRID != 0 {
+		srid, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if srid != 4326 {
+			return nil, fmt.Errorf("WKB: SRID %d is not supported, coordinates must be WGS 84 (4326)", srid)
+		}
+	}
+	code &^= ewkbZ | ewkbSRID
+	switch code / 1000 {
+	case 0:
+	case 1:
+		z = true
+	default:
+		return nil, fmt.Errorf("WKB: measured (M) coordinates are not supported")
+	}
+
+	switch code % 1000 {
+	case wkbPoint:
+		position, err := r.position(z)
+		if err != nil {
+			return nil, err
+		}
+		// PostGIS writes POINT EMPTY as NaN coordinates
+		if math.IsNaN(position[0]) && math.IsNaN(position[1]) {
+			return nil, fmt.Errorf("WKB: POINT EMPTY has no GeoJSON equivalent")
+		}
+		return Point(position), nil
+	case wkbLineString:
+		positions, err := r.positions(z)
+		return LineString(positions), err
+	case wkbPolygon:
+		rings, err := r.rings(z)
+		return Polygon(rings), err
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection:
+		n, err := r.count(5)
+		if err != nil {
+			return nil, err
+		}
+		members := make([]Geometry, n)
+		for i := range members {
+			if members[i], err = r.geometry(); err != nil {
+				return nil, err
+			}
+		}
+		return collect(code%1000, members)
+	default:
+		return nil, fmt.Errorf("WKB: unsupported geometry type %d at offset %d", code, start)
+	}
+}
+
+// collect builds a multi geometry from its members
+func collect(code uint32, members []Geometry) (Geometry, error) {
+	switch code {
+	case wkbMultiPoint:
+		multi := make(MultiPoint, len(members))
+		for i, member := range members {
+			point, ok := member.(Point)
+			if !ok {
+				return nil, fmt.Errorf("WKB: MultiPoint member %d is a %s", i, member.Type())
+			}
+			multi[i] = Position(point)
+		}
+		return multi, nil
+	case wkbMultiLineString:
+		multi := make(MultiLineString, len(members))
+		for i, member := range members {
+			line, ok := member.(LineString)
+			if !ok {
+				return nil, fmt.Errorf("WKB: MultiLineString member %d is a %s", i, member.Type())
+			}
+			multi[i] = line
+		}
+		return multi, nil
+	case wkbMultiPolygon:
+		multi := make(MultiPolygon, len(members))
+		for i, member := range members {
+			polygon, ok := member.(Polygon)
+			if !ok {
+				return nil, fmt.Errorf("WKB: MultiPolygon member %d is a %s", i, member.Type())
+			}
+			multi[i] = polygon
+		}
+		return multi, nil
+	default:
+		return GeometryCollection(members), nil
+	}
+}
@@ -0,0 +1,404 @@
+package geometry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// WKT writes a geometry as well-known text. Coordinates keep their full
+// precision and geometries with altitudes are tagged Z.
+func WKT(g Geometry) string {
+	var b strings.Builder
+	writeWKT(&b, g, dimension(g) == 3)
+	return b.String()
+}
+
+func writeWKT(b *strings.Builder, g Geometry, z bool) {
+	b.WriteString(strings.ToUpper(g.Type()))
+	if z {
+		b.WriteString(" Z")
+	}
+
+	var body strings.Builder
+	switch v := g.(type) {
+	case Point:
+		if len(v) == 0 {
+			body.WriteString("EMPTY")
+			break
+		}
+		body.WriteByte('(')
+		writePosition(&body, Position(v), z)
+		body.WriteByte(')')
+	case MultiPoint:
+		if len(v) == 0 {
+			body.WriteString("EMPTY")
+			break
+		}
+		body.WriteByte('(')
+		for i, p := range v {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.WriteByte('(')
+			writePosition(&body, p, z)
+			body.WriteByte(')')
+		}
+		body.WriteByte(')')
+	case LineString:
+		writePositions(&body, v, z)
+	case MultiLineString:
+		writeRings(&body, v, z)
+	case Polygon:
+		writeRings(&body, v, z)
+	case MultiPolygon:
+		if len(v) == 0 {
+			body.WriteString("EMPTY")
+			break
+		}
+		body.WriteByte('(')
+		for i, polygon := range v {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			writeRings(&body, polygon, z)
+		}
+		body.WriteByte(')')
+	case GeometryCollection:
+		if len(v) == 0 {
+			body.WriteString("EMPTY")
+			break
+		}
+		body.WriteByte('(')
+		for i, member := range v {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			writeWKT(&body, member, z)
+		}
+		body.WriteByte(')')
+	}
+
+	// POINT(1 2), POINT Z (1 2 3) and POINT EMPTY, as PostGIS writes them
+	if z || body.String() == "EMPTY" {
+		b.WriteByte(' ')
+	}
+	b.WriteString(body.String())
+}
+
+func writePosition(b *strings.Builder, p Position, z bool) {
+	b.WriteString(formatCoordinate(p[0]))
+	b.WriteByte(' ')
+	b.WriteString(formatCoordinate(p[1]))
+	if z {
+		b.WriteByte(' ')
+		b.WriteString(formatCoordinate(p[2]))
+	}
+}
+
+func writePositions(b *strings.Builder, positions []Position, z bool) {
+	if len(positions) == 0 {
+		b.WriteString("EMPTY")
+		return
+	}
+	b.WriteByte('(')
+	for i, p := range positions {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writePosition(b, p, z)
+	}
+	b.WriteByte(')')
+}
+
+func writeRings(b *strings.Builder, rings [][]Position, z bool) {
+	if len(rings) == 0 {
+		b.WriteString("EMPTY")
+		return
+	}
+	b.WriteByte('(')
+	for i, ring := range rings {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writePositions(b, ring, z)
+	}
+	b.WriteByte(')')
+}
+
+// formatCoordinate writes the shortest decimal that reads back as the same
+// float64
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// ParseWKT reads a geometry from well-known text, as written by WKT or
+// PostGIS's ST_AsText. An SRID=4326; prefix is accepted.
+func ParseWKT(text string) (Geometry, error) {
+	p := &wktParser{text: text}
+
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(text)), "SRID=") {
+		separator := strings.IndexByte(text, ';')
+		if separator < 0 {
+			return nil, fmt.Errorf("WKT: SRID prefix must end with ';'")
+		}
+		srid := strings.TrimSpace(text[strings.IndexByte(text, '=')+1 : separator])
+		if srid != "4326" {
+			return nil, fmt.Errorf("WKT: SRID %s is not supported, coordinates must be WGS 84 (4326)", srid)
+		}
+		p.pos = separator + 1
+	}
+
+	g, err := p.geometry()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.next(); token != "" {
+		return nil, p.errorf("unexpected %q after geometry", token)
+	}
+	if err := Validate(g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+type wktParser struct {
+	text string
+	pos  int
+	// start of the last token read, for error offsets
+	start int
+}
+
+// next reads a word, a number or one of ( ) , and returns "" at the end
+func (p *wktParser) next() string {
+	p.skipSpace()
+	p.start = p.pos
+	if p.pos >= len(p.text) {
+		return ""
+	}
+
+	switch p.text[p.pos] {
+	case '(', ')', ',':
+		p.pos++
+		return p.text[p.start:p.pos]
+	}
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if c == '(' || c == ')' || c == ',' || unicode.IsSpace(rune(c)) {
+			break
+		}
+		p.pos++
+	}
+	return p.text[p.start:p.pos]
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) peek() string {
+	pos, start := p.pos, p.start
+	token := p.next()
+	p.pos, p.start = pos, start
+	return token
+}
+
+func (p *wktParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("WKT: %s at offset %d", fmt.Sprintf(format, args...), p.start)
+}
+
+func (p *wktParser) expect(token string) error {
+	if next := p.next(); next != token {
+		if next == "" {
+			return p.errorf("expected %q, got end of text", token)
+		}
+		return p.errorf("expected %q, got %q", token, next)
+	}
+	return nil
+}
+
+func (p *wktParser) geometry() (Geometry, error) {
+	name := strings.ToUpper(p.next())
+	if name == "" {
+		return nil, p.errorf("expected a geometry type, got end of text")
+	}
+
+	z := false
+	switch strings.ToUpper(p.peek()) {
+	case "Z":
+		p.next()
+		z = true
+	case "M", "ZM":
+		p.next()
+		return nil, p.errorf("measured (M) coordinates are not supported")
+	}
+	// Some writers glue the tag to the type, as in POINTZ
+	if strings.HasSuffix(name, "M") {
+		return nil, p.errorf("measured (M) coordinates are not supported")
+	}
+	if strings.HasSuffix(name, "Z") {
+		name = strings.TrimSuffix(name, "Z")
+		z = true
+	}
+
+	empty := false
+	if strings.ToUpper(p.peek()) == "EMPTY" {
+		p.next()
+		empty = true
+	}
+
+	switch name {
+	case "POINT":
+		if empty {
+			return nil, p.errorf("POINT EMPTY has no GeoJSON equivalent")
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		position, err := p.position(z)
+		if err != nil {
+			return nil, err
+		}
+		return Point(position), p.expect(")")
+	case "MULTIPOINT":
+		if empty {
+			return MultiPoint{}, nil
+		}
+		positions, err := p.multiPoint(z)
+		return MultiPoint(positions), err
+	case "LINESTRING":
+		if empty {
+			return LineString{}, nil
+		}
+		positions, err := p.positions(z)
+		return LineString(positions), err
+	case "MULTILINESTRING":
+		if empty {
+			return MultiLineString{}, nil
+		}
+		lines, err := p.rings(z)
+		return MultiLineString(lines), err
+	case "POLYGON":
+		if empty {
+			return Polygon{}, nil
+		}
+		rings, err := p.rings(z)
+		return Polygon(rings), err
+	case "MULTIPOLYGON":
+		if empty {
+			return MultiPolygon{}, nil
+		}
+		polygons := make(MultiPolygon, 0)
+		err := p.list(func() error {
+			rings, err := p.rings(z)
+			polygons = append(polygons, rings)
+			return err
+		})
+		return polygons, err
+	case "GEOMETRYCOLLECTION":
+		if empty {
+			return GeometryCollection{}, nil
+		}
+		collection := make(GeometryCollection, 0)
+		err := p.list(func() error {
+			member, err := p.geometry()
+			collection = append(collection, member)
+			return err
+		})
+		return collection, err
+	default:
+		return nil, p.errorf("unsupported geometry type %q", name)
+	}
+}
+
+// list reads a parenthesised, comma separated list of items
+func (p *wktParser) list(item func() error) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for {
+		if err := item(); err != nil {
+			return err
+		}
+		switch token := p.next(); token {
+		case ",":
+		case ")":
+			return nil
+		case "":
+			return p.errorf("expected \",\" or \")\", got end of text")
+		default:
+			return p.errorf("expected \",\" or \")\", got %q", token)
+		}
+	}
+}
+
+func (p *wktParser) position(z bool) (Position, error) {
+	position := make(Position, 0, 3)
+	p.skipSpace()
+	start := p.pos
+	for {
+		token := p.peek()
+		if token == "" || token == "," || token == ")" {
+			break
+		}
+		p.next()
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", token)
+		}
+		position = append(position, value)
+	}
+
+	p.start = start
+	if z && len(position) != 3 {
+		return nil, p.errorf("Z position must have 3 numbers, got %d", len(position))
+	}
+	if len(position) < 2 || len(position) > 3 {
+		return nil, p.errorf("position must have 2 or 3 numbers, got %d", len(position))
+	}
+	return position, nil
+}
+
+func (p *wktParser) positions(z bool) ([]Position, error) {
+	positions := make([]Position, 0)
+	err := p.list(func() error {
+		position, err := p.position(z)
+		positions = append(positions, position)
+		return err
+	})
+	return positions, err
+}
+
+// multiPoint accepts points with or without their own parentheses
+func (p *wktParser) multiPoint(z bool) ([]Position, error) {
+	positions := make([]Position, 0)
+	err := p.list(func() error {
+		wrapped := p.peek() == "("
+		if wrapped {
+			p.next()
+		}
+		position, err := p.position(z)
+		if err != nil {
+			return err
+		}
+		positions = append(positions, position)
+		if wrapped {
+			return p.expect(")")
+		}
+		return nil
+	})
+	return positions, err
+}
+
+func (p *wktParser) rings(z bool) ([][]Position, error) {
+	rings := make([][]Position, 0)
+	err := p.list(func() error {
+		ring, err := p.positions(z)
+		rings = append(rings, ring)
+		return err
+	})
+	return rings, err
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go-spatial/geometry"
+	"go-spatial/middleware"
 	"go-spatial/models"
 	"go-spatial/services"
 )
@@ -60,6 +65,13 @@ func (h *GeofenceHandler) CreateGeofence(c *fiber.Ctx) error {
 
 	// Create geofence
 	if err := h.geofenceService.CreateGeofence(&geofence); err != nil {
+		if errors.Is(err, services.ErrInvalidGeometry) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid geofence geometry",
+				"details": err.Error(),
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
 			"message": "Failed to create geofence",
@@ -84,6 +96,11 @@ func (h *GeofenceHandler) GetGeofence(c *fiber.Ctx) error {
 		})
 	}
 
+	format, ok := geometryFormat(c)
+	if !ok {
+		return invalidGeometryFormat(c)
+	}
+
 	geofence, err := h.geofenceService.GetGeofence(id)
 	if err != nil {
 		if err.Error() == "geofence not found" {
@@ -99,6 +116,25 @@ func (h *GeofenceHandler) GetGeofence(c *fiber.Ctx) error {
 		})
 	}
 
+	// Drivers may read shared fences and their own, not other drivers' fences
+	if geofence.DriverID != nil {
+		if _, allowed := middleware.ScopeDriverID(c, *geofence.DriverID); !allowed {
+			return middleware.ScopeDenied(c)
+		}
+	}
+
+	if wantsGeoJSON(c) {
+		return c.JSON(geofenceFeature(*geofence), geoJSONContentType)
+	}
+
+	if err := encodeGeofenceGeometry(geofence, format); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to encode geofence geometry",
+			"details": err.Error(),
+		})
+	}
+
 	return c.JSON(fiber.Map{
 		"geofence": geofence,
 	})
@@ -130,6 +166,13 @@ func (h *GeofenceHandler) UpdateGeofence(c *fiber.Ctx) error {
 				"message": "Geofence not found",
 			})
 		}
+		if errors.Is(err, services.ErrInvalidGeometry) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid geofence geometry",
+				"details": err.Error(),
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
 			"message": "Failed to update geofence",
@@ -176,11 +219,19 @@ func (h *GeofenceHandler) DeleteGeofence(c *fiber.Ctx) error {
 // ListGeofences handles listing geofences with filtering
 func (h *GeofenceHandler) ListGeofences(c *fiber.Ctx) error {
 	// Parse query parameters
-	driverID := c.Query("driver_id")
+	driverID, allowed := middleware.ScopeDriverID(c, c.Query("driver_id"))
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
 	activeStr := c.Query("active")
 	limitStr := c.Query("limit", "50")
 	offsetStr := c.Query("offset", "0")
 
+	format, ok := geometryFormat(c)
+	if !ok {
+		return invalidGeometryFormat(c)
+	}
+
 	// Convert parameters
 	limit, err := strconv.Atoi(limitStr)
 	if err != nil || limit <= 0 || limit > 100 {
@@ -192,21 +243,7 @@ func (h *GeofenceHandler) ListGeofences(c *fiber.Ctx) error {
 		offset = 0
 	}
 
-	var active *bool
-	if activeStr != "" {
-		activeBool, err := strconv.ParseBool(activeStr)
-		if err == nil {
-			active = &activeBool
-		}
-	}
-
-	var driverIDPtr *string
-	if driverID != "" {
-		driverIDPtr = &driverID
-	}
-
-	// Get geofences
-	geofences, err := h.geofenceService.ListGeofences(driverIDPtr, active, limit, offset)
+	geofences, err := h.listGeofences(c, driverID, activeStr, limit, offset)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
@@ -215,6 +252,20 @@ func (h *GeofenceHandler) ListGeofences(c *fiber.Ctx) error {
 		})
 	}
 
+	if wantsGeoJSON(c) {
+		return c.JSON(geofenceFeatureCollection(geofences), geoJSONContentType)
+	}
+
+	for i := range geofences {
+		if err := encodeGeofenceGeometry(&geofences[i], format); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   true,
+				"message": "Failed to encode geofence geometry",
+				"details": err.Error(),
+			})
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"geofences": geofences,
 		"count":     len(geofences),
@@ -227,6 +278,49 @@ func (h *GeofenceHandler) ListGeofences(c *fiber.Ctx) error {
 	})
 }
 
+// ExportGeofences returns every geofence matching the list filters as a
+// GeoJSON FeatureCollection that map libraries can load directly
+func (h *GeofenceHandler) ExportGeofences(c *fiber.Ctx) error {
+	driverID, allowed := middleware.ScopeDriverID(c, c.Query("driver_id"))
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+
+	geofences, err := h.listGeofences(c, driverID, c.Query("active"), 0, 0)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to export geofences",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(geofenceFeatureCollection(geofences), geoJSONContentType)
+}
+
+// listGeofences applies the driver and active filters; a limit of zero
+// returns every match
+func (h *GeofenceHandler) listGeofences(c *fiber.Ctx, driverID, activeStr string, limit, offset int) ([]models.Geofence, error) {
+	var active *bool
+	if activeStr != "" {
+		activeBool, err := strconv.ParseBool(activeStr)
+		if err == nil {
+			active = &activeBool
+		}
+	}
+
+	var driverIDPtr *string
+	if driverID != "" {
+		driverIDPtr = &driverID
+	}
+
+	// Drivers also see the fences shared by all drivers
+	includeShared := middleware.IsAuthenticated(c) &&
+		!middleware.HasRole(c, models.RoleDispatcher, models.RoleAdmin)
+
+	return h.geofenceService.ListGeofences(driverIDPtr, includeShared, active, limit, offset)
+}
+
 // CheckGeofenceEntry handles geofence entry/exit checking
 func (h *GeofenceHandler) CheckGeofenceEntry(c *fiber.Ctx) error {
 	startTime := time.Now()
@@ -243,6 +337,12 @@ func (h *GeofenceHandler) CheckGeofenceEntry(c *fiber.Ctx) error {
 		})
 	}
 
+	driverID, allowed := middleware.ScopeDriverID(c, request.DriverID)
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	request.DriverID = driverID
+
 	// Validate required fields
 	if request.DriverID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -251,10 +351,11 @@ func (h *GeofenceHandler) CheckGeofenceEntry(c *fiber.Ctx) error {
 		})
 	}
 
-	if request.Location.Latitude == 0 || request.Location.Longitude == 0 {
+	if err := services.ValidateLocation(request.Location); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error":   true,
 			"message": "Valid location coordinates are required",
+			"details": err.Error(),
 		})
 	}
 
@@ -340,58 +441,178 @@ func (h *GeofenceHandler) GetGeofenceStats(c *fiber.Ctx) error {
 	})
 }
 
-// GetGeofenceActivity returns recent geofence activity
+// GetGeofenceActivity returns recorded geofence entry/exit events
 func (h *GeofenceHandler) GetGeofenceActivity(c *fiber.Ctx) error {
 	// Parse query parameters
-	driverID := c.Query("driver_id")
-	hours := c.Query("hours", "24")
-	hoursInt, err := strconv.Atoi(hours)
+	driverID, allowed := middleware.ScopeDriverID(c, c.Query("driver_id"))
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	geofenceID := c.Query("geofence_id")
+	eventType := c.Query("event_type")
+	limitStr := c.Query("limit", "50")
+
+	if eventType != "" && eventType != "entry" && eventType != "exit" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid event_type (must be entry or exit)",
+		})
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	// Time window: explicit since/until (RFC3339) or the last N hours
+	until := time.Now()
+	if untilStr := c.Query("until"); untilStr != "" {
+		until, err = time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid until value (must be RFC3339)",
+			})
+		}
+	}
+
+	hoursInt, err := strconv.Atoi(c.Query("hours", "24"))
 	if err != nil || hoursInt <= 0 || hoursInt > 168 { // Max 1 week
 		hoursInt = 24
 	}
+	since := until.Add(-time.Duration(hoursInt) * time.Hour)
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		since, err = time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid since value (must be RFC3339)",
+			})
+		}
+	}
 
-	// For demo purposes, return simulated activity data
-	// In production, you'd query actual geofence events from database
-	activity := []fiber.Map{
-		{
-			"timestamp":     time.Now().Add(-2 * time.Hour).Unix(),
-			"driver_id":     driverID,
-			"geofence_id":   "geofence_1",
-			"geofence_name": "Downtown Delivery Zone",
-			"event_type":    "entry",
-			"location": fiber.Map{
-				"latitude":  40.7128,
-				"longitude": -74.0060,
-			},
-		},
-		{
-			"timestamp":     time.Now().Add(-4 * time.Hour).Unix(),
-			"driver_id":     driverID,
-			"geofence_id":   "geofence_2",
-			"geofence_name": "Warehouse Area",
-			"event_type":    "exit",
-			"location": fiber.Map{
-				"latitude":  40.7589,
-				"longitude": -73.9851,
-			},
-		},
+	if !since.Before(until) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "since must be before until",
+		})
+	}
+
+	filter := models.GeofenceActivityFilter{
+		Since:  since,
+		Until:  until,
+		Cursor: c.Query("cursor"),
+		Limit:  limit,
+	}
+	if driverID != "" {
+		filter.DriverID = &driverID
+	}
+	if geofenceID != "" {
+		filter.GeofenceID = &geofenceID
+	}
+	if eventType != "" {
+		filter.EventType = &eventType
+	}
+
+	activity, err := h.geofenceService.GetGeofenceActivity(filter)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCursor) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid cursor",
+				"details": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to get geofence activity",
+			"details": err.Error(),
+		})
 	}
 
 	return c.JSON(fiber.Map{
-		"activity":     activity,
-		"period_hours": hoursInt,
-		"driver_id":    driverID,
-		"event_count":  len(activity),
-		"summary": fiber.Map{
-			"entries":          1,
-			"exits":            1,
-			"unique_geofences": 2,
+		"activity":    activity.Events,
+		"event_count": len(activity.Events),
+		"summary":     activity.Summary,
+		"next_cursor": activity.NextCursor,
+		"since":       since.Unix(),
+		"until":       until.Unix(),
+		"limit":       limit,
+		"filters": fiber.Map{
+			"driver_id":   driverID,
+			"geofence_id": geofenceID,
+			"event_type":  eventType,
 		},
 	})
 }
 
 // Helper functions
 
+// GeoJSON documents are sent with their registered media type
+const geoJSONContentType = "application/geo+json"
+
+// geometryFormat reads the format query parameter, GeoJSON by default
+func geometryFormat(c *fiber.Ctx) (string, bool) {
+	format := strings.ToLower(c.Query("format", geometry.FormatGeoJSON))
+	return format, geometry.ValidFormat(format)
+}
+
+func invalidGeometryFormat(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error":   true,
+		"message": "Invalid format",
+		"details": "format must be geojson, wkt, wkb-hex or polyline",
+	})
+}
+
+// wantsGeoJSON reports whether the client asked for a GeoJSON document
+// rather than the usual JSON response
+func wantsGeoJSON(c *fiber.Ctx) bool {
+	return c.Accepts(fiber.MIMEApplicationJSON, geoJSONContentType) == geoJSONContentType
+}
+
+// encodeGeofenceGeometry replaces a stored geofence's geometry with its
+// encoding in the requested format
+func encodeGeofenceGeometry(geofence *models.Geofence, format string) error {
+	g, ok := geofence.Geometry.(geometry.Geometry)
+	if !ok {
+		return fmt.Errorf("geofence %s has no stored geometry", geofence.ID)
+	}
+
+	encoded, err := geometry.Encode(g, format)
+	if err != nil {
+		return err
+	}
+	geofence.Geometry = encoded
+	return nil
+}
+
+// geofenceFeature is a geofence as a GeoJSON Feature. Its own properties
+// are kept, alongside the geofence's name and settings.
+func geofenceFeature(geofence models.Geofence) geometry.Feature {
+	properties := make(map[string]interface{}, len(geofence.Properties)+6)
+	for key, value := range geofence.Properties {
+		properties[key] = value
+	}
+	properties["name"] = geofence.Name
+	properties["driver_id"] = geofence.DriverID
+	properties["buffer_distance"] = geofence.BufferDistance
+	properties["active"] = geofence.Active
+	properties["created_at"] = geofence.CreatedAt
+	properties["updated_at"] = geofence.UpdatedAt
+
+	g, _ := geofence.Geometry.(geometry.Geometry)
+	return geometry.Feature{ID: geofence.ID, Geometry: g, Properties: properties}
+}
+
+func geofenceFeatureCollection(geofences []models.Geofence) geometry.FeatureCollection {
+	collection := geometry.FeatureCollection{Features: make([]geometry.Feature, len(geofences))}
+	for i, geofence := range geofences {
+		collection.Features[i] = geofenceFeature(geofence)
+	}
+	return collection
+}
+
 func generateGeofenceID() string {
 	return "geofence_" + strconv.FormatInt(time.Now().UnixNano(), 36)
 }
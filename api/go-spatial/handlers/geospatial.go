@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go-spatial/middleware"
 	"go-spatial/models"
 	"go-spatial/services"
 )
@@ -33,6 +35,12 @@ func (h *SpatialHandler) AnalyzeLocation(c *fiber.Ctx) error {
 		})
 	}
 
+	driverID, allowed := middleware.ScopeDriverID(c, request.DriverID)
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	request.DriverID = driverID
+
 	// Validate required fields
 	if request.DriverID == "" || request.Location.Latitude == 0 || request.Location.Longitude == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -106,6 +114,12 @@ func (h *SpatialHandler) BatchAnalyze(c *fiber.Ctx) error {
 		})
 	}
 
+	driverID, allowed := middleware.ScopeDriverID(c, request.DriverID)
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	request.DriverID = driverID
+
 	if len(request.Locations) == 0 || len(request.Locations) > 100 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error":   true,
@@ -278,6 +292,13 @@ func (h *SpatialHandler) CheckIntersection(c *fiber.Ctx) error {
 
 	intersects, err := h.spatialService.CheckIntersection(request.Geometry1, request.Geometry2)
 	if err != nil {
+		if errors.Is(err, services.ErrInvalidGeometry) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid geometry",
+				"details": err.Error(),
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
 			"message": "Intersection check failed",
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go-spatial/middleware"
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+type LocationHandler struct {
+	tracker         *services.LocationTracker
+	locationHistory *services.LocationHistoryService
+}
+
+func NewLocationHandler(tracker *services.LocationTracker, locationHistory *services.LocationHistoryService) *LocationHandler {
+	return &LocationHandler{
+		tracker:         tracker,
+		locationHistory: locationHistory,
+	}
+}
+
+// RecordLocations handles single and bulk driver location ingestion
+func (h *LocationHandler) RecordLocations(c *fiber.Ctx) error {
+	var request models.LocationIngestRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid request body",
+		})
+	}
+
+	driverID, allowed := middleware.ScopeDriverID(c, request.DriverID)
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	if driverID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Driver ID required",
+		})
+	}
+
+	locations := request.Locations
+	if request.Location != nil {
+		locations = append(locations, *request.Location)
+	}
+
+	if len(locations) == 0 || len(locations) > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Request must contain between 1 and 1000 locations",
+		})
+	}
+
+	now := time.Now().Unix()
+	for i := range locations {
+		if err := services.ValidateLocation(locations[i]); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": fmt.Sprintf("Invalid location %d", i),
+				"details": err.Error(),
+			})
+		}
+		if locations[i].Timestamp == 0 {
+			locations[i].Timestamp = now
+		}
+	}
+
+	// Stored points also feed the live geofence and deviation checks
+	result, err := h.tracker.ProcessLocationBatch(driverID, locations)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to record locations",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success":         true,
+		"driver_id":       driverID,
+		"points_recorded": result.PointsRecorded,
+		"alerts":          result.GeofenceAlerts,
+		"deviation":       result.Deviation,
+	})
+}
+
+// GetDriverTrack returns a driver's recorded positions over a time window as
+// a GeoJSON LineString feature or a point list
+func (h *LocationHandler) GetDriverTrack(c *fiber.Ctx) error {
+	driverID, allowed := middleware.ScopeDriverID(c, c.Params("driverId"))
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+
+	format := c.Query("format", "geojson")
+	if format != "geojson" && format != "points" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid format (must be geojson or points)",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "5000"))
+	if err != nil || limit <= 0 || limit > 10000 {
+		limit = 5000
+	}
+
+	// Time window: explicit since/until (RFC3339) or the last N hours
+	until := time.Now()
+	if untilStr := c.Query("until"); untilStr != "" {
+		until, err = time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid until value (must be RFC3339)",
+			})
+		}
+	}
+
+	hoursInt, err := strconv.Atoi(c.Query("hours", "24"))
+	if err != nil || hoursInt <= 0 || hoursInt > 168 { // Max 1 week
+		hoursInt = 24
+	}
+	since := until.Add(-time.Duration(hoursInt) * time.Hour)
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		since, err = time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid since value (must be RFC3339)",
+			})
+		}
+	}
+
+	if !since.Before(until) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "since must be before until",
+		})
+	}
+
+	track, err := h.locationHistory.GetTrack(driverID, since, until, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to get driver track",
+			"details": err.Error(),
+		})
+	}
+
+	if format == "points" {
+		return c.JSON(track)
+	}
+
+	return c.JSON(trackFeature(track))
+}
+
+// Helper methods
+
+func trackFeature(track *models.DriverTrack) fiber.Map {
+	coordinates := make([][]float64, 0, len(track.Points))
+	timestamps := make([]int64, 0, len(track.Points))
+	for _, point := range track.Points {
+		coordinates = append(coordinates, []float64{point.Longitude, point.Latitude})
+		timestamps = append(timestamps, point.Timestamp)
+	}
+
+	return fiber.Map{
+		"type": "Feature",
+		"geometry": fiber.Map{
+			"type":        "LineString",
+			"coordinates": coordinates,
+		},
+		"properties": fiber.Map{
+			"driver_id":       track.DriverID,
+			"since":           track.Since,
+			"until":           track.Until,
+			"point_count":     track.PointCount,
+			"distance_meters": track.DistanceMeters,
+			"truncated":       track.Truncated,
+			"timestamps":      timestamps,
+		},
+	}
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go-spatial/middleware"
 	"go-spatial/models"
 	"go-spatial/services"
 )
@@ -34,10 +36,10 @@ func (h *RouteHandler) OptimizeRoute(c *fiber.Ctx) error {
 	}
 
 	// Validate request
-	if request.Origin.Latitude == 0 || request.Origin.Longitude == 0 {
+	if err := services.ValidateLocation(request.Origin); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error":   true,
-			"message": "Valid origin coordinates required",
+			"message": "Invalid origin: " + err.Error(),
 		})
 	}
 
@@ -55,8 +57,48 @@ func (h *RouteHandler) OptimizeRoute(c *fiber.Ctx) error {
 		})
 	}
 
+	for i, destination := range request.Destinations {
+		if message := validateStop(destination); message != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid destination " + strconv.Itoa(i) + ": " + message,
+			})
+		}
+	}
+
+	if message := validatePreferences(request.Preferences); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": message,
+		})
+	}
+
+	if _, err := services.ParseRestrictions(request.Vehicle.Restrictions); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid vehicle restrictions",
+			"details": err.Error(),
+		})
+	}
+
+	driverID, allowed := middleware.ScopeDriverID(c, request.DriverID)
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
+	request.DriverID = driverID
+	if request.DriverID == "" {
+		request.DriverID = middleware.GetDriverID(c)
+	}
+
 	// Perform route optimization
 	response, err := h.routeService.OptimizeRoute(request)
+	if errors.Is(err, services.ErrNoRoadRoute) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":   true,
+			"message": "No road route between the stops",
+			"details": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
@@ -91,11 +133,190 @@ func (h *RouteHandler) OptimizeRoute(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{
 		"optimized_route":  response.OptimizedRoute,
+		"improvement":      response.Improvement,
 		"performance":      response.Performance,
 		"performance_data": performanceData,
 	})
 }
 
+// OptimizeFleet plans routes for several vehicles with capacities and shifts
+func (h *RouteHandler) OptimizeFleet(c *fiber.Ctx) error {
+	startTime := time.Now()
+
+	var request models.FleetOptimizationRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid request body",
+		})
+	}
+
+	if len(request.Vehicles) == 0 || len(request.Vehicles) > 50 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Between 1 and 50 vehicles required",
+		})
+	}
+
+	if len(request.Stops) == 0 || len(request.Stops) > 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Between 1 and 500 stops required",
+		})
+	}
+
+	vehicleIDs := make(map[string]bool, len(request.Vehicles))
+	available := 0
+	for i, vehicle := range request.Vehicles {
+		if vehicle.ID == "" || vehicleIDs[vehicle.ID] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Vehicle " + strconv.Itoa(i) + " needs a unique id",
+			})
+		}
+		vehicleIDs[vehicle.ID] = true
+
+		if vehicle.Capacity <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Vehicle " + vehicle.ID + " needs a positive capacity",
+			})
+		}
+		if err := services.ValidateLocation(vehicle.Depot); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid depot for vehicle " + vehicle.ID + ": " + err.Error(),
+			})
+		}
+		if vehicle.ShiftStart != nil && vehicle.ShiftEnd != nil && !vehicle.ShiftEnd.After(*vehicle.ShiftStart) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "shift_end must be after shift_start for vehicle " + vehicle.ID,
+			})
+		}
+		// Vehicles whose shift is over are returned without a route
+		if vehicle.ShiftEnd == nil || vehicle.ShiftEnd.After(services.ShiftDeparture(vehicle, startTime)) {
+			available++
+		}
+	}
+	if available == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "The shifts of all vehicles have already ended",
+		})
+	}
+
+	stopIDs := make(map[string]bool, len(request.Stops))
+	for i, stop := range request.Stops {
+		if stop.ID == "" || stopIDs[stop.ID] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Stop " + strconv.Itoa(i) + " needs a unique id",
+			})
+		}
+		stopIDs[stop.ID] = true
+
+		if err := services.ValidateLocation(stop.Location); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid location for stop " + stop.ID + ": " + err.Error(),
+			})
+		}
+		if stop.Demand < 0 || stop.ServiceTime < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "demand and service_time must not be negative for stop " + stop.ID,
+			})
+		}
+	}
+
+	if message := validatePreferences(request.Preferences); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": message,
+		})
+	}
+
+	response, err := h.routeService.OptimizeFleet(request)
+	if errors.Is(err, services.ErrNoRoadRoute) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":   true,
+			"message": "No road route between the stops",
+			"details": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Fleet optimization failed",
+			"details": err.Error(),
+		})
+	}
+
+	response.Performance.QueryTime = time.Since(startTime).Milliseconds()
+
+	return c.JSON(response)
+}
+
+// DistanceMatrix returns distances and durations between many locations
+func (h *RouteHandler) DistanceMatrix(c *fiber.Ctx) error {
+	startTime := time.Now()
+
+	var request models.DistanceMatrixRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid request body",
+		})
+	}
+
+	if len(request.Origins) == 0 || len(request.Origins) > 100 || len(request.Destinations) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Between 1 and 100 origins and at most 100 destinations allowed",
+		})
+	}
+
+	for i, origin := range request.Origins {
+		if err := services.ValidateLocation(origin); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid origin " + strconv.Itoa(i) + ": " + err.Error(),
+			})
+		}
+	}
+	for i, destination := range request.Destinations {
+		if err := services.ValidateLocation(destination); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid destination " + strconv.Itoa(i) + ": " + err.Error(),
+			})
+		}
+	}
+
+	switch request.Method {
+	case "", services.MatrixHaversine, services.MatrixVincenty, services.MatrixPostGIS:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "method must be haversine, vincenty or postgis",
+		})
+	}
+
+	response, err := h.routeService.DistanceMatrix(request)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Distance matrix calculation failed",
+			"details": err.Error(),
+		})
+	}
+
+	response.Performance.QueryTime = time.Since(startTime).Milliseconds()
+
+	return c.JSON(response)
+}
+
 // CalculateRoute handles simple route calculation between two points
 func (h *RouteHandler) CalculateRoute(c *fiber.Ctx) error {
 	startTime := time.Now()
@@ -103,6 +324,7 @@ func (h *RouteHandler) CalculateRoute(c *fiber.Ctx) error {
 	var request struct {
 		Origin      models.Location `json:"origin"`
 		Destination models.Location `json:"destination"`
+		VehicleType string          `json:"vehicle_type"`
 	}
 
 	if err := c.BodyParser(&request); err != nil {
@@ -122,7 +344,14 @@ func (h *RouteHandler) CalculateRoute(c *fiber.Ctx) error {
 	}
 
 	// Calculate route
-	route, err := h.routeService.CalculateRoute(request.Origin, request.Destination)
+	route, err := h.routeService.CalculateRoute(middleware.GetDriverID(c), request.VehicleType, request.Origin, request.Destination)
+	if errors.Is(err, services.ErrNoRoadRoute) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":   true,
+			"message": "No road route between origin and destination",
+			"details": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
@@ -196,18 +425,43 @@ func (h *RouteHandler) GetTrafficData(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get optional query parameters
-	radius := c.Query("radius", "1000") // Default 1km
-	radiusFloat, err := strconv.ParseFloat(radius, 64)
-	if err != nil || radiusFloat <= 0 {
-		radiusFloat = 1000
+	radius, err := strconv.ParseFloat(c.Query("radius", "1000"), 64) // Default 1km
+	if err != nil || radius <= 0 || radius > 5000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Radius must be greater than 0 and at most 5000 meters",
+		})
+	}
+
+	owner, err := h.routeService.GetRouteDriverID(routeID)
+	if err != nil {
+		if err.Error() == "route not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Route not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to get traffic data",
+			"details": err.Error(),
+		})
+	}
+	if _, allowed := middleware.ScopeDriverID(c, owner); !allowed {
+		return middleware.ScopeDenied(c)
 	}
 
 	startTime := time.Now()
 
-	// Get traffic data
-	trafficData, err := h.routeService.GetTrafficData(routeID)
+	// Get traffic along the route
+	traffic, err := h.routeService.GetTrafficData(routeID, radius)
 	if err != nil {
+		if err.Error() == "route not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Route not found",
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   true,
 			"message": "Failed to get traffic data",
@@ -219,81 +473,192 @@ func (h *RouteHandler) GetTrafficData(c *fiber.Ctx) error {
 
 	// Determine traffic status
 	status := "normal"
-	if trafficData.CongestionLevel > 0.8 {
+	if traffic.CongestionLevel > 0.8 {
 		status = "severe"
-	} else if trafficData.CongestionLevel > 0.6 {
+	} else if traffic.CongestionLevel > 0.6 {
 		status = "heavy"
-	} else if trafficData.CongestionLevel > 0.3 {
+	} else if traffic.CongestionLevel > 0.3 {
 		status = "moderate"
 	}
 
 	return c.JSON(fiber.Map{
 		"route_id":        routeID,
-		"traffic_data":    trafficData,
+		"traffic_data":    traffic,
 		"status":          status,
-		"recommendations": h.generateTrafficRecommendations(trafficData),
+		"recommendations": h.generateTrafficRecommendations(&traffic.TrafficData),
 		"performance": fiber.Map{
 			"query_time":    responseTime,
-			"data_sources":  1,
-			"radius_meters": radiusFloat,
+			"data_sources":  traffic.DataPoints,
+			"radius_meters": radius,
 		},
 	})
 }
 
+// RecordRouteTrace stores positions actually driven along a stored route
+func (h *RouteHandler) RecordRouteTrace(c *fiber.Ctx) error {
+	routeID := c.Params("routeId")
+	if routeID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Route ID required",
+		})
+	}
+
+	var request models.RouteTraceRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid request body",
+		})
+	}
+
+	if len(request.Points) == 0 || len(request.Points) > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Trace must contain between 1 and 1000 points",
+		})
+	}
+
+	for i, point := range request.Points {
+		if point.Latitude < -90 || point.Latitude > 90 ||
+			point.Longitude < -180 || point.Longitude > 180 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid coordinates in trace point " + strconv.Itoa(i),
+			})
+		}
+	}
+
+	// Only the route's driver, or a dispatcher, may report how it was driven
+	owner, err := h.routeService.GetRouteDriverID(routeID)
+	if err != nil {
+		if err.Error() == "route not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Route not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to record route trace",
+			"details": err.Error(),
+		})
+	}
+	if _, allowed := middleware.ScopeDriverID(c, owner); !allowed {
+		return middleware.ScopeDenied(c)
+	}
+
+	recorded, err := h.routeService.RecordTrace(routeID, request.Points)
+	if err != nil {
+		if err.Error() == "route not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Route not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to record route trace",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success":         true,
+		"route_id":        routeID,
+		"points_recorded": recorded,
+	})
+}
+
 // GetRouteAnalytics provides analytics for route performance
 func (h *RouteHandler) GetRouteAnalytics(c *fiber.Ctx) error {
 	// Get query parameters
-	driverID := c.Query("driver_id")
+	driverID, allowed := middleware.ScopeDriverID(c, c.Query("driver_id"))
+	if !allowed {
+		return middleware.ScopeDenied(c)
+	}
 	days := c.Query("days", "7")
 	daysInt, err := strconv.Atoi(days)
-	if err != nil || daysInt <= 0 {
+	if err != nil || daysInt <= 0 || daysInt > 366 {
 		daysInt = 7
 	}
 
+	period := c.Query("period", "day")
+	if period != "day" && period != "week" && period != "month" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid period (must be day, week or month)",
+		})
+	}
+
 	startTime := time.Now()
 
-	// For demo purposes, return simulated analytics
-	// In production, you'd query actual route history from database
-	analytics := fiber.Map{
-		"driver_id":               driverID,
-		"period_days":             daysInt,
-		"total_routes":            45,
-		"total_distance_km":       1250.5,
-		"total_duration_hours":    78.2,
-		"average_speed_kmh":       42.3,
-		"fuel_consumption_liters": 156.8,
-		"optimization_savings": fiber.Map{
-			"distance_saved_km": 89.2,
-			"time_saved_hours":  4.1,
-			"fuel_saved_liters": 12.4,
-			"cost_saved_usd":    45.80,
-		},
-		"performance_metrics": fiber.Map{
-			"routes_optimized":             43,
-			"optimization_success_rate":    95.6,
-			"average_optimization_time_ms": 145,
-		},
-		"traffic_analysis": fiber.Map{
-			"heavy_traffic_encounters": 12,
-			"average_delay_minutes":    8.5,
-			"best_departure_times":     []string{"06:30", "09:45", "14:15"},
-		},
+	until := time.Now()
+	since := until.AddDate(0, 0, -daysInt)
+
+	var driverIDPtr *string
+	if driverID != "" {
+		driverIDPtr = &driverID
+	}
+
+	analytics, err := h.routeService.GetRouteAnalytics(driverIDPtr, since, until, period)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to get route analytics",
+			"details": err.Error(),
+		})
 	}
 
 	responseTime := time.Since(startTime).Milliseconds()
 
 	return c.JSON(fiber.Map{
+		"driver_id":    driverID,
+		"period_days":  daysInt,
 		"analytics":    analytics,
 		"generated_at": time.Now().Unix(),
 		"performance": fiber.Map{
 			"calculation_time":     responseTime,
-			"data_points_analyzed": 450,
+			"data_points_analyzed": analytics.DataPoints,
 		},
 	})
 }
 
 // Private helper methods
 
+// validatePreferences returns why route preferences are unusable, or an
+// empty string
+func validatePreferences(preferences models.RoutePreferences) string {
+	switch preferences.OptimizeFor {
+	case "", services.OptimizeForTime, services.OptimizeForDistance, services.OptimizeForFuel:
+	default:
+		return "optimize_for must be time, distance or fuel"
+	}
+
+	if preferences.TimeBudgetMs < 0 {
+		return "time_budget_ms must not be negative"
+	}
+
+	return ""
+}
+
+// validateStop returns why a route stop, including its time window and
+// service time, is unusable, or an empty string
+func validateStop(stop models.Location) string {
+	if err := services.ValidateLocation(stop); err != nil {
+		return err.Error()
+	}
+	if stop.ServiceTime < 0 {
+		return "service_time must not be negative"
+	}
+	if stop.EarliestArrival != nil && stop.LatestArrival != nil &&
+		stop.LatestArrival.Before(*stop.EarliestArrival) {
+		return "latest_arrival must not be before earliest_arrival"
+	}
+
+	return ""
+}
+
 func (h *RouteHandler) generateTrafficRecommendations(trafficData *models.TrafficData) []string {
 	recommendations := make([]string, 0)
 
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+type TrafficHandler struct {
+	trafficService *services.TrafficService
+}
+
+func NewTrafficHandler(trafficService *services.TrafficService) *TrafficHandler {
+	return &TrafficHandler{
+		trafficService: trafficService,
+	}
+}
+
+// IngestObservations handles bulk traffic observation ingestion
+func (h *TrafficHandler) IngestObservations(c *fiber.Ctx) error {
+	var request models.TrafficIngestRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid request body",
+		})
+	}
+
+	if err := validateSource(request.Source); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid source",
+			"details": err.Error(),
+		})
+	}
+
+	if len(request.Observations) == 0 || len(request.Observations) > 5000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Request must contain between 1 and 5000 observations",
+		})
+	}
+
+	result, err := h.trafficService.Ingest(request.Source, request.Observations)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to ingest traffic observations",
+			"details": err.Error(),
+		})
+	}
+
+	return ingestResponse(c, result)
+}
+
+// IngestFeed handles a traffic feed document posted in one of the feed
+// formats; the source defaults to the format name
+func (h *TrafficHandler) IngestFeed(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Params("format"))
+	source := c.Query("source", format)
+
+	if err := validateSource(source); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Invalid source",
+			"details": err.Error(),
+		})
+	}
+
+	if len(c.Body()) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Feed body required",
+		})
+	}
+
+	result, err := h.trafficService.IngestFeed(format, source, bytes.NewReader(c.Body()))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidTrafficFeed) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid traffic feed",
+				"details": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Failed to ingest traffic feed",
+			"details": err.Error(),
+		})
+	}
+
+	return ingestResponse(c, result)
+}
+
+// validateSource rejects malformed source names and the source written by
+// the fleet probe aggregator
+func validateSource(source string) error {
+	if source == services.FleetProbeSource {
+		return errors.New("source " + source + " is reserved for fleet probe speeds")
+	}
+	return services.ValidateTrafficSource(source)
+}
+
+// ingestResponse reports a batch as created unless every observation in
+// it was rejected
+func ingestResponse(c *fiber.Ctx, result *models.TrafficIngestResult) error {
+	if result.Received > 0 && result.Rejected == result.Received {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":   true,
+			"message": "No valid traffic observations",
+			"result":  result,
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"result":  result,
+	})
+}
@@ -1,42 +1,66 @@
 package handlers
 
 import (
+	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"go-spatial/middleware"
 	"go-spatial/services"
 )
 
+// Close codes sent to sockets that fail authentication
+const (
+	closeUnauthorized = 4401
+	closeInvalidAuth  = websocket.ClosePolicyViolation
+)
+
+// Time a client has to send its auth message when no token was passed with
+// the upgrade request
+const authHandshakeTimeout = 10 * time.Second
+
 type WebSocketHandler struct {
 	hub            *services.WebSocketHub
 	spatialService *services.SpatialService
+	verifier       *middleware.TokenVerifier
 }
 
-func NewWebSocketHandler(hub *services.WebSocketHub, spatialService *services.SpatialService) *WebSocketHandler {
+func NewWebSocketHandler(hub *services.WebSocketHub, spatialService *services.SpatialService, verifier *middleware.TokenVerifier) *WebSocketHandler {
 	return &WebSocketHandler{
 		hub:            hub,
 		spatialService: spatialService,
+		verifier:       verifier,
 	}
 }
 
-// HandleConnection handles new WebSocket connections
+// HandleConnection handles new WebSocket connections. The client is bound to
+// the identity verified during the upgrade or, failing that, by an initial
+// {"type":"auth","payload":{"token":"..."}} message.
 func (h *WebSocketHandler) HandleConnection(c *websocket.Conn) {
-	// Extract driver ID from query parameters or headers
-	driverID := c.Query("driver_id")
-	if driverID == "" {
-		// Try to get from Locals (set by middleware)
-		if id, ok := c.Locals("driver_id").(string); ok {
-			driverID = id
-		} else {
-			driverID = "unknown"
+	identity, _ := c.Locals("identity").(*middleware.Identity)
+	if identity == nil {
+		identity = h.authenticateHandshake(c)
+		if identity == nil {
+			return
 		}
 	}
 
+	driverID := identity.DriverID
+
 	log.Printf("New WebSocket connection for driver: %s from %s", driverID, c.RemoteAddr())
 
 	// Register the client with the hub
-	_ = h.hub.RegisterClient(c, driverID)
+	client := h.hub.RegisterClient(c, driverID, identity.Roles)
+
+	// Close the socket once the token it was opened with expires
+	if exp, err := identity.Claims.GetExpirationTime(); err == nil && exp != nil {
+		timer := time.AfterFunc(time.Until(exp.Time), func() {
+			client.CloseWithCode(closeUnauthorized, "token expired")
+		})
+		defer timer.Stop()
+	}
 
 	// Send initial connection confirmation
 	h.hub.BroadcastToDriver(driverID, map[string]interface{}{
@@ -51,9 +75,10 @@ func (h *WebSocketHandler) HandleConnection(c *websocket.Conn) {
 		},
 	})
 
-	// The client will handle its own read/write loops
-	// Connection cleanup is handled automatically when the connection closes
 	log.Printf("WebSocket connection established for driver: %s", driverID)
+
+	// Block until the connection closes; cleanup is handled by the hub
+	client.Listen()
 }
 
 // GetConnectionStats returns WebSocket connection statistics
@@ -104,3 +129,45 @@ func (h *WebSocketHandler) BroadcastMessage(c *fiber.Ctx) error {
 		"message": "Message broadcasted successfully",
 	})
 }
+
+// Helper methods
+
+func (h *WebSocketHandler) authenticateHandshake(c *websocket.Conn) *middleware.Identity {
+	c.SetReadDeadline(time.Now().Add(authHandshakeTimeout))
+
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		closeConnection(c, closeUnauthorized, "authentication required")
+		return nil
+	}
+
+	var request struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Token string `json:"token"`
+		} `json:"payload"`
+	}
+
+	if err := json.Unmarshal(message, &request); err != nil || request.Type != "auth" || request.Payload.Token == "" {
+		closeConnection(c, closeInvalidAuth, "first message must be an auth message")
+		return nil
+	}
+
+	identity, err := h.verifier.Verify(request.Payload.Token)
+	if err != nil {
+		closeConnection(c, closeUnauthorized, "invalid token")
+		return nil
+	}
+
+	c.SetReadDeadline(time.Time{})
+
+	return identity
+}
+
+func closeConnection(c *websocket.Conn, code int, reason string) {
+	log.Printf("Closing WebSocket connection from %s: %s", c.RemoteAddr(), reason)
+
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+}
@@ -20,6 +20,7 @@ import (
 	"go-spatial/database"
 	"go-spatial/handlers"
 	"go-spatial/middleware"
+	"go-spatial/models"
 	"go-spatial/services"
 )
 
@@ -31,6 +32,9 @@ func main() {
 
 	// Initialize configuration
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize database connection with PostGIS
 	db, err := database.Initialize(cfg.DatabaseURL)
@@ -47,8 +51,93 @@ func main() {
 	// Initialize services
 	spatialService := services.NewSpatialService(db)
 	geofenceService := services.NewGeofenceService(db)
+	geofenceService.SetPresenceSettings(services.PresenceSettings{
+		DwellTime:  time.Duration(cfg.Geofencing.DwellSeconds) * time.Second,
+		ExitMargin: float64(cfg.Geofencing.ExitMarginMeters),
+	})
 	routeService := services.NewRouteService(db)
+	routeService.SetSolverSettings(services.SolverSettings{
+		TimeBudget:    time.Duration(cfg.Routing.SolverTimeBudgetMs) * time.Millisecond,
+		MaxIterations: cfg.Routing.SolverIterations,
+		Seed:          int64(cfg.Routing.SolverSeed),
+	})
+	routeService.SetMatrixSettings(services.MatrixSettings{
+		Method: cfg.Routing.MatrixMethod,
+	})
+	var roadGraph *services.RoadGraph
+	if cfg.Routing.OSMFile != "" {
+		roadGraph, err = services.LoadRoadGraph(cfg.Routing.OSMFile)
+		if err != nil {
+			log.Fatalf("Failed to import road network: %v", err)
+		}
+		log.Printf("Road network loaded: %d nodes, %d road segments", roadGraph.NodeCount(), roadGraph.EdgeCount())
+		routeService.SetRoadGraph(roadGraph)
+	}
+	locationHistoryService := services.NewLocationHistoryService(db)
+	trafficService := services.NewTrafficService(db)
+	trafficFeeds, _ := cfg.Traffic.FeedList()
+	feeds := make([]services.TrafficFeed, len(trafficFeeds))
+	for i, feed := range trafficFeeds {
+		feeds[i] = services.TrafficFeed{Source: feed.Source, Format: feed.Format, Location: feed.Location}
+	}
+	if err := trafficService.SetFeeds(feeds); err != nil {
+		log.Fatalf("Invalid traffic feeds: %v", err)
+	}
 	wsHub := services.NewWebSocketHub()
+	wsHub.SetOutboxSettings(services.OutboxSettings{
+		MaxMessages: cfg.WebSocket.OutboxSize,
+		Retention:   time.Duration(cfg.WebSocket.OutboxRetentionSeconds) * time.Second,
+	})
+
+	// Relay WebSocket messages between replicas behind the load balancer
+	switch cfg.WebSocket.Backplane {
+	case "redis":
+		backplane, err := services.NewRedisBackplane(cfg.RedisURL, cfg.WebSocket.BackplaneChannel)
+		if err != nil {
+			log.Fatalf("Failed to initialize WebSocket backplane: %v", err)
+		}
+		defer backplane.Close()
+
+		if err := wsHub.SetBackplane(backplane); err != nil {
+			log.Fatalf("Failed to subscribe to WebSocket backplane: %v", err)
+		}
+	case "memory":
+		// Single replica; messages stay in process
+	default:
+		log.Fatalf("Unknown WebSocket backplane: %s", cfg.WebSocket.Backplane)
+	}
+
+	// Live locations sent over WebSocket feed geofence and deviation checks
+	locationTracker := services.NewLocationTracker(wsHub, geofenceService, spatialService, routeService, locationHistoryService)
+	locationTracker.SetTrackingSettings(services.TrackingSettings{
+		ActiveRouteAge:     time.Duration(cfg.Tracking.ActiveRouteHours) * time.Hour,
+		DeviationThreshold: float64(cfg.Tracking.DeviationThresholdMeters),
+		AlertMaxAge:        time.Duration(cfg.Tracking.AlertMaxAgeSeconds) * time.Second,
+	})
+	wsHub.SetLocationProcessor(locationTracker)
+
+	// Driver speeds feed traffic_data alongside the external feeds
+	probeAggregator := services.NewFleetProbeAggregator(trafficService)
+	probeAggregator.SetProbeSettings(services.FleetProbeSettings{
+		Window:     time.Duration(cfg.Traffic.ProbeWindowSeconds) * time.Second,
+		MinDrivers: cfg.Traffic.ProbeMinDrivers,
+	})
+	if roadGraph != nil {
+		probeAggregator.SetRoadGraph(roadGraph)
+	}
+	if cfg.Traffic.ProbeIntervalSeconds > 0 {
+		locationTracker.SetProbeAggregator(probeAggregator)
+	}
+
+	// Congestion spikes in new traffic observations are pushed to nearby drivers
+	trafficAlerts := services.NewTrafficAlertMonitor(db, wsHub)
+	trafficAlerts.SetAlertSettings(services.TrafficAlertSettings{
+		Radius:         float64(cfg.Traffic.AlertRadiusMeters),
+		MinCongestion:  cfg.Traffic.AlertMinCongestion,
+		ActiveRouteAge: time.Duration(cfg.Tracking.ActiveRouteHours) * time.Hour,
+		PositionMaxAge: 15 * time.Minute,
+		Suppression:    time.Duration(cfg.Traffic.AlertSuppressionMinutes) * time.Minute,
+	})
 
 	// Initialize Fiber app with optimized settings
 	app := fiber.New(fiber.Config{
@@ -88,7 +177,6 @@ func main() {
 
 	// Custom middleware
 	app.Use(middleware.Performance())
-	app.Use(middleware.RateLimit())
 
 	// Health check endpoint
 	app.Get("/health", func(c *fiber.Ctx) error {
@@ -109,16 +197,47 @@ func main() {
 	spatialHandler := handlers.NewSpatialHandler(spatialService, geofenceService)
 	routeHandler := handlers.NewRouteHandler(routeService, spatialService)
 	geofenceHandler := handlers.NewGeofenceHandler(geofenceService, spatialService)
-	wsHandler := handlers.NewWebSocketHandler(wsHub, spatialService)
+	locationHandler := handlers.NewLocationHandler(locationTracker, locationHistoryService)
+	trafficHandler := handlers.NewTrafficHandler(trafficService)
+
+	// Token verification for protected routes; HS256 only when enabled
+	jwtSecret := ""
+	if cfg.Auth.AllowHS256 {
+		jwtSecret = cfg.JWTSecret
+	}
+	tokenVerifier, err := middleware.NewTokenVerifier(middleware.JWTConfig{
+		Secret:        jwtSecret,
+		PublicKeyFile: cfg.Auth.PublicKeyFile,
+		JWKSURL:       cfg.Auth.JWKSURL,
+		JWKSFile:      cfg.Auth.JWKSFile,
+		JWKSRefresh:   time.Duration(cfg.Auth.JWKSRefreshSeconds) * time.Second,
+		Issuer:        cfg.Auth.Issuer,
+		Audience:      cfg.Auth.Audience,
+		DriverIDClaim: cfg.Auth.DriverIDClaim,
+		RolesClaim:    cfg.Auth.RolesClaim,
+		Leeway:        time.Duration(cfg.Auth.LeewaySeconds) * time.Second,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize token verification: %v", err)
+	}
+	defer tokenVerifier.Close()
 
 	// API routes with versioning
 	v1 := app.Group("/api/v1")
 
-	// Authentication middleware for protected routes
-	v1.Use(middleware.Authentication())
+	// Authentication middleware for protected routes; rate limits follow it
+	// so they key on the verified caller
+	v1.Use(middleware.Authentication(tokenVerifier))
+	v1.Use(middleware.RateLimit())
+
+	// Role scopes: every caller needs one of the known roles; shared fences
+	// are managed by dispatchers and admins
+	anyRole := middleware.RequireRoles(models.RoleDriver, models.RoleDispatcher, models.RoleAdmin)
+	managers := middleware.RequireRoles(models.RoleDispatcher, models.RoleAdmin)
+	adminOnly := middleware.RequireRoles(models.RoleAdmin)
 
 	// Spatial analysis endpoints
-	spatial := v1.Group("/spatial")
+	spatial := v1.Group("/spatial", anyRole)
 	spatial.Post("/analyze", spatialHandler.AnalyzeLocation)
 	spatial.Post("/batch-analyze", spatialHandler.BatchAnalyze)
 	spatial.Get("/nearby", spatialHandler.FindNearby)
@@ -126,27 +245,45 @@ func main() {
 	spatial.Post("/intersects", spatialHandler.CheckIntersection)
 
 	// Route optimization endpoints
-	routes := v1.Group("/route")
+	routes := v1.Group("/route", anyRole)
 	routes.Post("/optimize", routeHandler.OptimizeRoute)
+	routes.Post("/fleet/optimize", managers, routeHandler.OptimizeFleet)
+	routes.Post("/matrix", routeHandler.DistanceMatrix)
 	routes.Post("/calculate", routeHandler.CalculateRoute)
 	routes.Post("/validate", routeHandler.ValidateRoute)
 	routes.Get("/traffic/:routeId", routeHandler.GetTrafficData)
+	routes.Get("/analytics", routeHandler.GetRouteAnalytics)
+	routes.Post("/:routeId/trace", routeHandler.RecordRouteTrace)
 
 	// Geofence management endpoints
-	geofences := v1.Group("/geofences")
+	v1.Get("/geofences.geojson", anyRole, geofenceHandler.ExportGeofences)
+	geofences := v1.Group("/geofences", anyRole)
 	geofences.Get("/", geofenceHandler.ListGeofences)
-	geofences.Post("/", geofenceHandler.CreateGeofence)
+	geofences.Post("/", managers, geofenceHandler.CreateGeofence)
+	geofences.Get("/activity", geofenceHandler.GetGeofenceActivity)
 	geofences.Get("/:id", geofenceHandler.GetGeofence)
-	geofences.Put("/:id", geofenceHandler.UpdateGeofence)
-	geofences.Delete("/:id", geofenceHandler.DeleteGeofence)
+	geofences.Put("/:id", managers, geofenceHandler.UpdateGeofence)
+	geofences.Delete("/:id", managers, geofenceHandler.DeleteGeofence)
 	geofences.Post("/check", geofenceHandler.CheckGeofenceEntry)
 
+	// Driver location history endpoints
+	locations := v1.Group("/locations", anyRole)
+	locations.Post("/", locationHandler.RecordLocations)
+	locations.Get("/:driverId/track", locationHandler.GetDriverTrack)
+
+	// Traffic observation ingestion endpoints
+	traffic := v1.Group("/traffic", managers)
+	traffic.Post("/observations", trafficHandler.IngestObservations)
+	traffic.Post("/feeds/:format", trafficHandler.IngestFeed)
+
 	// Performance monitoring endpoints
-	performance := v1.Group("/performance")
+	performance := v1.Group("/performance", adminOnly)
 	performance.Get("/metrics", spatialHandler.GetMetrics)
 	performance.Get("/health", spatialHandler.HealthCheck)
 
 	// WebSocket endpoint for real-time updates
+	wsHandler := handlers.NewWebSocketHandler(wsHub, spatialService, tokenVerifier)
+
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("allowed", true)
@@ -154,12 +291,44 @@ func main() {
 		}
 		return fiber.ErrUpgradeRequired
 	})
+	app.Use("/ws", middleware.WebSocketAuthentication(tokenVerifier))
+	app.Use("/ws", middleware.RateLimit())
 
-	app.Get("/ws/spatial", websocket.New(wsHandler.HandleConnection))
+	app.Get("/ws/spatial", websocket.New(wsHandler.HandleConnection, websocket.Config{
+		Subprotocols: []string{"bearer"},
+	}))
 
 	// Start WebSocket hub
 	go wsHub.Run()
 
+	// Prune driver locations past the retention period
+	if cfg.LocationHistory.RetentionDays > 0 && cfg.LocationHistory.PruneIntervalMinutes > 0 {
+		go locationHistoryService.RunRetention(
+			time.Duration(cfg.LocationHistory.RetentionDays)*24*time.Hour,
+			time.Duration(cfg.LocationHistory.PruneIntervalMinutes)*time.Minute,
+		)
+	}
+
+	// Prune traffic observations past the retention period and poll the
+	// configured feeds
+	if cfg.Traffic.RetentionDays > 0 && cfg.Traffic.PruneIntervalMinutes > 0 {
+		go trafficService.RunRetention(
+			time.Duration(cfg.Traffic.RetentionDays)*24*time.Hour,
+			time.Duration(cfg.Traffic.PruneIntervalMinutes)*time.Minute,
+		)
+	}
+	if len(feeds) > 0 && cfg.Traffic.FeedIntervalSeconds > 0 {
+		go trafficService.RunFeeds(time.Duration(cfg.Traffic.FeedIntervalSeconds) * time.Second)
+	}
+
+	if cfg.Traffic.ProbeIntervalSeconds > 0 {
+		go probeAggregator.Run(time.Duration(cfg.Traffic.ProbeIntervalSeconds) * time.Second)
+	}
+
+	if cfg.Traffic.AlertIntervalSeconds > 0 {
+		go trafficAlerts.Run(time.Duration(cfg.Traffic.AlertIntervalSeconds) * time.Second)
+	}
+
 	// Start performance monitoring
 	go startPerformanceMonitoring(spatialService)
 
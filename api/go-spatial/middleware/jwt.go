@@ -0,0 +1,393 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig configures bearer token verification
+type JWTConfig struct {
+	// Secret verifies HS256 tokens; leave empty to reject HS256
+	Secret string
+	// PublicKeyFile is a PEM encoded RSA public key used for RS256 tokens
+	// that carry no key ID
+	PublicKeyFile string
+	// JWKSURL and JWKSFile provide RS256 keys by key ID
+	JWKSURL  string
+	JWKSFile string
+	// JWKSRefresh is how often the key set is reloaded to pick up rotation
+	JWKSRefresh time.Duration
+
+	Issuer        string
+	Audience      string
+	DriverIDClaim string
+	RolesClaim    string
+	Leeway        time.Duration
+}
+
+// Identity is the authenticated caller taken from verified token claims
+type Identity struct {
+	Subject  string
+	DriverID string
+	Roles    []string
+	Claims   jwt.MapClaims
+}
+
+// TokenVerifier validates HS256/RS256 JWTs against the configured keys
+type TokenVerifier struct {
+	config    JWTConfig
+	parser    *jwt.Parser
+	publicKey *rsa.PublicKey
+
+	keys      map[string]*rsa.PublicKey
+	keysMutex sync.RWMutex
+
+	// Concurrent refreshes share the one in flight
+	refresh      *keyRefresh
+	lastAttempt  time.Time
+	refreshMutex sync.Mutex
+
+	client    *http.Client
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// keyRefresh is a key set reload that other callers can wait for
+type keyRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// Minimum time between key set reloads triggered by unknown key IDs
+const jwksMinRefreshInterval = 30 * time.Second
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// NewTokenVerifier creates a verifier and loads any configured RSA keys
+func NewTokenVerifier(config JWTConfig) (*TokenVerifier, error) {
+	if config.DriverIDClaim == "" {
+		config.DriverIDClaim = "driver_id"
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(config.Leeway),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+
+	v := &TokenVerifier{
+		config: config,
+		parser: jwt.NewParser(options...),
+		keys:   make(map[string]*rsa.PublicKey),
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+	}
+
+	if config.PublicKeyFile != "" {
+		pemBytes, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		v.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+	}
+
+	if v.hasKeySet() {
+		if err := v.sharedRefresh(); err != nil {
+			return nil, err
+		}
+
+		// Start key rotation goroutine
+		if config.JWKSRefresh > 0 {
+			go v.rotateKeys()
+		}
+	}
+
+	if config.Secret == "" && v.publicKey == nil && !v.hasKeySet() {
+		return nil, fmt.Errorf("no token verification keys configured")
+	}
+
+	return v, nil
+}
+
+// Verify checks the token signature and standard claims and returns the
+// caller identity
+func (v *TokenVerifier) Verify(tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := v.parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	if errors.Is(err, errUnknownKey) && v.hasKeySet() && v.canRefresh() {
+		// The issuer may have rotated keys since the last reload
+		if refreshErr := v.sharedRefresh(); refreshErr != nil {
+			log.Printf("JWKS refresh failed: %v", refreshErr)
+		}
+		claims = jwt.MapClaims{}
+		_, err = v.parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Claims: claims,
+		Roles:  claimStrings(claims[v.config.RolesClaim]),
+	}
+
+	identity.Subject, _ = claims.GetSubject()
+
+	if driverID, ok := claims[v.config.DriverIDClaim].(string); ok && driverID != "" {
+		identity.DriverID = driverID
+	} else {
+		identity.DriverID = identity.Subject
+	}
+
+	if identity.DriverID == "" {
+		return nil, fmt.Errorf("token has no %s or sub claim", v.config.DriverIDClaim)
+	}
+
+	return identity, nil
+}
+
+// Close stops the periodic key set reload
+func (v *TokenVerifier) Close() {
+	v.closeOnce.Do(func() { close(v.stop) })
+}
+
+// Helper methods
+
+func (v *TokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if v.config.Secret == "" {
+			return nil, fmt.Errorf("HS256 tokens are not accepted")
+		}
+		return []byte(v.config.Secret), nil
+
+	case "RS256":
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			if v.publicKey != nil {
+				return v.publicKey, nil
+			}
+
+			// A key set with a single key needs no key ID
+			v.keysMutex.RLock()
+			defer v.keysMutex.RUnlock()
+			if len(v.keys) == 1 {
+				for _, key := range v.keys {
+					return key, nil
+				}
+			}
+			return nil, errUnknownKey
+		}
+
+		v.keysMutex.RLock()
+		key, ok := v.keys[kid]
+		v.keysMutex.RUnlock()
+		if !ok {
+			return nil, errUnknownKey
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+}
+
+func (v *TokenVerifier) hasKeySet() bool {
+	return v.config.JWKSURL != "" || v.config.JWKSFile != ""
+}
+
+// canRefresh limits reloads triggered by unknown key IDs, failed ones
+// included, so bad tokens cannot hammer the key set endpoint
+func (v *TokenVerifier) canRefresh() bool {
+	v.refreshMutex.Lock()
+	defer v.refreshMutex.Unlock()
+
+	return v.refresh != nil || time.Since(v.lastAttempt) >= jwksMinRefreshInterval
+}
+
+func (v *TokenVerifier) rotateKeys() {
+	ticker := time.NewTicker(v.config.JWKSRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.sharedRefresh(); err != nil {
+				log.Printf("JWKS refresh failed: %v", err)
+			}
+		case <-v.stop:
+			return
+		}
+	}
+}
+
+// sharedRefresh reloads the key set, or waits for the reload already in
+// flight, so a burst of tokens with an unknown key ID fetches it once
+func (v *TokenVerifier) sharedRefresh() error {
+	v.refreshMutex.Lock()
+	if call := v.refresh; call != nil {
+		v.refreshMutex.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &keyRefresh{done: make(chan struct{})}
+	v.refresh = call
+	v.lastAttempt = time.Now()
+	v.refreshMutex.Unlock()
+
+	call.err = v.refreshKeys()
+
+	v.refreshMutex.Lock()
+	v.refresh = nil
+	v.refreshMutex.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// refreshKeys reloads the key set; on failure the previous keys stay active
+func (v *TokenVerifier) refreshKeys() error {
+	var data []byte
+	var err error
+
+	if v.config.JWKSFile != "" {
+		data, err = os.ReadFile(v.config.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+	} else {
+		resp, err := v.client.Get(v.config.JWKSURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+		}
+
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS: %w", err)
+		}
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.keysMutex.Lock()
+	v.keys = keys
+	v.keysMutex.Unlock()
+
+	return nil
+}
+
+// parseJWKS extracts the RSA signing keys from a JSON Web Key Set
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string   `json:"kid"`
+			Kty string   `json:"kty"`
+			Use string   `json:"use"`
+			Alg string   `json:"alg"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		if jwk.N != "" && jwk.E != "" {
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modulus for key %q", jwk.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exponent for key %q", jwk.Kid)
+			}
+
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+			continue
+		}
+
+		if len(jwk.X5c) > 0 {
+			der, err := base64.StdEncoding.DecodeString(jwk.X5c[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate for key %q", jwk.Kid)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate for key %q: %w", jwk.Kid, err)
+			}
+			if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+				keys[jwk.Kid] = key
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no RSA signing keys")
+	}
+
+	return keys, nil
+}
+
+// claimStrings accepts a JSON array of strings or a space separated string
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+
+	return []string{}
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
+
+	"go-spatial/models"
 )
 
 // Performance middleware tracks response times and adds performance headers
@@ -35,16 +37,23 @@ func Performance() fiber.Handler {
 	}
 }
 
-// RateLimit middleware implements rate limiting
+// RateLimit middleware implements rate limiting. It keys on the verified
+// token subject, so it must run after Authentication; anonymous requests
+// are limited by IP.
 func RateLimit() fiber.Handler {
 	return limiter.New(limiter.Config{
 		Max:        100,             // 100 requests
 		Expiration: 1 * time.Minute, // per minute
 		KeyGenerator: func(c *fiber.Ctx) string {
-			// Use IP + driver ID for rate limiting
-			driverID := c.Get("X-Driver-ID", "unknown")
-			ip := c.IP()
-			return fmt.Sprintf("%s:%s", ip, driverID)
+			if identity := GetIdentity(c); identity != nil {
+				if identity.Subject != "" {
+					return "sub:" + identity.Subject
+				}
+				if identity.DriverID != "" {
+					return "driver:" + identity.DriverID
+				}
+			}
+			return "ip:" + c.IP()
 		},
 		LimitReached: func(c *fiber.Ctx) error {
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
@@ -59,7 +68,7 @@ func RateLimit() fiber.Handler {
 }
 
 // Authentication middleware validates JWT tokens and driver authorization
-func Authentication() fiber.Handler {
+func Authentication(verifier *TokenVerifier) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Skip authentication for health checks and public endpoints
 		if strings.HasPrefix(c.Path(), "/health") ||
@@ -85,32 +94,83 @@ func Authentication() fiber.Handler {
 			})
 		}
 
-		token := tokenParts[1]
-
-		// For demo purposes, we'll do basic validation
-		// In production, you'd validate the JWT signature and claims
-		if token == "" || len(token) < 10 {
+		// Validate signature and exp/nbf/iss/aud claims
+		identity, err := verifier.Verify(tokenParts[1])
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error":   true,
 				"message": "Invalid token",
 			})
 		}
 
-		// Extract driver ID from header or token claims
-		driverID := c.Get("X-Driver-ID")
-		if driverID == "" {
-			// In production, extract from JWT claims
-			driverID = "demo-driver-id"
+		// Store driver information in context; the driver ID always comes
+		// from the verified claims, never from request headers
+		c.Locals("driver_id", identity.DriverID)
+		c.Locals("roles", identity.Roles)
+		c.Locals("identity", identity)
+		c.Locals("authenticated", true)
+
+		return c.Next()
+	}
+}
+
+// WebSocketAuthentication middleware verifies a token passed with the
+// WebSocket upgrade, either as the token/access_token query parameter or as
+// the second entry of a "bearer, <token>" Sec-WebSocket-Protocol header.
+// Upgrades without a token are let through so the client can authenticate
+// with its first message instead; upgrades with a bad token are rejected.
+func WebSocketAuthentication(verifier *TokenVerifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := c.Query("token", c.Query("access_token"))
+
+		if token == "" {
+			protocols := strings.Split(c.Get("Sec-WebSocket-Protocol"), ",")
+			if len(protocols) == 2 && strings.TrimSpace(protocols[0]) == "bearer" {
+				token = strings.TrimSpace(protocols[1])
+			}
+		}
+
+		if token == "" {
+			return c.Next()
+		}
+
+		identity, err := verifier.Verify(token)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   true,
+				"message": "Invalid token",
+			})
 		}
 
-		// Store driver information in context
-		c.Locals("driver_id", driverID)
+		c.Locals("driver_id", identity.DriverID)
+		c.Locals("roles", identity.Roles)
+		c.Locals("identity", identity)
 		c.Locals("authenticated", true)
 
 		return c.Next()
 	}
 }
 
+// RequireRoles middleware rejects callers that hold none of the given roles
+func RequireRoles(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !IsAuthenticated(c) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   true,
+				"message": "Authentication required",
+			})
+		}
+		if !HasRole(c, roles...) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":   true,
+				"message": "Insufficient permissions",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
 // CORS middleware for handling cross-origin requests
 func CORS(allowedOrigins string) fiber.Handler {
 	origins := strings.Split(allowedOrigins, ",")
@@ -258,12 +318,80 @@ func generateRequestID() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
-// GetDriverID extracts driver ID from request context
+// GetDriverID returns the driver ID from the verified token claims, or an
+// empty string for unauthenticated requests
 func GetDriverID(c *fiber.Ctx) string {
 	if driverID, ok := c.Locals("driver_id").(string); ok {
 		return driverID
 	}
-	return c.Get("X-Driver-ID", "unknown")
+	return ""
+}
+
+// GetRoles returns the roles of the authenticated caller; tokens without a
+// roles claim are treated as drivers, unauthenticated requests have none
+func GetRoles(c *fiber.Ctx) []string {
+	if !IsAuthenticated(c) {
+		return []string{}
+	}
+	if roles, ok := c.Locals("roles").([]string); ok && len(roles) > 0 {
+		return roles
+	}
+	return []string{models.RoleDriver}
+}
+
+// HasRole checks if the authenticated caller holds any of the given roles
+func HasRole(c *fiber.Ctx, roles ...string) bool {
+	for _, held := range GetRoles(c) {
+		for _, role := range roles {
+			if held == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ScopeDriverID resolves the driver a request may act on. Dispatchers and
+// admins may act on any driver; drivers only on themselves, defaulting to
+// their own ID when none is requested. Requests that did not pass through
+// Authentication may act on no driver; answer them with ScopeDenied.
+func ScopeDriverID(c *fiber.Ctx, requested string) (string, bool) {
+	if !IsAuthenticated(c) {
+		return "", false
+	}
+	if HasRole(c, models.RoleDispatcher, models.RoleAdmin) {
+		return requested, true
+	}
+
+	own := GetDriverID(c)
+	if requested == "" || requested == own {
+		return own, true
+	}
+
+	return "", false
+}
+
+// ScopeDenied answers a request refused by ScopeDriverID: 401 without
+// verified credentials, 403 when acting on another driver
+func ScopeDenied(c *fiber.Ctx) error {
+	if !IsAuthenticated(c) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   true,
+			"message": "Authentication required",
+		})
+	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error":   true,
+		"message": "Drivers may only access their own data",
+	})
+}
+
+// GetIdentity returns the verified identity of the caller, if any
+func GetIdentity(c *fiber.Ctx) *Identity {
+	if identity, ok := c.Locals("identity").(*Identity); ok {
+		return identity
+	}
+	return nil
 }
 
 // GetRequestID extracts request ID from request context
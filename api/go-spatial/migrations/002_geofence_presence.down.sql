@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_driver_geofence_presence_geofence;
+DROP INDEX IF EXISTS idx_driver_geofence_presence_inside;
+
+DROP TABLE IF EXISTS driver_geofence_presence;
@@ -0,0 +1,20 @@
+-- Track which geofences each driver is currently inside so that checks can
+-- emit real entry/exit transitions instead of re-reporting every position
+CREATE TABLE IF NOT EXISTS driver_geofence_presence (
+    driver_id VARCHAR(255) NOT NULL,
+    geofence_id UUID NOT NULL REFERENCES geofences(id) ON DELETE CASCADE,
+    inside BOOLEAN NOT NULL DEFAULT false,
+    state_since TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    pending_inside BOOLEAN,
+    pending_since TIMESTAMP WITH TIME ZONE,
+    last_location GEOMETRY(POINT, 4326),
+    last_seen TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (driver_id, geofence_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_driver_geofence_presence_inside
+    ON driver_geofence_presence (driver_id)
+    WHERE inside = true OR pending_inside IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_driver_geofence_presence_geofence
+    ON driver_geofence_presence (geofence_id);
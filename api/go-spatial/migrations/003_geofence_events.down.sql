@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_geofence_events_geofence;
+DROP INDEX IF EXISTS idx_geofence_events_driver;
+DROP INDEX IF EXISTS idx_geofence_events_occurred_at;
+
+DROP TABLE IF EXISTS geofence_events;
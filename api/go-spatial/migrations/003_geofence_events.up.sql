@@ -0,0 +1,20 @@
+-- Append-only log of every confirmed geofence entry/exit transition
+CREATE TABLE IF NOT EXISTS geofence_events (
+    id BIGSERIAL PRIMARY KEY,
+    geofence_id UUID NOT NULL,
+    geofence_name VARCHAR(255) NOT NULL,
+    driver_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(10) NOT NULL CHECK (event_type IN ('entry', 'exit')),
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    dwell_seconds BIGINT,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_geofence_events_occurred_at
+    ON geofence_events (occurred_at DESC, id DESC);
+
+CREATE INDEX IF NOT EXISTS idx_geofence_events_driver
+    ON geofence_events (driver_id, occurred_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_geofence_events_geofence
+    ON geofence_events (geofence_id, occurred_at DESC);
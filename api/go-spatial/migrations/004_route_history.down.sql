@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_route_traces_route_recorded;
+DROP INDEX IF EXISTS idx_routes_geometry;
+DROP INDEX IF EXISTS idx_routes_created;
+DROP INDEX IF EXISTS idx_routes_driver_created;
+
+DROP TABLE IF EXISTS route_traces;
+DROP TABLE IF EXISTS routes;
@@ -0,0 +1,41 @@
+-- Every planned route (optimized or point-to-point) with the metrics of the
+-- naive visiting order so optimization savings can be reported
+CREATE TABLE IF NOT EXISTS routes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    driver_id VARCHAR(255) NOT NULL,
+    route_type VARCHAR(20) NOT NULL CHECK (route_type IN ('optimized', 'calculated')),
+    vehicle_type VARCHAR(50),
+    optimize_for VARCHAR(20),
+    waypoints JSONB NOT NULL DEFAULT '[]',
+    geometry GEOMETRY(LINESTRING, 4326),
+    total_distance FLOAT NOT NULL,
+    total_duration INT NOT NULL,
+    estimated_fuel FLOAT NOT NULL,
+    naive_distance FLOAT NOT NULL,
+    naive_duration INT NOT NULL,
+    naive_fuel FLOAT NOT NULL,
+    calculation_time_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Positions actually driven while following a route
+CREATE TABLE IF NOT EXISTS route_traces (
+    id BIGSERIAL PRIMARY KEY,
+    route_id UUID NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+    driver_id VARCHAR(255) NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    speed FLOAT,
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_routes_driver_created
+    ON routes (driver_id, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_routes_created
+    ON routes (created_at);
+
+CREATE INDEX IF NOT EXISTS idx_routes_geometry
+    ON routes USING GIST (geometry);
+
+CREATE INDEX IF NOT EXISTS idx_route_traces_route_recorded
+    ON route_traces (route_id, recorded_at);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_driver_locations_location;
+DROP INDEX IF EXISTS idx_driver_locations_recorded;
+DROP INDEX IF EXISTS idx_driver_locations_driver_recorded;
+
+DROP TABLE IF EXISTS driver_locations;
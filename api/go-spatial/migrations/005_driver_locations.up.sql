@@ -0,0 +1,21 @@
+-- Time series of positions reported by drivers
+CREATE TABLE IF NOT EXISTS driver_locations (
+    id BIGSERIAL PRIMARY KEY,
+    driver_id VARCHAR(255) NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    altitude FLOAT,
+    accuracy FLOAT,
+    heading FLOAT,
+    speed FLOAT,
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_driver_locations_driver_recorded
+    ON driver_locations (driver_id, recorded_at);
+
+CREATE INDEX IF NOT EXISTS idx_driver_locations_recorded
+    ON driver_locations (recorded_at);
+
+CREATE INDEX IF NOT EXISTS idx_driver_locations_location
+    ON driver_locations USING GIST (location);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_traffic_data_source_key;
+
+ALTER TABLE traffic_data DROP COLUMN IF EXISTS observation_key;
@@ -0,0 +1,6 @@
+-- Ingested observations are deduplicated per source on a key derived from
+-- where and when they were measured
+ALTER TABLE traffic_data ADD COLUMN IF NOT EXISTS observation_key VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_traffic_data_source_key
+    ON traffic_data (source, observation_key);
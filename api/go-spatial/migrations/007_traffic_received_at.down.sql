@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_traffic_data_received;
+
+ALTER TABLE traffic_data DROP COLUMN IF EXISTS received_at;
@@ -0,0 +1,6 @@
+-- Traffic alerts pick up observations by when they arrived rather than
+-- when they were measured, so late feeds are not skipped
+ALTER TABLE traffic_data ADD COLUMN IF NOT EXISTS received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS idx_traffic_data_received
+    ON traffic_data (received_at);
@@ -0,0 +1,5 @@
+ALTER TABLE geofences DROP CONSTRAINT IF EXISTS geofences_geometry_areal;
+
+-- Multipolygon fences keep only their first polygon
+ALTER TABLE geofences ALTER COLUMN geometry TYPE GEOMETRY(POLYGON, 4326)
+    USING ST_GeometryN(ST_Multi(geometry), 1);
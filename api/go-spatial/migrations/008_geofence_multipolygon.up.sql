@@ -0,0 +1,6 @@
+-- Geofences may be multipolygons, such as a depot split across a road
+ALTER TABLE geofences ALTER COLUMN geometry TYPE GEOMETRY(GEOMETRY, 4326);
+
+ALTER TABLE geofences DROP CONSTRAINT IF EXISTS geofences_geometry_areal;
+ALTER TABLE geofences ADD CONSTRAINT geofences_geometry_areal
+    CHECK (GeometryType(geometry) IN ('POLYGON', 'MULTIPOLYGON'));
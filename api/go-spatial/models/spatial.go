@@ -14,6 +14,11 @@ type Location struct {
 	Address      *string  `json:"address,omitempty"`
 	CustomerName *string  `json:"customer_name,omitempty"`
 	Distance     *float64 `json:"distance,omitempty"`
+
+	// Delivery constraints when the location is a route stop
+	EarliestArrival *time.Time `json:"earliest_arrival,omitempty"`
+	LatestArrival   *time.Time `json:"latest_arrival,omitempty"`
+	ServiceTime     int        `json:"service_time,omitempty"` // seconds
 }
 
 // SpatialAnalysisRequest represents a request for spatial analysis
@@ -114,19 +119,90 @@ type Geofence struct {
 
 // GeofenceAlert represents a geofence alert
 type GeofenceAlert struct {
-	GeofenceID string    `json:"geofence_id"`
-	DriverID   string    `json:"driver_id"`
-	AlertType  string    `json:"alert_type"` // entry, exit
-	Location   Location  `json:"location"`
-	Timestamp  time.Time `json:"timestamp"`
+	GeofenceID   string    `json:"geofence_id"`
+	GeofenceName string    `json:"geofence_name,omitempty"`
+	DriverID     string    `json:"driver_id"`
+	AlertType    string    `json:"alert_type"` // entry, exit
+	Location     Location  `json:"location"`
+	Timestamp    time.Time `json:"timestamp"`
+	DwellSeconds int64     `json:"dwell_seconds,omitempty"` // time spent inside, set on exit
+}
+
+// RouteDeviationAlert represents a driver leaving their active route
+type RouteDeviationAlert struct {
+	RouteID         string    `json:"route_id"`
+	DriverID        string    `json:"driver_id"`
+	Location        Location  `json:"location"`
+	DistanceToRoute float64   `json:"distance_to_route"`
+	Threshold       float64   `json:"threshold"`
+	EstimatedDelay  int       `json:"estimated_delay"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// LocationIngestRequest carries one or more positions reported by a driver
+type LocationIngestRequest struct {
+	DriverID  string     `json:"driver_id"`
+	Location  *Location  `json:"location,omitempty"`
+	Locations []Location `json:"locations,omitempty"`
+}
+
+// DriverTrack is the recorded positions of a driver over a time window
+type DriverTrack struct {
+	DriverID       string     `json:"driver_id"`
+	Since          time.Time  `json:"since"`
+	Until          time.Time  `json:"until"`
+	PointCount     int        `json:"point_count"`
+	DistanceMeters float64    `json:"distance_meters"` // over the whole window
+	Truncated      bool       `json:"truncated"`
+	Points         []Location `json:"points"`
+}
+
+// GeofenceEvent represents a recorded geofence transition
+type GeofenceEvent struct {
+	ID           int64     `json:"id"`
+	GeofenceID   string    `json:"geofence_id"`
+	GeofenceName string    `json:"geofence_name"`
+	DriverID     string    `json:"driver_id"`
+	EventType    string    `json:"event_type"` // entry, exit
+	Location     Location  `json:"location"`
+	DwellSeconds *int64    `json:"dwell_seconds,omitempty"`
+	OccurredAt   time.Time `json:"occurred_at"`
+}
+
+// GeofenceActivityFilter narrows a geofence activity query
+type GeofenceActivityFilter struct {
+	DriverID   *string
+	GeofenceID *string
+	EventType  *string
+	Since      time.Time
+	Until      time.Time
+	Cursor     string
+	Limit      int
+}
+
+// GeofenceActivitySummary aggregates events matching an activity filter
+type GeofenceActivitySummary struct {
+	Entries         int `json:"entries"`
+	Exits           int `json:"exits"`
+	UniqueGeofences int `json:"unique_geofences"`
+	UniqueDrivers   int `json:"unique_drivers"`
+}
+
+// GeofenceActivity is one page of geofence events with its summary
+type GeofenceActivity struct {
+	Events     []GeofenceEvent         `json:"events"`
+	Summary    GeofenceActivitySummary `json:"summary"`
+	NextCursor *string                 `json:"next_cursor,omitempty"`
 }
 
 // RouteOptimizationRequest represents a route optimization request
 type RouteOptimizationRequest struct {
+	DriverID     string           `json:"driver_id,omitempty"`
 	Origin       Location         `json:"origin"`
 	Destinations []Location       `json:"destinations"`
 	Vehicle      Vehicle          `json:"vehicle"`
 	Preferences  RoutePreferences `json:"preferences"`
+	StartTime    *time.Time       `json:"start_time,omitempty"` // defaults to now
 }
 
 // Vehicle represents vehicle specifications
@@ -141,22 +217,253 @@ type RoutePreferences struct {
 	OptimizeFor   string `json:"optimize_for"` // time, distance, fuel
 	AvoidTolls    bool   `json:"avoid_tolls"`
 	AvoidHighways bool   `json:"avoid_highways"`
+	// Seed overrides the solver seed; equal requests with the same seed
+	// return the same route unless the time budget stops the search (see
+	// stopped_on_deadline) or the traffic near the stops changed
+	Seed         *int64 `json:"seed,omitempty"`
+	TimeBudgetMs int    `json:"time_budget_ms,omitempty"`
 }
 
 // OptimizedRoute represents an optimized route
 type OptimizedRoute struct {
+	ID            string     `json:"id,omitempty"`
 	Waypoints     []Location `json:"waypoints"`
 	TotalDistance float64    `json:"total_distance"`
 	TotalDuration int        `json:"total_duration"`
 	EstimatedFuel float64    `json:"estimated_fuel"`
+
+	// Geometry is the road path when the route follows a road network
+	Geometry []Location `json:"geometry,omitempty"`
+
+	// Schedule has one entry per waypoint
+	Schedule             []WaypointSchedule    `json:"schedule,omitempty"`
+	TimeWindowViolations []TimeWindowViolation `json:"time_window_violations,omitempty"`
+
+	UnsatisfiedPreferences []UnsatisfiedPreference `json:"unsatisfied_preferences,omitempty"`
+
+	// Legs has one entry per pair of consecutive waypoints
+	Legs []RouteLeg `json:"legs,omitempty"`
+}
+
+// RouteLeg is the path driven between two consecutive waypoints
+type RouteLeg struct {
+	Distance  float64           `json:"distance"` // meters
+	Duration  int               `json:"duration"` // seconds of driving
+	Polyline  string            `json:"polyline"` // Google encoded polyline
+	Geometry  GeoJSONLineString `json:"geometry"`
+	Maneuvers []RouteManeuver   `json:"maneuvers"`
+}
+
+// GeoJSONLineString is a GeoJSON LineString of [longitude, latitude] pairs
+type GeoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+// RouteManeuver is one driving instruction
+type RouteManeuver struct {
+	Type        string   `json:"type"`               // depart, turn, continue, arrive
+	Modifier    string   `json:"modifier,omitempty"` // left, slight right, straight, uturn, ...
+	Road        string   `json:"road,omitempty"`
+	Instruction string   `json:"instruction"`
+	Location    Location `json:"location"`
+	Distance    float64  `json:"distance"` // meters until the next maneuver
+	Duration    int      `json:"duration"` // seconds until the next maneuver
+}
+
+// UnsatisfiedPreference is a route preference or vehicle restriction the
+// route does not honour
+type UnsatisfiedPreference struct {
+	Preference string `json:"preference"` // avoid_tolls, avoid_highways or a vehicle restriction
+	Reason     string `json:"reason"`
+}
+
+// WaypointSchedule is when the vehicle reaches and leaves a waypoint
+type WaypointSchedule struct {
+	ETA       time.Time `json:"eta"`
+	Wait      int       `json:"wait"` // seconds until the time window opens
+	Departure time.Time `json:"departure"`
+	// Slack is how many seconds later the waypoint could be reached without
+	// missing its time window or a later one; absent when none limits it
+	Slack *int `json:"slack,omitempty"`
+}
+
+// TimeWindowViolation is a waypoint reached after its latest arrival
+type TimeWindowViolation struct {
+	WaypointIndex int       `json:"waypoint_index"`
+	LatestArrival time.Time `json:"latest_arrival"`
+	ETA           time.Time `json:"eta"`
+	LateBy        int       `json:"late_by"` // seconds
 }
 
 // RouteOptimizationResponse represents the response from route optimization
 type RouteOptimizationResponse struct {
 	OptimizedRoute OptimizedRoute     `json:"optimized_route"`
+	Improvement    RouteImprovement   `json:"improvement"`
 	Performance    PerformanceMetrics `json:"performance"`
 }
 
+// DistanceMatrixRequest asks for the distance and duration from every origin
+// to every destination; without destinations, between all origins
+type DistanceMatrixRequest struct {
+	Origins      []Location `json:"origins"`
+	Destinations []Location `json:"destinations,omitempty"`
+	Method       string     `json:"method,omitempty"` // haversine, vincenty, postgis
+	VehicleType  string     `json:"vehicle_type,omitempty"`
+	// DepartureTime predicts durations for a later departure; defaults to now
+	DepartureTime *time.Time `json:"departure_time,omitempty"`
+}
+
+// DistanceMatrixResponse holds meters and seconds indexed [origin][destination]
+type DistanceMatrixResponse struct {
+	Distances   [][]float64        `json:"distances"`
+	Durations   [][]float64        `json:"durations"`
+	Method      string             `json:"method"`
+	Cached      bool               `json:"cached"` // distances were reused
+	Performance PerformanceMetrics `json:"performance"`
+}
+
+// RouteImprovement compares an optimized route with visiting the
+// destinations in the order given
+type RouteImprovement struct {
+	OptimizeFor        string  `json:"optimize_for"`
+	NaiveDistance      float64 `json:"naive_distance"`
+	NaiveDuration      int     `json:"naive_duration"`
+	NaiveFuel          float64 `json:"naive_fuel"`
+	DistanceSaved      float64 `json:"distance_saved"`
+	DurationSaved      int     `json:"duration_saved"`
+	FuelSaved          float64 `json:"fuel_saved"`
+	ImprovementPercent float64 `json:"improvement_percent"` // of the optimized objective
+	Seed               int64   `json:"seed"`
+	Iterations         int     `json:"iterations"`
+	StoppedOnDeadline  bool    `json:"stopped_on_deadline"`
+}
+
+// FleetOptimizationRequest plans routes for several vehicles at once
+type FleetOptimizationRequest struct {
+	Vehicles    []FleetVehicle   `json:"vehicles"`
+	Stops       []FleetStop      `json:"stops"`
+	Preferences RoutePreferences `json:"preferences"`
+}
+
+// FleetVehicle is a vehicle available for fleet planning; its route starts
+// and ends at the depot within the shift window
+type FleetVehicle struct {
+	ID         string     `json:"id"`
+	DriverID   string     `json:"driver_id,omitempty"`
+	Type       string     `json:"type"` // van, truck, motorcycle
+	Capacity   int        `json:"capacity"`
+	Depot      Location   `json:"depot"`
+	ShiftStart *time.Time `json:"shift_start,omitempty"`
+	ShiftEnd   *time.Time `json:"shift_end,omitempty"`
+}
+
+// FleetStop is a destination and the load delivered there
+type FleetStop struct {
+	ID          string   `json:"id"`
+	Location    Location `json:"location"`
+	Demand      int      `json:"demand"`
+	ServiceTime int      `json:"service_time,omitempty"` // seconds
+}
+
+// FleetRoute is the planned route of one vehicle
+type FleetRoute struct {
+	VehicleID     string     `json:"vehicle_id"`
+	DriverID      string     `json:"driver_id,omitempty"`
+	RouteID       string     `json:"route_id,omitempty"`
+	StopIDs       []string   `json:"stop_ids"`
+	Waypoints     []Location `json:"waypoints"` // depot, stops, depot
+	Load          int        `json:"load"`
+	Capacity      int        `json:"capacity"`
+	TotalDistance float64    `json:"total_distance"`
+	TotalDuration int        `json:"total_duration"` // includes service time
+	EstimatedFuel float64    `json:"estimated_fuel"`
+	// Excluded says why the vehicle was left out of planning, such as a
+	// shift that has already ended
+	Excluded string `json:"excluded,omitempty"`
+
+	UnsatisfiedPreferences []UnsatisfiedPreference `json:"unsatisfied_preferences,omitempty"`
+	Legs                   []RouteLeg              `json:"legs,omitempty"`
+}
+
+// UnassignedStop is a stop no vehicle could serve
+type UnassignedStop struct {
+	StopID  string `json:"stop_id"`
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+// FleetSummary totals a fleet plan
+type FleetSummary struct {
+	VehiclesUsed  int     `json:"vehicles_used"`
+	AssignedStops int     `json:"assigned_stops"`
+	TotalDistance float64 `json:"total_distance"`
+	TotalDuration int     `json:"total_duration"`
+	EstimatedFuel float64 `json:"estimated_fuel"`
+	// StoppedOnDeadline is set when the time budget cut the search short
+	StoppedOnDeadline bool `json:"stopped_on_deadline"`
+}
+
+// FleetOptimizationResponse holds one route per vehicle and the stops left
+// out
+type FleetOptimizationResponse struct {
+	Routes      []FleetRoute       `json:"routes"`
+	Unassigned  []UnassignedStop   `json:"unassigned"`
+	Summary     FleetSummary       `json:"summary"`
+	Performance PerformanceMetrics `json:"performance"`
+}
+
+// RouteTraceRequest carries positions driven while following a route
+type RouteTraceRequest struct {
+	Points []Location `json:"points"`
+}
+
+// OptimizationSavings compares optimized routes against their naive order
+type OptimizationSavings struct {
+	DistanceSavedKm float64 `json:"distance_saved_km"`
+	TimeSavedHours  float64 `json:"time_saved_hours"`
+	FuelSavedLiters float64 `json:"fuel_saved_liters"`
+}
+
+// RouteAnalyticsTotals aggregates recorded routes and their driven traces
+type RouteAnalyticsTotals struct {
+	TotalRoutes               int                 `json:"total_routes"`
+	RoutesOptimized           int                 `json:"routes_optimized"`
+	TracedRoutes              int                 `json:"traced_routes"`
+	TotalDistanceKm           float64             `json:"total_distance_km"`
+	TotalDurationHours        float64             `json:"total_duration_hours"`
+	AverageSpeedKmh           float64             `json:"average_speed_kmh"`
+	FuelConsumptionLiters     float64             `json:"fuel_consumption_liters"`
+	OptimizationSavings       OptimizationSavings `json:"optimization_savings"`
+	TrafficDelayMinutes       float64             `json:"traffic_delay_minutes"` // along the driven traces
+	DelayedRoutes             int                 `json:"delayed_routes"`        // traced routes slowed by traffic
+	OverrunMinutes            float64             `json:"overrun_minutes"`       // driven time beyond the plan
+	AverageOptimizationTimeMs float64             `json:"average_optimization_time_ms"`
+}
+
+// DriverRouteAnalytics holds route totals for one driver
+type DriverRouteAnalytics struct {
+	DriverID string               `json:"driver_id"`
+	Totals   RouteAnalyticsTotals `json:"totals"`
+}
+
+// PeriodRouteAnalytics holds route totals for one day, week or month
+type PeriodRouteAnalytics struct {
+	PeriodStart time.Time            `json:"period_start"`
+	Totals      RouteAnalyticsTotals `json:"totals"`
+}
+
+// RouteAnalytics is the route analytics report for a time window
+type RouteAnalytics struct {
+	Since      time.Time              `json:"since"`
+	Until      time.Time              `json:"until"`
+	Period     string                 `json:"period"` // day, week, month
+	Totals     RouteAnalyticsTotals   `json:"totals"`
+	ByDriver   []DriverRouteAnalytics `json:"by_driver"`
+	ByPeriod   []PeriodRouteAnalytics `json:"by_period"`
+	DataPoints int                    `json:"data_points_analyzed"`
+}
+
 // PointOfInterest represents a point of interest
 type PointOfInterest struct {
 	ID        string  `json:"id"`
@@ -176,6 +483,60 @@ type TrafficData struct {
 	Timestamp       time.Time `json:"timestamp"`
 }
 
+// RouteTraffic is the recent traffic along a stored route. The embedded
+// TrafficData summarises the whole route at its midpoint.
+type RouteTraffic struct {
+	TrafficData
+	RouteID       string                `json:"route_id"`
+	RadiusMeters  float64               `json:"radius_meters"`
+	FreeFlowSpeed float64               `json:"free_flow_speed"` // km/h
+	TotalDelay    int                   `json:"total_delay"`     // seconds
+	DataPoints    int                   `json:"data_points"`
+	Segments      []RouteTrafficSegment `json:"segments"`
+	WorstSegment  *RouteTrafficSegment  `json:"worst_segment,omitempty"`
+}
+
+// RouteTrafficSegment is the traffic along one stretch of a route
+type RouteTrafficSegment struct {
+	Index           int      `json:"index"`
+	Start           Location `json:"start"`
+	End             Location `json:"end"`
+	Distance        float64  `json:"distance"`         // meters
+	CongestionLevel float64  `json:"congestion_level"` // 0.0 to 1.0
+	AverageSpeed    float64  `json:"average_speed"`    // km/h
+	Delay           int      `json:"delay"`            // seconds
+	DataPoints      int      `json:"data_points"`
+}
+
+// TrafficReport is one traffic observation submitted for ingestion. The
+// congestion level is derived from the speeds when it is not given.
+type TrafficReport struct {
+	Latitude        float64                `json:"latitude"`
+	Longitude       float64                `json:"longitude"`
+	AverageSpeed    float64                `json:"average_speed"`              // km/h
+	FreeFlowSpeed   float64                `json:"free_flow_speed,omitempty"`  // km/h
+	CongestionLevel *float64               `json:"congestion_level,omitempty"` // 0.0 to 1.0
+	Timestamp       time.Time              `json:"timestamp"`
+	ExternalID      string                 `json:"external_id,omitempty"` // the feed's ID for the location or probe
+	Properties      map[string]interface{} `json:"properties,omitempty"`
+}
+
+// TrafficIngestRequest carries a batch of observations from one source
+type TrafficIngestRequest struct {
+	Source       string          `json:"source"`
+	Observations []TrafficReport `json:"observations"`
+}
+
+// TrafficIngestResult counts what became of a batch of observations
+type TrafficIngestResult struct {
+	Source     string   `json:"source"`
+	Received   int      `json:"received"`
+	Stored     int      `json:"stored"`
+	Duplicates int      `json:"duplicates"`
+	Rejected   int      `json:"rejected"`
+	Errors     []string `json:"errors,omitempty"` // the first few rejections
+}
+
 // DeliveryLocation represents a delivery destination
 type DeliveryLocation struct {
 	ID           string     `json:"id"`
@@ -187,8 +548,16 @@ type DeliveryLocation struct {
 	Active       bool       `json:"active"`
 }
 
+// Roles recognised in token claims
+const (
+	RoleDriver     = "driver"
+	RoleDispatcher = "dispatcher"
+	RoleAdmin      = "admin"
+)
+
 // WebSocketMessage represents a WebSocket message
 type WebSocketMessage struct {
+	ID        uint64      `json:"id,omitempty"` // per-driver sequence, set on messages kept for replay; rising but not contiguous across restarts
 	Type      string      `json:"type"`
 	DriverID  string      `json:"driver_id,omitempty"`
 	Payload   interface{} `json:"payload"`
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"go-spatial/models"
+)
+
+// Backplane relays WebSocket messages between hub replicas so a message
+// published on one replica reaches clients connected to any other
+type Backplane interface {
+	// Publish sends a message to every subscribed hub
+	Publish(message BackplaneMessage) error
+	// Subscribe registers the handler for messages from all hubs
+	Subscribe(handler func(BackplaneMessage)) error
+	// NextMessageID allocates the next ID of a driver's messages from a
+	// sequence shared by all hubs
+	NextMessageID(driverID string) (uint64, error)
+	Close() error
+}
+
+// Kinds of messages relayed over the backplane
+const (
+	backplaneDriver = "driver"
+	backplaneAll    = "all"
+	backplaneTopic  = "topic"
+	backplaneAck    = "ack"
+)
+
+// BackplaneMessage is an encoded WebSocket message and its audience
+type BackplaneMessage struct {
+	Origin   string `json:"origin"` // ID of the publishing hub
+	Kind     string `json:"kind"`   // driver, all, topic, ack
+	DriverID string `json:"driver_id,omitempty"`
+	// Outbox ID of a driver message, or the ID acknowledged by an ack
+	MessageID uint64           `json:"message_id,omitempty"`
+	Topics    []string         `json:"topics,omitempty"`
+	Location  *models.Location `json:"location,omitempty"`
+	Data      json.RawMessage  `json:"data"`
+}
+
+// MemoryBackplane connects hubs running in the same process
+type MemoryBackplane struct {
+	subscribers []chan BackplaneMessage
+	sequences   map[string]uint64
+	mutex       sync.RWMutex
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subscribers: make([]chan BackplaneMessage, 0),
+		sequences:   make(map[string]uint64),
+	}
+}
+
+// Publish delivers the message to every subscriber without blocking
+func (b *MemoryBackplane) Publish(message BackplaneMessage) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			log.Printf("Memory backplane subscriber is full, dropping %s message", message.Kind)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe starts delivering published messages to the handler
+func (b *MemoryBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	messages := make(chan BackplaneMessage, 1024)
+
+	b.mutex.Lock()
+	b.subscribers = append(b.subscribers, messages)
+	b.mutex.Unlock()
+
+	go func() {
+		for message := range messages {
+			handler(message)
+		}
+	}()
+
+	return nil
+}
+
+// NextMessageID increments the driver's sequence
+func (b *MemoryBackplane) NextMessageID(driverID string) (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.sequences[driverID]++
+	return b.sequences[driverID], nil
+}
+
+// Close stops delivery to all subscribers
+func (b *MemoryBackplane) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, subscriber := range b.subscribers {
+		close(subscriber)
+	}
+	b.subscribers = nil
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackplane relays hub messages between replicas over Redis pub/sub
+type RedisBackplane struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+// NewRedisBackplane connects to Redis and publishes on the given channel
+func NewRedisBackplane(redisURL, channel string) (*RedisBackplane, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisBackplane{
+		client:  client,
+		channel: channel,
+	}, nil
+}
+
+// Publish sends the message to every replica subscribed to the channel
+func (b *RedisBackplane) Publish(message BackplaneMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal backplane message: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := b.client.Publish(ctx, b.channel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish to Redis: %w", err)
+	}
+
+	return nil
+}
+
+// Subscribe starts delivering messages from the channel to the handler; the
+// Redis client reconnects and resubscribes on its own after failures
+func (b *RedisBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to Redis channel: %w", err)
+	}
+	b.pubsub = pubsub
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var message BackplaneMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+				log.Printf("Invalid backplane message: %v", err)
+				continue
+			}
+			handler(message)
+		}
+	}()
+
+	return nil
+}
+
+// NextMessageID increments the driver's sequence key, which every replica
+// shares
+func (b *RedisBackplane) NextMessageID(driverID string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	id, err := b.client.Incr(ctx, b.channel+":seq:"+driverID).Uint64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment message sequence: %w", err)
+	}
+
+	return id, nil
+}
+
+// Close unsubscribes and closes the Redis connection
+func (b *RedisBackplane) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+
+	"go-spatial/models"
+)
+
+// Ways of computing matrix distances
+const (
+	MatrixHaversine = "haversine"
+	MatrixVincenty  = "vincenty"
+	MatrixPostGIS   = "postgis"
+)
+
+// Computed distance matrices are reused for this long
+const matrixCacheTTL = 2 * time.Minute
+
+// MatrixSettings selects how route distances are computed
+type MatrixSettings struct {
+	Method string
+}
+
+// SetMatrixSettings overrides the default distance method
+func (s *RouteService) SetMatrixSettings(settings MatrixSettings) {
+	s.matrixSettings = settings
+}
+
+// DistanceMatrix returns the distance and duration from every origin to
+// every destination, or between all origins when there are no destinations.
+// Durations use the same traffic and speed model as route optimization.
+func (s *RouteService) DistanceMatrix(request models.DistanceMatrixRequest) (*models.DistanceMatrixResponse, error) {
+	startTime := time.Now()
+
+	origins := request.Origins
+	destinations := request.Destinations
+	if len(destinations) == 0 {
+		destinations = origins
+	}
+
+	method := request.Method
+	if method == "" {
+		method = s.matrixSettings.Method
+	}
+
+	distances, cached, err := s.distances(origins, destinations, method)
+	if err != nil {
+		return nil, err
+	}
+
+	traffic, err := s.trafficConditions(append(append([]models.Location{}, origins...), destinations...))
+	if err != nil {
+		return nil, err
+	}
+	cruise := s.getAverageSpeedForVehicle(request.VehicleType)
+	departure := startTime
+	if request.DepartureTime != nil {
+		departure = *request.DepartureTime
+	}
+
+	durations := make([][]float64, len(origins))
+	for i, origin := range origins {
+		durations[i] = make([]float64, len(destinations))
+		for j, destination := range destinations {
+			if distance := distances[i][j]; distance > 0 {
+				speed := legSpeed(traffic, cruise, origin, destination, distance, departure)
+				durations[i][j] = (distance / 1000.0) / speed * 3600
+			}
+		}
+	}
+
+	return &models.DistanceMatrixResponse{
+		Distances: distances,
+		Durations: durations,
+		Method:    method,
+		Cached:    cached,
+		Performance: models.PerformanceMetrics{
+			CalculationTime: time.Since(startTime).Milliseconds(),
+		},
+	}, nil
+}
+
+// distances returns the meters from every origin to every destination and
+// whether the matrix came from the cache. The result is shared with the
+// cache and must not be modified.
+func (s *RouteService) distances(origins, destinations []models.Location, method string) ([][]float64, bool, error) {
+	if method == "" {
+		method = MatrixHaversine
+	}
+
+	key := matrixCacheKey(method, origins, destinations)
+	if cached, found := s.matrixCache.Get(key); found {
+		return cached.([][]float64), true, nil
+	}
+
+	var matrix [][]float64
+	switch method {
+	case MatrixHaversine:
+		matrix = pairwise(origins, destinations, haversineDistance)
+	case MatrixVincenty:
+		matrix = pairwise(origins, destinations, vincentyDistance)
+	case MatrixPostGIS:
+		var err error
+		if matrix, err = s.postgisDistances(origins, destinations); err != nil {
+			return nil, false, err
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported distance method %q", method)
+	}
+
+	s.matrixCache.Set(key, matrix)
+	return matrix, false, nil
+}
+
+// postgisDistances measures all pairs on the spheroid in one query
+func (s *RouteService) postgisDistances(origins, destinations []models.Location) ([][]float64, error) {
+	coordinates := func(locations []models.Location) (pq.Float64Array, pq.Float64Array) {
+		lngs := make(pq.Float64Array, len(locations))
+		lats := make(pq.Float64Array, len(locations))
+		for i, location := range locations {
+			lngs[i] = location.Longitude
+			lats[i] = location.Latitude
+		}
+		return lngs, lats
+	}
+	originLngs, originLats := coordinates(origins)
+	destinationLngs, destinationLats := coordinates(destinations)
+
+	rows, err := s.db.Query(`
+		SELECT o.i, d.j, ST_Distance(
+			ST_SetSRID(ST_MakePoint(o.lng, o.lat), 4326)::geography,
+			ST_SetSRID(ST_MakePoint(d.lng, d.lat), 4326)::geography
+		)
+		FROM unnest($1::float8[], $2::float8[]) WITH ORDINALITY AS o(lng, lat, i)
+		CROSS JOIN unnest($3::float8[], $4::float8[]) WITH ORDINALITY AS d(lng, lat, j)
+	`, originLngs, originLats, destinationLngs, destinationLats)
+	if err != nil {
+		return nil, fmt.Errorf("distance matrix query failed: %w", err)
+	}
+	defer rows.Close()
+
+	matrix := make([][]float64, len(origins))
+	for i := range matrix {
+		matrix[i] = make([]float64, len(destinations))
+	}
+
+	for rows.Next() {
+		var i, j int
+		var distance float64
+		if err := rows.Scan(&i, &j, &distance); err != nil {
+			return nil, fmt.Errorf("failed to scan distance: %w", err)
+		}
+		// Ordinals start at 1
+		matrix[i-1][j-1] = distance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read distances: %w", err)
+	}
+
+	return matrix, nil
+}
+
+func pairwise(origins, destinations []models.Location, distance func(a, b models.Location) float64) [][]float64 {
+	matrix := make([][]float64, len(origins))
+	for i, origin := range origins {
+		matrix[i] = make([]float64, len(destinations))
+		for j, destination := range destinations {
+			matrix[i][j] = distance(origin, destination)
+		}
+	}
+	return matrix
+}
+
+func matrixCacheKey(method string, origins, destinations []models.Location) string {
+	hash := sha256.New()
+	hash.Write([]byte(method))
+
+	for _, locations := range [][]models.Location{origins, destinations} {
+		hash.Write([]byte{'|'})
+		for _, location := range locations {
+			hash.Write([]byte(strconv.FormatFloat(location.Latitude, 'g', -1, 64)))
+			hash.Write([]byte{','})
+			hash.Write([]byte(strconv.FormatFloat(location.Longitude, 'g', -1, 64)))
+			hash.Write([]byte{';'})
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// vincentyDistance is the distance in meters on the WGS84 ellipsoid. Nearly
+// antipodal points, where the iteration does not converge, fall back to the
+// great-circle distance.
+func vincentyDistance(a, b models.Location) float64 {
+	const (
+		semiMajor  = 6378137.0
+		flattening = 1 / 298.257223563
+		semiMinor  = semiMajor * (1 - flattening)
+	)
+
+	toRadians := math.Pi / 180
+	l := (b.Longitude - a.Longitude) * toRadians
+	u1 := math.Atan((1 - flattening) * math.Tan(a.Latitude*toRadians))
+	u2 := math.Atan((1 - flattening) * math.Tan(b.Latitude*toRadians))
+	sinU1, cosU1 := math.Sincos(u1)
+	sinU2, cosU2 := math.Sincos(u2)
+
+	lambda := l
+	for iteration := 0; iteration < 200; iteration++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) +
+			math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+		if sinSigma == 0 {
+			return 0 // Coincident points
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+
+		c := flattening / 16 * cosSqAlpha * (4 + flattening*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = l + (1-c)*flattening*sinAlpha*
+			(sigma+c*sinSigma*(cos2SigmaM+c*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda-previous) < 1e-12 {
+			uSq := cosSqAlpha * (semiMajor*semiMajor - semiMinor*semiMinor) / (semiMinor * semiMinor)
+			bigA := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			bigB := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := bigB * sinSigma * (cos2SigmaM + bigB/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				bigB/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+
+			return semiMinor * bigA * (sigma - deltaSigma)
+		}
+	}
+
+	return haversineDistance(a, b)
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go-spatial/models"
+)
+
+// FleetProbeSource is the traffic_data source of speeds measured by our
+// own drivers; the ingestion API does not accept it
+const FleetProbeSource = "fleet_probe"
+
+// Driver pings are binned into cells of this many degrees, about 200 m
+const probeCellDegrees = 0.002
+
+// Pings slower than this are parked or stopped at a delivery rather than
+// moving with traffic
+const minProbeSpeed = 1.0 // km/h
+
+const defaultFreeFlowHalfLife = 24 * time.Hour
+
+// Cells take the speeds of a road within this many meters
+const probeRoadDistance = 100.0
+
+// FleetProbeSettings controls how driver pings become traffic observations
+type FleetProbeSettings struct {
+	// Window is how long a ping counts towards its cell's average
+	Window time.Duration
+	// MinDrivers is how many distinct drivers a cell needs within the
+	// window before its average is written
+	MinDrivers int
+	// FreeFlowHalfLife is how long a learned free-flow speed takes to fall
+	// halfway back to the road's prior speed, a day when zero
+	FreeFlowHalfLife time.Duration
+}
+
+// FleetProbeAggregator turns the speeds reported by drivers into rolling
+// per-cell averages and writes them as fleet_probe traffic observations.
+// Cells are split by direction of travel when pings carry a heading.
+type FleetProbeAggregator struct {
+	traffic  *TrafficService
+	roads    *RoadGraph
+	settings FleetProbeSettings
+	cells    map[probeCell]*probeCellState
+	mutex    sync.Mutex
+}
+
+type probeCell struct {
+	lat, lng  int
+	direction int // 0-3 clockwise from north, -1 without heading
+}
+
+type probeSample struct {
+	driverID string
+	location models.Location
+	speed    float64 // km/h
+	at       time.Time
+}
+
+type probeCellState struct {
+	samples []probeSample
+	// Free-flow speed learned from windows with enough drivers, and when it
+	// was last updated
+	freeFlow  float64
+	learnedAt time.Time
+}
+
+func NewFleetProbeAggregator(traffic *TrafficService) *FleetProbeAggregator {
+	return &FleetProbeAggregator{
+		traffic: traffic,
+		settings: FleetProbeSettings{
+			Window:     10 * time.Minute,
+			MinDrivers: 2,
+		},
+		cells: make(map[probeCell]*probeCellState),
+	}
+}
+
+// SetProbeSettings overrides the default window and driver threshold
+func (a *FleetProbeAggregator) SetProbeSettings(settings FleetProbeSettings) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.settings = settings
+}
+
+// SetRoadGraph takes each cell's prior and highest free-flow speed from the
+// class of its nearest road
+func (a *FleetProbeAggregator) SetRoadGraph(graph *RoadGraph) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.roads = graph
+}
+
+// AddLocations bins a driver's pings that carry a speed in m/s. Pings
+// older than the window, such as a batch flushed after a dead zone, are
+// ignored, and pings stamped in the future count as received now.
+func (a *FleetProbeAggregator) AddLocations(driverID string, locations []models.Location) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-a.settings.Window)
+	for _, location := range locations {
+		if location.Speed == nil {
+			continue
+		}
+		at := time.Unix(location.Timestamp, 0)
+		if at.After(now) {
+			at = now
+		}
+		speed := *location.Speed * 3.6
+		if at.Before(cutoff) || speed < minProbeSpeed || speed > maxTrafficSpeed {
+			continue
+		}
+
+		cell := probeCell{
+			lat:       int(math.Floor(location.Latitude / probeCellDegrees)),
+			lng:       int(math.Floor(location.Longitude / probeCellDegrees)),
+			direction: -1,
+		}
+		if location.Heading != nil {
+			cell.direction = int(math.Mod(*location.Heading+45, 360) / 90)
+		}
+
+		state := a.cells[cell]
+		if state == nil {
+			state = &probeCellState{}
+			a.cells[cell] = state
+		}
+		state.samples = append(state.samples, probeSample{
+			driverID: driverID,
+			location: plainLocation(location),
+			speed:    speed,
+			at:       at,
+		})
+	}
+}
+
+// Averages drops pings that left the window and reports the average speed
+// of every cell with enough drivers. Congestion is how far that average
+// falls below the cell's free-flow speed: the road's prior speed, raised
+// by the 85th percentile of faster windows and decaying back over time.
+func (a *FleetProbeAggregator) Averages(now time.Time) []models.TrafficReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	cutoff := now.Add(-a.settings.Window)
+	reports := make([]models.TrafficReport, 0)
+	for cell, state := range a.cells {
+		kept := state.samples[:0]
+		for _, sample := range state.samples {
+			if !sample.at.Before(cutoff) {
+				kept = append(kept, sample)
+			}
+		}
+		state.samples = kept
+		if len(kept) == 0 {
+			delete(a.cells, cell)
+			continue
+		}
+
+		drivers := make(map[string]bool)
+		speeds := make([]float64, len(kept))
+		var latitude, longitude, total float64
+		for i, sample := range kept {
+			drivers[sample.driverID] = true
+			speeds[i] = sample.speed
+			latitude += sample.location.Latitude
+			longitude += sample.location.Longitude
+			total += sample.speed
+		}
+		// A window too few drivers vouch for neither is reported nor
+		// teaches the cell its free-flow speed
+		if len(drivers) < a.settings.MinDrivers {
+			continue
+		}
+
+		n := float64(len(kept))
+		location := models.Location{Latitude: latitude / n, Longitude: longitude / n}
+		sort.Float64s(speeds)
+		a.learnFreeFlow(state, location, speeds[int(0.85*float64(len(speeds)-1))], now)
+
+		average := total / n
+		congestion := 0.0
+		if state.freeFlow > 0 {
+			congestion = math.Max(0, math.Min(1, 1-average/state.freeFlow))
+		}
+
+		reports = append(reports, models.TrafficReport{
+			Latitude:        location.Latitude,
+			Longitude:       location.Longitude,
+			AverageSpeed:    average,
+			FreeFlowSpeed:   state.freeFlow,
+			CongestionLevel: &congestion,
+			Timestamp:       now.Truncate(time.Second),
+			ExternalID:      fmt.Sprintf("cell:%d:%d:%d", cell.lat, cell.lng, cell.direction),
+			Properties: map[string]interface{}{
+				"samples": len(kept),
+				"drivers": len(drivers),
+			},
+		})
+	}
+
+	return reports
+}
+
+// learnFreeFlow decays a cell's free-flow speed towards the road's prior,
+// raises it to the window's typical speed and bounds it by the road's
+// limit; the caller must hold mutex
+func (a *FleetProbeAggregator) learnFreeFlow(state *probeCellState, location models.Location, typical float64, now time.Time) {
+	prior, limit := defaultFreeFlowSpeed, maxTrafficSpeed
+	if a.roads != nil {
+		if freeFlow, roadLimit, ok := a.roads.RoadSpeeds(location, probeRoadDistance); ok {
+			prior, limit = freeFlow, roadLimit
+		}
+	}
+
+	freeFlow := prior
+	if !state.learnedAt.IsZero() {
+		halfLife := a.settings.FreeFlowHalfLife
+		if halfLife <= 0 {
+			halfLife = defaultFreeFlowHalfLife
+		}
+		halfLives := now.Sub(state.learnedAt).Hours() / halfLife.Hours()
+		freeFlow = prior + (state.freeFlow-prior)*math.Pow(0.5, halfLives)
+	}
+
+	state.freeFlow = math.Min(math.Max(freeFlow, typical), limit)
+	state.learnedAt = now
+}
+
+// Flush writes the current averages to traffic_data
+func (a *FleetProbeAggregator) Flush(now time.Time) (*models.TrafficIngestResult, error) {
+	reports := a.Averages(now)
+	if len(reports) == 0 {
+		return &models.TrafficIngestResult{Source: FleetProbeSource}, nil
+	}
+	return a.traffic.Ingest(FleetProbeSource, reports)
+}
+
+// Run flushes the averages at each interval
+func (a *FleetProbeAggregator) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if _, err := a.Flush(now); err != nil {
+				log.Printf("Fleet probe aggregation failed: %v", err)
+			}
+		}
+	}
+}
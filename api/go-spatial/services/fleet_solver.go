@@ -0,0 +1,436 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// FleetProblem is a capacitated vehicle routing problem over numbered nodes
+// (depots and stops share one index space)
+type FleetProblem struct {
+	Vehicles []FleetVehicleSpec
+	Stops    []FleetStopSpec
+}
+
+// FleetVehicleSpec is one vehicle of a fleet problem. Vehicles of the same
+// type may share their Costs and Durations matrices.
+type FleetVehicleSpec struct {
+	Depot    int // node the vehicle leaves from and returns to
+	Capacity int
+	// MaxDuration is the shift length in seconds; zero means unlimited
+	MaxDuration float64
+	Costs       [][]float64 // objective cost between nodes
+	Durations   [][]float64 // travel seconds between nodes
+}
+
+// FleetStopSpec is a stop to be served by at most one vehicle
+type FleetStopSpec struct {
+	Node        int
+	Demand      int
+	ServiceTime float64 // seconds spent at the stop
+}
+
+// Reasons a stop is left out of every route
+const (
+	UnassignedExceedsCapacity = "demand_exceeds_vehicle_capacity"
+	UnassignedNoCapacityLeft  = "no_capacity_left"
+	UnassignedOutsideShift    = "outside_shift_limits"
+)
+
+// FleetSolution assigns stops to vehicles
+type FleetSolution struct {
+	// Routes holds, per vehicle, indices into FleetProblem.Stops in visiting
+	// order
+	Routes            [][]int
+	Unassigned        map[int]string // stop index to reason
+	Cost              float64
+	StoppedOnDeadline bool
+}
+
+// SolveFleet builds routes by regret insertion, so stops with few good
+// options are placed first, then improves them by moving stops between
+// vehicles and re-ordering each route with SolveRoute. Every route respects
+// its vehicle's capacity and shift length. Once the time budget is spent the
+// remaining stops are placed at their cheapest position and improvement is
+// skipped.
+func SolveFleet(problem FleetProblem, options SolverOptions) FleetSolution {
+	var deadline time.Time
+	if options.TimeBudget > 0 {
+		deadline = time.Now().Add(options.TimeBudget)
+	}
+
+	solver := &fleetSolver{
+		problem:   problem,
+		routes:    make([][]int, len(problem.Vehicles)),
+		loads:     make([]int, len(problem.Vehicles)),
+		costs:     make([]float64, len(problem.Vehicles)),
+		durations: make([]float64, len(problem.Vehicles)),
+		expired: func() bool {
+			return !deadline.IsZero() && time.Now().After(deadline)
+		},
+	}
+	for i := range solver.routes {
+		solver.routes[i] = []int{}
+	}
+
+	stops := make([]int, len(problem.Stops))
+	for i := range stops {
+		stops[i] = i
+	}
+	unassigned := solver.insertAll(stops)
+
+	for !solver.expired() && solver.relocate() {
+	}
+
+	routeOptions := options
+	routeOptions.ReturnToStart = true
+	for v := range solver.routes {
+		if !deadline.IsZero() {
+			routeOptions.TimeBudget = time.Until(deadline) / time.Duration(len(solver.routes)-v)
+			if routeOptions.TimeBudget <= 0 {
+				break
+			}
+		}
+		solver.reorder(v, routeOptions)
+	}
+
+	// Improvements may have freed room for stops that did not fit before
+	retry := make([]int, 0)
+	for stop, reason := range unassigned {
+		if reason != UnassignedExceedsCapacity {
+			retry = append(retry, stop)
+			delete(unassigned, stop)
+		}
+	}
+	sort.Ints(retry)
+	for stop, reason := range solver.insertAll(retry) {
+		unassigned[stop] = reason
+	}
+
+	solution := FleetSolution{
+		Routes:            solver.routes,
+		Unassigned:        unassigned,
+		StoppedOnDeadline: solver.expired(),
+	}
+	for _, cost := range solver.costs {
+		solution.Cost += cost
+	}
+
+	return solution
+}
+
+// fleetSolver holds the routes under construction with their load, cost and
+// duration, so insertions and removals are priced without walking a route
+type fleetSolver struct {
+	problem   FleetProblem
+	routes    [][]int
+	loads     []int
+	costs     []float64
+	durations []float64 // travel and service seconds
+	expired   func() bool
+}
+
+// insertion is a feasible place for a stop in a vehicle's route
+type insertion struct {
+	vehicle  int
+	position int
+	delta    float64
+	duration float64 // added seconds
+}
+
+// insertAll places stops by regret insertion and returns those that could
+// not be placed with the reason why. After the deadline each remaining stop
+// simply takes its cheapest position.
+func (f *fleetSolver) insertAll(stops []int) map[int]string {
+	unassigned := make(map[int]string)
+	pending := make([]int, 0, len(stops))
+
+	maxCapacity := f.maxCapacity()
+	for _, stop := range stops {
+		if f.problem.Stops[stop].Demand > maxCapacity {
+			unassigned[stop] = UnassignedExceedsCapacity
+		} else {
+			pending = append(pending, stop)
+		}
+	}
+
+	for len(pending) > 0 {
+		if f.expired() {
+			for _, stop := range pending {
+				if first, _, ok := f.bestInsertions(stop); ok {
+					f.insert(stop, first)
+				} else {
+					unassigned[stop] = f.blockReason(stop)
+				}
+			}
+			return unassigned
+		}
+
+		best := -1
+		var bestInsertion insertion
+		bestRegret := math.Inf(-1)
+
+		for i := 0; i < len(pending); i++ {
+			stop := pending[i]
+			first, second, ok := f.bestInsertions(stop)
+			if !ok {
+				// Routes only grow, so the stop will not fit later either
+				unassigned[stop] = f.blockReason(stop)
+				pending = append(pending[:i], pending[i+1:]...)
+				i--
+				continue
+			}
+
+			// A stop with a single feasible vehicle has unbounded regret
+			regret := math.Inf(1)
+			if second != nil {
+				regret = second.delta - first.delta
+			}
+			if regret > bestRegret || (regret == bestRegret && first.delta < bestInsertion.delta) {
+				best = i
+				bestInsertion = first
+				bestRegret = regret
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		f.insert(pending[best], bestInsertion)
+		pending = append(pending[:best], pending[best+1:]...)
+	}
+
+	return unassigned
+}
+
+// bestInsertions returns the cheapest feasible insertion of a stop and the
+// cheapest one in a different vehicle
+func (f *fleetSolver) bestInsertions(stop int) (insertion, *insertion, bool) {
+	var first, second *insertion
+
+	for v := range f.routes {
+		at, ok := f.bestInsertionInto(v, stop)
+		if !ok {
+			continue
+		}
+		switch {
+		case first == nil || at.delta < first.delta:
+			first, second = &at, first
+		case second == nil || at.delta < second.delta:
+			second = &at
+		}
+	}
+	if first == nil {
+		return insertion{}, nil, false
+	}
+
+	return *first, second, true
+}
+
+// bestInsertionInto returns the cheapest feasible position for a stop in
+// one vehicle's route
+func (f *fleetSolver) bestInsertionInto(v, stop int) (insertion, bool) {
+	vehicle := f.problem.Vehicles[v]
+	spec := f.problem.Stops[stop]
+	if f.loads[v]+spec.Demand > vehicle.Capacity {
+		return insertion{}, false
+	}
+
+	route := f.routes[v]
+	best := insertion{vehicle: v, delta: math.Inf(1)}
+
+	for pos := 0; pos <= len(route); pos++ {
+		prev, next := f.neighbours(v, route, pos, pos)
+		duration := f.detour(vehicle.Durations, len(route) == 0, prev, spec.Node, next) + spec.ServiceTime
+		if vehicle.MaxDuration > 0 && f.durations[v]+duration > vehicle.MaxDuration {
+			continue
+		}
+		if delta := f.detour(vehicle.Costs, len(route) == 0, prev, spec.Node, next); delta < best.delta {
+			best.position = pos
+			best.delta = delta
+			best.duration = duration
+		}
+	}
+
+	return best, !math.IsInf(best.delta, 1)
+}
+
+// neighbours returns the nodes before position from and after position to
+// in a vehicle's route, the depot at either end
+func (f *fleetSolver) neighbours(v int, route []int, from, to int) (int, int) {
+	prev, next := f.problem.Vehicles[v].Depot, f.problem.Vehicles[v].Depot
+	if from > 0 {
+		prev = f.problem.Stops[route[from-1]].Node
+	}
+	if to < len(route) {
+		next = f.problem.Stops[route[to]].Node
+	}
+	return prev, next
+}
+
+// detour is the added cost of visiting node between prev and next; an empty
+// route has no prev to next edge to replace
+func (f *fleetSolver) detour(matrix [][]float64, empty bool, prev, node, next int) float64 {
+	delta := matrix[prev][node] + matrix[node][next]
+	if !empty {
+		delta -= matrix[prev][next]
+	}
+	return delta
+}
+
+// blockReason explains why a stop fits in no vehicle
+func (f *fleetSolver) blockReason(stop int) string {
+	demand := f.problem.Stops[stop].Demand
+	for v, vehicle := range f.problem.Vehicles {
+		if demand > vehicle.Capacity {
+			continue
+		}
+		// The vehicle could carry the stop on its own; if it still has room
+		// the shift is what stops it
+		if f.loads[v]+demand <= vehicle.Capacity {
+			return UnassignedOutsideShift
+		}
+	}
+	return UnassignedNoCapacityLeft
+}
+
+func (f *fleetSolver) insert(stop int, at insertion) {
+	f.routes[at.vehicle] = insertAt(f.routes[at.vehicle], at.position, stop)
+	f.loads[at.vehicle] += f.problem.Stops[stop].Demand
+	f.costs[at.vehicle] += at.delta
+	f.durations[at.vehicle] += at.duration
+}
+
+// removal returns the cost and seconds saved by taking the stop at position
+// i out of a vehicle's route
+func (f *fleetSolver) removal(v, i int) (float64, float64) {
+	route := f.routes[v]
+	if len(route) == 1 {
+		return f.costs[v], f.durations[v]
+	}
+
+	vehicle := f.problem.Vehicles[v]
+	spec := f.problem.Stops[route[i]]
+	prev, next := f.neighbours(v, route, i, i+1)
+
+	return f.detour(vehicle.Costs, false, prev, spec.Node, next),
+		f.detour(vehicle.Durations, false, prev, spec.Node, next) + spec.ServiceTime
+}
+
+// relocate moves the single stop whose move to another vehicle saves the
+// most cost; it reports whether a move was made
+func (f *fleetSolver) relocate() bool {
+	var bestFrom, bestIndex int
+	var bestTo insertion
+	bestSaving := 1e-9
+
+	for from, route := range f.routes {
+		for i, stop := range route {
+			saved, _ := f.removal(from, i)
+
+			for to := range f.routes {
+				if to == from {
+					continue
+				}
+				at, ok := f.bestInsertionInto(to, stop)
+				if !ok {
+					continue
+				}
+				if saving := saved - at.delta; saving > bestSaving {
+					bestFrom, bestIndex, bestTo, bestSaving = from, i, at, saving
+				}
+			}
+		}
+	}
+
+	if bestSaving <= 1e-9 {
+		return false
+	}
+
+	route := f.routes[bestFrom]
+	stop := route[bestIndex]
+	savedCost, savedDuration := f.removal(bestFrom, bestIndex)
+	f.routes[bestFrom] = append(append([]int{}, route[:bestIndex]...), route[bestIndex+1:]...)
+	f.loads[bestFrom] -= f.problem.Stops[stop].Demand
+	f.costs[bestFrom] -= savedCost
+	f.durations[bestFrom] -= savedDuration
+	f.insert(stop, bestTo)
+
+	return true
+}
+
+// reorder re-solves one vehicle's visiting order, keeping the current order
+// when the new one is not cheaper or does not fit the shift
+func (f *fleetSolver) reorder(v int, options SolverOptions) {
+	route := f.routes[v]
+	if len(route) < 2 {
+		return
+	}
+
+	vehicle := f.problem.Vehicles[v]
+	nodes := make([]int, 0, len(route)+1)
+	nodes = append(nodes, vehicle.Depot)
+	for _, stop := range route {
+		nodes = append(nodes, f.problem.Stops[stop].Node)
+	}
+
+	costs := make([][]float64, len(nodes))
+	for i, a := range nodes {
+		costs[i] = make([]float64, len(nodes))
+		for j, b := range nodes {
+			costs[i][j] = vehicle.Costs[a][b]
+		}
+	}
+
+	result := SolveRoute(costs, options)
+
+	reordered := make([]int, len(result.Order))
+	for i, index := range result.Order {
+		reordered[i] = route[index-1]
+	}
+
+	cost := f.roundTrip(vehicle.Depot, reordered, vehicle.Costs, false)
+	duration := f.roundTrip(vehicle.Depot, reordered, vehicle.Durations, true)
+	if cost < f.costs[v]-1e-9 && (vehicle.MaxDuration <= 0 || duration <= vehicle.MaxDuration) {
+		f.routes[v] = reordered
+		f.costs[v] = cost
+		f.durations[v] = duration
+	}
+}
+
+func (f *fleetSolver) roundTrip(depot int, route []int, matrix [][]float64, withService bool) float64 {
+	if len(route) == 0 {
+		return 0
+	}
+
+	var total float64
+	previous := depot
+	for _, stop := range route {
+		node := f.problem.Stops[stop].Node
+		total += matrix[previous][node]
+		if withService {
+			total += f.problem.Stops[stop].ServiceTime
+		}
+		previous = node
+	}
+	return total + matrix[previous][depot]
+}
+
+func (f *fleetSolver) maxCapacity() int {
+	capacity := 0
+	for _, vehicle := range f.problem.Vehicles {
+		if vehicle.Capacity > capacity {
+			capacity = vehicle.Capacity
+		}
+	}
+	return capacity
+}
+
+func insertAt(route []int, position, stop int) []int {
+	result := make([]int, 0, len(route)+1)
+	result = append(result, route[:position]...)
+	result = append(result, stop)
+	return append(result, route[position:]...)
+}
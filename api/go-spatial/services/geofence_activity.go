@@ -0,0 +1,211 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-spatial/models"
+)
+
+// ErrInvalidCursor is returned for an activity cursor that was not issued
+// by GetGeofenceActivity
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// GetGeofenceActivity returns recorded geofence events matching the filter,
+// newest first, together with a summary over the whole filtered window
+func (s *GeofenceService) GetGeofenceActivity(filter models.GeofenceActivityFilter) (*models.GeofenceActivity, error) {
+	where, args := activityWhereClause(filter)
+
+	summaryQuery := `
+		SELECT
+			COUNT(CASE WHEN event_type = 'entry' THEN 1 END) as entries,
+			COUNT(CASE WHEN event_type = 'exit' THEN 1 END) as exits,
+			COUNT(DISTINCT geofence_id) as unique_geofences,
+			COUNT(DISTINCT driver_id) as unique_drivers
+		FROM geofence_events
+		WHERE ` + where
+
+	var summary models.GeofenceActivitySummary
+	err := s.db.QueryRow(summaryQuery, args...).Scan(
+		&summary.Entries,
+		&summary.Exits,
+		&summary.UniqueGeofences,
+		&summary.UniqueDrivers,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize geofence activity: %w", err)
+	}
+
+	// Keyset pagination on (occurred_at, id) keeps pages stable while new
+	// events are being appended
+	pageWhere := where
+	pageArgs := append([]interface{}{}, args...)
+
+	if filter.Cursor != "" {
+		cursorTime, cursorID, err := decodeActivityCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		pageWhere += fmt.Sprintf(" AND (occurred_at, id) < ($%d, $%d)", len(pageArgs)+1, len(pageArgs)+2)
+		pageArgs = append(pageArgs, cursorTime, cursorID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	// Fetch one extra row to know whether another page exists
+	pageArgs = append(pageArgs, limit+1)
+	eventsQuery := fmt.Sprintf(`
+		SELECT
+			id, geofence_id, geofence_name, driver_id, event_type,
+			ST_X(location) as longitude, ST_Y(location) as latitude,
+			dwell_seconds, occurred_at
+		FROM geofence_events
+		WHERE %s
+		ORDER BY occurred_at DESC, id DESC
+		LIMIT $%d
+	`, pageWhere, len(pageArgs))
+
+	rows, err := s.db.Query(eventsQuery, pageArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query geofence activity: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]models.GeofenceEvent, 0, limit)
+
+	for rows.Next() {
+		var event models.GeofenceEvent
+		var dwellSeconds sql.NullInt64
+
+		if err := rows.Scan(
+			&event.ID,
+			&event.GeofenceID,
+			&event.GeofenceName,
+			&event.DriverID,
+			&event.EventType,
+			&event.Location.Longitude,
+			&event.Location.Latitude,
+			&dwellSeconds,
+			&event.OccurredAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan geofence event: %w", err)
+		}
+
+		event.Location.Timestamp = event.OccurredAt.Unix()
+		if dwellSeconds.Valid {
+			event.DwellSeconds = &dwellSeconds.Int64
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read geofence activity: %w", err)
+	}
+
+	activity := &models.GeofenceActivity{
+		Summary: summary,
+	}
+
+	if len(events) > limit {
+		events = events[:limit]
+		last := events[len(events)-1]
+		cursor := encodeActivityCursor(last.OccurredAt, last.ID)
+		activity.NextCursor = &cursor
+	}
+	activity.Events = events
+
+	return activity, nil
+}
+
+// Helper methods
+
+func (s *GeofenceService) recordEvent(tx *sql.Tx, alert models.GeofenceAlert) error {
+	var dwellSeconds interface{}
+	if alert.AlertType == "exit" {
+		dwellSeconds = alert.DwellSeconds
+	}
+
+	query := `
+		INSERT INTO geofence_events (
+			geofence_id, geofence_name, driver_id, event_type,
+			location, dwell_seconds, occurred_at
+		)
+		VALUES ($1, $2, $3, $4, ST_SetSRID(ST_Point($5, $6), 4326), $7, $8)
+	`
+
+	_, err := tx.Exec(query,
+		alert.GeofenceID,
+		alert.GeofenceName,
+		alert.DriverID,
+		alert.AlertType,
+		alert.Location.Longitude,
+		alert.Location.Latitude,
+		dwellSeconds,
+		alert.Timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record geofence event: %w", err)
+	}
+
+	return nil
+}
+
+func activityWhereClause(filter models.GeofenceActivityFilter) (string, []interface{}) {
+	conditions := []string{"occurred_at >= $1", "occurred_at < $2"}
+	args := []interface{}{filter.Since, filter.Until}
+
+	if filter.DriverID != nil {
+		args = append(args, *filter.DriverID)
+		conditions = append(conditions, fmt.Sprintf("driver_id = $%d", len(args)))
+	}
+
+	if filter.GeofenceID != nil {
+		args = append(args, *filter.GeofenceID)
+		conditions = append(conditions, fmt.Sprintf("geofence_id = $%d", len(args)))
+	}
+
+	if filter.EventType != nil {
+		args = append(args, *filter.EventType)
+		conditions = append(conditions, fmt.Sprintf("event_type = $%d", len(args)))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+func encodeActivityCursor(occurredAt time.Time, id int64) string {
+	raw := fmt.Sprintf("%d:%d", occurredAt.UnixNano(), id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeActivityCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("%w: missing separator", ErrInvalidCursor)
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	return time.Unix(0, nanos), id, nil
+}
@@ -3,29 +3,63 @@ package services
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
+	"go-spatial/geometry"
 	"go-spatial/models"
 )
 
+// ErrInvalidGeometry is returned for geometries that cannot be read or are
+// not valid where they are used
+var ErrInvalidGeometry = errors.New("invalid geometry")
+
 type GeofenceService struct {
-	db *sql.DB
+	db       *sql.DB
+	presence PresenceSettings
+}
+
+// PresenceSettings controls how entry and exit transitions are confirmed
+type PresenceSettings struct {
+	// DwellTime is how long a driver has to stay on the new side of a
+	// boundary before the transition is reported
+	DwellTime time.Duration
+	// ExitMargin is the distance in meters a driver has to move outside a
+	// fence before an exit is considered; a larger buffer_distance wins
+	ExitMargin float64
+}
+
+// presenceState is the persisted view of a driver relative to one geofence
+type presenceState struct {
+	Inside        bool
+	StateSince    time.Time
+	PendingInside *bool
+	PendingSince  time.Time
+	// LastSeen is when the row was last updated, on the same clock
+	LastSeen time.Time
 }
 
 func NewGeofenceService(db *sql.DB) *GeofenceService {
 	return &GeofenceService{
 		db: db,
+		presence: PresenceSettings{
+			ExitMargin: 15,
+		},
 	}
 }
 
+// SetPresenceSettings overrides the default transition detection settings
+func (s *GeofenceService) SetPresenceSettings(settings PresenceSettings) {
+	s.presence = settings
+}
+
 // CreateGeofence creates a new geofence
 func (s *GeofenceService) CreateGeofence(geofence *models.Geofence) error {
 	// Convert geometry to WKT format for PostGIS
 	geometryWKT, err := s.geometryToWKT(geofence.Geometry)
 	if err != nil {
-		return fmt.Errorf("invalid geometry: %w", err)
+		return err
 	}
 
 	// Convert properties to JSON
@@ -36,7 +70,7 @@ func (s *GeofenceService) CreateGeofence(geofence *models.Geofence) error {
 
 	query := `
 		INSERT INTO geofences (id, name, geometry, properties, driver_id, buffer_distance, active)
-		VALUES ($1, $2, ST_GeomFromText($3, 4326), $4, $5, $6, $7)
+		VALUES ($1, $2, ST_Force2D(ST_GeomFromText($3, 4326)), $4, $5, $6, $7)
 	`
 
 	_, err = s.db.Exec(query,
@@ -60,7 +94,7 @@ func (s *GeofenceService) CreateGeofence(geofence *models.Geofence) error {
 func (s *GeofenceService) GetGeofence(id string) (*models.Geofence, error) {
 	query := `
 		SELECT 
-			id, name, ST_AsText(geometry) as geometry_wkt, 
+			id, name, ST_AsBinary(geometry) as geometry_wkb, 
 			properties, driver_id, buffer_distance, active,
 			created_at, updated_at
 		FROM geofences 
@@ -68,14 +102,14 @@ func (s *GeofenceService) GetGeofence(id string) (*models.Geofence, error) {
 	`
 
 	var geofence models.Geofence
-	var geometryWKT string
+	var geometryWKB []byte
 	var propertiesJSON []byte
 	var driverID sql.NullString
 
 	err := s.db.QueryRow(query, id).Scan(
 		&geofence.ID,
 		&geofence.Name,
-		&geometryWKT,
+		&geometryWKB,
 		&propertiesJSON,
 		&driverID,
 		&geofence.BufferDistance,
@@ -91,8 +125,11 @@ func (s *GeofenceService) GetGeofence(id string) (*models.Geofence, error) {
 		return nil, fmt.Errorf("failed to get geofence: %w", err)
 	}
 
-	// Convert WKT back to geometry
-	geofence.Geometry = geometryWKT
+	// Geometries are read as WKB to keep every bit of their coordinates
+	geofence.Geometry, err = geometry.ParseWKB(geometryWKB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geofence geometry: %w", err)
+	}
 
 	// Unmarshal properties
 	if err := json.Unmarshal(propertiesJSON, &geofence.Properties); err != nil {
@@ -112,7 +149,7 @@ func (s *GeofenceService) UpdateGeofence(id string, geofence *models.Geofence) e
 	// Convert geometry to WKT format for PostGIS
 	geometryWKT, err := s.geometryToWKT(geofence.Geometry)
 	if err != nil {
-		return fmt.Errorf("invalid geometry: %w", err)
+		return err
 	}
 
 	// Convert properties to JSON
@@ -123,7 +160,7 @@ func (s *GeofenceService) UpdateGeofence(id string, geofence *models.Geofence) e
 
 	query := `
 		UPDATE geofences 
-		SET name = $2, geometry = ST_GeomFromText($3, 4326), 
+		SET name = $2, geometry = ST_Force2D(ST_GeomFromText($3, 4326)), 
 		    properties = $4, driver_id = $5, buffer_distance = $6, 
 		    active = $7, updated_at = NOW()
 		WHERE id = $1
@@ -176,11 +213,12 @@ func (s *GeofenceService) DeleteGeofence(id string) error {
 	return nil
 }
 
-// ListGeofences retrieves geofences with optional filtering
-func (s *GeofenceService) ListGeofences(driverID *string, active *bool, limit, offset int) ([]models.Geofence, error) {
+// ListGeofences retrieves geofences with optional filtering. With
+// includeShared, a driver filter also matches fences shared by all drivers.
+func (s *GeofenceService) ListGeofences(driverID *string, includeShared bool, active *bool, limit, offset int) ([]models.Geofence, error) {
 	baseQuery := `
 		SELECT 
-			id, name, ST_AsText(geometry) as geometry_wkt, 
+			id, name, ST_AsBinary(geometry) as geometry_wkb, 
 			properties, driver_id, buffer_distance, active,
 			created_at, updated_at
 		FROM geofences 
@@ -193,7 +231,11 @@ func (s *GeofenceService) ListGeofences(driverID *string, active *bool, limit, o
 	// Add filters
 	if driverID != nil {
 		argCount++
-		baseQuery += fmt.Sprintf(" AND driver_id = $%d", argCount)
+		if includeShared {
+			baseQuery += fmt.Sprintf(" AND (driver_id = $%d OR driver_id IS NULL)", argCount)
+		} else {
+			baseQuery += fmt.Sprintf(" AND driver_id = $%d", argCount)
+		}
 		args = append(args, *driverID)
 	}
 
@@ -228,14 +270,14 @@ func (s *GeofenceService) ListGeofences(driverID *string, active *bool, limit, o
 
 	for rows.Next() {
 		var geofence models.Geofence
-		var geometryWKT string
+		var geometryWKB []byte
 		var propertiesJSON []byte
 		var driverIDField sql.NullString
 
 		err := rows.Scan(
 			&geofence.ID,
 			&geofence.Name,
-			&geometryWKT,
+			&geometryWKB,
 			&propertiesJSON,
 			&driverIDField,
 			&geofence.BufferDistance,
@@ -248,8 +290,10 @@ func (s *GeofenceService) ListGeofences(driverID *string, active *bool, limit, o
 			continue
 		}
 
-		// Convert WKT back to geometry
-		geofence.Geometry = geometryWKT
+		geofence.Geometry, err = geometry.ParseWKB(geometryWKB)
+		if err != nil {
+			continue
+		}
 
 		// Unmarshal properties
 		if err := json.Unmarshal(propertiesJSON, &geofence.Properties); err != nil {
@@ -267,60 +311,178 @@ func (s *GeofenceService) ListGeofences(driverID *string, active *bool, limit, o
 	return geofences, nil
 }
 
-// CheckGeofenceEntry checks if a location triggers any geofence alerts
+// CheckGeofenceEntry checks a driver position against nearby geofences and
+// returns an alert for every confirmed entry or exit since the last check
 func (s *GeofenceService) CheckGeofenceEntry(driverID string, location models.Location) ([]models.GeofenceAlert, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialise checks for one driver, which may arrive over HTTP and the
+	// WebSocket at once, so a transition is only reported once
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, driverID); err != nil {
+		return nil, fmt.Errorf("failed to lock geofence presence: %w", err)
+	}
+
+	// Candidates are fences near the position plus any fence the driver is
+	// currently inside (or about to change state for), so exits are detected
+	// even when the driver is already far away
 	query := `
 		SELECT 
 			g.id,
 			g.name,
-			CASE 
-				WHEN ST_Contains(g.geometry, ST_Point($1, $2)) THEN 'entry'
-				ELSE 'exit'
-			END as alert_type,
-			ST_Contains(g.geometry, ST_Point($1, $2)) as is_inside
+			g.properties,
+			ST_Contains(g.geometry, ST_SetSRID(ST_Point($1, $2), 4326)) as is_inside,
+			ST_DWithin(
+				g.geometry::geography,
+				ST_Point($1, $2)::geography,
+				GREATEST(g.buffer_distance, $4)
+			) as within_margin,
+			COALESCE(p.inside, false) as was_inside,
+			p.state_since,
+			p.pending_inside,
+			p.pending_since,
+			p.last_seen
 		FROM geofences g
+		LEFT JOIN driver_geofence_presence p
+			ON p.geofence_id = g.id AND p.driver_id = $3
 		WHERE 
 			g.active = true
 			AND (g.driver_id IS NULL OR g.driver_id = $3)
 			AND (
-				ST_Contains(g.geometry, ST_Point($1, $2))
-				OR ST_DWithin(
+				ST_DWithin(
 					g.geometry::geography,
 					ST_Point($1, $2)::geography,
-					g.buffer_distance
+					GREATEST(g.buffer_distance, $4)
 				)
+				OR p.inside = true
+				OR p.pending_inside IS NOT NULL
 			)
 	`
 
-	rows, err := s.db.Query(query, location.Longitude, location.Latitude, driverID)
+	rows, err := tx.Query(query, location.Longitude, location.Latitude, driverID, s.presence.ExitMargin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check geofence entry: %w", err)
 	}
-	defer rows.Close()
 
-	alerts := make([]models.GeofenceAlert, 0)
+	type candidate struct {
+		id           string
+		name         string
+		properties   map[string]interface{}
+		isInside     bool
+		withinMargin bool
+		state        presenceState
+	}
+
+	candidates := make([]candidate, 0)
 
 	for rows.Next() {
-		var geofenceID, geofenceName, alertType string
-		var isInside bool
+		var c candidate
+		var propertiesJSON []byte
+		var stateSince, pendingSince, lastSeen sql.NullTime
+		var pendingInside sql.NullBool
 
-		if err := rows.Scan(&geofenceID, &geofenceName, &alertType, &isInside); err != nil {
+		if err := rows.Scan(
+			&c.id,
+			&c.name,
+			&propertiesJSON,
+			&c.isInside,
+			&c.withinMargin,
+			&c.state.Inside,
+			&stateSince,
+			&pendingInside,
+			&pendingSince,
+			&lastSeen,
+		); err != nil {
 			continue
 		}
 
-		// Only create alerts for actual entry/exit events
-		if isInside {
-			alert := models.GeofenceAlert{
-				GeofenceID: geofenceID,
-				DriverID:   driverID,
-				AlertType:  alertType,
-				Location:   location,
-				Timestamp:  time.Now(),
-			}
+		if err := json.Unmarshal(propertiesJSON, &c.properties); err != nil {
+			c.properties = make(map[string]interface{})
+		}
+		if stateSince.Valid {
+			c.state.StateSince = stateSince.Time
+		}
+		if pendingInside.Valid && pendingSince.Valid {
+			c.state.PendingInside = &pendingInside.Bool
+			c.state.PendingSince = pendingSince.Time
+		}
+		if lastSeen.Valid {
+			c.state.LastSeen = lastSeen.Time
+		}
+
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read geofence candidates: %w", err)
+	}
+
+	// Dwell is measured on the device clock, so buffered fixes delivered
+	// late still confirm transitions at the time they happened
+	observedAt := time.Now()
+	if location.Timestamp > 0 && location.Timestamp < observedAt.Unix() {
+		observedAt = time.Unix(location.Timestamp, 0)
+	}
+	alerts := make([]models.GeofenceAlert, 0)
+
+	for _, c := range candidates {
+		// A fix older than the stored state cannot run the clock backwards
+		now := observedAt
+		if now.Before(c.state.LastSeen) {
+			now = c.state.LastSeen
+		}
+
+		// Once inside, a driver only counts as outside after moving beyond the
+		// exit margin, which absorbs GPS jitter along the boundary
+		observedInside := c.isInside || (c.state.Inside && c.withinMargin)
+
+		dwell := s.presence.DwellTime
+		if seconds, ok := c.properties["dwell_seconds"].(float64); ok && seconds >= 0 {
+			dwell = time.Duration(seconds * float64(time.Second))
+		}
+
+		previousSince := c.state.StateSince
+		alertType := c.state.advance(observedInside, now, dwell)
+
+		if err := s.savePresence(tx, driverID, c.id, c.state, location, now); err != nil {
+			return nil, err
+		}
+
+		if alertType == "" {
+			continue
+		}
+
+		alert := models.GeofenceAlert{
+			GeofenceID:   c.id,
+			GeofenceName: c.name,
+			DriverID:     driverID,
+			AlertType:    alertType,
+			Location:     location,
+			Timestamp:    now,
+		}
+		if alertType == "exit" && !previousSince.IsZero() {
+			alert.DwellSeconds = int64(c.state.StateSince.Sub(previousSince).Seconds())
+		}
+
+		// Every confirmed transition is logged; the alert_on_* properties only
+		// decide whether the caller is notified
+		if err := s.recordEvent(tx, alert); err != nil {
+			return nil, err
+		}
+
+		if alertEnabled(c.properties, alertType) {
 			alerts = append(alerts, alert)
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit geofence presence: %w", err)
+	}
+
 	return alerts, nil
 }
 
@@ -366,126 +528,119 @@ func (s *GeofenceService) GetGeofenceStats() (map[string]interface{}, error) {
 
 // Helper methods
 
-func (s *GeofenceService) geometryToWKT(geom interface{}) (string, error) {
-	// Handle different geometry input formats
-	switch v := geom.(type) {
-	case string:
-		// Assume it's already WKT
-		return v, nil
-	case map[string]interface{}:
-		// Handle GeoJSON format
-		return s.geoJSONToWKT(v)
-	default:
-		return "", fmt.Errorf("unsupported geometry type")
+// advance applies an observation to the presence state and returns "entry" or
+// "exit" when a transition is confirmed, or an empty string otherwise
+func (p *presenceState) advance(observedInside bool, now time.Time, dwell time.Duration) string {
+	if observedInside == p.Inside {
+		p.PendingInside = nil
+		p.PendingSince = time.Time{}
+		return ""
 	}
-}
 
-func (s *GeofenceService) geoJSONToWKT(geoJSON map[string]interface{}) (string, error) {
-	geomType, ok := geoJSON["type"].(string)
-	if !ok {
-		return "", fmt.Errorf("missing geometry type")
+	if p.PendingInside == nil || *p.PendingInside != observedInside {
+		p.PendingInside = &observedInside
+		p.PendingSince = now
 	}
 
-	coordinates, ok := geoJSON["coordinates"].([]interface{})
-	if !ok {
-		return "", fmt.Errorf("missing coordinates")
+	if now.Sub(p.PendingSince) < dwell {
+		return ""
 	}
 
-	switch geomType {
-	case "Polygon":
-		return s.coordinatesToPolygonWKT(coordinates)
-	case "Point":
-		return s.coordinatesToPointWKT(coordinates)
-	case "LineString":
-		return s.coordinatesToLineStringWKT(coordinates)
-	default:
-		return "", fmt.Errorf("unsupported geometry type: %s", geomType)
-	}
-}
+	p.Inside = observedInside
+	p.StateSince = p.PendingSince
+	p.PendingInside = nil
+	p.PendingSince = time.Time{}
 
-func (s *GeofenceService) coordinatesToPolygonWKT(coordinates []interface{}) (string, error) {
-	if len(coordinates) == 0 {
-		return "", fmt.Errorf("empty coordinates")
+	if observedInside {
+		return "entry"
 	}
+	return "exit"
+}
 
-	rings := make([]string, 0)
-
-	for _, ring := range coordinates {
-		ringCoords, ok := ring.([]interface{})
-		if !ok {
-			continue
-		}
-
-		ringWKT := ""
-		for i, coord := range ringCoords {
-			coordArray, ok := coord.([]interface{})
-			if !ok || len(coordArray) < 2 {
-				continue
-			}
-
-			lng, ok1 := coordArray[0].(float64)
-			lat, ok2 := coordArray[1].(float64)
-			if !ok1 || !ok2 {
-				continue
-			}
-
-			if i > 0 {
-				ringWKT += ","
-			}
-			ringWKT += fmt.Sprintf("%.6f %.6f", lng, lat)
-		}
-
-		if ringWKT != "" {
-			rings = append(rings, fmt.Sprintf("(%s)", ringWKT))
+func (s *GeofenceService) savePresence(tx *sql.Tx, driverID, geofenceID string, state presenceState, location models.Location, now time.Time) error {
+	// Drivers that are outside with nothing pending need no row
+	if !state.Inside && state.PendingInside == nil {
+		_, err := tx.Exec(
+			`DELETE FROM driver_geofence_presence WHERE driver_id = $1 AND geofence_id = $2`,
+			driverID, geofenceID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to clear geofence presence: %w", err)
 		}
+		return nil
 	}
 
-	if len(rings) == 0 {
-		return "", fmt.Errorf("no valid rings found")
+	stateSince := state.StateSince
+	if stateSince.IsZero() {
+		stateSince = now
 	}
 
-	return fmt.Sprintf("POLYGON(%s)", strings.Join(rings, ",")), nil
-}
-
-func (s *GeofenceService) coordinatesToPointWKT(coordinates []interface{}) (string, error) {
-	if len(coordinates) < 2 {
-		return "", fmt.Errorf("point coordinates must have at least 2 elements")
+	var pendingSince interface{}
+	if state.PendingInside != nil {
+		pendingSince = state.PendingSince
 	}
 
-	lng, ok1 := coordinates[0].(float64)
-	lat, ok2 := coordinates[1].(float64)
-	if !ok1 || !ok2 {
-		return "", fmt.Errorf("invalid coordinate values")
+	query := `
+		INSERT INTO driver_geofence_presence (
+			driver_id, geofence_id, inside, state_since,
+			pending_inside, pending_since, last_location, last_seen
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, ST_SetSRID(ST_Point($7, $8), 4326), $9)
+		ON CONFLICT (driver_id, geofence_id) DO UPDATE SET
+			inside = EXCLUDED.inside,
+			state_since = EXCLUDED.state_since,
+			pending_inside = EXCLUDED.pending_inside,
+			pending_since = EXCLUDED.pending_since,
+			last_location = EXCLUDED.last_location,
+			last_seen = EXCLUDED.last_seen
+	`
+
+	_, err := tx.Exec(query,
+		driverID,
+		geofenceID,
+		state.Inside,
+		stateSince,
+		state.PendingInside,
+		pendingSince,
+		location.Longitude,
+		location.Latitude,
+		now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save geofence presence: %w", err)
 	}
 
-	return fmt.Sprintf("POINT(%.6f %.6f)", lng, lat), nil
+	return nil
 }
 
-func (s *GeofenceService) coordinatesToLineStringWKT(coordinates []interface{}) (string, error) {
-	if len(coordinates) < 2 {
-		return "", fmt.Errorf("linestring must have at least 2 points")
+// alertEnabled honours the alert_on_entry / alert_on_exit geofence properties
+func alertEnabled(properties map[string]interface{}, alertType string) bool {
+	if enabled, ok := properties["alert_on_"+alertType].(bool); ok {
+		return enabled
 	}
+	return true
+}
 
-	points := make([]string, 0)
+// geometryToWKT reads a geofence boundary given as WKT or GeoJSON, which
+// may be a Feature. Boundaries are polygons or multipolygons.
+func (s *GeofenceService) geometryToWKT(geom interface{}) (string, error) {
+	g, err := geometry.Decode(geom)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+	}
 
-	for _, coord := range coordinates {
-		coordArray, ok := coord.([]interface{})
-		if !ok || len(coordArray) < 2 {
-			continue
+	switch v := g.(type) {
+	case geometry.Polygon:
+		if len(v) == 0 {
+			return "", fmt.Errorf("%w: geofence polygon is empty", ErrInvalidGeometry)
 		}
-
-		lng, ok1 := coordArray[0].(float64)
-		lat, ok2 := coordArray[1].(float64)
-		if !ok1 || !ok2 {
-			continue
+	case geometry.MultiPolygon:
+		if len(v) == 0 {
+			return "", fmt.Errorf("%w: geofence multipolygon is empty", ErrInvalidGeometry)
 		}
-
-		points = append(points, fmt.Sprintf("%.6f %.6f", lng, lat))
-	}
-
-	if len(points) < 2 {
-		return "", fmt.Errorf("insufficient valid points for linestring")
+	default:
+		return "", fmt.Errorf("%w: geofence must be a Polygon or MultiPolygon, got %s", ErrInvalidGeometry, g.Type())
 	}
 
-	return fmt.Sprintf("LINESTRING(%s)", strings.Join(points, ",")), nil
+	return geometry.WKT(g), nil
 }
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-spatial/models"
+)
+
+// LocationHistoryService stores and queries the positions reported by drivers
+type LocationHistoryService struct {
+	db *sql.DB
+}
+
+func NewLocationHistoryService(db *sql.DB) *LocationHistoryService {
+	return &LocationHistoryService{
+		db: db,
+	}
+}
+
+// RecordLocations stores driver positions; points without a timestamp are
+// recorded at the time they were received
+func (s *LocationHistoryService) RecordLocations(driverID string, locations []models.Location) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO driver_locations (
+			driver_id, location, altitude, accuracy, heading, speed, recorded_at
+		)
+		VALUES ($1, ST_SetSRID(ST_Point($2, $3), 4326), $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare location insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, location := range locations {
+		recordedAt := time.Now()
+		if location.Timestamp > 0 {
+			recordedAt = time.Unix(location.Timestamp, 0)
+		}
+
+		if _, err := stmt.Exec(
+			driverID,
+			location.Longitude,
+			location.Latitude,
+			location.Altitude,
+			location.Accuracy,
+			location.Heading,
+			location.Speed,
+			recordedAt,
+		); err != nil {
+			return 0, fmt.Errorf("failed to record location: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit locations: %w", err)
+	}
+
+	return len(locations), nil
+}
+
+// GetTrack returns up to limit positions of a driver between since and until
+// in recording order
+func (s *LocationHistoryService) GetTrack(driverID string, since, until time.Time, limit int) (*models.DriverTrack, error) {
+	query := `
+		SELECT
+			ST_X(location) as longitude,
+			ST_Y(location) as latitude,
+			altitude,
+			COALESCE(accuracy, 0),
+			heading,
+			speed,
+			recorded_at
+		FROM driver_locations
+		WHERE driver_id = $1 AND recorded_at >= $2 AND recorded_at < $3
+		ORDER BY recorded_at, id
+		LIMIT $4
+	`
+
+	// Fetch one extra row to know whether the track was cut off
+	rows, err := s.db.Query(query, driverID, since, until, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query driver track: %w", err)
+	}
+	defer rows.Close()
+
+	points := make([]models.Location, 0)
+
+	for rows.Next() {
+		var point models.Location
+		var altitude, heading, speed sql.NullFloat64
+		var recordedAt time.Time
+
+		if err := rows.Scan(
+			&point.Longitude,
+			&point.Latitude,
+			&altitude,
+			&point.Accuracy,
+			&heading,
+			&speed,
+			&recordedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan driver location: %w", err)
+		}
+
+		if altitude.Valid {
+			point.Altitude = &altitude.Float64
+		}
+		if heading.Valid {
+			point.Heading = &heading.Float64
+		}
+		if speed.Valid {
+			point.Speed = &speed.Float64
+		}
+		point.Timestamp = recordedAt.Unix()
+
+		points = append(points, point)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read driver track: %w", err)
+	}
+
+	track := &models.DriverTrack{
+		DriverID: driverID,
+		Since:    since,
+		Until:    until,
+	}
+
+	if len(points) > limit {
+		points = points[:limit]
+		track.Truncated = true
+	}
+	track.Points = points
+	track.PointCount = len(points)
+
+	distanceQuery := `
+		SELECT COALESCE(ST_Length(ST_MakeLine(location ORDER BY recorded_at, id)::geography), 0)
+		FROM driver_locations
+		WHERE driver_id = $1 AND recorded_at >= $2 AND recorded_at < $3
+	`
+
+	if err := s.db.QueryRow(distanceQuery, driverID, since, until).Scan(&track.DistanceMeters); err != nil {
+		return nil, fmt.Errorf("failed to calculate track distance: %w", err)
+	}
+
+	return track, nil
+}
+
+// PruneLocations deletes positions recorded before the cutoff
+func (s *LocationHistoryService) PruneLocations(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM driver_locations WHERE recorded_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune driver locations: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// RunRetention periodically prunes positions older than retention
+func (s *LocationHistoryService) RunRetention(retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pruned, err := s.PruneLocations(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Location retention failed: %v", err)
+				continue
+			}
+			if pruned > 0 {
+				log.Printf("Pruned %d driver locations older than %s", pruned, retention)
+			}
+		}
+	}
+}
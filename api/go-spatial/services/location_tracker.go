@@ -0,0 +1,269 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go-spatial/models"
+)
+
+// LocationProcessor handles location updates received from connected drivers
+type LocationProcessor interface {
+	ProcessLocation(driverID string, location models.Location) (*LocationUpdateResult, error)
+	ProcessLocationBatch(driverID string, locations []models.Location) (*LocationUpdateResult, error)
+}
+
+// LocationUpdateResult summarizes the checks run for one location update
+type LocationUpdateResult struct {
+	PointsRecorded  int                         `json:"points_recorded"`
+	GeofenceAlerts  []models.GeofenceAlert      `json:"geofence_alerts"`
+	RouteID         string                      `json:"route_id,omitempty"`
+	DistanceToRoute *float64                    `json:"distance_to_route,omitempty"`
+	Deviation       *models.RouteDeviationAlert `json:"deviation,omitempty"`
+}
+
+// TrackingSettings controls route deviation detection for live locations
+type TrackingSettings struct {
+	// ActiveRouteAge is how long after creation a stored route counts as the
+	// driver's active route
+	ActiveRouteAge time.Duration
+	// DeviationThreshold is the distance from the route in meters beyond
+	// which the driver is considered off route
+	DeviationThreshold float64
+	// AlertMaxAge is how old the latest location of an update may be for
+	// geofence and deviation alerts to still be sent; zero means no limit
+	AlertMaxAge time.Duration
+}
+
+// LocationTracker runs live driver locations through geofence and route
+// deviation checks and pushes resulting alerts to the driver's connections
+type LocationTracker struct {
+	hub             *WebSocketHub
+	geofenceService *GeofenceService
+	spatialService  *SpatialService
+	routeService    *RouteService
+	history         *LocationHistoryService
+	probes          *FleetProbeAggregator
+	settings        TrackingSettings
+
+	// Drivers currently off their active route, keyed by driver ID, so a
+	// deviation is reported once rather than on every update
+	offRoute      map[string]string
+	offRouteMutex sync.Mutex
+}
+
+// Maximum clock skew accepted for client supplied timestamps
+const maxLocationClockSkew = 5 * time.Minute
+
+func NewLocationTracker(hub *WebSocketHub, geofenceService *GeofenceService, spatialService *SpatialService, routeService *RouteService, history *LocationHistoryService) *LocationTracker {
+	return &LocationTracker{
+		hub:             hub,
+		geofenceService: geofenceService,
+		spatialService:  spatialService,
+		routeService:    routeService,
+		history:         history,
+		settings: TrackingSettings{
+			ActiveRouteAge:     12 * time.Hour,
+			DeviationThreshold: 100,
+			AlertMaxAge:        5 * time.Minute,
+		},
+		offRoute: make(map[string]string),
+	}
+}
+
+// SetTrackingSettings overrides the default deviation detection settings
+func (t *LocationTracker) SetTrackingSettings(settings TrackingSettings) {
+	t.settings = settings
+}
+
+// SetProbeAggregator feeds recorded locations into fleet traffic speeds
+func (t *LocationTracker) SetProbeAggregator(probes *FleetProbeAggregator) {
+	t.probes = probes
+}
+
+// ProcessLocation records a driver location, checks it against geofences and
+// the active route and sends any resulting alerts over the driver's WebSocket
+// connections
+func (t *LocationTracker) ProcessLocation(driverID string, location models.Location) (*LocationUpdateResult, error) {
+	return t.ProcessLocationBatch(driverID, []models.Location{location})
+}
+
+// ProcessLocationBatch records buffered driver locations and runs the live
+// checks for the most recent one
+func (t *LocationTracker) ProcessLocationBatch(driverID string, locations []models.Location) (*LocationUpdateResult, error) {
+	if len(locations) == 0 {
+		return &LocationUpdateResult{GeofenceAlerts: []models.GeofenceAlert{}}, nil
+	}
+
+	recorded, err := t.history.RecordLocations(driverID, locations)
+	if err != nil {
+		return nil, err
+	}
+	if t.probes != nil {
+		t.probes.AddLocations(driverID, locations)
+	}
+
+	latest := locations[0]
+	for _, location := range locations[1:] {
+		if location.Timestamp >= latest.Timestamp {
+			latest = location
+		}
+	}
+
+	if err := t.hub.PublishLocation(driverID, latest); err != nil {
+		log.Printf("Failed to publish location of driver %s: %v", driverID, err)
+	}
+
+	// Positions driven while a route is active make up its actual trace,
+	// including batches delivered late
+	route, err := t.routeService.GetActiveRoute(driverID, t.settings.ActiveRouteAge)
+	if err != nil {
+		return nil, err
+	}
+	if route != nil {
+		if _, err := t.routeService.RecordTrace(route.ID, locations); err != nil {
+			return nil, err
+		}
+	}
+
+	// A batch flushed after a long offline period describes where the driver
+	// was, not where they are; alerting on it would be misleading
+	maxAge := t.settings.AlertMaxAge
+	if maxAge > 0 && time.Since(time.Unix(latest.Timestamp, 0)) > maxAge {
+		return &LocationUpdateResult{
+			PointsRecorded: recorded,
+			GeofenceAlerts: []models.GeofenceAlert{},
+		}, nil
+	}
+
+	result, err := t.checkLocation(driverID, latest, route)
+	if err != nil {
+		return nil, err
+	}
+	result.PointsRecorded = recorded
+
+	return result, nil
+}
+
+// checkLocation runs geofence and route deviation checks for a position and
+// pushes resulting alerts. route is the driver's active route, if any.
+func (t *LocationTracker) checkLocation(driverID string, location models.Location, route *models.OptimizedRoute) (*LocationUpdateResult, error) {
+	alerts, err := t.geofenceService.CheckGeofenceEntry(driverID, location)
+	if err != nil {
+		return nil, fmt.Errorf("geofence check failed: %w", err)
+	}
+
+	result := &LocationUpdateResult{
+		GeofenceAlerts: alerts,
+	}
+
+	for _, alert := range alerts {
+		if err := t.hub.SendGeofenceAlert(driverID, alert); err != nil {
+			log.Printf("Failed to send geofence alert to driver %s: %v", driverID, err)
+		}
+		if err := t.hub.PublishGeofenceAlert(alert); err != nil {
+			log.Printf("Failed to publish geofence alert: %v", err)
+		}
+	}
+
+	// Deviation is measured from the road path, or from straight lines
+	// between the stops for routes stored without one
+	var path []models.Location
+	if route != nil {
+		path = route.Geometry
+		if len(path) < 2 {
+			path = route.Waypoints
+		}
+	}
+	if len(path) < 2 {
+		t.clearDeviation(driverID)
+		return result, nil
+	}
+
+	analysis, err := t.spatialService.CheckRouteDeviation(location, path)
+	if err != nil {
+		return nil, fmt.Errorf("route deviation check failed: %w", err)
+	}
+
+	result.RouteID = route.ID
+	result.DistanceToRoute = analysis.DistanceToRoute
+
+	if *analysis.DistanceToRoute <= t.settings.DeviationThreshold {
+		t.clearDeviation(driverID)
+		return result, nil
+	}
+
+	if !t.markDeviation(driverID, route.ID) {
+		// Already reported for this route
+		return result, nil
+	}
+
+	deviation := models.RouteDeviationAlert{
+		RouteID:         route.ID,
+		DriverID:        driverID,
+		Location:        location,
+		DistanceToRoute: *analysis.DistanceToRoute,
+		Threshold:       t.settings.DeviationThreshold,
+		EstimatedDelay:  *analysis.EstimatedDelay,
+		Timestamp:       time.Unix(location.Timestamp, 0),
+	}
+	result.Deviation = &deviation
+
+	if err := t.hub.SendRouteDeviationAlert(driverID, deviation); err != nil {
+		log.Printf("Failed to send route deviation alert to driver %s: %v", driverID, err)
+	}
+	if err := t.hub.PublishRouteDeviation(deviation); err != nil {
+		log.Printf("Failed to publish route deviation alert: %v", err)
+	}
+
+	return result, nil
+}
+
+// ValidateLocation checks that a reported location is usable for tracking
+func ValidateLocation(location models.Location) error {
+	if location.Latitude < -90 || location.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90")
+	}
+	if location.Longitude < -180 || location.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180")
+	}
+	if location.Latitude == 0 && location.Longitude == 0 {
+		return fmt.Errorf("latitude and longitude are required")
+	}
+	if location.Accuracy < 0 {
+		return fmt.Errorf("accuracy must not be negative")
+	}
+	if location.Speed != nil && *location.Speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+	if location.Heading != nil && (*location.Heading < 0 || *location.Heading >= 360) {
+		return fmt.Errorf("heading must be between 0 and 360")
+	}
+	if location.Timestamp > time.Now().Add(maxLocationClockSkew).Unix() {
+		return fmt.Errorf("timestamp is in the future")
+	}
+
+	return nil
+}
+
+// Helper methods
+
+func (t *LocationTracker) markDeviation(driverID, routeID string) bool {
+	t.offRouteMutex.Lock()
+	defer t.offRouteMutex.Unlock()
+
+	if t.offRoute[driverID] == routeID {
+		return false
+	}
+	t.offRoute[driverID] = routeID
+	return true
+}
+
+func (t *LocationTracker) clearDeviation(driverID string) {
+	t.offRouteMutex.Lock()
+	defer t.offRouteMutex.Unlock()
+
+	delete(t.offRoute, driverID)
+}
@@ -0,0 +1,445 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Largest blob header and blob the PBF format allows
+const (
+	maxPBFHeaderSize = 64 * 1024
+	maxPBFBlobSize   = 32 * 1024 * 1024
+)
+
+// LoadRoadGraph imports an OpenStreetMap extract. Files ending in .pbf are
+// read as PBF, anything else as OSM XML. Every node is held in memory while
+// importing, so the extract should cover a city or region.
+func LoadRoadGraph(path string) (*RoadGraph, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OSM extract: %w", err)
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(strings.ToLower(path), ".pbf") {
+		return ReadOSMPBF(bufio.NewReader(file))
+	}
+	return ReadOSMXML(bufio.NewReader(file))
+}
+
+// ReadOSMXML builds a road graph from an OSM XML document
+func ReadOSMXML(r io.Reader) (*RoadGraph, error) {
+	type xmlTag struct {
+		Key   string `xml:"k,attr"`
+		Value string `xml:"v,attr"`
+	}
+	type xmlNode struct {
+		ID  int64   `xml:"id,attr"`
+		Lat float64 `xml:"lat,attr"`
+		Lon float64 `xml:"lon,attr"`
+	}
+	type xmlWay struct {
+		Refs []struct {
+			Ref int64 `xml:"ref,attr"`
+		} `xml:"nd"`
+		Tags []xmlTag `xml:"tag"`
+	}
+
+	builder := newRoadGraphBuilder()
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OSM XML: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "node":
+			var node xmlNode
+			if err := decoder.DecodeElement(&node, &start); err != nil {
+				return nil, fmt.Errorf("failed to read OSM node: %w", err)
+			}
+			builder.addNode(node.ID, node.Lat, node.Lon)
+		case "way":
+			var way xmlWay
+			if err := decoder.DecodeElement(&way, &start); err != nil {
+				return nil, fmt.Errorf("failed to read OSM way: %w", err)
+			}
+			refs := make([]int64, len(way.Refs))
+			for i, ref := range way.Refs {
+				refs[i] = ref.Ref
+			}
+			tags := make(map[string]string, len(way.Tags))
+			for _, tag := range way.Tags {
+				tags[tag.Key] = tag.Value
+			}
+			builder.addWay(refs, tags)
+		}
+	}
+
+	return builder.build()
+}
+
+// ReadOSMPBF builds a road graph from an OSM PBF file
+func ReadOSMPBF(r io.Reader) (*RoadGraph, error) {
+	builder := newRoadGraphBuilder()
+	for {
+		blobType, data, err := readPBFBlob(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch blobType {
+		case "OSMHeader":
+			if err := checkPBFHeader(data); err != nil {
+				return nil, err
+			}
+		case "OSMData":
+			if err := readPBFBlock(data, builder); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return builder.build()
+}
+
+// readPBFBlob reads the next blob of a PBF file and returns its type and
+// uncompressed contents
+func readPBFBlob(r io.Reader) (string, []byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		if err == io.EOF {
+			return "", nil, io.EOF
+		}
+		return "", nil, fmt.Errorf("failed to read PBF blob header size: %w", err)
+	}
+	if size > maxPBFHeaderSize {
+		return "", nil, fmt.Errorf("PBF blob header of %d bytes is too large", size)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, fmt.Errorf("failed to read PBF blob header: %w", err)
+	}
+
+	var blobType string
+	var blobSize uint64
+	err := eachProtoField(header, func(field protoField) error {
+		switch field.number {
+		case 1:
+			blobType = string(field.bytes)
+		case 3:
+			blobSize = field.varint
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if blobSize > maxPBFBlobSize {
+		return "", nil, fmt.Errorf("PBF blob of %d bytes is too large", blobSize)
+	}
+
+	blob := make([]byte, blobSize)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return "", nil, fmt.Errorf("failed to read PBF blob: %w", err)
+	}
+
+	var data []byte
+	compressed := false
+	err = eachProtoField(blob, func(field protoField) error {
+		switch field.number {
+		case 1: // raw
+			data = field.bytes
+		case 3: // zlib_data
+			compressed = true
+			data = field.bytes
+		case 4, 5, 6, 7: // lzma, bzip2, lz4, zstd
+			return fmt.Errorf("unsupported PBF blob compression")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if compressed {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to decompress PBF blob: %w", err)
+		}
+		defer reader.Close()
+		if data, err = io.ReadAll(io.LimitReader(reader, maxPBFBlobSize)); err != nil {
+			return "", nil, fmt.Errorf("failed to decompress PBF blob: %w", err)
+		}
+	}
+
+	return blobType, data, nil
+}
+
+// checkPBFHeader rejects files that need features this reader lacks
+func checkPBFHeader(data []byte) error {
+	return eachProtoField(data, func(field protoField) error {
+		if field.number != 4 { // required_features
+			return nil
+		}
+		switch feature := string(field.bytes); feature {
+		case "OsmSchema-V0.6", "DenseNodes":
+			return nil
+		default:
+			return fmt.Errorf("unsupported PBF feature %q", feature)
+		}
+	})
+}
+
+// pbfBlock is the coordinate encoding and string table of a PrimitiveBlock
+type pbfBlock struct {
+	strings     []string
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func (b pbfBlock) degrees(offset, value int64) float64 {
+	return 1e-9 * float64(offset+b.granularity*value)
+}
+
+func readPBFBlock(data []byte, builder *roadGraphBuilder) error {
+	block := pbfBlock{granularity: 100}
+	var groups [][]byte
+	err := eachProtoField(data, func(field protoField) error {
+		switch field.number {
+		case 1: // stringtable
+			return eachProtoField(field.bytes, func(entry protoField) error {
+				block.strings = append(block.strings, string(entry.bytes))
+				return nil
+			})
+		case 2: // primitivegroup
+			groups = append(groups, field.bytes)
+		case 17:
+			block.granularity = int64(field.varint)
+		case 19:
+			block.latOffset = int64(field.varint)
+		case 20:
+			block.lonOffset = int64(field.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		err := eachProtoField(group, func(field protoField) error {
+			switch field.number {
+			case 1:
+				return readPBFNode(field.bytes, block, builder)
+			case 2:
+				return readPBFDenseNodes(field.bytes, block, builder)
+			case 3:
+				return readPBFWay(field.bytes, block, builder)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readPBFNode(data []byte, block pbfBlock, builder *roadGraphBuilder) error {
+	var id, lat, lon int64
+	err := eachProtoField(data, func(field protoField) error {
+		switch field.number {
+		case 1:
+			id = zigzag(field.varint)
+		case 8:
+			lat = zigzag(field.varint)
+		case 9:
+			lon = zigzag(field.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	builder.addNode(id, block.degrees(block.latOffset, lat), block.degrees(block.lonOffset, lon))
+	return nil
+}
+
+func readPBFDenseNodes(data []byte, block pbfBlock, builder *roadGraphBuilder) error {
+	var ids, lats, lons []int64
+	err := eachProtoField(data, func(field protoField) error {
+		var err error
+		switch field.number {
+		case 1:
+			ids, err = packedSint64(field.bytes)
+		case 8:
+			lats, err = packedSint64(field.bytes)
+		case 9:
+			lons, err = packedSint64(field.bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return fmt.Errorf("malformed PBF dense nodes")
+	}
+
+	// Values are delta coded
+	var id, lat, lon int64
+	for i := range ids {
+		id += ids[i]
+		lat += lats[i]
+		lon += lons[i]
+		builder.addNode(id, block.degrees(block.latOffset, lat), block.degrees(block.lonOffset, lon))
+	}
+
+	return nil
+}
+
+func readPBFWay(data []byte, block pbfBlock, builder *roadGraphBuilder) error {
+	var keys, values []uint64
+	var refs []int64
+	err := eachProtoField(data, func(field protoField) error {
+		var err error
+		switch field.number {
+		case 2:
+			keys, err = packedUvarint(field.bytes)
+		case 3:
+			values, err = packedUvarint(field.bytes)
+		case 8:
+			refs, err = packedSint64(field.bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("malformed PBF way tags")
+	}
+
+	tags := make(map[string]string, len(keys))
+	for i := range keys {
+		if keys[i] >= uint64(len(block.strings)) || values[i] >= uint64(len(block.strings)) {
+			return fmt.Errorf("PBF way tag outside the string table")
+		}
+		tags[block.strings[keys[i]]] = block.strings[values[i]]
+	}
+
+	// Node references are delta coded
+	for i := 1; i < len(refs); i++ {
+		refs[i] += refs[i-1]
+	}
+
+	builder.addWay(refs, tags)
+	return nil
+}
+
+// protoField is one field of a protocol buffer message. Fixed-width fields
+// are skipped since no message read here uses them.
+type protoField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+var errMalformedProto = errors.New("malformed PBF message")
+
+func eachProtoField(data []byte, visit func(protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformedProto
+		}
+		data = data[n:]
+
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0: // varint
+			if field.varint, n = binary.Uvarint(data); n <= 0 {
+				return errMalformedProto
+			}
+			data = data[n:]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return errMalformedProto
+			}
+			data = data[8:]
+			continue
+		case 2: // length-delimited
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errMalformedProto
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return errMalformedProto
+			}
+			data = data[4:]
+			continue
+		default:
+			return errMalformedProto
+		}
+
+		if err := visit(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func packedUvarint(data []byte) ([]uint64, error) {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errMalformedProto
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+func packedSint64(data []byte) ([]int64, error) {
+	raw, err := packedUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]int64, len(raw))
+	for i, value := range raw {
+		values[i] = zigzag(value)
+	}
+	return values, nil
+}
+
+func zigzag(value uint64) int64 {
+	return int64(value>>1) ^ -int64(value&1)
+}
@@ -0,0 +1,540 @@
+package services
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"go-spatial/models"
+)
+
+// ErrNoRoadRoute is returned when the road graph cannot connect two points
+var ErrNoRoadRoute = errors.New("no road route found")
+
+// Points farther than this from any road cannot be routed
+const maxSnapDistance = 1000.0 // meters
+
+// Size of a road graph index cell in degrees (about 1.1 km of latitude)
+const roadCellSize = 0.01
+
+// RoadGraph is a directed road network imported from OpenStreetMap
+type RoadGraph struct {
+	nodes   []roadNode
+	offsets []int32 // edges leaving node i are edges[offsets[i]:offsets[i+1]]
+	edges   []roadEdge
+	cells   map[[2]int32][]int32
+}
+
+type roadNode struct {
+	lat, lng float64
+}
+
+type roadEdge struct {
+	to       int32
+	distance float64 // meters
+	class    string  // OSM highway tag
+	name     string  // street name or road number
+	maxSpeed float64 // km/h from the maxspeed tag, 0 when untagged
+	toll     bool
+	noHazmat bool    // closed to hazardous goods
+	height   float64 // meters of clearance, 0 when unlimited
+	weight   float64 // tonnes allowed, 0 when unlimited
+}
+
+// SpeedProfile is how fast a vehicle travels on each class of road
+type SpeedProfile struct {
+	Speeds   map[string]float64 // km/h by OSM highway tag
+	MaxSpeed float64            // km/h
+}
+
+// RoadPath is a route along the road graph
+type RoadPath struct {
+	Geometry []models.Location
+	Distance float64 // meters
+	Duration float64 // seconds
+	Tolls    bool    // uses a toll road
+	Highways bool    // uses a motorway or trunk road
+
+	// Segments are the straight pieces of Geometry in order
+	Segments []RoadSegment
+}
+
+// RoadSegment is a straight piece of a road path
+type RoadSegment struct {
+	From, To models.Location
+	Road     string  // street name or road number, empty when unnamed
+	Distance float64 // meters
+	Duration float64 // seconds
+}
+
+// Road class speeds relative to a vehicle's average urban speed
+var roadClassFactors = map[string]float64{
+	"motorway":       2.2,
+	"motorway_link":  1.2,
+	"trunk":          1.8,
+	"trunk_link":     1.0,
+	"primary":        1.2,
+	"primary_link":   0.9,
+	"secondary":      1.0,
+	"secondary_link": 0.8,
+	"tertiary":       0.9,
+	"tertiary_link":  0.7,
+	"unclassified":   0.8,
+	"residential":    0.6,
+	"living_street":  0.2,
+	"service":        0.4,
+	"road":           0.6,
+}
+
+// SpeedProfile scales the vehicle's average speed by road class and caps it
+// at what the vehicle may legally drive
+func (s *RouteService) SpeedProfile(vehicleType string) SpeedProfile {
+	cruise := s.getAverageSpeedForVehicle(vehicleType)
+
+	maxSpeed := 130.0
+	if vehicleType == "truck" {
+		maxSpeed = 90.0
+	}
+
+	speeds := make(map[string]float64, len(roadClassFactors))
+	for class, factor := range roadClassFactors {
+		speeds[class] = math.Min(cruise*factor, maxSpeed)
+	}
+
+	return SpeedProfile{Speeds: speeds, MaxSpeed: maxSpeed}
+}
+
+// SetRoadGraph routes calculated routes along roads instead of straight lines
+func (s *RouteService) SetRoadGraph(graph *RoadGraph) {
+	s.roadGraph = graph
+}
+
+// NodeCount returns the number of road graph nodes
+func (g *RoadGraph) NodeCount() int {
+	return len(g.nodes)
+}
+
+// EdgeCount returns the number of directed road segments
+func (g *RoadGraph) EdgeCount() int {
+	return len(g.edges)
+}
+
+// Route finds the fastest road path between two points with A*. Both points
+// are snapped to the nearest road node.
+func (g *RoadGraph) Route(origin, destination models.Location, profile SpeedProfile, options RoadOptions) (*RoadPath, error) {
+	from, fromDistance := g.nearestNode(origin)
+	if from < 0 || fromDistance > maxSnapDistance {
+		return nil, fmt.Errorf("%w: origin is not near a road", ErrNoRoadRoute)
+	}
+	to, toDistance := g.nearestNode(destination)
+	if to < 0 || toDistance > maxSnapDistance {
+		return nil, fmt.Errorf("%w: destination is not near a road", ErrNoRoadRoute)
+	}
+
+	tree := g.shortestPaths(from, []int32{to}, profile, options)
+	nodes, edges, found := tree.path(to)
+	if !found {
+		return nil, fmt.Errorf("%w: the points are not connected%s", ErrNoRoadRoute, options.Limits.suffix())
+	}
+
+	path := g.measure(edges, fromDistance+toDistance, profile)
+	path.Geometry = make([]models.Location, 0, len(nodes)+2)
+	path.Geometry = append(path.Geometry, origin)
+	for _, node := range nodes {
+		path.Geometry = append(path.Geometry, g.location(node))
+	}
+	path.Geometry = append(path.Geometry, destination)
+
+	// Reaching and leaving the road network are unnamed segments
+	accessSpeed := profile.speed(roadEdge{class: "service"}) / 3.6
+	path.Segments = make([]RoadSegment, 0, len(edges)+2)
+	path.Segments = append(path.Segments, RoadSegment{
+		From:     origin,
+		To:       path.Geometry[1],
+		Distance: fromDistance,
+		Duration: fromDistance / accessSpeed,
+	})
+	for i, edge := range edges {
+		path.Segments = append(path.Segments, RoadSegment{
+			From:     path.Geometry[i+1],
+			To:       path.Geometry[i+2],
+			Road:     edge.name,
+			Distance: edge.distance,
+			Duration: edge.distance / (profile.speed(edge) / 3.6),
+		})
+	}
+	path.Segments = append(path.Segments, RoadSegment{
+		From:     path.Geometry[len(path.Geometry)-2],
+		To:       destination,
+		Distance: toDistance,
+		Duration: toDistance / accessSpeed,
+	})
+
+	return path, nil
+}
+
+// Matrix finds the fastest road path between every ordered pair of stops,
+// without geometry. paths[i][i] is empty.
+func (g *RoadGraph) Matrix(stops []models.Location, profile SpeedProfile, options RoadOptions) ([][]RoadPath, error) {
+	nodes := make([]int32, len(stops))
+	snaps := make([]float64, len(stops))
+	for i, stop := range stops {
+		node, distance := g.nearestNode(stop)
+		if node < 0 || distance > maxSnapDistance {
+			return nil, fmt.Errorf("%w: stop %d is not near a road", ErrNoRoadRoute, i)
+		}
+		nodes[i], snaps[i] = node, distance
+	}
+
+	paths := make([][]RoadPath, len(stops))
+	for i := range stops {
+		paths[i] = make([]RoadPath, len(stops))
+		tree := g.shortestPaths(nodes[i], nodes, profile, options)
+		for j := range stops {
+			if i == j {
+				continue
+			}
+			_, edges, found := tree.path(nodes[j])
+			if !found {
+				return nil, fmt.Errorf("%w: stop %d cannot reach stop %d%s", ErrNoRoadRoute, i, j, options.Limits.suffix())
+			}
+			paths[i][j] = *g.measure(edges, snaps[i]+snaps[j], profile)
+		}
+	}
+
+	return paths, nil
+}
+
+// measure totals a path's edges plus the distance to and from the road
+// network, which is charged at service road speed
+func (g *RoadGraph) measure(edges []roadEdge, access float64, profile SpeedProfile) *RoadPath {
+	path := &RoadPath{
+		Distance: access,
+		Duration: access / (profile.speed(roadEdge{class: "service"}) / 3.6),
+	}
+	for _, edge := range edges {
+		path.Distance += edge.distance
+		path.Duration += edge.distance / (profile.speed(edge) / 3.6)
+		path.Tolls = path.Tolls || edge.toll
+		path.Highways = path.Highways || isHighway(edge.class)
+	}
+	return path
+}
+
+// roadTree holds the fastest paths found from one node
+type roadTree struct {
+	graph    *RoadGraph
+	from     int32
+	previous map[int32]int32 // node -> index of the edge reaching it
+	parent   map[int32]int32
+}
+
+// shortestPaths searches from a node until every target is settled. With a
+// single target the search is A*, otherwise Dijkstra.
+func (g *RoadGraph) shortestPaths(from int32, targets []int32, profile SpeedProfile, options RoadOptions) roadTree {
+	heuristic := func(int32) float64 { return 0 }
+	if len(targets) == 1 {
+		target := g.location(targets[0])
+		maxSpeed := profile.MaxSpeed / 3.6
+		heuristic = func(node int32) float64 {
+			return haversineDistance(g.location(node), target) / maxSpeed
+		}
+	}
+
+	remaining := make(map[int32]bool, len(targets))
+	for _, target := range targets {
+		remaining[target] = true
+	}
+
+	tree := roadTree{graph: g, from: from, previous: map[int32]int32{}, parent: map[int32]int32{}}
+	cost := map[int32]float64{from: 0}
+	settled := map[int32]bool{}
+	open := &roadQueue{{node: from, priority: heuristic(from)}}
+
+	for open.Len() > 0 && len(remaining) > 0 {
+		current := heap.Pop(open).(roadQueueItem)
+		if settled[current.node] {
+			continue
+		}
+		settled[current.node] = true
+		delete(remaining, current.node)
+
+		for i := g.offsets[current.node]; i < g.offsets[current.node+1]; i++ {
+			edge := g.edges[i]
+			edgeCost, usable := options.cost(edge, profile)
+			if !usable || settled[edge.to] {
+				continue
+			}
+			next := cost[current.node] + edgeCost
+			if known, found := cost[edge.to]; found && known <= next {
+				continue
+			}
+			cost[edge.to] = next
+			tree.previous[edge.to] = i
+			tree.parent[edge.to] = current.node
+			heap.Push(open, roadQueueItem{node: edge.to, priority: next + heuristic(edge.to)})
+		}
+	}
+
+	return tree
+}
+
+// path returns the nodes and edges from the tree's root to a node
+func (t roadTree) path(to int32) ([]int32, []roadEdge, bool) {
+	if _, reached := t.parent[to]; !reached && to != t.from {
+		return nil, nil, false
+	}
+
+	nodes := []int32{to}
+	var edges []roadEdge
+	for node := to; node != t.from; node = t.parent[node] {
+		nodes = append(nodes, t.parent[node])
+		edges = append(edges, t.graph.edges[t.previous[node]])
+	}
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	for i, j := 0, len(edges)-1; i < j; i, j = i+1, j-1 {
+		edges[i], edges[j] = edges[j], edges[i]
+	}
+
+	return nodes, edges, true
+}
+
+// speed is the km/h for an edge, or 0 when the vehicle cannot use it
+func (p SpeedProfile) speed(edge roadEdge) float64 {
+	speed, found := p.Speeds[edge.class]
+	if !found {
+		return 0
+	}
+	if edge.maxSpeed > 0 {
+		speed = math.Min(speed, edge.maxSpeed)
+	}
+	return math.Min(speed, p.MaxSpeed)
+}
+
+// RoadSpeeds estimates the free-flow speed of the fastest road at the node
+// nearest a location from its class, capped by its maxspeed tag, and the
+// limit in km/h traffic there is expected to stay under. ok is false when
+// no road is within maxDistance meters.
+func (g *RoadGraph) RoadSpeeds(location models.Location, maxDistance float64) (freeFlow, limit float64, ok bool) {
+	node, distance := g.nearestNode(location)
+	if node < 0 || distance > maxDistance {
+		return 0, 0, false
+	}
+
+	for _, edge := range g.edges[g.offsets[node]:g.offsets[node+1]] {
+		speed := defaultFreeFlowSpeed * roadClassFactors[edge.class]
+		// Untagged roads allow some headroom over their class speed
+		edgeLimit := speed * 1.25
+		if edge.maxSpeed > 0 {
+			speed = math.Min(speed, edge.maxSpeed)
+			edgeLimit = edge.maxSpeed
+		}
+		if speed > freeFlow {
+			freeFlow, limit = speed, edgeLimit
+		}
+	}
+
+	return freeFlow, limit, freeFlow > 0
+}
+
+func (g *RoadGraph) location(node int32) models.Location {
+	return models.Location{Latitude: g.nodes[node].lat, Longitude: g.nodes[node].lng}
+}
+
+// nearestNode returns the closest road node and its distance in meters, or
+// -1 when no node is in the surrounding index cells
+func (g *RoadGraph) nearestNode(location models.Location) (int32, float64) {
+	center := roadCell(location.Latitude, location.Longitude)
+
+	// Longitude cells narrow towards the poles
+	lngRings := int32(10)
+	if cos := math.Cos(location.Latitude * math.Pi / 180); cos > 0.1 {
+		lngRings = int32(math.Ceil(1 / cos))
+	}
+
+	best, bestDistance := int32(-1), math.Inf(1)
+	for dLat := int32(-1); dLat <= 1; dLat++ {
+		for dLng := -lngRings; dLng <= lngRings; dLng++ {
+			for _, node := range g.cells[[2]int32{center[0] + dLat, center[1] + dLng}] {
+				if distance := haversineDistance(location, g.location(node)); distance < bestDistance {
+					best, bestDistance = node, distance
+				}
+			}
+		}
+	}
+
+	return best, bestDistance
+}
+
+func roadCell(lat, lng float64) [2]int32 {
+	return [2]int32{int32(math.Floor(lat / roadCellSize)), int32(math.Floor(lng / roadCellSize))}
+}
+
+// roadGraphBuilder collects OSM nodes and ways and turns the routable ways
+// into a graph
+type roadGraphBuilder struct {
+	coordinates map[int64]roadNode
+	ways        []osmWay
+}
+
+type osmWay struct {
+	refs []int64
+	tags map[string]string
+}
+
+func newRoadGraphBuilder() *roadGraphBuilder {
+	return &roadGraphBuilder{coordinates: make(map[int64]roadNode)}
+}
+
+func (b *roadGraphBuilder) addNode(id int64, lat, lng float64) {
+	b.coordinates[id] = roadNode{lat: lat, lng: lng}
+}
+
+func (b *roadGraphBuilder) addWay(refs []int64, tags map[string]string) {
+	if _, routable := roadClassFactors[tags["highway"]]; !routable || len(refs) < 2 {
+		return
+	}
+	switch tags["access"] {
+	case "no", "private":
+		return
+	}
+	if tags["motor_vehicle"] == "no" || tags["area"] == "yes" {
+		return
+	}
+	b.ways = append(b.ways, osmWay{refs: refs, tags: tags})
+}
+
+func (b *roadGraphBuilder) build() (*RoadGraph, error) {
+	type directedEdge struct {
+		from int32
+		roadEdge
+	}
+
+	graph := &RoadGraph{cells: make(map[[2]int32][]int32)}
+	index := make(map[int64]int32)
+	nodeIndex := func(id int64) (int32, bool) {
+		if i, found := index[id]; found {
+			return i, true
+		}
+		coordinate, found := b.coordinates[id]
+		if !found {
+			return 0, false // Outside the extract
+		}
+		i := int32(len(graph.nodes))
+		index[id] = i
+		graph.nodes = append(graph.nodes, coordinate)
+		cell := roadCell(coordinate.lat, coordinate.lng)
+		graph.cells[cell] = append(graph.cells[cell], i)
+		return i, true
+	}
+
+	var edges []directedEdge
+	for _, way := range b.ways {
+		template := roadEdge{
+			class:    way.tags["highway"],
+			name:     roadName(way.tags),
+			maxSpeed: parseMaxSpeed(way.tags["maxspeed"]),
+			toll:     way.tags["toll"] == "yes",
+			noHazmat: way.tags["hazmat"] == "no",
+			height:   parseMaxHeight(way.tags["maxheight"]),
+			weight:   parseMaxWeight(way.tags["maxweight"]),
+		}
+		forward, backward := wayDirections(way.tags)
+
+		for i := 1; i < len(way.refs); i++ {
+			from, fromFound := nodeIndex(way.refs[i-1])
+			to, toFound := nodeIndex(way.refs[i])
+			if !fromFound || !toFound || from == to {
+				continue
+			}
+			edge := template
+			edge.distance = haversineDistance(graph.location(from), graph.location(to))
+			if forward {
+				edge.to = to
+				edges = append(edges, directedEdge{from, edge})
+			}
+			if backward {
+				edge.to = from
+				edges = append(edges, directedEdge{to, edge})
+			}
+		}
+	}
+
+	if len(edges) == 0 {
+		return nil, fmt.Errorf("extract contains no routable roads")
+	}
+
+	sort.SliceStable(edges, func(i, j int) bool { return edges[i].from < edges[j].from })
+	graph.offsets = make([]int32, len(graph.nodes)+1)
+	graph.edges = make([]roadEdge, len(edges))
+	for i, edge := range edges {
+		graph.edges[i] = edge.roadEdge
+		graph.offsets[edge.from+1]++
+	}
+	for i := 1; i < len(graph.offsets); i++ {
+		graph.offsets[i] += graph.offsets[i-1]
+	}
+
+	return graph, nil
+}
+
+// roadName is a way's street name, or its road number when it has none
+func roadName(tags map[string]string) string {
+	if name := tags["name"]; name != "" {
+		return name
+	}
+	return tags["ref"]
+}
+
+// wayDirections reports whether a way may be driven along and against its
+// node order
+func wayDirections(tags map[string]string) (forward, backward bool) {
+	switch tags["oneway"] {
+	case "yes", "true", "1":
+		return true, false
+	case "-1", "reverse":
+		return false, true
+	case "no", "false", "0":
+		return true, true
+	}
+	if tags["junction"] == "roundabout" || tags["highway"] == "motorway" || tags["highway"] == "motorway_link" {
+		return true, false
+	}
+	return true, true
+}
+
+// parseMaxSpeed reads an OSM maxspeed value such as "50" or "30 mph" into
+// km/h, returning 0 for missing or symbolic values
+func parseMaxSpeed(value string) float64 {
+	var speed float64
+	var unit string
+	if n, _ := fmt.Sscanf(value, "%g %s", &speed, &unit); n == 0 || speed <= 0 {
+		return 0
+	}
+	if unit == "mph" {
+		return speed * 1.609344
+	}
+	return speed
+}
+
+type roadQueueItem struct {
+	node     int32
+	priority float64
+}
+
+type roadQueue []roadQueueItem
+
+func (q roadQueue) Len() int            { return len(q) }
+func (q roadQueue) Less(i, j int) bool  { return q[i].priority < q[j].priority }
+func (q roadQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *roadQueue) Push(x interface{}) { *q = append(*q, x.(roadQueueItem)) }
+func (q *roadQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
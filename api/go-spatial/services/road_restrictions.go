@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-spatial/models"
+)
+
+// Roads a request asks to avoid cost this many times their travel time, so
+// they are used only when the alternative is much slower
+const avoidPenalty = 10.0
+
+// Preferences reported when a route cannot honour them
+const (
+	PreferenceAvoidTolls    = "avoid_tolls"
+	PreferenceAvoidHighways = "avoid_highways"
+)
+
+// RoadOptions are the per-request preferences and vehicle limits applied
+// when routing along roads
+type RoadOptions struct {
+	AvoidTolls    bool
+	AvoidHighways bool
+	Limits        VehicleLimits
+}
+
+// VehicleLimits exclude roads the vehicle may not use
+type VehicleLimits struct {
+	Height float64 // meters, 0 when not given
+	Weight float64 // tonnes, 0 when not given
+	Hazmat bool    // carries hazardous goods
+}
+
+// ParseRestrictions reads vehicle restrictions of the form "height:4.1"
+// (meters), "weight:18" (tonnes) and "hazmat"
+func ParseRestrictions(restrictions []string) (VehicleLimits, error) {
+	var limits VehicleLimits
+	for _, restriction := range restrictions {
+		name, value, hasValue := strings.Cut(strings.ToLower(strings.TrimSpace(restriction)), ":")
+		switch name {
+		case "hazmat":
+			if hasValue {
+				return VehicleLimits{}, fmt.Errorf("restriction %q takes no value", restriction)
+			}
+			limits.Hazmat = true
+		case "height", "weight":
+			number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if !hasValue || err != nil || number <= 0 {
+				return VehicleLimits{}, fmt.Errorf("restriction %q needs a positive number", restriction)
+			}
+			if name == "height" {
+				limits.Height = number
+			} else {
+				limits.Weight = number
+			}
+		default:
+			return VehicleLimits{}, fmt.Errorf("unknown restriction %q; use height:<m>, weight:<t> or hazmat", restriction)
+		}
+	}
+	return limits, nil
+}
+
+// roadOptions combines a request's preferences and vehicle restrictions
+func roadOptions(preferences models.RoutePreferences, restrictions []string) (RoadOptions, error) {
+	limits, err := ParseRestrictions(restrictions)
+	if err != nil {
+		return RoadOptions{}, err
+	}
+	return RoadOptions{
+		AvoidTolls:    preferences.AvoidTolls,
+		AvoidHighways: preferences.AvoidHighways,
+		Limits:        limits,
+	}, nil
+}
+
+// cost is the search cost of an edge in seconds, with avoided roads
+// penalised, and whether the vehicle may use it at all
+func (o RoadOptions) cost(edge roadEdge, profile SpeedProfile) (float64, bool) {
+	speed := profile.speed(edge)
+	if speed <= 0 || !o.Limits.allows(edge) {
+		return 0, false
+	}
+
+	cost := edge.distance / (speed / 3.6)
+	if o.AvoidTolls && edge.toll {
+		cost *= avoidPenalty
+	}
+	if o.AvoidHighways && isHighway(edge.class) {
+		cost *= avoidPenalty
+	}
+	return cost, true
+}
+
+func (l VehicleLimits) allows(edge roadEdge) bool {
+	if l.Hazmat && edge.noHazmat {
+		return false
+	}
+	if l.Height > 0 && edge.height > 0 && l.Height > edge.height {
+		return false
+	}
+	if l.Weight > 0 && edge.weight > 0 && l.Weight > edge.weight {
+		return false
+	}
+	return true
+}
+
+func (l VehicleLimits) any() bool {
+	return l.Hazmat || l.Height > 0 || l.Weight > 0
+}
+
+// suffix explains an unreachable stop when restrictions may be the cause
+func (l VehicleLimits) suffix() string {
+	if l.any() {
+		return " within the vehicle restrictions"
+	}
+	return ""
+}
+
+// unsatisfiedPreferences lists what a route could not honour. Without a
+// road network nothing can be checked, so every requested preference and
+// restriction is reported.
+func unsatisfiedPreferences(options RoadOptions, restrictions []string, onRoads, tolls, highways bool) []models.UnsatisfiedPreference {
+	var unsatisfied []models.UnsatisfiedPreference
+
+	if !onRoads {
+		const reason = "no road network is loaded"
+		if options.AvoidTolls {
+			unsatisfied = append(unsatisfied, models.UnsatisfiedPreference{Preference: PreferenceAvoidTolls, Reason: reason})
+		}
+		if options.AvoidHighways {
+			unsatisfied = append(unsatisfied, models.UnsatisfiedPreference{Preference: PreferenceAvoidHighways, Reason: reason})
+		}
+		for _, restriction := range restrictions {
+			unsatisfied = append(unsatisfied, models.UnsatisfiedPreference{Preference: restriction, Reason: reason})
+		}
+		return unsatisfied
+	}
+
+	if options.AvoidTolls && tolls {
+		unsatisfied = append(unsatisfied, models.UnsatisfiedPreference{
+			Preference: PreferenceAvoidTolls,
+			Reason:     "no route between the stops avoids toll roads",
+		})
+	}
+	if options.AvoidHighways && highways {
+		unsatisfied = append(unsatisfied, models.UnsatisfiedPreference{
+			Preference: PreferenceAvoidHighways,
+			Reason:     "no route between the stops avoids highways",
+		})
+	}
+	return unsatisfied
+}
+
+// isHighway reports whether a road class counts as a highway for
+// avoid_highways
+func isHighway(class string) bool {
+	switch class {
+	case "motorway", "motorway_link", "trunk", "trunk_link":
+		return true
+	}
+	return false
+}
+
+// parseMaxHeight reads an OSM maxheight value such as "4.2", "4.2 m" or
+// "14'6\"" into meters, returning 0 for missing or symbolic values
+func parseMaxHeight(value string) float64 {
+	value = strings.TrimSpace(value)
+	if feet, rest, imperial := strings.Cut(value, "'"); imperial {
+		ft, err := strconv.ParseFloat(strings.TrimSpace(feet), 64)
+		if err != nil {
+			return 0
+		}
+		in, _ := strconv.ParseFloat(strings.Trim(strings.TrimSpace(rest), `"`), 64)
+		return (ft*12 + in) * 0.0254
+	}
+
+	meters, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "m")), 64)
+	if err != nil || meters <= 0 {
+		return 0
+	}
+	return meters
+}
+
+// parseMaxWeight reads an OSM maxweight value such as "7.5", "7.5 t" or
+// "12000 kg" into tonnes, returning 0 for missing or symbolic values
+func parseMaxWeight(value string) float64 {
+	var weight float64
+	var unit string
+	if n, _ := fmt.Sscanf(value, "%g %s", &weight, &unit); n == 0 || weight <= 0 {
+		return 0
+	}
+	switch unit {
+	case "kg":
+		return weight / 1000
+	case "lbs":
+		return weight * 0.000453592
+	case "st": // US short tons
+		return weight * 0.907185
+	}
+	return weight
+}
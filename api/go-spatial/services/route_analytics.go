@@ -0,0 +1,430 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"go-spatial/geometry"
+	"go-spatial/models"
+)
+
+// Traffic observations within this many meters of a driven trace count
+// towards its traffic delay
+const traceTrafficRadius = 250.0
+
+// routeHistoryRow is one stored route joined with the aggregate of its trace
+type routeHistoryRow struct {
+	RouteID         string
+	DriverID        string
+	RouteType       string
+	VehicleType     string
+	CreatedAt       time.Time
+	PlannedDistance float64
+	PlannedDuration float64
+	PlannedFuel     float64
+	NaiveDistance   float64
+	NaiveDuration   float64
+	NaiveFuel       float64
+	CalculationTime int64
+	TracePoints     int
+	ActualDistance  float64
+	ActualDuration  float64
+	TraceStart      time.Time
+	TraceEnd        time.Time
+	// TrafficDelay is the delay in seconds the traffic observed along the
+	// trace while it was driven accounts for
+	TrafficDelay float64
+}
+
+// GetRouteDriverID returns the driver a stored route was planned for
+func (s *RouteService) GetRouteDriverID(routeID string) (string, error) {
+	var driverID string
+	err := s.db.QueryRow(`SELECT driver_id FROM routes WHERE id = $1`, routeID).Scan(&driverID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("route not found")
+		}
+		return "", fmt.Errorf("failed to get route: %w", err)
+	}
+	return driverID, nil
+}
+
+// RecordTrace stores positions driven while following a stored route
+func (s *RouteService) RecordTrace(routeID string, points []models.Location) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var driverID string
+	err = tx.QueryRow(`SELECT driver_id FROM routes WHERE id = $1`, routeID).Scan(&driverID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("route not found")
+		}
+		return 0, fmt.Errorf("failed to get route: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO route_traces (route_id, driver_id, location, speed, recorded_at)
+		VALUES ($1, $2, ST_SetSRID(ST_Point($3, $4), 4326), $5, $6)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare trace insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, point := range points {
+		recordedAt := time.Now()
+		if point.Timestamp > 0 {
+			recordedAt = time.Unix(point.Timestamp, 0)
+		}
+
+		if _, err := stmt.Exec(routeID, driverID, point.Longitude, point.Latitude, point.Speed, recordedAt); err != nil {
+			return 0, fmt.Errorf("failed to record trace point: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit route trace: %w", err)
+	}
+
+	return len(points), nil
+}
+
+// GetRouteAnalytics aggregates stored routes and their traces between since
+// and until, overall, per driver and per day/week/month
+func (s *RouteService) GetRouteAnalytics(driverID *string, since, until time.Time, period string) (*models.RouteAnalytics, error) {
+	query := `
+		SELECT
+			r.id,
+			r.driver_id,
+			r.route_type,
+			COALESCE(r.vehicle_type, ''),
+			r.created_at,
+			r.total_distance,
+			r.total_duration,
+			r.estimated_fuel,
+			r.naive_distance,
+			r.naive_duration,
+			r.naive_fuel,
+			r.calculation_time_ms,
+			COALESCE(t.points, 0),
+			COALESCE(t.actual_distance, 0),
+			COALESCE(t.actual_duration, 0),
+			t.trace_start,
+			t.trace_end
+		FROM routes r
+		LEFT JOIN LATERAL (
+			SELECT
+				COUNT(*) as points,
+				ST_Length(ST_MakeLine(rt.location ORDER BY rt.recorded_at)::geography) as actual_distance,
+				EXTRACT(EPOCH FROM MAX(rt.recorded_at) - MIN(rt.recorded_at)) as actual_duration,
+				MIN(rt.recorded_at) as trace_start,
+				MAX(rt.recorded_at) as trace_end
+			FROM route_traces rt
+			WHERE rt.route_id = r.id
+		) t ON true
+		WHERE r.created_at >= $1 AND r.created_at < $2
+	`
+
+	args := []interface{}{since, until}
+	if driverID != nil {
+		query += " AND r.driver_id = $3"
+		args = append(args, *driverID)
+	}
+	query += " ORDER BY r.created_at"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query route history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make([]routeHistoryRow, 0)
+
+	for rows.Next() {
+		var row routeHistoryRow
+		var traceStart, traceEnd sql.NullTime
+
+		if err := rows.Scan(
+			&row.RouteID,
+			&row.DriverID,
+			&row.RouteType,
+			&row.VehicleType,
+			&row.CreatedAt,
+			&row.PlannedDistance,
+			&row.PlannedDuration,
+			&row.PlannedFuel,
+			&row.NaiveDistance,
+			&row.NaiveDuration,
+			&row.NaiveFuel,
+			&row.CalculationTime,
+			&row.TracePoints,
+			&row.ActualDistance,
+			&row.ActualDuration,
+			&traceStart,
+			&traceEnd,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan route history: %w", err)
+		}
+		row.TraceStart = traceStart.Time
+		row.TraceEnd = traceEnd.Time
+
+		history = append(history, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read route history: %w", err)
+	}
+	rows.Close()
+
+	for i := range history {
+		if history[i].TracePoints < 2 {
+			continue
+		}
+		delay, err := s.traceTrafficDelay(history[i])
+		if err != nil {
+			return nil, err
+		}
+		history[i].TrafficDelay = delay
+	}
+
+	return s.aggregateRouteHistory(history, since, until, period), nil
+}
+
+// traceTrafficDelay runs the traffic observed along a driven trace, from
+// shortly before it started until it ended, through the corridor model
+func (s *RouteService) traceTrafficDelay(row routeHistoryRow) (float64, error) {
+	rows, err := s.db.Query(`
+		SELECT ST_Y(location), ST_X(location)
+		FROM route_traces
+		WHERE route_id = $1
+		ORDER BY recorded_at
+	`, row.RouteID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query route trace: %w", err)
+	}
+	defer rows.Close()
+
+	var points []models.Location
+	for rows.Next() {
+		var point models.Location
+		if err := rows.Scan(&point.Latitude, &point.Longitude); err != nil {
+			return 0, fmt.Errorf("failed to scan route trace: %w", err)
+		}
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read route trace: %w", err)
+	}
+	if len(points) < 2 {
+		return 0, nil
+	}
+
+	observations, err := s.corridorTraffic(points, traceTrafficRadius, row.TraceStart.Add(-trafficMaxAge), row.TraceEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	traffic := RouteCorridorTraffic(points, observations, traceTrafficRadius, s.getAverageSpeedForVehicle(row.VehicleType))
+	return float64(traffic.TotalDelay), nil
+}
+
+// Helper methods
+
+func (s *RouteService) saveRoute(record routeRecord) (string, error) {
+	waypointsJSON, err := json.Marshal(record.Route.Waypoints)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal waypoints: %w", err)
+	}
+
+	driverID := record.DriverID
+	if driverID == "" {
+		driverID = "unknown"
+	}
+
+	query := `
+		INSERT INTO routes (
+			driver_id, route_type, vehicle_type, optimize_for, waypoints, geometry,
+			total_distance, total_duration, estimated_fuel,
+			naive_distance, naive_duration, naive_fuel, calculation_time_ms
+		)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, ST_GeomFromText($6, 4326),
+			$7, $8, $9, $10, $11, $12, $13)
+		RETURNING id
+	`
+
+	// Store the road path when the route follows one
+	path := record.Route.Waypoints
+	if len(record.Route.Geometry) >= 2 {
+		path = record.Route.Geometry
+	}
+
+	var routeID string
+	err = s.db.QueryRow(query,
+		driverID,
+		record.RouteType,
+		record.VehicleType,
+		record.OptimizeFor,
+		waypointsJSON,
+		buildRouteLineStringWKT(path),
+		record.Route.TotalDistance,
+		record.Route.TotalDuration,
+		record.Route.EstimatedFuel,
+		record.NaiveDistance,
+		record.NaiveDuration,
+		record.NaiveFuel,
+		record.CalculationTime,
+	).Scan(&routeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to save route: %w", err)
+	}
+
+	return routeID, nil
+}
+
+func (s *RouteService) aggregateRouteHistory(history []routeHistoryRow, since, until time.Time, period string) *models.RouteAnalytics {
+	type accumulator struct {
+		totals           models.RouteAnalyticsTotals
+		drivingSeconds   float64
+		optimizationTime int64
+	}
+
+	overall := &accumulator{}
+	byDriver := make(map[string]*accumulator)
+	byPeriod := make(map[time.Time]*accumulator)
+
+	dataPoints := 0
+
+	for _, row := range history {
+		periodStart := truncateToPeriod(row.CreatedAt, period)
+
+		if byDriver[row.DriverID] == nil {
+			byDriver[row.DriverID] = &accumulator{}
+		}
+		if byPeriod[periodStart] == nil {
+			byPeriod[periodStart] = &accumulator{}
+		}
+
+		// Driven distance and duration win over planned values once a trace
+		// with at least two points exists
+		distance := row.PlannedDistance
+		duration := row.PlannedDuration
+		fuel := row.PlannedFuel
+		traced := row.TracePoints >= 2
+		if traced {
+			distance = row.ActualDistance
+			duration = row.ActualDuration
+			fuel = s.calculateFuelConsumption(row.ActualDistance, row.VehicleType)
+		}
+
+		dataPoints += 1 + row.TracePoints
+
+		for _, acc := range []*accumulator{overall, byDriver[row.DriverID], byPeriod[periodStart]} {
+			t := &acc.totals
+			t.TotalRoutes++
+			t.TotalDistanceKm += distance / 1000.0
+			t.TotalDurationHours += duration / 3600.0
+			t.FuelConsumptionLiters += fuel
+			acc.drivingSeconds += duration
+
+			if row.RouteType == "optimized" {
+				t.RoutesOptimized++
+				t.OptimizationSavings.DistanceSavedKm += (row.NaiveDistance - row.PlannedDistance) / 1000.0
+				t.OptimizationSavings.TimeSavedHours += (row.NaiveDuration - row.PlannedDuration) / 3600.0
+				t.OptimizationSavings.FuelSavedLiters += row.NaiveFuel - row.PlannedFuel
+				acc.optimizationTime += row.CalculationTime
+			}
+
+			// Traffic delay is credited from observations along the trace;
+			// time driven beyond the plan is reported apart as overrun
+			if traced {
+				t.TracedRoutes++
+				if row.TrafficDelay > 0 {
+					t.TrafficDelayMinutes += row.TrafficDelay / 60.0
+					t.DelayedRoutes++
+				}
+				if overrun := row.ActualDuration - row.PlannedDuration; overrun > 0 {
+					t.OverrunMinutes += overrun / 60.0
+				}
+			}
+		}
+	}
+
+	finalize := func(acc *accumulator) models.RouteAnalyticsTotals {
+		t := acc.totals
+		if acc.drivingSeconds > 0 {
+			t.AverageSpeedKmh = t.TotalDistanceKm / (acc.drivingSeconds / 3600.0)
+		}
+		if t.RoutesOptimized > 0 {
+			t.AverageOptimizationTimeMs = float64(acc.optimizationTime) / float64(t.RoutesOptimized)
+		}
+		return t
+	}
+
+	analytics := &models.RouteAnalytics{
+		Since:      since,
+		Until:      until,
+		Period:     period,
+		Totals:     finalize(overall),
+		ByDriver:   make([]models.DriverRouteAnalytics, 0, len(byDriver)),
+		ByPeriod:   make([]models.PeriodRouteAnalytics, 0, len(byPeriod)),
+		DataPoints: dataPoints,
+	}
+
+	for driverID, acc := range byDriver {
+		analytics.ByDriver = append(analytics.ByDriver, models.DriverRouteAnalytics{
+			DriverID: driverID,
+			Totals:   finalize(acc),
+		})
+	}
+	sort.Slice(analytics.ByDriver, func(i, j int) bool {
+		return analytics.ByDriver[i].DriverID < analytics.ByDriver[j].DriverID
+	})
+
+	for periodStart, acc := range byPeriod {
+		analytics.ByPeriod = append(analytics.ByPeriod, models.PeriodRouteAnalytics{
+			PeriodStart: periodStart,
+			Totals:      finalize(acc),
+		})
+	}
+	sort.Slice(analytics.ByPeriod, func(i, j int) bool {
+		return analytics.ByPeriod[i].PeriodStart.Before(analytics.ByPeriod[j].PeriodStart)
+	})
+
+	return analytics
+}
+
+func truncateToPeriod(t time.Time, period string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case "week":
+		// ISO weeks start on Monday
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func buildRouteLineStringWKT(points []models.Location) string {
+	if len(points) < 2 {
+		return "LINESTRING EMPTY"
+	}
+
+	line := make(geometry.LineString, len(points))
+	for i, point := range points {
+		line[i] = geometry.Position{point.Longitude, point.Latitude}
+	}
+
+	return geometry.WKT(line)
+}
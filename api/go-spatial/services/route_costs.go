@@ -0,0 +1,361 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Traffic observations count for a leg when they are within this many
+// meters of its start, middle or end
+const trafficLegRadius = 1000.0
+
+// Only observations this recent are used to price legs
+const trafficMaxAge = 30 * time.Minute
+
+// Legs shorter than this run below cruising speed
+const cruiseDistance = 10000.0
+
+// TrafficObservation is an average speed reported at a location
+type TrafficObservation struct {
+	Location   models.Location
+	Speed      float64 // km/h
+	Congestion float64 // 0.0 to 1.0, when known
+}
+
+// LegCosts holds the distance in meters, duration in seconds and fuel in
+// liters of every leg between a set of stops
+type LegCosts struct {
+	Distances [][]float64
+	Durations [][]float64
+	Fuel      [][]float64
+
+	// Legs priced along the road network record whether they use toll
+	// roads or highways
+	onRoads  bool
+	tolls    [][]bool
+	highways [][]bool
+
+	// Inputs for pricing the legs at other times
+	stops   []models.Location
+	traffic *TrafficConditions
+	cruise  float64
+	free    [][]float64 // km/h without traffic data
+}
+
+// LegCosts prices every leg between the stops for a vehicle leaving at the
+// given time. A leg's speed is the traffic predicted near it, capped at the
+// vehicle's speed; without traffic data it follows the vehicle's speed
+// profile, which is slower on short legs. Fuel use per kilometer rises away
+// from economical speeds, so time, distance and fuel each rank routes
+// differently.
+//
+// With a road graph loaded, legs follow the fastest road path that honours
+// the options, and traffic can only slow them down.
+func (s *RouteService) LegCosts(stops []models.Location, traffic *TrafficConditions, vehicleType string, options RoadOptions, departure time.Time) (LegCosts, error) {
+	n := len(stops)
+	legs := LegCosts{
+		Fuel:    make([][]float64, n),
+		stops:   stops,
+		traffic: traffic,
+		cruise:  s.getAverageSpeedForVehicle(vehicleType),
+		free:    make([][]float64, n),
+	}
+
+	var roads [][]RoadPath
+	if s.roadGraph != nil {
+		var err error
+		roads, err = s.roadGraph.Matrix(stops, s.SpeedProfile(vehicleType), options)
+		if err != nil {
+			return LegCosts{}, err
+		}
+		legs.onRoads = true
+		legs.Distances = make([][]float64, n)
+		legs.tolls = make([][]bool, n)
+		legs.highways = make([][]bool, n)
+		for i := range stops {
+			legs.Distances[i] = make([]float64, n)
+			legs.tolls[i] = make([]bool, n)
+			legs.highways[i] = make([]bool, n)
+			for j, path := range roads[i] {
+				legs.Distances[i][j] = path.Distance
+				legs.tolls[i][j] = path.Tolls
+				legs.highways[i][j] = path.Highways
+			}
+		}
+	} else {
+		distances, _, err := s.distances(stops, stops, s.matrixSettings.Method)
+		if err != nil {
+			return LegCosts{}, err
+		}
+		legs.Distances = distances
+	}
+
+	for i := range stops {
+		legs.free[i] = make([]float64, n)
+		for j := range stops {
+			if distance := legs.Distances[i][j]; i != j && distance > 0 {
+				if roads != nil {
+					legs.free[i][j] = distance / roads[i][j].Duration * 3.6
+				} else {
+					legs.free[i][j] = profileSpeed(legs.cruise, distance)
+				}
+			}
+		}
+	}
+
+	legs.Durations = legs.DurationsAt(departure)
+	for i := range stops {
+		legs.Fuel[i] = make([]float64, n)
+		for j := range stops {
+			if duration := legs.Durations[i][j]; duration > 0 {
+				distance := legs.Distances[i][j]
+				speed := (distance / 1000.0) / (duration / 3600)
+				legs.Fuel[i][j] = s.calculateFuelConsumption(distance, vehicleType) * fuelSpeedFactor(speed)
+			}
+		}
+	}
+
+	return legs, nil
+}
+
+// DurationsAt returns the travel seconds of every leg entered at the given
+// time
+func (l LegCosts) DurationsAt(at time.Time) [][]float64 {
+	durations := make([][]float64, len(l.stops))
+	for i := range l.stops {
+		durations[i] = make([]float64, len(l.stops))
+		for j := range l.stops {
+			if speed := l.speed(i, j, at); speed > 0 {
+				durations[i][j] = (l.Distances[i][j] / 1000.0) / speed * 3600
+			}
+		}
+	}
+	return durations
+}
+
+// HourlyDurations returns the leg durations for legs entered in each hour
+// after the start, or nil when there is no traffic data to vary them
+func (l LegCosts) HourlyDurations(start time.Time, hours int) [][][]float64 {
+	if l.traffic.empty() || hours < 2 {
+		return nil
+	}
+
+	hourly := make([][][]float64, hours)
+	for hour := range hourly {
+		hourly[hour] = l.DurationsAt(start.Add(time.Duration(hour) * time.Hour))
+	}
+	return hourly
+}
+
+// speed is the average km/h on a leg entered at the given time, 0 for legs
+// of no length
+func (l LegCosts) speed(i, j int, at time.Time) float64 {
+	free := l.free[i][j]
+	if free == 0 {
+		return 0
+	}
+
+	observed, ok := l.traffic.speedAlong(l.stops[i], l.stops[j], at)
+	switch {
+	case !ok:
+		return free
+	case l.onRoads:
+		return math.Min(free, observed)
+	default:
+		return math.Min(observed, l.cruise)
+	}
+}
+
+// Objective returns the matrix the solver minimises for an objective
+func (l LegCosts) Objective(optimizeFor string) [][]float64 {
+	switch optimizeFor {
+	case OptimizeForDistance:
+		return l.Distances
+	case OptimizeForFuel:
+		return l.Fuel
+	default:
+		return l.Durations
+	}
+}
+
+// RouteMetrics returns the distance, duration and fuel of visiting the stops
+// in order
+func (l LegCosts) RouteMetrics(order []int) (float64, float64, float64) {
+	var distance, duration, fuel float64
+	for i := 0; i+1 < len(order); i++ {
+		from, to := order[i], order[i+1]
+		distance += l.Distances[from][to]
+		duration += l.Durations[from][to]
+		fuel += l.Fuel[from][to]
+	}
+	return distance, duration, fuel
+}
+
+// Along returns the distance and duration of each leg when visiting the
+// stops in order
+func (l LegCosts) Along(order []int) ([]float64, []float64) {
+	distances := make([]float64, 0, len(order))
+	durations := make([]float64, 0, len(order))
+	for i := 0; i+1 < len(order); i++ {
+		distances = append(distances, l.Distances[order[i]][order[i+1]])
+		durations = append(durations, l.Durations[order[i]][order[i+1]])
+	}
+	return distances, durations
+}
+
+// Unsatisfied lists the preferences and restrictions that visiting the stops
+// in order does not honour
+func (l LegCosts) Unsatisfied(order []int, options RoadOptions, restrictions []string) []models.UnsatisfiedPreference {
+	var tolls, highways bool
+	if l.onRoads {
+		for i := 0; i+1 < len(order); i++ {
+			tolls = tolls || l.tolls[order[i]][order[i+1]]
+			highways = highways || l.highways[order[i]][order[i+1]]
+		}
+	}
+	return unsatisfiedPreferences(options, restrictions, l.onRoads, tolls, highways)
+}
+
+// recentTraffic loads the traffic observations of the last 30 minutes
+// around the stops
+func (s *RouteService) recentTraffic(stops []models.Location) ([]TrafficObservation, error) {
+	if len(stops) == 0 {
+		return nil, nil
+	}
+
+	minLng, minLat, maxLng, maxLat := trafficEnvelope(stops)
+	rows, err := s.db.Query(`
+		SELECT ST_Y(location), ST_X(location), average_speed
+		FROM traffic_data
+		WHERE location && ST_MakeEnvelope($1, $2, $3, $4, 4326)
+			AND timestamp > $5
+			AND average_speed > 0
+	`, minLng, minLat, maxLng, maxLat, time.Now().Add(-trafficMaxAge))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query traffic data: %w", err)
+	}
+	defer rows.Close()
+
+	observations := make([]TrafficObservation, 0)
+	for rows.Next() {
+		var observation TrafficObservation
+		if err := rows.Scan(&observation.Location.Latitude, &observation.Location.Longitude, &observation.Speed); err != nil {
+			return nil, fmt.Errorf("failed to scan traffic data: %w", err)
+		}
+		observations = append(observations, observation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read traffic data: %w", err)
+	}
+
+	return observations, nil
+}
+
+// legSpeed is the average speed in km/h over a leg entered at the given
+// time: the predicted traffic speed capped at cruise, or the speed profile
+// without traffic data
+func legSpeed(traffic *TrafficConditions, cruise float64, from, to models.Location, distance float64, at time.Time) float64 {
+	if speed, ok := traffic.speedAlong(from, to, at); ok {
+		return math.Min(speed, cruise)
+	}
+	return profileSpeed(cruise, distance)
+}
+
+// profileSpeed is the average speed over a leg without traffic data: short
+// legs run through junctions and starts at 60% of cruising speed, reaching
+// full speed at cruiseDistance
+func profileSpeed(cruise, distance float64) float64 {
+	share := math.Min(1, distance/cruiseDistance)
+	return cruise * (0.6 + 0.4*share)
+}
+
+// fuelSpeedFactor scales a vehicle's rated consumption: stop-and-go traffic
+// below 50 km/h costs up to 50% more, and drag adds 1% per km/h above 90
+func fuelSpeedFactor(speed float64) float64 {
+	factor := 1.0
+	if speed < 50 {
+		factor += 0.5 * (50 - speed) / 50
+	}
+	if speed > 90 {
+		factor += 0.01 * (speed - 90)
+	}
+	return factor
+}
+
+// trafficGrid buckets observations into cells of about trafficLegRadius
+type trafficGrid map[[2]int][]TrafficObservation
+
+const trafficCellDegrees = 0.01
+
+func newTrafficGrid(observations []TrafficObservation) trafficGrid {
+	grid := make(trafficGrid)
+	for _, observation := range observations {
+		cell := trafficCell(observation.Location)
+		grid[cell] = append(grid[cell], observation)
+	}
+	return grid
+}
+
+func trafficCell(location models.Location) [2]int {
+	return [2]int{
+		int(math.Floor(location.Latitude / trafficCellDegrees)),
+		int(math.Floor(location.Longitude / trafficCellDegrees)),
+	}
+}
+
+// speedAlong averages the observations near the start, middle and end of a
+// leg
+func (g trafficGrid) speedAlong(from, to models.Location) (float64, bool) {
+	if len(g) == 0 {
+		return 0, false
+	}
+
+	middle := models.Location{
+		Latitude:  (from.Latitude + to.Latitude) / 2,
+		Longitude: (from.Longitude + to.Longitude) / 2,
+	}
+
+	var total float64
+	count := 0
+	for _, point := range []models.Location{from, middle, to} {
+		if speed, ok := g.speedNear(point); ok {
+			total += speed
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+
+	return total / float64(count), true
+}
+
+// speedNear averages the observations within trafficLegRadius of a point
+func (g trafficGrid) speedNear(point models.Location) (float64, bool) {
+	center := trafficCell(point)
+
+	// Longitude cells narrow towards the poles
+	cos := math.Max(math.Cos(point.Latitude*math.Pi/180), 0.01)
+	lngCells := int(math.Ceil(trafficLegRadius / (111320.0 * cos * trafficCellDegrees)))
+
+	var total float64
+	count := 0
+	for dLat := -1; dLat <= 1; dLat++ {
+		for dLng := -lngCells; dLng <= lngCells; dLng++ {
+			for _, observation := range g[[2]int{center[0] + dLat, center[1] + dLng}] {
+				if haversineDistance(point, observation.Location) <= trafficLegRadius {
+					total += observation.Speed
+					count++
+				}
+			}
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+
+	return total / float64(count), true
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go-spatial/models"
+)
+
+// OptimizeFleet plans one capacity-respecting route per vehicle, each
+// starting and ending at the vehicle's depot, and reports the stops no
+// vehicle could take
+func (s *RouteService) OptimizeFleet(request models.FleetOptimizationRequest) (*models.FleetOptimizationResponse, error) {
+	startTime := time.Now()
+
+	if len(request.Vehicles) == 0 {
+		return nil, fmt.Errorf("no vehicles provided")
+	}
+	if len(request.Stops) == 0 {
+		return nil, fmt.Errorf("no stops provided")
+	}
+
+	optimizeFor, err := resolveOptimizeFor(request.Preferences)
+	if err != nil {
+		return nil, err
+	}
+	options := s.solverOptions(request.Preferences)
+	roads := RoadOptions{
+		AvoidTolls:    request.Preferences.AvoidTolls,
+		AvoidHighways: request.Preferences.AvoidHighways,
+	}
+
+	// Nodes 0..len(Vehicles)-1 are the depots, the stops follow
+	nodes := make([]models.Location, 0, len(request.Vehicles)+len(request.Stops))
+	for _, vehicle := range request.Vehicles {
+		nodes = append(nodes, vehicle.Depot)
+	}
+	for _, stop := range request.Stops {
+		nodes = append(nodes, stop.Location)
+	}
+	traffic, err := s.trafficConditions(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Vehicles of one type share their leg costs
+	byType := make(map[string]LegCosts)
+
+	// Vehicles whose shift is over are left out of planning; specs maps
+	// each remaining vehicle to its problem vehicle
+	problem := FleetProblem{
+		Vehicles: make([]FleetVehicleSpec, 0, len(request.Vehicles)),
+		Stops:    make([]FleetStopSpec, len(request.Stops)),
+	}
+	specs := make(map[int]int, len(request.Vehicles))
+	excluded := make(map[int]string)
+	for i, vehicle := range request.Vehicles {
+		maxDuration, err := shiftSeconds(vehicle, startTime)
+		if err != nil {
+			excluded[i] = err.Error()
+			continue
+		}
+
+		legs, ok := byType[vehicle.Type]
+		if !ok {
+			legs, err = s.LegCosts(nodes, traffic, vehicle.Type, roads, startTime)
+			if err != nil {
+				return nil, err
+			}
+			byType[vehicle.Type] = legs
+		}
+
+		specs[i] = len(problem.Vehicles)
+		problem.Vehicles = append(problem.Vehicles, FleetVehicleSpec{
+			Depot:       i,
+			Capacity:    vehicle.Capacity,
+			MaxDuration: maxDuration,
+			Costs:       legs.Objective(optimizeFor),
+			Durations:   legs.Durations,
+		})
+	}
+	if len(problem.Vehicles) == 0 {
+		return nil, fmt.Errorf("no vehicle has shift time left")
+	}
+	for i, stop := range request.Stops {
+		problem.Stops[i] = FleetStopSpec{
+			Node:        len(request.Vehicles) + i,
+			Demand:      stop.Demand,
+			ServiceTime: float64(stop.ServiceTime),
+		}
+	}
+
+	solution := SolveFleet(problem, options)
+
+	response := &models.FleetOptimizationResponse{
+		Routes:     make([]models.FleetRoute, 0, len(request.Vehicles)),
+		Unassigned: make([]models.UnassignedStop, 0, len(solution.Unassigned)),
+	}
+	response.Summary.StoppedOnDeadline = solution.StoppedOnDeadline
+	records := make([]routeRecord, len(request.Vehicles))
+
+	for v, vehicle := range request.Vehicles {
+		var assigned []int
+		if spec, ok := specs[v]; ok {
+			assigned = solution.Routes[spec]
+		}
+		route := models.FleetRoute{
+			VehicleID: vehicle.ID,
+			DriverID:  vehicle.DriverID,
+			StopIDs:   make([]string, 0, len(assigned)),
+			Waypoints: make([]models.Location, 0, len(assigned)+2),
+			Capacity:  vehicle.Capacity,
+			Excluded:  excluded[v],
+		}
+
+		order := make([]int, 0, len(assigned)+2)
+		order = append(order, v)
+		route.Waypoints = append(route.Waypoints, vehicle.Depot)
+		serviceTime := 0
+		for _, stopIndex := range assigned {
+			stop := request.Stops[stopIndex]
+			order = append(order, problem.Stops[stopIndex].Node)
+			route.StopIDs = append(route.StopIDs, stop.ID)
+			route.Waypoints = append(route.Waypoints, stop.Location)
+			route.Load += stop.Demand
+			serviceTime += stop.ServiceTime
+		}
+
+		if len(assigned) > 0 {
+			order = append(order, v)
+			route.Waypoints = append(route.Waypoints, vehicle.Depot)
+
+			legs := byType[vehicle.Type]
+			totalDistance, totalDuration, estimatedFuel := legs.RouteMetrics(order)
+			route.TotalDistance = totalDistance
+			route.TotalDuration = int(totalDuration) + serviceTime
+			route.EstimatedFuel = estimatedFuel
+			route.UnsatisfiedPreferences = legs.Unsatisfied(order, roads, nil)
+
+			legDistances, legDurations := legs.Along(order)
+			var geometry []models.Location
+			route.Legs, geometry, err = s.routeLegs(route.Waypoints, legDistances, legDurations, vehicle.Type, roads)
+			if err != nil {
+				return nil, err
+			}
+
+			// Visiting the same stops in the order they were given is the
+			// baseline for reported savings, as in OptimizeRoute
+			naiveOrder := append([]int{}, order...)
+			sort.Ints(naiveOrder[1 : len(naiveOrder)-1])
+			naiveDistance, naiveDuration, naiveFuel := legs.RouteMetrics(naiveOrder)
+			records[v] = routeRecord{
+				DriverID:      vehicle.DriverID,
+				RouteType:     "optimized",
+				VehicleType:   vehicle.Type,
+				OptimizeFor:   optimizeFor,
+				NaiveDistance: naiveDistance,
+				NaiveDuration: int(naiveDuration) + serviceTime,
+				NaiveFuel:     naiveFuel,
+				Route:         models.OptimizedRoute{Geometry: geometry},
+			}
+
+			response.Summary.VehiclesUsed++
+			response.Summary.AssignedStops += len(assigned)
+			response.Summary.TotalDistance += route.TotalDistance
+			response.Summary.TotalDuration += route.TotalDuration
+			response.Summary.EstimatedFuel += route.EstimatedFuel
+		}
+
+		response.Routes = append(response.Routes, route)
+	}
+
+	for stopIndex := range request.Stops {
+		reason, ok := solution.Unassigned[stopIndex]
+		if !ok {
+			continue
+		}
+		response.Unassigned = append(response.Unassigned, models.UnassignedStop{
+			StopID:  request.Stops[stopIndex].ID,
+			Reason:  reason,
+			Details: unassignedDetails(reason, request.Stops[stopIndex]),
+		})
+	}
+
+	calculationTime := time.Since(startTime).Milliseconds()
+	response.Performance.CalculationTime = calculationTime
+
+	for i := range response.Routes {
+		route := &response.Routes[i]
+		if len(route.StopIDs) == 0 {
+			continue
+		}
+
+		record := records[i]
+		record.Route = models.OptimizedRoute{
+			Waypoints:     route.Waypoints,
+			TotalDistance: route.TotalDistance,
+			TotalDuration: route.TotalDuration,
+			EstimatedFuel: route.EstimatedFuel,
+			Geometry:      record.Route.Geometry,
+		}
+		record.CalculationTime = calculationTime
+
+		routeID, err := s.saveRoute(record)
+		if err != nil {
+			return nil, err
+		}
+		route.RouteID = routeID
+	}
+
+	return response, nil
+}
+
+// shiftSeconds is the time left in a vehicle's shift, zero when unlimited.
+// A shift that has not started yet counts from its start, any other from now.
+func shiftSeconds(vehicle models.FleetVehicle, now time.Time) (float64, error) {
+	if vehicle.ShiftEnd == nil {
+		return 0, nil
+	}
+	start := ShiftDeparture(vehicle, now)
+	if !vehicle.ShiftEnd.After(start) {
+		return 0, fmt.Errorf("shift of vehicle %s has already ended", vehicle.ID)
+	}
+	return vehicle.ShiftEnd.Sub(start).Seconds(), nil
+}
+
+// ShiftDeparture is when a vehicle can leave its depot: the shift start, or
+// now once the shift is under way
+func ShiftDeparture(vehicle models.FleetVehicle, now time.Time) time.Time {
+	if vehicle.ShiftStart != nil && vehicle.ShiftStart.After(now) {
+		return *vehicle.ShiftStart
+	}
+	return now
+}
+
+func unassignedDetails(reason string, stop models.FleetStop) string {
+	switch reason {
+	case UnassignedExceedsCapacity:
+		return fmt.Sprintf("demand %d is larger than the capacity of every vehicle", stop.Demand)
+	case UnassignedNoCapacityLeft:
+		return fmt.Sprintf("no vehicle has %d units of capacity left", stop.Demand)
+	case UnassignedOutsideShift:
+		return "no vehicle can reach the stop and return to its depot within its shift"
+	default:
+		return ""
+	}
+}
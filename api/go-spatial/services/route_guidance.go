@@ -0,0 +1,230 @@
+package services
+
+import (
+	"math"
+	"strconv"
+
+	"go-spatial/geometry"
+	"go-spatial/models"
+)
+
+// Bends sharper than this start a new maneuver even on the same road
+const maneuverTurnAngle = 45.0
+
+// Segments shorter than this have no usable bearing
+const minSegmentDistance = 0.5 // meters
+
+// routeLegs describes the path between each pair of consecutive waypoints.
+// Distances and durations come from the priced legs; geometry and
+// maneuvers follow the road network when one is loaded and are straight
+// lines otherwise. The whole road path is returned alongside, or nil
+// without a road network.
+func (s *RouteService) routeLegs(waypoints []models.Location, distances, durations []float64, vehicleType string, options RoadOptions) ([]models.RouteLeg, []models.Location, error) {
+	legs := make([]models.RouteLeg, 0, len(waypoints)-1)
+	var geometry []models.Location
+
+	for i := 0; i+1 < len(waypoints); i++ {
+		from, to := waypoints[i], waypoints[i+1]
+		points := []models.Location{from, to}
+		segments := []RoadSegment{{From: from, To: to, Distance: distances[i], Duration: durations[i]}}
+
+		if s.roadGraph != nil {
+			path, err := s.roadGraph.Route(from, to, s.SpeedProfile(vehicleType), options)
+			if err != nil {
+				return nil, nil, err
+			}
+			points, segments = path.Geometry, path.Segments
+			if len(geometry) > 0 {
+				geometry = append(geometry, plainLocations(points[1:])...)
+			} else {
+				geometry = plainLocations(points)
+			}
+		}
+
+		legs = append(legs, buildLeg(points, segments, distances[i], durations[i], i+1))
+	}
+
+	return legs, geometry, nil
+}
+
+// Leg describes the path as a route leg ending at the given stop number
+func (p *RoadPath) Leg(stop int) models.RouteLeg {
+	return buildLeg(p.Geometry, p.Segments, p.Distance, p.Duration, stop)
+}
+
+// buildLeg describes one leg ending at the given stop number
+func buildLeg(points []models.Location, segments []RoadSegment, distance, duration float64, stop int) models.RouteLeg {
+	points = plainLocations(points)
+	return models.RouteLeg{
+		Distance:  distance,
+		Duration:  int(duration),
+		Polyline:  EncodePolyline(points),
+		Geometry:  lineString(points),
+		Maneuvers: maneuvers(segments, duration, stop),
+	}
+}
+
+// maneuvers turns a leg's segments into driving instructions. Segment
+// durations are scaled to add up to the leg's duration, which may include
+// traffic the segments do not.
+func maneuvers(segments []RoadSegment, duration float64, stop int) []models.RouteManeuver {
+	driven := make([]RoadSegment, 0, len(segments))
+	var segmentTime float64
+	for _, segment := range segments {
+		if segment.Distance >= minSegmentDistance {
+			driven = append(driven, segment)
+			segmentTime += segment.Duration
+		}
+	}
+
+	arrive := models.RouteManeuver{
+		Type:        "arrive",
+		Instruction: "Arrive at stop " + strconv.Itoa(stop),
+	}
+	if len(segments) > 0 {
+		arrive.Location = plainLocation(segments[len(segments)-1].To)
+	}
+	if len(driven) == 0 {
+		return []models.RouteManeuver{arrive}
+	}
+
+	scale := 1.0
+	if segmentTime > 0 {
+		scale = duration / segmentTime
+	}
+
+	first := driven[0]
+	result := []models.RouteManeuver{{
+		Type:     "depart",
+		Road:     first.Road,
+		Location: plainLocation(first.From),
+	}}
+	result[0].Instruction = "Head " + compassDirection(bearing(first.From, first.To))
+	if first.Road != "" {
+		result[0].Instruction += " on " + first.Road
+	}
+
+	var elapsed float64
+	for i, segment := range driven {
+		current := &result[len(result)-1]
+		if i > 0 {
+			angle := turnAngle(bearing(driven[i-1].From, driven[i-1].To), bearing(segment.From, segment.To))
+			renamed := segment.Road != "" && segment.Road != current.Road
+			if renamed || math.Abs(angle) > maneuverTurnAngle {
+				current.Duration = int(math.Round(elapsed * scale))
+				elapsed = 0
+				result = append(result, turnManeuver(segment, angle))
+				current = &result[len(result)-1]
+			}
+		}
+		current.Distance += segment.Distance
+		elapsed += segment.Duration
+	}
+	result[len(result)-1].Duration = int(math.Round(elapsed * scale))
+
+	return append(result, arrive)
+}
+
+func turnManeuver(segment RoadSegment, angle float64) models.RouteManeuver {
+	maneuver := models.RouteManeuver{
+		Type:     "turn",
+		Modifier: turnModifier(angle),
+		Road:     segment.Road,
+		Location: plainLocation(segment.From),
+	}
+
+	switch maneuver.Modifier {
+	case "straight":
+		maneuver.Type = "continue"
+		maneuver.Instruction = "Continue straight"
+		if segment.Road != "" {
+			maneuver.Instruction = "Continue onto " + segment.Road
+		}
+		return maneuver
+	case "uturn":
+		maneuver.Instruction = "Make a U-turn"
+	default:
+		maneuver.Instruction = "Turn " + maneuver.Modifier
+	}
+	if segment.Road != "" {
+		maneuver.Instruction += " onto " + segment.Road
+	}
+	return maneuver
+}
+
+// turnModifier names a change of heading in degrees, positive to the right
+func turnModifier(angle float64) string {
+	side := "right"
+	if angle < 0 {
+		side = "left"
+	}
+	switch magnitude := math.Abs(angle); {
+	case magnitude < 20:
+		return "straight"
+	case magnitude < maneuverTurnAngle:
+		return "slight " + side
+	case magnitude < 135:
+		return side
+	case magnitude < 170:
+		return "sharp " + side
+	default:
+		return "uturn"
+	}
+}
+
+// bearing is the initial compass bearing from one point to another in
+// degrees
+func bearing(from, to models.Location) float64 {
+	toRadians := math.Pi / 180
+	lat1, lat2 := from.Latitude*toRadians, to.Latitude*toRadians
+	dLng := (to.Longitude - from.Longitude) * toRadians
+
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)/toRadians+360, 360)
+}
+
+// turnAngle is the change from one bearing to the next in (-180, 180]
+func turnAngle(from, to float64) float64 {
+	angle := math.Mod(to-from+540, 360) - 180
+	if angle == -180 {
+		return 180
+	}
+	return angle
+}
+
+func compassDirection(bearing float64) string {
+	directions := []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest"}
+	return directions[int(math.Round(bearing/45))%8]
+}
+
+// EncodePolyline encodes points in Google's polyline format with five
+// decimal places
+func EncodePolyline(points []models.Location) string {
+	positions := make([]geometry.Position, len(points))
+	for i, point := range points {
+		positions[i] = geometry.Position{point.Longitude, point.Latitude}
+	}
+	return geometry.EncodePolyline(positions)
+}
+
+func lineString(points []models.Location) models.GeoJSONLineString {
+	coordinates := make([][]float64, len(points))
+	for i, point := range points {
+		coordinates[i] = []float64{point.Longitude, point.Latitude}
+	}
+	return models.GeoJSONLineString{Type: "LineString", Coordinates: coordinates}
+}
+
+// plainLocation drops everything but the coordinates of a location
+func plainLocation(location models.Location) models.Location {
+	return models.Location{Latitude: location.Latitude, Longitude: location.Longitude}
+}
+
+func plainLocations(locations []models.Location) []models.Location {
+	plain := make([]models.Location, len(locations))
+	for i, location := range locations {
+		plain[i] = plainLocation(location)
+	}
+	return plain
+}
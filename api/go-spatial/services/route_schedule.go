@@ -0,0 +1,262 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// StopWindow bounds when a stop may be reached, in seconds from the route
+// start, and how long serving it takes
+type StopWindow struct {
+	Earliest float64
+	Latest   float64 // math.Inf(1) when the stop has no deadline
+	Service  float64
+}
+
+// OpenWindow is a stop that may be reached at any time
+func OpenWindow(service float64) StopWindow {
+	return StopWindow{Latest: math.Inf(1), Service: service}
+}
+
+// StopTiming is when a route reaches and leaves one stop, in seconds from
+// the route start
+type StopTiming struct {
+	Arrival   float64
+	Wait      float64
+	Departure float64
+	// Slack is how much later the stop could be reached without missing
+	// its window or a later one; +Inf when no window limits it
+	Slack float64
+	Late  float64
+}
+
+// WindowProblem is an open route from node 0 whose stops have time windows
+type WindowProblem struct {
+	Costs     [][]float64
+	Durations [][]float64 // travel seconds
+	Windows   []StopWindow
+	// WaitingCosts adds waiting time to the cost; set it when Costs are
+	// travel times
+	WaitingCosts bool
+	// HourlyDurations optionally replace Durations with travel seconds for
+	// legs entered in each hour after the start; the last hour repeats
+	HourlyDurations [][][]float64
+}
+
+// SolveRouteWithWindows orders the stops so that as few seconds as possible
+// are late and, among equally late orders, the cost is lowest. Without any
+// deadlines or opening times it is SolveRoute.
+func SolveRouteWithWindows(problem WindowProblem, options SolverOptions) SolverResult {
+	if (!problem.hasWindows() && problem.HourlyDurations == nil) || len(problem.Costs) <= 2 {
+		result := SolveRoute(problem.Costs, options)
+		result.Cost, _ = problem.Evaluate(append([]int{0}, result.Order...))
+		return result
+	}
+
+	var deadline time.Time
+	if options.TimeBudget > 0 {
+		deadline = time.Now().Add(options.TimeBudget)
+		// Leave half of the budget to the window search
+		options.TimeBudget /= 2
+	}
+	expired := func() bool {
+		return !deadline.IsZero() && time.Now().After(deadline)
+	}
+
+	result := SolveRoute(problem.Costs, options)
+
+	// The cheapest order and the earliest-deadline-first order are the
+	// starting points; the better one is improved
+	best := append([]int{0}, result.Order...)
+	bestCost, bestLate := problem.Evaluate(best)
+
+	edf := problem.deadlineOrder()
+	if cost, late := problem.Evaluate(edf); windowBetter(cost, late, bestCost, bestLate) {
+		best, bestCost, bestLate = edf, cost, late
+	}
+
+	for improved := true; improved; {
+		improved = false
+		for _, candidate := range windowMoves(best) {
+			if expired() {
+				result.StoppedOnDeadline = true
+				break
+			}
+			if cost, late := problem.Evaluate(candidate); windowBetter(cost, late, bestCost, bestLate) {
+				best, bestCost, bestLate = candidate, cost, late
+				result.Improvements++
+				improved = true
+				break
+			}
+		}
+	}
+
+	result.Order = best[1:]
+	result.Cost = bestCost
+
+	return result
+}
+
+// Evaluate returns the cost and the total late seconds of a path starting
+// at node 0
+func (p WindowProblem) Evaluate(path []int) (float64, float64) {
+	timings := p.Schedule(path)
+
+	cost := pathCost(p.Costs, path)
+	if p.WaitingCosts && p.HourlyDurations != nil {
+		// Travel times depend on when each leg is driven
+		cost = 0
+		for i := 1; i < len(timings); i++ {
+			cost += timings[i].Arrival - timings[i-1].Departure
+		}
+	}
+
+	var late float64
+	for _, timing := range timings {
+		late += timing.Late
+		if p.WaitingCosts {
+			cost += timing.Wait
+		}
+	}
+
+	return cost, late
+}
+
+// Hours bounds how many hours after the start any visiting order can
+// take, allowing half again for traffic
+func (p WindowProblem) Hours() int {
+	var bound, earliest float64
+	for i, window := range p.Windows {
+		longest := 0.0
+		for _, duration := range p.Durations[i] {
+			longest = math.Max(longest, duration)
+		}
+		bound += longest + window.Service
+		earliest = math.Max(earliest, window.Earliest)
+	}
+
+	hours := int(math.Ceil((earliest+bound*1.5)/3600)) + 1
+	return min(hours, maxTrafficHours)
+}
+
+// travelTime is the seconds from one node to another when leaving at the
+// given second after the start
+func (p WindowProblem) travelTime(from, to int, departure float64) float64 {
+	if p.HourlyDurations == nil {
+		return p.Durations[from][to]
+	}
+	hour := int(math.Max(departure, 0) / 3600)
+	return p.HourlyDurations[min(hour, len(p.HourlyDurations)-1)][from][to]
+}
+
+// Schedule times every stop of a path starting at node 0. A vehicle that
+// arrives early waits for the window to open; one that arrives late is
+// served straight away.
+func (p WindowProblem) Schedule(path []int) []StopTiming {
+	timings := make([]StopTiming, len(path))
+
+	clock := 0.0
+	for i, node := range path {
+		if i > 0 {
+			clock += p.travelTime(path[i-1], node, clock)
+		}
+
+		window := p.Windows[node]
+		timing := StopTiming{Arrival: clock}
+		if clock < window.Earliest {
+			timing.Wait = window.Earliest - clock
+		}
+		if clock > window.Latest {
+			timing.Late = clock - window.Latest
+		}
+
+		clock += timing.Wait + window.Service
+		timing.Departure = clock
+		timings[i] = timing
+	}
+
+	// Arriving later at a stop first uses up its waiting time, then pushes
+	// back every later stop
+	next := math.Inf(1)
+	for i := len(path) - 1; i >= 0; i-- {
+		window := p.Windows[path[i]]
+		timing := &timings[i]
+		timing.Slack = math.Min(math.Max(window.Latest-timing.Arrival, 0), timing.Wait+next)
+		next = timing.Slack
+	}
+
+	return timings
+}
+
+func (p WindowProblem) hasWindows() bool {
+	for _, window := range p.Windows {
+		if window.Earliest > 0 || !math.IsInf(window.Latest, 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadlineOrder visits the stops by latest arrival, then earliest arrival
+func (p WindowProblem) deadlineOrder() []int {
+	path := make([]int, len(p.Windows))
+	for i := range path {
+		path[i] = i
+	}
+
+	stops := path[1:]
+	sort.SliceStable(stops, func(i, j int) bool {
+		a, b := p.Windows[stops[i]], p.Windows[stops[j]]
+		if a.Latest != b.Latest {
+			return a.Latest < b.Latest
+		}
+		return a.Earliest < b.Earliest
+	})
+
+	return path
+}
+
+// windowMoves lists the paths one relocation or swap of a stop away
+func windowMoves(path []int) [][]int {
+	moves := make([][]int, 0)
+
+	for i := 1; i < len(path); i++ {
+		for j := 1; j < len(path); j++ {
+			if i == j {
+				continue
+			}
+
+			moved := make([]int, 0, len(path))
+			for k, node := range path {
+				if k == i {
+					continue
+				}
+				if k == j && j < i {
+					moved = append(moved, path[i])
+				}
+				moved = append(moved, node)
+				if k == j && j > i {
+					moved = append(moved, path[i])
+				}
+			}
+			moves = append(moves, moved)
+
+			if j > i {
+				swapped := append([]int{}, path...)
+				swapped[i], swapped[j] = swapped[j], swapped[i]
+				moves = append(moves, swapped)
+			}
+		}
+	}
+
+	return moves
+}
+
+// windowBetter prefers fewer late seconds, then a lower cost
+func windowBetter(cost, late, bestCost, bestLate float64) bool {
+	if late < bestLate-1e-6 {
+		return true
+	}
+	return late <= bestLate+1e-6 && cost < bestCost-1e-9
+}
@@ -2,23 +2,72 @@ package services
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math"
 	"time"
 
+	"go-spatial/geometry"
 	"go-spatial/models"
 )
 
 type RouteService struct {
-	db *sql.DB
+	db             *sql.DB
+	solverSettings SolverSettings
+	matrixSettings MatrixSettings
+	matrixCache    *Cache
+	roadGraph      *RoadGraph
+}
+
+// SolverSettings are the route solver defaults used when a request does not
+// override them
+type SolverSettings struct {
+	TimeBudget    time.Duration
+	MaxIterations int
+	Seed          int64
+}
+
+// Optimization objectives
+const (
+	OptimizeForTime     = "time"
+	OptimizeForDistance = "distance"
+	OptimizeForFuel     = "fuel"
+)
+
+// Upper bound on a per-request solver time budget
+const maxSolverTimeBudget = 5 * time.Second
+
+// routeRecord is a planned route as persisted in the routes table
+type routeRecord struct {
+	DriverID        string
+	RouteType       string // optimized, calculated
+	VehicleType     string
+	OptimizeFor     string
+	Route           models.OptimizedRoute
+	NaiveDistance   float64
+	NaiveDuration   int
+	NaiveFuel       float64
+	CalculationTime int64
 }
 
 func NewRouteService(db *sql.DB) *RouteService {
 	return &RouteService{
 		db: db,
+		solverSettings: SolverSettings{
+			TimeBudget:    100 * time.Millisecond,
+			MaxIterations: defaultSolverIterations,
+			Seed:          1,
+		},
+		matrixSettings: MatrixSettings{Method: MatrixHaversine},
+		matrixCache:    NewCache(matrixCacheTTL),
 	}
 }
 
+// SetSolverSettings overrides the default route solver limits
+func (s *RouteService) SetSolverSettings(settings SolverSettings) {
+	s.solverSettings = settings
+}
+
 // OptimizeRoute performs route optimization using spatial algorithms
 func (s *RouteService) OptimizeRoute(request models.RouteOptimizationRequest) (*models.RouteOptimizationResponse, error) {
 	startTime := time.Now()
@@ -28,18 +77,80 @@ func (s *RouteService) OptimizeRoute(request models.RouteOptimizationRequest) (*
 		return nil, fmt.Errorf("no destinations provided")
 	}
 
-	// For demo purposes, we'll implement a simple nearest neighbor algorithm
-	// In production, you'd use more sophisticated algorithms like Genetic Algorithm,
-	// Simulated Annealing, or call external routing services like OSRM
-	optimizedWaypoints, err := s.optimizeWaypointsNearestNeighbor(request.Origin, request.Destinations)
+	optimizeFor, err := resolveOptimizeFor(request.Preferences)
+	if err != nil {
+		return nil, err
+	}
+	options := s.solverOptions(request.Preferences)
+	roads, err := roadOptions(request.Preferences, request.Vehicle.Restrictions)
 	if err != nil {
-		return nil, fmt.Errorf("route optimization failed: %w", err)
+		return nil, err
 	}
 
-	// Calculate route metrics
-	totalDistance, totalDuration, estimatedFuel, err := s.calculateRouteMetrics(optimizedWaypoints, request.Vehicle)
+	// Index 0 is the origin, index i the (i-1)th destination
+	stops := append([]models.Location{request.Origin}, request.Destinations...)
+	traffic, err := s.trafficConditions(stops)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate route metrics: %w", err)
+		return nil, err
+	}
+
+	// The start time is the departure, so ETAs follow the traffic expected
+	// at each hour of the route
+	routeStart := startTime
+	if request.StartTime != nil {
+		routeStart = *request.StartTime
+	}
+	legs, err := s.LegCosts(stops, traffic, request.Vehicle.Type, roads, routeStart)
+	if err != nil {
+		return nil, err
+	}
+
+	problem := WindowProblem{
+		Costs:        legs.Objective(optimizeFor),
+		Durations:    legs.Durations,
+		Windows:      stopWindows(stops, routeStart),
+		WaitingCosts: optimizeFor == OptimizeForTime,
+	}
+	problem.HourlyDurations = legs.HourlyDurations(routeStart, problem.Hours())
+
+	solution := SolveRouteWithWindows(problem, options)
+
+	optimizedOrder := append([]int{0}, solution.Order...)
+	naiveOrder := make([]int, len(stops))
+	for i := range naiveOrder {
+		naiveOrder[i] = i
+	}
+
+	optimizedWaypoints := make([]models.Location, len(optimizedOrder))
+	for i, index := range optimizedOrder {
+		optimizedWaypoints[i] = stops[index]
+	}
+
+	// Durations include waiting for time windows and time spent at stops
+	timings := problem.Schedule(optimizedOrder)
+	totalDistance, _, estimatedFuel := legs.RouteMetrics(optimizedOrder)
+	totalDuration := timings[len(timings)-1].Departure
+
+	// Metrics for visiting destinations in the order given, used to report
+	// optimization savings
+	naiveTimings := problem.Schedule(naiveOrder)
+	naiveDistance, _, naiveFuel := legs.RouteMetrics(naiveOrder)
+	naiveDuration := naiveTimings[len(naiveTimings)-1].Departure
+
+	improvement := models.RouteImprovement{
+		OptimizeFor:   optimizeFor,
+		NaiveDistance: naiveDistance,
+		NaiveDuration: int(naiveDuration),
+		NaiveFuel:     naiveFuel,
+		DistanceSaved: naiveDistance - totalDistance,
+		DurationSaved: int(naiveDuration) - int(totalDuration),
+		FuelSaved:     naiveFuel - estimatedFuel,
+		Seed:          options.Seed,
+		Iterations:    solution.Iterations,
+	}
+	improvement.StoppedOnDeadline = solution.StoppedOnDeadline
+	if naiveCost, _ := problem.Evaluate(naiveOrder); naiveCost > 0 {
+		improvement.ImprovementPercent = (naiveCost - solution.Cost) / naiveCost * 100
 	}
 
 	calculationTime := time.Since(startTime).Milliseconds()
@@ -51,38 +162,150 @@ func (s *RouteService) OptimizeRoute(request models.RouteOptimizationRequest) (*
 			TotalDuration: int(totalDuration),
 			EstimatedFuel: estimatedFuel,
 		},
+		Improvement: improvement,
 		Performance: models.PerformanceMetrics{
 			CalculationTime: calculationTime,
-			SpatialQueries:  len(request.Destinations),
 		},
 	}
+	response.OptimizedRoute.Schedule, response.OptimizedRoute.TimeWindowViolations =
+		buildSchedule(optimizedWaypoints, timings, routeStart)
+	response.OptimizedRoute.UnsatisfiedPreferences = legs.Unsatisfied(optimizedOrder, roads, request.Vehicle.Restrictions)
+
+	legDistances, _ := legs.Along(optimizedOrder)
+	legDurations := make([]float64, len(legDistances))
+	for i := range legDurations {
+		legDurations[i] = timings[i+1].Arrival - timings[i].Departure
+	}
+	response.OptimizedRoute.Legs, response.OptimizedRoute.Geometry, err =
+		s.routeLegs(optimizedWaypoints, legDistances, legDurations, request.Vehicle.Type, roads)
+	if err != nil {
+		return nil, err
+	}
+
+	routeID, err := s.saveRoute(routeRecord{
+		DriverID:        request.DriverID,
+		RouteType:       "optimized",
+		VehicleType:     request.Vehicle.Type,
+		OptimizeFor:     optimizeFor,
+		Route:           response.OptimizedRoute,
+		NaiveDistance:   naiveDistance,
+		NaiveDuration:   int(naiveDuration),
+		NaiveFuel:       naiveFuel,
+		CalculationTime: calculationTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.OptimizedRoute.ID = routeID
 
 	return response, nil
 }
 
-// CalculateRoute calculates route between two points
-func (s *RouteService) CalculateRoute(origin, destination models.Location) (*models.OptimizedRoute, error) {
-	// Calculate direct distance and duration
-	distance, err := s.calculateDistance(origin, destination)
-	if err != nil {
-		return nil, fmt.Errorf("failed to calculate distance: %w", err)
+// stopWindows converts the stops' arrival bounds to seconds after the route
+// start
+func stopWindows(stops []models.Location, start time.Time) []StopWindow {
+	windows := make([]StopWindow, len(stops))
+	for i, stop := range stops {
+		window := OpenWindow(float64(stop.ServiceTime))
+		if stop.EarliestArrival != nil {
+			window.Earliest = math.Max(stop.EarliestArrival.Sub(start).Seconds(), 0)
+		}
+		if stop.LatestArrival != nil {
+			window.Latest = stop.LatestArrival.Sub(start).Seconds()
+		}
+		windows[i] = window
+	}
+
+	// The route leaves its origin at the start time
+	windows[0] = OpenWindow(0)
+
+	return windows
+}
+
+// buildSchedule turns stop timings into waypoint ETAs and the time window
+// violations
+func buildSchedule(waypoints []models.Location, timings []StopTiming, start time.Time) ([]models.WaypointSchedule, []models.TimeWindowViolation) {
+	schedule := make([]models.WaypointSchedule, len(timings))
+	violations := make([]models.TimeWindowViolation, 0)
+
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	for i, timing := range timings {
+		entry := models.WaypointSchedule{
+			ETA:       at(timing.Arrival),
+			Wait:      int(timing.Wait),
+			Departure: at(timing.Departure),
+		}
+		if !math.IsInf(timing.Slack, 1) {
+			slack := int(timing.Slack)
+			entry.Slack = &slack
+		}
+		schedule[i] = entry
+
+		if timing.Late > 0 {
+			violations = append(violations, models.TimeWindowViolation{
+				WaypointIndex: i,
+				LatestArrival: *waypoints[i].LatestArrival,
+				ETA:           entry.ETA,
+				LateBy:        int(math.Ceil(timing.Late)),
+			})
+		}
 	}
 
-	// Estimate duration (assuming average speed of 50 km/h in urban areas)
-	avgSpeedKmh := 50.0
-	durationHours := (distance / 1000.0) / avgSpeedKmh
-	durationSeconds := int(durationHours * 3600)
+	return schedule, violations
+}
 
-	// Estimate fuel consumption (assuming 8L/100km for a van)
-	fuelConsumptionPer100km := 8.0
-	estimatedFuel := (distance / 1000.0) * (fuelConsumptionPer100km / 100.0)
+// CalculateRoute calculates route between two points. With a road graph
+// loaded the route follows the roads, otherwise it is a straight line.
+func (s *RouteService) CalculateRoute(driverID, vehicleType string, origin, destination models.Location) (*models.OptimizedRoute, error) {
+	startTime := time.Now()
 
 	route := &models.OptimizedRoute{
-		Waypoints:     []models.Location{origin, destination},
-		TotalDistance: distance,
-		TotalDuration: durationSeconds,
-		EstimatedFuel: estimatedFuel,
+		Waypoints: []models.Location{origin, destination},
+	}
+
+	if s.roadGraph != nil {
+		path, err := s.roadGraph.Route(origin, destination, s.SpeedProfile(vehicleType), RoadOptions{})
+		if err != nil {
+			return nil, err
+		}
+		route.Geometry = plainLocations(path.Geometry)
+		route.TotalDistance = path.Distance
+		route.TotalDuration = int(path.Duration)
+		route.Legs = []models.RouteLeg{path.Leg(1)}
+	} else {
+		distances, _, err := s.distances([]models.Location{origin}, []models.Location{destination}, s.matrixSettings.Method)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate distance: %w", err)
+		}
+		distance := distances[0][0]
+		duration := (distance / 1000.0) / s.getAverageSpeedForVehicle(vehicleType) * 3600
+		route.TotalDistance = distance
+		route.TotalDuration = int(duration)
+		route.Legs = []models.RouteLeg{buildLeg(
+			route.Waypoints,
+			[]RoadSegment{{From: origin, To: destination, Distance: distance, Duration: duration}},
+			distance, duration, 1,
+		)}
 	}
+	route.EstimatedFuel = s.calculateFuelConsumption(route.TotalDistance, vehicleType)
+
+	routeID, err := s.saveRoute(routeRecord{
+		DriverID:        driverID,
+		RouteType:       "calculated",
+		VehicleType:     vehicleType,
+		Route:           *route,
+		NaiveDistance:   route.TotalDistance,
+		NaiveDuration:   route.TotalDuration,
+		NaiveFuel:       route.EstimatedFuel,
+		CalculationTime: time.Since(startTime).Milliseconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	route.ID = routeID
 
 	return route, nil
 }
@@ -109,8 +332,8 @@ func (s *RouteService) ValidateRoute(waypoints []models.Location) (*models.Route
 
 	// Check for extremely long segments (> 500km)
 	for i := 0; i < len(waypoints)-1; i++ {
-		distance, err := s.calculateDistance(waypoints[i], waypoints[i+1])
-		if err == nil && distance > 500000 { // 500km in meters
+		distance := haversineDistance(waypoints[i], waypoints[i+1])
+		if distance > 500000 { // 500km in meters
 			issues = append(issues, fmt.Sprintf("Very long segment between waypoints %d and %d (%.2f km)",
 				i, i+1, distance/1000))
 		}
@@ -130,143 +353,87 @@ func (s *RouteService) ValidateRoute(waypoints []models.Location) (*models.Route
 	}, nil
 }
 
-// GetTrafficData retrieves traffic data for a route
-func (s *RouteService) GetTrafficData(routeID string) (*models.TrafficData, error) {
-	// For demo purposes, return simulated traffic data
-	// In production, you'd integrate with real traffic APIs
-
+// GetActiveRoute returns the driver's most recent route stored within maxAge,
+// or nil when the driver has no active route
+func (s *RouteService) GetActiveRoute(driverID string, maxAge time.Duration) (*models.OptimizedRoute, error) {
 	query := `
-		SELECT 
-			AVG(congestion_level) as avg_congestion,
-			AVG(average_speed) as avg_speed,
-			COUNT(*) as data_points
-		FROM traffic_data
-		WHERE timestamp > NOW() - INTERVAL '30 minutes'
+		SELECT id, waypoints, ST_AsBinary(geometry), total_distance, total_duration, estimated_fuel
+		FROM routes
+		WHERE driver_id = $1 AND created_at >= $2
+		ORDER BY created_at DESC
+		LIMIT 1
 	`
 
-	var avgCongestion, avgSpeed sql.NullFloat64
-	var dataPoints int
-
-	err := s.db.QueryRow(query).Scan(&avgCongestion, &avgSpeed, &dataPoints)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("failed to get traffic data: %w", err)
+	var route models.OptimizedRoute
+	var waypointsJSON, geometryWKB []byte
+
+	err := s.db.QueryRow(query, driverID, time.Now().Add(-maxAge)).Scan(
+		&route.ID,
+		&waypointsJSON,
+		&geometryWKB,
+		&route.TotalDistance,
+		&route.TotalDuration,
+		&route.EstimatedFuel,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get active route: %w", err)
 	}
 
-	// Default values if no data available
-	congestionLevel := 0.3 // Light traffic
-	averageSpeed := 45.0   // 45 km/h
-
-	if avgCongestion.Valid {
-		congestionLevel = avgCongestion.Float64
-	}
-	if avgSpeed.Valid {
-		averageSpeed = avgSpeed.Float64
+	if err := json.Unmarshal(waypointsJSON, &route.Waypoints); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal route waypoints: %w", err)
 	}
 
-	trafficData := &models.TrafficData{
-		Location: models.Location{
-			Latitude:  0, // Would be specific to route
-			Longitude: 0,
-			Timestamp: time.Now().Unix(),
-		},
-		CongestionLevel: congestionLevel,
-		AverageSpeed:    averageSpeed,
-		Timestamp:       time.Now(),
+	// The stored path follows the roads when the route was road-routed
+	if geometryWKB != nil {
+		path, err := geometry.ParseWKB(geometryWKB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read route geometry: %w", err)
+		}
+		if line, ok := path.(geometry.LineString); ok && len(line) >= 2 {
+			route.Geometry = make([]models.Location, len(line))
+			for i, position := range line {
+				route.Geometry[i] = models.Location{Latitude: position[1], Longitude: position[0]}
+			}
+		}
 	}
 
-	return trafficData, nil
+	return &route, nil
 }
 
 // Private helper methods
 
-func (s *RouteService) optimizeWaypointsNearestNeighbor(origin models.Location, destinations []models.Location) ([]models.Location, error) {
-	if len(destinations) == 0 {
-		return []models.Location{origin}, nil
-	}
-
-	optimized := []models.Location{origin}
-	remaining := make([]models.Location, len(destinations))
-	copy(remaining, destinations)
-
-	current := origin
-
-	// Nearest neighbor algorithm
-	for len(remaining) > 0 {
-		nearestIndex := 0
-		nearestDistance := math.Inf(1)
-
-		// Find nearest unvisited destination
-		for i, dest := range remaining {
-			distance, err := s.calculateDistance(current, dest)
-			if err != nil {
-				continue
-			}
-
-			if distance < nearestDistance {
-				nearestDistance = distance
-				nearestIndex = i
-			}
-		}
-
-		// Add nearest destination to route
-		optimized = append(optimized, remaining[nearestIndex])
-		current = remaining[nearestIndex]
-
-		// Remove from remaining destinations
-		remaining = append(remaining[:nearestIndex], remaining[nearestIndex+1:]...)
+// resolveOptimizeFor returns the requested objective, time by default
+func resolveOptimizeFor(preferences models.RoutePreferences) (string, error) {
+	switch preferences.OptimizeFor {
+	case "":
+		return OptimizeForTime, nil
+	case OptimizeForTime, OptimizeForDistance, OptimizeForFuel:
+		return preferences.OptimizeFor, nil
+	default:
+		return "", fmt.Errorf("unsupported optimize_for %q", preferences.OptimizeFor)
 	}
-
-	return optimized, nil
 }
 
-func (s *RouteService) calculateRouteMetrics(waypoints []models.Location, vehicle models.Vehicle) (float64, float64, float64, error) {
-	if len(waypoints) < 2 {
-		return 0, 0, 0, fmt.Errorf("insufficient waypoints")
+// solverOptions applies request overrides to the default solver settings
+func (s *RouteService) solverOptions(preferences models.RoutePreferences) SolverOptions {
+	options := SolverOptions{
+		Seed:          s.solverSettings.Seed,
+		TimeBudget:    s.solverSettings.TimeBudget,
+		MaxIterations: s.solverSettings.MaxIterations,
 	}
-
-	var totalDistance float64
-	var totalDuration float64
-
-	// Calculate cumulative distance and duration
-	for i := 0; i < len(waypoints)-1; i++ {
-		distance, err := s.calculateDistance(waypoints[i], waypoints[i+1])
-		if err != nil {
-			return 0, 0, 0, fmt.Errorf("failed to calculate segment distance: %w", err)
-		}
-
-		totalDistance += distance
-
-		// Estimate duration based on vehicle type and road conditions
-		avgSpeed := s.getAverageSpeedForVehicle(vehicle.Type)
-		segmentDuration := (distance / 1000.0) / avgSpeed * 3600 // Convert to seconds
-		totalDuration += segmentDuration
+	if preferences.Seed != nil {
+		options.Seed = *preferences.Seed
 	}
-
-	// Calculate fuel consumption based on vehicle type
-	estimatedFuel := s.calculateFuelConsumption(totalDistance, vehicle.Type)
-
-	return totalDistance, totalDuration, estimatedFuel, nil
-}
-
-func (s *RouteService) calculateDistance(origin, destination models.Location) (float64, error) {
-	query := `
-		SELECT ST_Distance(
-			ST_Point($1, $2)::geography,
-			ST_Point($3, $4)::geography
-		) as distance
-	`
-
-	var distance float64
-	err := s.db.QueryRow(query,
-		origin.Longitude, origin.Latitude,
-		destination.Longitude, destination.Latitude,
-	).Scan(&distance)
-
-	if err != nil {
-		return 0, fmt.Errorf("distance calculation failed: %w", err)
+	if budget := preferences.TimeBudgetMs; budget > 0 {
+		options.TimeBudget = time.Duration(budget) * time.Millisecond
+		if options.TimeBudget > maxSolverTimeBudget {
+			options.TimeBudget = maxSolverTimeBudget
+		}
 	}
-
-	return distance, nil
+	return options
 }
 
 func (s *RouteService) getAverageSpeedForVehicle(vehicleType string) float64 {
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"go-spatial/models"
+)
+
+// SolverOptions controls the route solver search
+type SolverOptions struct {
+	// Seed makes perturbations reproducible; the same seed, costs and
+	// iteration limit give the same route as long as the time budget does
+	// not cut the search short. Set TimeBudget to zero for results that
+	// never depend on machine speed.
+	Seed int64
+	// TimeBudget caps the improvement phase; zero means no time limit
+	TimeBudget time.Duration
+	// MaxIterations caps the number of perturbation restarts
+	MaxIterations int
+	// ReturnToStart closes the route back at the start
+	ReturnToStart bool
+}
+
+// SolverResult is a visiting order of the stops after the fixed start
+type SolverResult struct {
+	// Order holds the cost matrix indices of the stops, excluding the start
+	Order             []int   `json:"order"`
+	Cost              float64 `json:"cost"`
+	ConstructionCost  float64 `json:"construction_cost"`
+	Iterations        int     `json:"iterations"`
+	Improvements      int     `json:"improvements"`
+	StoppedOnDeadline bool    `json:"stopped_on_deadline"`
+}
+
+// Default solver limits
+const (
+	defaultSolverIterations = 200
+	maxOrOptSegment         = 3
+)
+
+// SolveRoute orders the stops 1..n-1 of a cost matrix into a path starting
+// at index 0, open unless ReturnToStart is set. It builds a route by cheapest
+// insertion, improves it with 2-opt and Or-opt local search, and then
+// perturbs the best route with seeded segment reversals until the iteration
+// limit or time budget is hit. costs may be asymmetric.
+func SolveRoute(costs [][]float64, options SolverOptions) SolverResult {
+	n := len(costs)
+	if n <= 1 {
+		return SolverResult{Order: []int{}}
+	}
+
+	// A closed route ends at a copy of the start that never moves
+	fixed := 0
+	if options.ReturnToStart {
+		costs = closeCosts(costs)
+		fixed = 1
+	}
+
+	if options.MaxIterations <= 0 {
+		options.MaxIterations = defaultSolverIterations
+	}
+
+	var deadline time.Time
+	if options.TimeBudget > 0 {
+		deadline = time.Now().Add(options.TimeBudget)
+	}
+	expired := func() bool {
+		return !deadline.IsZero() && time.Now().After(deadline)
+	}
+
+	path := cheapestInsertion(costs, fixed)
+	result := SolverResult{
+		ConstructionCost: pathCost(costs, path),
+	}
+
+	localSearch(costs, path, fixed, expired)
+	best := append([]int{}, path...)
+	bestCost := pathCost(costs, best)
+
+	rng := rand.New(rand.NewSource(options.Seed))
+
+	// Perturbations need at least two stops to reorder
+	for n > 3 && result.Iterations < options.MaxIterations {
+		if expired() {
+			result.StoppedOnDeadline = true
+			break
+		}
+		result.Iterations++
+
+		candidate := append([]int{}, best...)
+		perturb(candidate, fixed, rng)
+		localSearch(costs, candidate, fixed, expired)
+
+		if cost := pathCost(costs, candidate); cost < bestCost-1e-9 {
+			best = candidate
+			bestCost = cost
+			result.Improvements++
+		}
+	}
+
+	result.Order = best[1 : len(best)-fixed]
+	result.Cost = bestCost
+
+	return result
+}
+
+// NaiveOrderCost is the cost of visiting the stops in index order
+func NaiveOrderCost(costs [][]float64, returnToStart bool) float64 {
+	path := make([]int, len(costs))
+	for i := range path {
+		path[i] = i
+	}
+	if returnToStart && len(path) > 1 {
+		path = append(path, 0)
+	}
+	return pathCost(costs, path)
+}
+
+// Helper functions
+
+// cheapestInsertion starts from the fixed start (and end) and repeatedly
+// inserts the stop whose cheapest insertion position adds the least cost
+func cheapestInsertion(costs [][]float64, fixed int) []int {
+	n := len(costs)
+	path := []int{0}
+	inserted := make([]bool, n)
+	inserted[0] = true
+	if fixed > 0 {
+		path = append(path, n-1)
+		inserted[n-1] = true
+	}
+
+	for len(path) < n {
+		bestStop, bestPos := -1, 0
+		bestDelta := math.Inf(1)
+
+		for stop := 1; stop < n; stop++ {
+			if inserted[stop] {
+				continue
+			}
+			for pos := 1; pos <= len(path)-fixed; pos++ {
+				prev := path[pos-1]
+				delta := costs[prev][stop]
+				if pos < len(path) {
+					next := path[pos]
+					delta += costs[stop][next] - costs[prev][next]
+				}
+				if delta < bestDelta {
+					bestDelta = delta
+					bestStop = stop
+					bestPos = pos
+				}
+			}
+		}
+
+		path = append(path, 0)
+		copy(path[bestPos+1:], path[bestPos:])
+		path[bestPos] = bestStop
+		inserted[bestStop] = true
+	}
+
+	return path
+}
+
+// localSearch applies improving 2-opt and Or-opt moves until none is left;
+// the start and the last fixed positions never move
+func localSearch(costs [][]float64, path []int, fixed int, expired func() bool) {
+	for !expired() {
+		if twoOpt(costs, path, fixed) {
+			continue
+		}
+		if orOpt(costs, path, fixed) {
+			continue
+		}
+		return
+	}
+}
+
+// twoOpt reverses the first segment path[i..j] whose reversal lowers the
+// cost
+func twoOpt(costs [][]float64, path []int, fixed int) bool {
+	n := len(path)
+	last := n - 1 - fixed // last movable position
+
+	for i := 1; i < last; i++ {
+		var forward, reverse float64
+		for j := i + 1; j <= last; j++ {
+			// Cost of the segment's inner edges in both directions
+			forward += costs[path[j-1]][path[j]]
+			reverse += costs[path[j]][path[j-1]]
+
+			before := costs[path[i-1]][path[i]] + forward
+			after := costs[path[i-1]][path[j]] + reverse
+			if j+1 < n {
+				before += costs[path[j]][path[j+1]]
+				after += costs[path[i]][path[j+1]]
+			}
+
+			if after < before-1e-9 {
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					path[a], path[b] = path[b], path[a]
+				}
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// orOpt moves the first segment of up to three stops whose relocation lowers
+// the cost
+func orOpt(costs [][]float64, path []int, fixed int) bool {
+	n := len(path)
+
+	for length := 1; length <= maxOrOptSegment; length++ {
+		for i := 1; i+length <= n-fixed; i++ {
+			j := i + length - 1 // last stop of the segment
+			first, last := path[i], path[j]
+			prev := path[i-1]
+
+			// Saving from taking the segment out
+			removed := costs[prev][first]
+			if j+1 < n {
+				next := path[j+1]
+				removed += costs[last][next] - costs[prev][next]
+			}
+
+			// Try every gap outside the segment: between path[k] and path[k+1]
+			for k := 0; k < n-fixed; k++ {
+				if k >= i-1 && k <= j {
+					continue
+				}
+				a := path[k]
+				added := costs[a][first]
+				if k+1 < n {
+					b := path[k+1]
+					added += costs[last][b] - costs[a][b]
+				}
+
+				if added < removed-1e-9 {
+					moveSegment(path, i, j, k)
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// moveSegment moves path[i..j] to just after path[k]
+func moveSegment(path []int, i, j, k int) {
+	segment := append([]int{}, path[i:j+1]...)
+	rest := append(append([]int{}, path[:i]...), path[j+1:]...)
+
+	// Position of path[k] within rest
+	pos := k
+	if k > j {
+		pos = k - len(segment)
+	}
+
+	result := append(append(append([]int{}, rest[:pos+1]...), segment...), rest[pos+1:]...)
+	copy(path, result)
+}
+
+// perturb reverses a random segment and relocates another so local search
+// can escape its current optimum
+func perturb(path []int, fixed int, rng *rand.Rand) {
+	n := len(path) - fixed
+
+	i := 1 + rng.Intn(n-1)
+	j := 1 + rng.Intn(n-1)
+	if i > j {
+		i, j = j, i
+	}
+	for a, b := i, j; a < b; a, b = a+1, b-1 {
+		path[a], path[b] = path[b], path[a]
+	}
+
+	from := 1 + rng.Intn(n-1)
+	to := rng.Intn(n)
+	if to != from && to != from-1 {
+		moveSegment(path, from, from, to)
+	}
+}
+
+// closeCosts appends a copy of the start as the last node
+func closeCosts(costs [][]float64) [][]float64 {
+	n := len(costs)
+	closed := make([][]float64, n+1)
+	for i := 0; i < n; i++ {
+		closed[i] = append(append(make([]float64, 0, n+1), costs[i]...), costs[i][0])
+	}
+	closed[n] = append(append(make([]float64, 0, n+1), costs[0]...), 0)
+	return closed
+}
+
+func pathCost(costs [][]float64, path []int) float64 {
+	var total float64
+	for i := 0; i+1 < len(path); i++ {
+		total += costs[path[i]][path[i+1]]
+	}
+	return total
+}
+
+// haversineDistance returns the great-circle distance in meters
+func haversineDistance(a, b models.Location) float64 {
+	const earthRadius = 6371008.8 // meters
+
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
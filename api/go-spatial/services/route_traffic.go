@@ -0,0 +1,302 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Routes are reported in stretches of about this many meters
+const routeTrafficSegmentLength = 1000.0
+
+// GetTrafficData reports the traffic of the last 30 minutes within radius
+// meters of a stored route, stretch by stretch
+func (s *RouteService) GetTrafficData(routeID string, radius float64) (*models.RouteTraffic, error) {
+	var vehicleType sql.NullString
+	var waypointsJSON []byte
+	err := s.db.QueryRow(`SELECT vehicle_type, waypoints FROM routes WHERE id = $1`, routeID).Scan(&vehicleType, &waypointsJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("route not found")
+		}
+		return nil, fmt.Errorf("failed to get route: %w", err)
+	}
+
+	points, err := s.routePath(routeID)
+	if err != nil {
+		return nil, err
+	}
+	// Routes stored without geometry are followed stop to stop
+	if len(points) < 2 {
+		if err := json.Unmarshal(waypointsJSON, &points); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal route waypoints: %w", err)
+		}
+		points = plainLocations(points)
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("route has no path")
+	}
+
+	now := time.Now()
+	observations, err := s.corridorTraffic(points, radius, now.Add(-trafficMaxAge), now)
+	if err != nil {
+		return nil, err
+	}
+
+	traffic := RouteCorridorTraffic(points, observations, radius, s.getAverageSpeedForVehicle(vehicleType.String))
+	traffic.RouteID = routeID
+	return &traffic, nil
+}
+
+// routePath loads the points of a stored route's geometry
+func (s *RouteService) routePath(routeID string) ([]models.Location, error) {
+	rows, err := s.db.Query(`
+		SELECT ST_Y(point.geom), ST_X(point.geom)
+		FROM routes, ST_DumpPoints(routes.geometry) AS point
+		WHERE routes.id = $1
+		ORDER BY point.path
+	`, routeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query route geometry: %w", err)
+	}
+	defer rows.Close()
+
+	var points []models.Location
+	for rows.Next() {
+		var point models.Location
+		if err := rows.Scan(&point.Latitude, &point.Longitude); err != nil {
+			return nil, fmt.Errorf("failed to scan route geometry: %w", err)
+		}
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read route geometry: %w", err)
+	}
+
+	return points, nil
+}
+
+// corridorTraffic loads the observations made between since and until
+// within radius meters of a path
+func (s *RouteService) corridorTraffic(points []models.Location, radius float64, since, until time.Time) ([]TrafficObservation, error) {
+	// The bounding box prefilter is in degrees, which shrink in longitude
+	// away from the equator
+	var maxLatitude float64
+	for _, point := range points {
+		maxLatitude = math.Max(maxLatitude, math.Abs(point.Latitude))
+	}
+	margin := radius / (111320.0 * math.Max(math.Cos(maxLatitude*math.Pi/180), 0.01))
+
+	rows, err := s.db.Query(`
+		SELECT ST_Y(location), ST_X(location), average_speed, congestion_level
+		FROM traffic_data
+		WHERE location && ST_Expand(ST_GeomFromText($1, 4326), $2)
+			AND ST_DWithin(location::geography, ST_GeomFromText($1, 4326)::geography, $3)
+			AND timestamp > $4 AND timestamp <= $5
+			AND average_speed > 0
+	`, buildRouteLineStringWKT(points), margin, radius, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query route traffic: %w", err)
+	}
+	defer rows.Close()
+
+	observations := make([]TrafficObservation, 0)
+	for rows.Next() {
+		var observation TrafficObservation
+		if err := rows.Scan(
+			&observation.Location.Latitude,
+			&observation.Location.Longitude,
+			&observation.Speed,
+			&observation.Congestion,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan route traffic: %w", err)
+		}
+		observations = append(observations, observation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read route traffic: %w", err)
+	}
+
+	return observations, nil
+}
+
+// RouteCorridorTraffic cuts a path into stretches of about a kilometer and
+// credits each observation within radius meters to the nearest one. A
+// stretch's delay is the extra time its observed speed takes over the
+// free-flow speed; stretches without observations are assumed free-flowing.
+func RouteCorridorTraffic(points []models.Location, observations []TrafficObservation, radius, freeFlow float64) models.RouteTraffic {
+	stretches := splitRoute(points, routeTrafficSegmentLength)
+
+	type totals struct {
+		congestion float64
+		speed      float64
+		count      int
+	}
+	sums := make([]totals, len(stretches))
+	dataPoints := 0
+	for _, observation := range observations {
+		nearest, best := -1, radius
+		for i, stretch := range stretches {
+			if distance := lineDistance(observation.Location, stretch); distance <= best {
+				nearest, best = i, distance
+			}
+		}
+		if nearest < 0 {
+			continue
+		}
+		sums[nearest].congestion += observation.Congestion
+		sums[nearest].speed += observation.Speed
+		sums[nearest].count++
+		dataPoints++
+	}
+
+	traffic := models.RouteTraffic{
+		RadiusMeters:  radius,
+		FreeFlowSpeed: freeFlow,
+		DataPoints:    dataPoints,
+		Segments:      make([]models.RouteTrafficSegment, len(stretches)),
+	}
+
+	var length, observedDistance, observedTime, weightedCongestion, delay float64
+	worst := -1
+	for i, stretch := range stretches {
+		segment := models.RouteTrafficSegment{
+			Index:        i,
+			Start:        stretch[0],
+			End:          stretch[len(stretch)-1],
+			Distance:     pathLength(stretch),
+			AverageSpeed: freeFlow,
+		}
+		length += segment.Distance
+
+		if sum := sums[i]; sum.count > 0 {
+			segment.DataPoints = sum.count
+			segment.CongestionLevel = sum.congestion / float64(sum.count)
+			segment.AverageSpeed = sum.speed / float64(sum.count)
+
+			seconds := segment.Distance / (segment.AverageSpeed / 3.6)
+			if segmentDelay := seconds - segment.Distance/(freeFlow/3.6); segmentDelay > 0 {
+				segment.Delay = int(math.Round(segmentDelay))
+				delay += segmentDelay
+			}
+
+			observedDistance += segment.Distance
+			observedTime += seconds
+			weightedCongestion += segment.CongestionLevel * segment.Distance
+
+			if worst < 0 || segment.CongestionLevel > traffic.Segments[worst].CongestionLevel ||
+				(segment.CongestionLevel == traffic.Segments[worst].CongestionLevel && segment.Delay > traffic.Segments[worst].Delay) {
+				worst = i
+			}
+		}
+
+		traffic.Segments[i] = segment
+	}
+
+	traffic.TotalDelay = int(math.Round(delay))
+	if worst >= 0 {
+		worstSegment := traffic.Segments[worst]
+		traffic.WorstSegment = &worstSegment
+	}
+
+	now := time.Now()
+	traffic.Location = pointAlong(points, length/2)
+	traffic.Location.Timestamp = now.Unix()
+	traffic.Timestamp = now
+	traffic.AverageSpeed = freeFlow
+	if observedDistance > 0 && observedTime > 0 {
+		traffic.CongestionLevel = weightedCongestion / observedDistance
+		traffic.AverageSpeed = observedDistance / observedTime * 3.6
+	}
+
+	return traffic
+}
+
+// splitRoute cuts a path into stretches of length meters, the last one
+// holding whatever remains
+func splitRoute(points []models.Location, length float64) [][]models.Location {
+	var stretches [][]models.Location
+	current := []models.Location{points[0]}
+	var covered float64
+
+	for i := 0; i+1 < len(points); i++ {
+		from, to := points[i], points[i+1]
+		step := haversineDistance(from, to)
+		for step > 0 && covered+step >= length {
+			cut := interpolateLocation(from, to, (length-covered)/step)
+			stretches = append(stretches, append(current, cut))
+			current = []models.Location{cut}
+			step -= length - covered
+			from, covered = cut, 0
+		}
+		if step > 0 {
+			current = append(current, to)
+			covered += step
+		}
+	}
+
+	if len(stretches) == 0 || covered >= minSegmentDistance {
+		if len(current) < 2 {
+			current = append(current, points[len(points)-1])
+		}
+		stretches = append(stretches, current)
+	}
+	return stretches
+}
+
+// pointAlong is the point the given number of meters along a path
+func pointAlong(points []models.Location, distance float64) models.Location {
+	for i := 0; i+1 < len(points); i++ {
+		step := haversineDistance(points[i], points[i+1])
+		if step > 0 && distance <= step {
+			return interpolateLocation(points[i], points[i+1], distance/step)
+		}
+		distance -= step
+	}
+	return plainLocation(points[len(points)-1])
+}
+
+func pathLength(points []models.Location) float64 {
+	var length float64
+	for i := 0; i+1 < len(points); i++ {
+		length += haversineDistance(points[i], points[i+1])
+	}
+	return length
+}
+
+func interpolateLocation(from, to models.Location, fraction float64) models.Location {
+	return models.Location{
+		Latitude:  from.Latitude + (to.Latitude-from.Latitude)*fraction,
+		Longitude: from.Longitude + (to.Longitude-from.Longitude)*fraction,
+	}
+}
+
+// lineDistance is the distance in meters from a point to the closest point
+// of a line, on a flat projection around the point
+func lineDistance(point models.Location, line []models.Location) float64 {
+	const metersPerDegree = 111320.0
+	cos := math.Cos(point.Latitude * math.Pi / 180)
+	project := func(location models.Location) (float64, float64) {
+		return (location.Longitude - point.Longitude) * metersPerDegree * cos,
+			(location.Latitude - point.Latitude) * metersPerDegree
+	}
+
+	best := math.Inf(1)
+	for i := 0; i+1 < len(line); i++ {
+		ax, ay := project(line[i])
+		bx, by := project(line[i+1])
+		dx, dy := bx-ax, by-ay
+
+		// Fraction of the way along the segment closest to the point
+		var t float64
+		if lengthSquared := dx*dx + dy*dy; lengthSquared > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSquared))
+		}
+		best = math.Min(best, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+	return best
+}
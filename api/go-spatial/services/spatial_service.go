@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"go-spatial/geometry"
 	"go-spatial/models"
 )
 
@@ -105,7 +106,7 @@ func (c *Cache) Set(key string, value interface{}) {
 // CheckGeofences performs real-time geofence checking
 func (s *SpatialService) CheckGeofences(driverID string, location models.Location) (*models.SpatialAnalysisResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	// Check cache first
 	cacheKey := fmt.Sprintf("geofence_%s_%.6f_%.6f", driverID, location.Latitude, location.Longitude)
@@ -178,7 +179,7 @@ func (s *SpatialService) CheckGeofences(driverID string, location models.Locatio
 // CheckRouteDeviation analyzes route deviation
 func (s *SpatialService) CheckRouteDeviation(currentLocation models.Location, expectedRoute []models.Location) (*models.SpatialAnalysisResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	if len(expectedRoute) < 2 {
 		return nil, fmt.Errorf("expected route must have at least 2 points")
@@ -220,7 +221,7 @@ func (s *SpatialService) CheckRouteDeviation(currentLocation models.Location, ex
 // CheckDeliveryZone checks if location is in delivery zone
 func (s *SpatialService) CheckDeliveryZone(location models.Location) (*models.SpatialAnalysisResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	// Find nearby delivery points using spatial index
 	query := `
@@ -284,7 +285,7 @@ func (s *SpatialService) CheckDeliveryZone(location models.Location) (*models.Sp
 // AnalyzeTraffic performs traffic analysis
 func (s *SpatialService) AnalyzeTraffic(location models.Location) (*models.SpatialAnalysisResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	// Query traffic data from spatial database
 	query := `
@@ -336,7 +337,7 @@ func (s *SpatialService) AnalyzeTraffic(location models.Location) (*models.Spati
 // BatchAnalyze performs batch spatial analysis
 func (s *SpatialService) BatchAnalyze(request models.BatchSpatialAnalysisRequest) ([]models.SpatialAnalysisResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	results := make([]models.SpatialAnalysisResult, 0, len(request.Locations))
 
@@ -368,7 +369,7 @@ func (s *SpatialService) BatchAnalyze(request models.BatchSpatialAnalysisRequest
 // FindNearbyPOIs finds nearby points of interest
 func (s *SpatialService) FindNearbyPOIs(location models.Location, radius float64, poiType string, limit int) ([]models.PointOfInterest, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	// Cache key for POI queries
 	cacheKey := fmt.Sprintf("poi_%.6f_%.6f_%.0f_%s_%d",
@@ -443,7 +444,7 @@ func (s *SpatialService) FindNearbyPOIs(location models.Location, radius float64
 // CalculateDistance calculates distance between two points
 func (s *SpatialService) CalculateDistance(origin, destination models.Location, method string) (*models.DistanceResult, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	var query string
 	switch method {
@@ -476,7 +477,7 @@ func (s *SpatialService) CalculateDistance(origin, destination models.Location,
 // CheckIntersection checks if two geometries intersect
 func (s *SpatialService) CheckIntersection(geom1, geom2 interface{}) (bool, error) {
 	startTime := time.Now()
-	defer s.recordQueryTime(time.Since(startTime).Milliseconds())
+	defer func() { s.recordQueryTime(time.Since(startTime).Milliseconds()) }()
 
 	// Convert geometries to WKT
 	wkt1, err := s.geometryToWKT(geom1)
@@ -584,16 +585,12 @@ func (s *SpatialService) buildLineStringWKT(points []models.Location) string {
 		return ""
 	}
 
-	wkt := "LINESTRING("
+	line := make(geometry.LineString, len(points))
 	for i, point := range points {
-		if i > 0 {
-			wkt += ","
-		}
-		wkt += fmt.Sprintf("%.6f %.6f", point.Longitude, point.Latitude)
+		line[i] = geometry.Position{point.Longitude, point.Latitude}
 	}
-	wkt += ")"
 
-	return wkt
+	return geometry.WKT(line)
 }
 
 func (s *SpatialService) calculateDelayFromDeviation(distanceMeters float64) int {
@@ -601,12 +598,13 @@ func (s *SpatialService) calculateDelayFromDeviation(distanceMeters float64) int
 	return int(math.Ceil(distanceMeters / 100))
 }
 
+// geometryToWKT reads a geometry given as WKT or GeoJSON. A Feature stands
+// for its geometry and a FeatureCollection for a GeometryCollection.
 func (s *SpatialService) geometryToWKT(geom interface{}) (string, error) {
-	// This would convert various geometry types to WKT
-	// For now, assume it's already a WKT string
-	if wkt, ok := geom.(string); ok {
-		return wkt, nil
+	g, err := geometry.Decode(geom)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
 	}
 
-	return "", fmt.Errorf("unsupported geometry type")
+	return geometry.WKT(g), nil
 }
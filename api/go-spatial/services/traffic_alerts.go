@@ -0,0 +1,311 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Congested observations are grouped into incidents by cells of this many
+// degrees, about 500 m
+const trafficIncidentCellDegrees = 0.005
+
+// TrafficAlertSettings controls which congestion spikes are pushed to
+// which drivers
+type TrafficAlertSettings struct {
+	// Radius is how close in meters a driver's position or active route
+	// must come to a spike for the driver to be alerted
+	Radius float64
+	// MinCongestion is the average congestion level a cell's new
+	// observations must reach to count as a spike
+	MinCongestion float64
+	// ActiveRouteAge is how long after creation a stored route counts as
+	// the driver's active route
+	ActiveRouteAge time.Duration
+	// PositionMaxAge is how recent a driver's last location must be to
+	// count as their current position
+	PositionMaxAge time.Duration
+	// Suppression is how long an incident is not sent to the same driver
+	// again unless its severity rises
+	Suppression time.Duration
+}
+
+// TrafficIncident is a congestion spike: the observations received in one
+// cell since the last check whose average congestion crossed the threshold
+type TrafficIncident struct {
+	Key             string
+	Location        models.Location
+	CongestionLevel float64
+	AverageSpeed    float64
+	Observations    int
+	Timestamp       time.Time
+}
+
+// TrafficAlertMonitor watches new traffic observations for congestion
+// spikes and alerts the drivers whose position or active route is near one
+type TrafficAlertMonitor struct {
+	db       *sql.DB
+	hub      *WebSocketHub
+	settings TrafficAlertSettings
+
+	// Observations received after lastCheck have not been looked at yet
+	lastCheck time.Time
+	// Alerts already sent, keyed by driver and incident, so an incident
+	// is not re-sent on every check
+	sent  map[trafficAlertKey]sentTrafficAlert
+	mutex sync.Mutex
+}
+
+type trafficAlertKey struct {
+	driverID string
+	incident string
+}
+
+type sentTrafficAlert struct {
+	severity string
+	at       time.Time
+}
+
+func NewTrafficAlertMonitor(db *sql.DB, hub *WebSocketHub) *TrafficAlertMonitor {
+	return &TrafficAlertMonitor{
+		db:  db,
+		hub: hub,
+		settings: TrafficAlertSettings{
+			Radius:         1000,
+			MinCongestion:  0.7,
+			ActiveRouteAge: 12 * time.Hour,
+			PositionMaxAge: 15 * time.Minute,
+			Suppression:    30 * time.Minute,
+		},
+		lastCheck: time.Now(),
+		sent:      make(map[trafficAlertKey]sentTrafficAlert),
+	}
+}
+
+// SetAlertSettings overrides the default radius, threshold and suppression
+func (m *TrafficAlertMonitor) SetAlertSettings(settings TrafficAlertSettings) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settings = settings
+}
+
+func (m *TrafficAlertMonitor) alertSettings() TrafficAlertSettings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.settings
+}
+
+// Incidents groups the observations received in (since, until] into cells
+// and returns the cells congested enough to alert on. Observations measured
+// longer ago than trafficMaxAge, such as a backfilled feed, are ignored.
+func (m *TrafficAlertMonitor) Incidents(since, until time.Time) ([]TrafficIncident, error) {
+	settings := m.alertSettings()
+
+	query := `
+		SELECT FLOOR(ST_Y(location) / $4)::bigint AS cell_lat,
+		       FLOOR(ST_X(location) / $4)::bigint AS cell_lng,
+		       AVG(ST_Y(location)), AVG(ST_X(location)),
+		       AVG(congestion_level), AVG(average_speed),
+		       COUNT(*), MAX(timestamp)
+		FROM traffic_data
+		WHERE received_at > $1 AND received_at <= $2 AND timestamp >= $3
+		GROUP BY cell_lat, cell_lng
+		HAVING AVG(congestion_level) >= $5
+	`
+
+	rows, err := m.db.Query(query, since, until, until.Add(-trafficMaxAge),
+		trafficIncidentCellDegrees, settings.MinCongestion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find traffic incidents: %w", err)
+	}
+	defer rows.Close()
+
+	incidents := make([]TrafficIncident, 0)
+	for rows.Next() {
+		var cellLat, cellLng int64
+		var incident TrafficIncident
+		if err := rows.Scan(
+			&cellLat,
+			&cellLng,
+			&incident.Location.Latitude,
+			&incident.Location.Longitude,
+			&incident.CongestionLevel,
+			&incident.AverageSpeed,
+			&incident.Observations,
+			&incident.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan traffic incident: %w", err)
+		}
+		incident.Key = fmt.Sprintf("%d:%d", cellLat, cellLng)
+		incidents = append(incidents, incident)
+	}
+
+	return incidents, rows.Err()
+}
+
+// AffectedDrivers returns the drivers whose active route passes within the
+// alert radius of an incident or whose latest position is within it
+func (m *TrafficAlertMonitor) AffectedDrivers(incident TrafficIncident, now time.Time) ([]string, error) {
+	settings := m.alertSettings()
+
+	query := `
+		WITH incident AS (
+			SELECT ST_SetSRID(ST_Point($1, $2), 4326)::geography AS geog
+		)
+		SELECT active.driver_id
+		FROM (
+			SELECT DISTINCT ON (driver_id) driver_id, geometry
+			FROM routes
+			WHERE created_at >= $3
+			ORDER BY driver_id, created_at DESC
+		) active, incident
+		WHERE ST_DWithin(active.geometry::geography, incident.geog, $4)
+		UNION
+		SELECT latest.driver_id
+		FROM (
+			SELECT DISTINCT ON (driver_id) driver_id, location
+			FROM driver_locations
+			WHERE recorded_at >= $5
+			ORDER BY driver_id, recorded_at DESC
+		) latest, incident
+		WHERE ST_DWithin(latest.location::geography, incident.geog, $4)
+	`
+
+	rows, err := m.db.Query(query,
+		incident.Location.Longitude,
+		incident.Location.Latitude,
+		now.Add(-settings.ActiveRouteAge),
+		settings.Radius,
+		now.Add(-settings.PositionMaxAge),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find drivers near traffic incident: %w", err)
+	}
+	defer rows.Close()
+
+	drivers := make([]string, 0)
+	for rows.Next() {
+		var driverID string
+		if err := rows.Scan(&driverID); err != nil {
+			return nil, fmt.Errorf("failed to scan driver: %w", err)
+		}
+		drivers = append(drivers, driverID)
+	}
+
+	return drivers, rows.Err()
+}
+
+// Alert sends an incident to the given drivers, skipping drivers already
+// alerted about it within the suppression window unless it has become more
+// severe since. It returns how many alerts were sent.
+func (m *TrafficAlertMonitor) Alert(incident TrafficIncident, driverIDs []string, now time.Time) int {
+	severity := trafficSeverity(incident.CongestionLevel)
+	traffic := models.TrafficData{
+		Location:        incident.Location,
+		CongestionLevel: incident.CongestionLevel,
+		AverageSpeed:    incident.AverageSpeed,
+		Timestamp:       incident.Timestamp,
+	}
+
+	sent := 0
+	for _, driverID := range driverIDs {
+		if !m.markAlert(trafficAlertKey{driverID: driverID, incident: incident.Key}, severity, now) {
+			continue
+		}
+		if err := m.hub.SendTrafficAlert(driverID, traffic); err != nil {
+			log.Printf("Failed to send traffic alert to driver %s: %v", driverID, err)
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+// Check alerts drivers about the incidents among observations received
+// since the previous check
+func (m *TrafficAlertMonitor) Check(now time.Time) (int, error) {
+	m.mutex.Lock()
+	since := m.lastCheck
+	m.mutex.Unlock()
+
+	incidents, err := m.Incidents(since, now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, incident := range incidents {
+		drivers, err := m.AffectedDrivers(incident, now)
+		if err != nil {
+			return sent, err
+		}
+		sent += m.Alert(incident, drivers, now)
+	}
+
+	m.mutex.Lock()
+	m.lastCheck = now
+	m.pruneAlerts(now)
+	m.mutex.Unlock()
+
+	return sent, nil
+}
+
+// Run checks for new incidents at each interval
+func (m *TrafficAlertMonitor) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			sent, err := m.Check(now)
+			if err != nil {
+				log.Printf("Traffic alert check failed: %v", err)
+				continue
+			}
+			if sent > 0 {
+				log.Printf("Sent %d traffic alerts", sent)
+			}
+		}
+	}
+}
+
+// Helper methods
+
+func (m *TrafficAlertMonitor) markAlert(key trafficAlertKey, severity string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	previous, ok := m.sent[key]
+	if ok && now.Sub(previous.at) < m.settings.Suppression &&
+		trafficSeverityRank(severity) <= trafficSeverityRank(previous.severity) {
+		return false
+	}
+	m.sent[key] = sentTrafficAlert{severity: severity, at: now}
+	return true
+}
+
+// pruneAlerts forgets alerts whose suppression has expired; the caller
+// holds the mutex
+func (m *TrafficAlertMonitor) pruneAlerts(now time.Time) {
+	for key, alert := range m.sent {
+		if now.Sub(alert.at) >= m.settings.Suppression {
+			delete(m.sent, key)
+		}
+	}
+}
+
+func trafficSeverityRank(severity string) int {
+	switch severity {
+	case "high":
+		return 2
+	case "medium":
+		return 1
+	}
+	return 0
+}
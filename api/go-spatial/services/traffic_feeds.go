@@ -0,0 +1,341 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Feed formats understood without registering an adapter
+const (
+	TrafficFormatDATEX2 = "datex2"
+	TrafficFormatTMCCSV = "tmc-csv"
+	TrafficFormatProbe  = "probe"
+)
+
+// TrafficFeedAdapter parses one traffic feed format into observations.
+// Values are passed through as read; Ingest validates them.
+type TrafficFeedAdapter interface {
+	Parse(r io.Reader) ([]models.TrafficReport, error)
+}
+
+// TrafficFeedAdapterFunc lets a plain function serve as an adapter
+type TrafficFeedAdapterFunc func(r io.Reader) ([]models.TrafficReport, error)
+
+func (f TrafficFeedAdapterFunc) Parse(r io.Reader) ([]models.TrafficReport, error) {
+	return f(r)
+}
+
+// Congestion levels of the DATEX II traffic status values
+var datexTrafficStatus = map[string]float64{
+	"freeFlow":   0.1,
+	"heavy":      0.5,
+	"congested":  0.8,
+	"impossible": 1.0,
+}
+
+// ParseDATEX2 reads the elaborated data of a DATEX II publication. Speed,
+// free-flow speed and traffic status reported separately for the same
+// point and time are merged into one observation; points without a speed
+// are skipped.
+func ParseDATEX2(r io.Reader) ([]models.TrafficReport, error) {
+	type coordinates struct {
+		Latitude  *float64 `xml:"latitude"`
+		Longitude *float64 `xml:"longitude"`
+	}
+	type basicData struct {
+		Time     string      `xml:"measurementOrCalculationTime"`
+		Point    coordinates `xml:"pertinentLocation>pointByCoordinates>pointCoordinates"`
+		Display  coordinates `xml:"pertinentLocation>locationForDisplay"`
+		Speed    *float64    `xml:"averageVehicleSpeed>speed"`
+		FreeFlow *float64    `xml:"freeFlowSpeed>speed"`
+		Status   string      `xml:"trafficStatus>trafficStatusValue"`
+	}
+
+	var publicationTime time.Time
+	var order []string
+	merged := make(map[string]*models.TrafficReport)
+	hasSpeed := make(map[string]bool)
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DATEX II XML: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "publicationTime":
+			var value string
+			if err := decoder.DecodeElement(&value, &start); err != nil {
+				return nil, fmt.Errorf("failed to read DATEX II publication time: %w", err)
+			}
+			if publicationTime, err = parseFeedTime(value); err != nil {
+				return nil, err
+			}
+		case "basicData":
+			var data basicData
+			if err := decoder.DecodeElement(&data, &start); err != nil {
+				return nil, fmt.Errorf("failed to read DATEX II basic data: %w", err)
+			}
+
+			point := data.Point
+			if point.Latitude == nil || point.Longitude == nil {
+				point = data.Display
+			}
+			if point.Latitude == nil || point.Longitude == nil {
+				continue
+			}
+			measured, err := parseFeedTime(data.Time)
+			if err != nil {
+				return nil, err
+			}
+
+			key := observationKey(models.TrafficReport{Latitude: *point.Latitude, Longitude: *point.Longitude, Timestamp: measured})
+			report := merged[key]
+			if report == nil {
+				report = &models.TrafficReport{Latitude: *point.Latitude, Longitude: *point.Longitude, Timestamp: measured}
+				merged[key] = report
+				order = append(order, key)
+			}
+			if data.Speed != nil {
+				report.AverageSpeed = *data.Speed
+				hasSpeed[key] = true
+			}
+			if data.FreeFlow != nil {
+				report.FreeFlowSpeed = *data.FreeFlow
+			}
+			if level, ok := datexTrafficStatus[strings.TrimSpace(data.Status)]; ok {
+				report.CongestionLevel = &level
+			}
+		}
+	}
+
+	reports := make([]models.TrafficReport, 0, len(order))
+	for _, key := range order {
+		if !hasSpeed[key] {
+			continue
+		}
+		report := *merged[key]
+		if report.Timestamp.IsZero() {
+			report.Timestamp = publicationTime
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ParseTMCCSV reads TMC-style flow records: a header row, then one row per
+// location code and direction. Columns are matched by name: lat, lon and
+// sp (speed in km/h) are required; ff (free-flow speed), jf (jam factor 0
+// to 10), congestion (0 to 1), tmc, dir and timestamp are optional.
+func ParseTMCCSV(r io.Reader) ([]models.TrafficReport, error) {
+	aliases := map[string]string{
+		"lat": "lat", "latitude": "lat",
+		"lon": "lon", "lng": "lon", "longitude": "lon",
+		"sp": "sp", "speed": "sp", "average_speed": "sp",
+		"ff": "ff", "free_flow": "ff", "free_flow_speed": "ff",
+		"jf": "jf", "jam_factor": "jf",
+		"congestion": "congestion", "congestion_level": "congestion",
+		"tmc": "tmc", "location_code": "tmc",
+		"dir": "dir", "direction": "dir",
+		"timestamp": "timestamp", "time": "timestamp",
+	}
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []models.TrafficReport{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TMC CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if column, ok := aliases[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[column] = i
+		}
+	}
+	for _, required := range []string{"lat", "lon", "sp"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("TMC CSV header has no %s column", required)
+		}
+	}
+
+	reports := make([]models.TrafficReport, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TMC CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		field := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(column string) (float64, bool, error) {
+			value := field(column)
+			if value == "" {
+				return 0, false, nil
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("TMC CSV line %d: invalid %s %q", line, column, value)
+			}
+			return parsed, true, nil
+		}
+
+		required := func(column string) (float64, error) {
+			value, present, err := number(column)
+			if err == nil && !present {
+				err = fmt.Errorf("TMC CSV line %d: %s is required", line, column)
+			}
+			return value, err
+		}
+
+		var report models.TrafficReport
+		if report.Latitude, err = required("lat"); err != nil {
+			return nil, err
+		}
+		if report.Longitude, err = required("lon"); err != nil {
+			return nil, err
+		}
+		if report.AverageSpeed, err = required("sp"); err != nil {
+			return nil, err
+		}
+		if report.FreeFlowSpeed, _, err = number("ff"); err != nil {
+			return nil, err
+		}
+
+		if congestion, present, err := number("congestion"); err != nil {
+			return nil, err
+		} else if present {
+			report.CongestionLevel = &congestion
+		} else if jam, present, err := number("jf"); err != nil {
+			return nil, err
+		} else if present {
+			congestion := jam / 10
+			report.CongestionLevel = &congestion
+		}
+
+		if report.Timestamp, err = parseFeedTime(field("timestamp")); err != nil {
+			return nil, fmt.Errorf("TMC CSV line %d: %w", line, err)
+		}
+		if code := field("tmc"); code != "" {
+			report.ExternalID = code + field("dir")
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// ParseProbeRecords reads newline-delimited JSON speed records from probe
+// vehicles with probe_id, latitude, longitude, speed in km/h, an optional
+// heading and a timestamp as RFC 3339 or Unix seconds
+func ParseProbeRecords(r io.Reader) ([]models.TrafficReport, error) {
+	type probeRecord struct {
+		ProbeID   string          `json:"probe_id"`
+		Latitude  float64         `json:"latitude"`
+		Longitude float64         `json:"longitude"`
+		Speed     *float64        `json:"speed"`
+		Heading   *float64        `json:"heading"`
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	reports := make([]models.TrafficReport, 0)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var record probeRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("probe record %d: %w", line, err)
+		}
+		if record.Speed == nil {
+			return nil, fmt.Errorf("probe record %d: speed is required", line)
+		}
+
+		report := models.TrafficReport{
+			Latitude:     record.Latitude,
+			Longitude:    record.Longitude,
+			AverageSpeed: *record.Speed,
+			ExternalID:   record.ProbeID,
+		}
+		if record.Heading != nil {
+			report.Properties = map[string]interface{}{"heading": *record.Heading}
+		}
+
+		var err error
+		var unix float64
+		var value string
+		switch {
+		case len(record.Timestamp) == 0 || string(record.Timestamp) == "null":
+		case json.Unmarshal(record.Timestamp, &unix) == nil:
+			report.Timestamp = time.Unix(int64(unix), 0)
+		case json.Unmarshal(record.Timestamp, &value) == nil:
+			report.Timestamp, err = parseFeedTime(value)
+		default:
+			err = fmt.Errorf("invalid timestamp %s", record.Timestamp)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("probe record %d: %w", line, err)
+		}
+
+		reports = append(reports, report)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read probe records: %w", err)
+	}
+
+	return reports, nil
+}
+
+// parseFeedTime reads RFC 3339 times, local date-times taken as UTC, and
+// Unix seconds. An empty value is the zero time.
+func parseFeedTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05", value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
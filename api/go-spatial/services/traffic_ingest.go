@@ -0,0 +1,356 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Congestion is derived against this speed when a report gives neither a
+// congestion level nor a free-flow speed
+const defaultFreeFlowSpeed = 50.0 // km/h
+
+// Speeds above this are treated as sensor errors
+const maxTrafficSpeed = 250.0 // km/h
+
+// At most this many rejection reasons are returned with a batch
+const maxIngestErrors = 20
+
+// Feeds larger than this are not read
+const maxTrafficFeedSize = 32 * 1024 * 1024
+
+// ErrInvalidTrafficFeed is returned for feeds in an unknown format or that
+// cannot be parsed
+var ErrInvalidTrafficFeed = errors.New("invalid traffic feed")
+
+var trafficSourcePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,99}$`)
+
+// TrafficService stores traffic observations from the ingestion API and
+// from polled feeds
+type TrafficService struct {
+	db       *sql.DB
+	adapters map[string]TrafficFeedAdapter
+	feeds    []TrafficFeed
+	client   *http.Client
+	mutex    sync.RWMutex
+}
+
+// TrafficFeed is a feed polled for observations. Location is a file path,
+// a file:// URL or an http(s) URL.
+type TrafficFeed struct {
+	Source   string
+	Format   string
+	Location string
+}
+
+func NewTrafficService(db *sql.DB) *TrafficService {
+	return &TrafficService{
+		db: db,
+		adapters: map[string]TrafficFeedAdapter{
+			TrafficFormatDATEX2: TrafficFeedAdapterFunc(ParseDATEX2),
+			TrafficFormatTMCCSV: TrafficFeedAdapterFunc(ParseTMCCSV),
+			TrafficFormatProbe:  TrafficFeedAdapterFunc(ParseProbeRecords),
+		},
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// RegisterFeedAdapter adds or replaces the parser of a feed format
+func (s *TrafficService) RegisterFeedAdapter(format string, adapter TrafficFeedAdapter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.adapters[format] = adapter
+}
+
+func (s *TrafficService) adapter(format string) (TrafficFeedAdapter, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	adapter, ok := s.adapters[format]
+	return adapter, ok
+}
+
+// SetFeeds replaces the feeds polled by RunFeeds
+func (s *TrafficService) SetFeeds(feeds []TrafficFeed) error {
+	for _, feed := range feeds {
+		if err := ValidateTrafficSource(feed.Source); err != nil {
+			return err
+		}
+		if feed.Source == FleetProbeSource {
+			return fmt.Errorf("traffic feed source %q is reserved", feed.Source)
+		}
+		if _, ok := s.adapter(feed.Format); !ok {
+			return fmt.Errorf("unknown traffic feed format %q", feed.Format)
+		}
+		if feed.Location == "" {
+			return fmt.Errorf("traffic feed %q has no location", feed.Source)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.feeds = feeds
+	return nil
+}
+
+// ValidateTrafficSource checks that a source name is short, lower case
+// and free of spaces
+func ValidateTrafficSource(source string) error {
+	if !trafficSourcePattern.MatchString(source) {
+		return fmt.Errorf("source must be 1 to 100 lower case letters, digits, '_', '.' or '-'")
+	}
+	return nil
+}
+
+// ValidateTrafficReport rejects observations that are out of range, in the
+// future, or too old to inform the traffic history
+func ValidateTrafficReport(report models.TrafficReport, now time.Time) error {
+	if report.Latitude < -90 || report.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90")
+	}
+	if report.Longitude < -180 || report.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180")
+	}
+	if report.Latitude == 0 && report.Longitude == 0 {
+		return fmt.Errorf("latitude and longitude are required")
+	}
+	if math.IsNaN(report.AverageSpeed) || report.AverageSpeed < 0 || report.AverageSpeed > maxTrafficSpeed {
+		return fmt.Errorf("average_speed must be between 0 and %.0f km/h", maxTrafficSpeed)
+	}
+	if math.IsNaN(report.FreeFlowSpeed) || report.FreeFlowSpeed < 0 || report.FreeFlowSpeed > maxTrafficSpeed {
+		return fmt.Errorf("free_flow_speed must be between 0 and %.0f km/h", maxTrafficSpeed)
+	}
+	if level := report.CongestionLevel; level != nil && (math.IsNaN(*level) || *level < 0 || *level > 1) {
+		return fmt.Errorf("congestion_level must be between 0 and 1")
+	}
+	if report.Timestamp.After(now.Add(maxLocationClockSkew)) {
+		return fmt.Errorf("timestamp is in the future")
+	}
+	if !report.Timestamp.IsZero() && report.Timestamp.Before(now.Add(-trafficHistoryAge)) {
+		return fmt.Errorf("timestamp is older than the traffic history")
+	}
+	if len(report.ExternalID) > 200 {
+		return fmt.Errorf("external_id must be at most 200 characters")
+	}
+	return nil
+}
+
+// congestionLevel is the reported level, or how far the speed falls below
+// free flow
+func congestionLevel(report models.TrafficReport) float64 {
+	if report.CongestionLevel != nil {
+		return *report.CongestionLevel
+	}
+	freeFlow := report.FreeFlowSpeed
+	if freeFlow <= 0 {
+		freeFlow = defaultFreeFlowSpeed
+	}
+	return math.Max(0, math.Min(1, 1-report.AverageSpeed/freeFlow))
+}
+
+// observationKey identifies an observation within its source: the feed's
+// own location ID when it has one, the rounded coordinates otherwise
+func observationKey(report models.TrafficReport) string {
+	if report.ExternalID != "" {
+		return fmt.Sprintf("%s@%d", report.ExternalID, report.Timestamp.Unix())
+	}
+	return fmt.Sprintf("%.5f,%.5f@%d", report.Latitude, report.Longitude, report.Timestamp.Unix())
+}
+
+// Ingest validates and stores observations from a source. Invalid
+// observations are rejected one by one; observations the source already
+// reported at the same place and time are skipped as duplicates.
+func (s *TrafficService) Ingest(source string, reports []models.TrafficReport) (*models.TrafficIngestResult, error) {
+	if err := ValidateTrafficSource(source); err != nil {
+		return nil, err
+	}
+
+	result := &models.TrafficIngestResult{Source: source, Received: len(reports)}
+	reject := func(i int, err error) {
+		result.Rejected++
+		if len(result.Errors) < maxIngestErrors {
+			result.Errors = append(result.Errors, fmt.Sprintf("observation %d: %v", i, err))
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO traffic_data (
+			location, congestion_level, average_speed, timestamp, source, properties, observation_key
+		)
+		VALUES (ST_SetSRID(ST_Point($1, $2), 4326), $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (source, observation_key) DO NOTHING
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare traffic insert: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for i, report := range reports {
+		if err := ValidateTrafficReport(report, now); err != nil {
+			reject(i, err)
+			continue
+		}
+		if report.Timestamp.IsZero() {
+			report.Timestamp = now
+		}
+
+		properties := make(map[string]interface{}, len(report.Properties)+2)
+		for key, value := range report.Properties {
+			properties[key] = value
+		}
+		if report.FreeFlowSpeed > 0 {
+			properties["free_flow_speed"] = report.FreeFlowSpeed
+		}
+		if report.ExternalID != "" {
+			properties["external_id"] = report.ExternalID
+		}
+		propertiesJSON, err := json.Marshal(properties)
+		if err != nil {
+			reject(i, fmt.Errorf("invalid properties: %w", err))
+			continue
+		}
+
+		inserted, err := stmt.Exec(
+			report.Longitude,
+			report.Latitude,
+			congestionLevel(report),
+			report.AverageSpeed,
+			report.Timestamp,
+			source,
+			propertiesJSON,
+			observationKey(report),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store traffic observation: %w", err)
+		}
+		if rows, _ := inserted.RowsAffected(); rows == 0 {
+			result.Duplicates++
+			continue
+		}
+		result.Stored++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit traffic observations: %w", err)
+	}
+
+	return result, nil
+}
+
+// IngestFeed parses a feed in the given format and stores its observations
+func (s *TrafficService) IngestFeed(format, source string, r io.Reader) (*models.TrafficIngestResult, error) {
+	adapter, ok := s.adapter(format)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidTrafficFeed, format)
+	}
+
+	reports, err := adapter.Parse(io.LimitReader(r, maxTrafficFeedSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrafficFeed, err)
+	}
+
+	return s.Ingest(source, reports)
+}
+
+// PollFeed reads a feed from its file or URL and stores its observations
+func (s *TrafficService) PollFeed(feed TrafficFeed) (*models.TrafficIngestResult, error) {
+	body, err := s.openFeed(feed.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return s.IngestFeed(feed.Format, feed.Source, body)
+}
+
+func (s *TrafficService) openFeed(location string) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		response, err := s.client.Get(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch traffic feed: %w", err)
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, fmt.Errorf("traffic feed returned status %d", response.StatusCode)
+		}
+		return response.Body, nil
+	}
+
+	file, err := os.Open(strings.TrimPrefix(location, "file://"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open traffic feed: %w", err)
+	}
+	return file, nil
+}
+
+// RunFeeds polls every feed now and then at each interval
+func (s *TrafficService) RunFeeds(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.mutex.RLock()
+		feeds := s.feeds
+		s.mutex.RUnlock()
+
+		for _, feed := range feeds {
+			result, err := s.PollFeed(feed)
+			if err != nil {
+				log.Printf("Traffic feed %s failed: %v", feed.Source, err)
+				continue
+			}
+			log.Printf("Traffic feed %s: %d stored, %d duplicates, %d rejected",
+				feed.Source, result.Stored, result.Duplicates, result.Rejected)
+		}
+
+		<-ticker.C
+	}
+}
+
+// PruneTraffic deletes observations taken before the cutoff
+func (s *TrafficService) PruneTraffic(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM traffic_data WHERE timestamp < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune traffic data: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// RunRetention periodically prunes observations older than retention
+func (s *TrafficService) RunRetention(retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pruned, err := s.PruneTraffic(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Traffic retention failed: %v", err)
+				continue
+			}
+			if pruned > 0 {
+				log.Printf("Pruned %d traffic observations older than %s", pruned, retention)
+			}
+		}
+	}
+}
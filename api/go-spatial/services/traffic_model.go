@@ -0,0 +1,156 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Live observations describe the traffic at the time they were loaded and
+// fade out over this long, leaving the hour-of-week history
+const liveTrafficHorizon = time.Hour
+
+// How far back observations feed the hour-of-week history
+const trafficHistoryAge = 8 * 7 * 24 * time.Hour
+
+// History is averaged over cells of this many degrees
+const trafficHistoryCell = 0.005
+
+// Hourly travel times are computed for at most this many hours after the
+// route start; later legs use the last hour
+const maxTrafficHours = 24
+
+// TrafficConditions combine the live traffic around a set of stops with the
+// speeds usually observed there in each hour of the week
+type TrafficConditions struct {
+	observedAt time.Time
+	live       trafficGrid
+	history    map[int]trafficGrid // by HourOfWeek
+}
+
+// NewTrafficConditions indexes live observations taken at observedAt and
+// historical averages keyed by HourOfWeek
+func NewTrafficConditions(live []TrafficObservation, history map[int][]TrafficObservation, observedAt time.Time) *TrafficConditions {
+	conditions := &TrafficConditions{
+		observedAt: observedAt,
+		live:       newTrafficGrid(live),
+		history:    make(map[int]trafficGrid, len(history)),
+	}
+	for hour, observations := range history {
+		conditions.history[hour] = newTrafficGrid(observations)
+	}
+	return conditions
+}
+
+// HourOfWeek numbers the hours of the week in UTC from Monday 00:00
+func HourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return (int(t.Weekday())+6)%7*24 + t.Hour()
+}
+
+// speedAlong predicts the average speed in km/h along a leg entered at the
+// given time. Live observations dominate close to when they were taken and
+// give way to the history for that hour of the week.
+func (c *TrafficConditions) speedAlong(from, to models.Location, at time.Time) (float64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	weight := 1 - at.Sub(c.observedAt).Seconds()/liveTrafficHorizon.Seconds()
+	weight = math.Max(0, math.Min(1, weight))
+
+	live, hasLive := c.live.speedAlong(from, to)
+	historical, hasHistory := c.history[HourOfWeek(at)].speedAlong(from, to)
+
+	switch {
+	case hasLive && hasHistory:
+		return weight*live + (1-weight)*historical, true
+	case hasLive && weight > 0:
+		return live, true
+	case hasHistory:
+		return historical, true
+	}
+	return 0, false
+}
+
+// empty reports whether there is no traffic data at all
+func (c *TrafficConditions) empty() bool {
+	return c == nil || (len(c.live) == 0 && len(c.history) == 0)
+}
+
+// trafficConditions loads the live and historical traffic around the stops
+func (s *RouteService) trafficConditions(stops []models.Location) (*TrafficConditions, error) {
+	now := time.Now()
+
+	live, err := s.recentTraffic(stops)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.trafficHistory(stops, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTrafficConditions(live, history, now), nil
+}
+
+// trafficHistory averages the traffic observed around the stops over the
+// last eight weeks by hour of the week and location
+func (s *RouteService) trafficHistory(stops []models.Location, now time.Time) (map[int][]TrafficObservation, error) {
+	if len(stops) == 0 {
+		return nil, nil
+	}
+
+	minLng, minLat, maxLng, maxLat := trafficEnvelope(stops)
+	rows, err := s.db.Query(`
+		SELECT ST_Y(cell), ST_X(cell), hour_of_week, AVG(average_speed)
+		FROM (
+			SELECT ST_SnapToGrid(location, $5) AS cell,
+				(EXTRACT(ISODOW FROM timestamp AT TIME ZONE 'UTC')::int - 1) * 24 +
+					EXTRACT(HOUR FROM timestamp AT TIME ZONE 'UTC')::int AS hour_of_week,
+				average_speed
+			FROM traffic_data
+			WHERE location && ST_MakeEnvelope($1, $2, $3, $4, 4326)
+				AND timestamp > $6
+				AND average_speed > 0
+		) samples
+		GROUP BY cell, hour_of_week
+	`, minLng, minLat, maxLng, maxLat, trafficHistoryCell, now.Add(-trafficHistoryAge))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query traffic history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make(map[int][]TrafficObservation)
+	for rows.Next() {
+		var observation TrafficObservation
+		var hour int
+		if err := rows.Scan(&observation.Location.Latitude, &observation.Location.Longitude, &hour, &observation.Speed); err != nil {
+			return nil, fmt.Errorf("failed to scan traffic history: %w", err)
+		}
+		history[hour] = append(history[hour], observation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read traffic history: %w", err)
+	}
+
+	return history, nil
+}
+
+// trafficEnvelope is the bounding box of the stops widened so that
+// observations just outside it still count
+func trafficEnvelope(stops []models.Location) (minLng, minLat, maxLng, maxLat float64) {
+	minLat, maxLat = stops[0].Latitude, stops[0].Latitude
+	minLng, maxLng = stops[0].Longitude, stops[0].Longitude
+	for _, stop := range stops[1:] {
+		minLat = math.Min(minLat, stop.Latitude)
+		maxLat = math.Max(maxLat, stop.Latitude)
+		minLng = math.Min(minLng, stop.Longitude)
+		maxLng = math.Max(maxLng, stop.Longitude)
+	}
+
+	margin := trafficLegRadius / 111320.0
+	return minLng - margin, minLat - margin, maxLng + margin, maxLat + margin
+}
@@ -1,15 +1,25 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/websocket/v2"
 	"go-spatial/models"
 )
 
+// Maximum number of locations accepted in one location_batch message
+const maxLocationBatchSize = 500
+
+// Location messages a client may have waiting for processing
+const maxPendingLocationUpdates = 16
+
 // WebSocketHub manages WebSocket connections and message broadcasting
 type WebSocketHub struct {
 	// Registered clients
@@ -27,11 +37,30 @@ type WebSocketHub struct {
 	// Driver-specific channels
 	driverChannels map[string]map[*WebSocketClient]bool
 
+	// Subscribers by topic, and region subscriptions by client
+	topicSubscribers  map[string]map[*WebSocketClient]bool
+	regionSubscribers map[*WebSocketClient][]boundingBox
+
 	// Mutex for thread-safe operations
 	mutex sync.RWMutex
 
 	// Performance metrics
 	metrics *WebSocketMetrics
+
+	// Handles location updates sent by drivers
+	locationProcessor LocationProcessor
+
+	// Relays messages to hubs on other replicas
+	id        string
+	backplane Backplane
+
+	// Sent driver messages kept for replay until acked. Without a backplane
+	// message IDs start above epoch, which is derived from the start time so
+	// IDs keep rising across restarts.
+	epoch          uint64
+	outboxes       map[string]*driverOutbox
+	outboxSettings OutboxSettings
+	outboxMutex    sync.Mutex
 }
 
 // WebSocketClient represents a WebSocket client connection
@@ -42,16 +71,44 @@ type WebSocketClient struct {
 	// Driver ID associated with this connection
 	driverID string
 
-	// Send channel for outbound messages
+	// Roles from the verified token
+	roles []string
+
+	// Topics this connection is subscribed to, guarded by the hub mutex
+	subscriptions map[string]bool
+
+	// Send channel for outbound messages; never closed, so senders cannot
+	// panic on a client that has gone away
 	send chan []byte
 
+	// Closed once the client is unregistered; stops the writer and the
+	// location worker
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// Closed when the writer goroutine has exited
+	writerDone chan struct{}
+
+	// Location messages waiting for the location worker, so database work
+	// does not hold up the read loop
+	locationUpdates chan locationMessage
+
 	// Hub reference
 	hub *WebSocketHub
 
 	// Connection metadata
 	connectedAt time.Time
-	lastPing    time.Time
-	isActive    bool
+	// lastPing is written by the read loop and read by the hub's cleanup,
+	// so it is kept as atomic Unix nanoseconds
+	lastPing atomic.Int64
+	isActive bool
+}
+
+// locationMessage is a location_update or location_batch message waiting for
+// the location worker
+type locationMessage struct {
+	data  []byte
+	batch bool
 }
 
 // WebSocketMetrics tracks WebSocket performance
@@ -70,11 +127,22 @@ type WebSocketMetrics struct {
 // NewWebSocketHub creates a new WebSocket hub
 func NewWebSocketHub() *WebSocketHub {
 	return &WebSocketHub{
+		id:             newHubID(),
 		clients:        make(map[*WebSocketClient]bool),
 		register:       make(chan *WebSocketClient),
 		unregister:     make(chan *WebSocketClient),
 		broadcast:      make(chan []byte),
 		driverChannels: make(map[string]map[*WebSocketClient]bool),
+
+		topicSubscribers:  make(map[string]map[*WebSocketClient]bool),
+		regionSubscribers: make(map[*WebSocketClient][]boundingBox),
+
+		epoch:    uint64(time.Now().Unix()) << 32,
+		outboxes: make(map[string]*driverOutbox),
+		outboxSettings: OutboxSettings{
+			MaxMessages: 256,
+			Retention:   10 * time.Minute,
+		},
 		metrics: &WebSocketMetrics{
 			LastUpdated: time.Now(),
 		},
@@ -103,30 +171,63 @@ func (h *WebSocketHub) Run() {
 	}
 }
 
-// RegisterClient registers a new WebSocket client
-func (h *WebSocketHub) RegisterClient(conn *websocket.Conn, driverID string) *WebSocketClient {
+// SetBackplane connects the hub to other replicas. Messages are always
+// delivered to local clients directly and relayed to the others through the
+// backplane.
+func (h *WebSocketHub) SetBackplane(backplane Backplane) error {
+	h.backplane = backplane
+	return backplane.Subscribe(h.handleBackplaneMessage)
+}
+
+// SetLocationProcessor sets the handler for incoming location updates;
+// without one, location updates are rejected
+func (h *WebSocketHub) SetLocationProcessor(processor LocationProcessor) {
+	h.locationProcessor = processor
+}
+
+// RegisterClient registers a new WebSocket client for an authenticated
+// driver. The caller must then run Listen on the returned client.
+func (h *WebSocketHub) RegisterClient(conn *websocket.Conn, driverID string, roles []string) *WebSocketClient {
 	client := &WebSocketClient{
-		conn:        conn,
-		driverID:    driverID,
-		send:        make(chan []byte, 256),
-		hub:         h,
-		connectedAt: time.Now(),
-		lastPing:    time.Now(),
-		isActive:    true,
+		conn:            conn,
+		driverID:        driverID,
+		roles:           roles,
+		subscriptions:   make(map[string]bool),
+		send:            make(chan []byte, 256),
+		done:            make(chan struct{}),
+		writerDone:      make(chan struct{}),
+		locationUpdates: make(chan locationMessage, maxPendingLocationUpdates),
+		hub:             h,
+		connectedAt:     time.Now(),
+		isActive:        true,
 	}
+	client.touch()
 
-	h.register <- client
+	// Register synchronously so messages sent right after this call reach
+	// the new client
+	h.registerClient(client)
 
-	// Start client goroutines
+	// Start writer and location worker goroutines; reading happens in Listen
 	go client.writePump()
-	go client.readPump()
+	go client.processLocationUpdates()
 
 	return client
 }
 
 // BroadcastToDriver sends a message to all connections for a specific driver
+// on every replica. The message gets a sequence ID and is kept in the
+// driver's outbox until acked, so it can be replayed after a reconnect.
 func (h *WebSocketHub) BroadcastToDriver(driverID string, message interface{}) error {
+	// A message numbered later must not overtake this one
+	outbox := h.lockOutbox(driverID)
+	defer h.unlockOutbox(outbox)
+
+	id, err := h.nextMessageID(driverID)
+	if err != nil {
+		return err
+	}
 	msgBytes, err := json.Marshal(models.WebSocketMessage{
+		ID:        id,
 		Type:      "driver_message",
 		DriverID:  driverID,
 		Payload:   message,
@@ -136,27 +237,18 @@ func (h *WebSocketHub) BroadcastToDriver(driverID string, message interface{}) e
 		return err
 	}
 
-	h.mutex.RLock()
-	driverClients, exists := h.driverChannels[driverID]
-	h.mutex.RUnlock()
+	h.outboxMutex.Lock()
+	h.storeMessage(driverID, id, msgBytes)
+	h.outboxMutex.Unlock()
 
-	if !exists {
-		return nil // No clients for this driver
-	}
+	h.deliverToDriver(driverID, msgBytes)
 
-	for client := range driverClients {
-		if client.isActive {
-			select {
-			case client.send <- msgBytes:
-				h.metrics.incrementMessagesSent()
-			default:
-				// Client's send channel is full, close it
-				h.unregister <- client
-			}
-		}
-	}
-
-	return nil
+	return h.relay(BackplaneMessage{
+		Kind:      backplaneDriver,
+		DriverID:  driverID,
+		MessageID: id,
+		Data:      msgBytes,
+	})
 }
 
 // BroadcastToAll sends a message to all connected clients
@@ -171,7 +263,11 @@ func (h *WebSocketHub) BroadcastToAll(message interface{}) error {
 	}
 
 	h.broadcast <- msgBytes
-	return nil
+
+	return h.relay(BackplaneMessage{
+		Kind: backplaneAll,
+		Data: msgBytes,
+	})
 }
 
 // SendGeofenceAlert sends geofence alert to specific driver
@@ -183,6 +279,15 @@ func (h *WebSocketHub) SendGeofenceAlert(driverID string, alert models.GeofenceA
 	})
 }
 
+// SendRouteDeviationAlert sends route deviation alert to specific driver
+func (h *WebSocketHub) SendRouteDeviationAlert(driverID string, alert models.RouteDeviationAlert) error {
+	return h.BroadcastToDriver(driverID, map[string]interface{}{
+		"type":    "route_deviation",
+		"alert":   alert,
+		"message": "Driver has left the planned route",
+	})
+}
+
 // SendRouteUpdate sends route update to specific driver
 func (h *WebSocketHub) SendRouteUpdate(driverID string, route models.OptimizedRoute) error {
 	return h.BroadcastToDriver(driverID, map[string]interface{}{
@@ -194,21 +299,24 @@ func (h *WebSocketHub) SendRouteUpdate(driverID string, route models.OptimizedRo
 
 // SendTrafficAlert sends traffic alert to specific driver
 func (h *WebSocketHub) SendTrafficAlert(driverID string, trafficData models.TrafficData) error {
-	severity := "low"
-	if trafficData.CongestionLevel > 0.8 {
-		severity = "high"
-	} else if trafficData.CongestionLevel > 0.5 {
-		severity = "medium"
-	}
-
 	return h.BroadcastToDriver(driverID, map[string]interface{}{
 		"type":     "traffic_alert",
 		"traffic":  trafficData,
-		"severity": severity,
+		"severity": trafficSeverity(trafficData.CongestionLevel),
 		"message":  "Traffic conditions have changed",
 	})
 }
 
+// trafficSeverity grades a congestion level for traffic alerts
+func trafficSeverity(congestion float64) string {
+	if congestion > 0.8 {
+		return "high"
+	} else if congestion > 0.5 {
+		return "medium"
+	}
+	return "low"
+}
+
 // SendPerformanceMetrics sends performance metrics to monitoring clients
 func (h *WebSocketHub) SendPerformanceMetrics(metrics interface{}) error {
 	return h.BroadcastToAll(map[string]interface{}{
@@ -238,6 +346,76 @@ func (h *WebSocketHub) GetMetrics() *WebSocketMetrics {
 
 // Private methods
 
+func (h *WebSocketHub) deliverToDriver(driverID string, msgBytes []byte) {
+	full := make([]*WebSocketClient, 0)
+
+	// Send while holding the lock so a client cannot be unregistered
+	// mid-delivery
+	h.mutex.RLock()
+	for client := range h.driverChannels[driverID] {
+		if client.isActive {
+			select {
+			case client.send <- msgBytes:
+				h.metrics.incrementMessagesSent()
+			default:
+				full = append(full, client)
+			}
+		}
+	}
+	h.mutex.RUnlock()
+
+	// Client's send channel is full, close it
+	for _, client := range full {
+		h.unregister <- client
+	}
+}
+
+// relay publishes a message for the other replicas
+func (h *WebSocketHub) relay(message BackplaneMessage) error {
+	if h.backplane == nil {
+		return nil
+	}
+
+	message.Origin = h.id
+	if err := h.backplane.Publish(message); err != nil {
+		return fmt.Errorf("failed to relay message: %w", err)
+	}
+
+	return nil
+}
+
+// handleBackplaneMessage delivers a message published by another replica to
+// the matching local clients
+func (h *WebSocketHub) handleBackplaneMessage(message BackplaneMessage) {
+	if message.Origin == h.id {
+		return // Already delivered locally
+	}
+
+	switch message.Kind {
+	case backplaneDriver:
+		outbox := h.lockOutbox(message.DriverID)
+		if message.MessageID > 0 {
+			h.outboxMutex.Lock()
+			h.storeMessage(message.DriverID, message.MessageID, message.Data)
+			h.outboxMutex.Unlock()
+		}
+		h.deliverToDriver(message.DriverID, message.Data)
+		h.unlockOutbox(outbox)
+	case backplaneAck:
+		h.ackMessages(message.DriverID, message.MessageID)
+	case backplaneAll:
+		h.broadcast <- message.Data
+	case backplaneTopic:
+		var location models.Location
+		if message.Location != nil {
+			location = *message.Location
+		}
+		h.deliverToSubscribers(message.Topics, location, message.Data)
+	default:
+		log.Printf("Unknown backplane message kind: %s", message.Kind)
+	}
+}
+
 func (h *WebSocketHub) registerClient(client *WebSocketClient) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -270,7 +448,7 @@ func (h *WebSocketHub) registerClient(client *WebSocketClient) {
 	case client.send <- welcomeMsg:
 	default:
 		// If can't send welcome message, close client
-		close(client.send)
+		client.stop()
 	}
 }
 
@@ -290,8 +468,11 @@ func (h *WebSocketHub) unregisterClient(client *WebSocketClient) {
 			}
 		}
 
-		// Close send channel
-		close(client.send)
+		// Remove topic subscriptions
+		h.removeSubscriptions(client)
+
+		// Stop the writer; the send channel stays open for late senders
+		client.stop()
 
 		// Mark as inactive
 		client.isActive = false
@@ -305,22 +486,26 @@ func (h *WebSocketHub) unregisterClient(client *WebSocketClient) {
 }
 
 func (h *WebSocketHub) broadcastMessage(message []byte) {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	full := make([]*WebSocketClient, 0)
 
+	h.mutex.RLock()
 	for client := range h.clients {
 		if client.isActive {
 			select {
 			case client.send <- message:
 				h.metrics.incrementMessagesSent()
 			default:
-				// Client's send channel is full, unregister it
-				delete(h.clients, client)
-				close(client.send)
-				client.isActive = false
+				full = append(full, client)
 			}
 		}
 	}
+	h.mutex.RUnlock()
+
+	// Client's send channel is full, unregister it. This runs on the hub
+	// goroutine, so it cannot go through the unregister channel.
+	for _, client := range full {
+		h.unregisterClient(client)
+	}
 }
 
 func (h *WebSocketHub) updateMetrics() {
@@ -351,7 +536,7 @@ func (h *WebSocketHub) cleanupInactiveConnections() {
 
 			for client := range h.clients {
 				// Remove clients that haven't pinged in the last 2 minutes
-				if time.Since(client.lastPing) > 2*time.Minute {
+				if client.sinceLastPing() > 2*time.Minute {
 					clientsToRemove = append(clientsToRemove, client)
 				}
 			}
@@ -361,28 +546,90 @@ func (h *WebSocketHub) cleanupInactiveConnections() {
 			for _, client := range clientsToRemove {
 				h.unregister <- client
 			}
+
+			// Drop expired outbox messages
+			h.pruneOutboxes()
 		}
 	}
 }
 
 // WebSocketClient methods
 
+// Listen reads from the connection until it closes. The connection handler
+// must block here, since the connection is released once it returns.
+func (c *WebSocketClient) Listen() {
+	c.readPump()
+
+	// The writer must be done with the connection before it is released
+	<-c.writerDone
+}
+
+// DriverID returns the verified driver ID bound to this connection
+func (c *WebSocketClient) DriverID() string {
+	return c.driverID
+}
+
+// CloseWithCode sends a close frame with the given code and reason; the read
+// loop then exits and the client is unregistered
+func (c *WebSocketClient) CloseWithCode(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+// touch records activity from the client
+func (c *WebSocketClient) touch() {
+	c.lastPing.Store(time.Now().UnixNano())
+}
+
+// sinceLastPing is how long ago the client was last heard from
+func (c *WebSocketClient) sinceLastPing() time.Duration {
+	return time.Since(time.Unix(0, c.lastPing.Load()))
+}
+
+// stop signals the writer and location worker to exit
+func (c *WebSocketClient) stop() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// queue hands a message to the writer, dropping it when the client is gone
+// or its send channel is full
+func (c *WebSocketClient) queue(message []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- message:
+		return true
+	default:
+		// Channel full, client will be cleaned up
+		return false
+	}
+}
+
 func (c *WebSocketClient) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.writerDone)
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				log.Printf("WebSocket write error: %v", err)
 				return
@@ -403,10 +650,11 @@ func (c *WebSocketClient) readPump() {
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(512)
+	// Large enough for a full location batch
+	c.conn.SetReadLimit(128 * 1024)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
-		c.lastPing = time.Now()
+		c.touch()
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		return nil
 	})
@@ -422,7 +670,7 @@ func (c *WebSocketClient) readPump() {
 		}
 
 		c.hub.metrics.incrementMessagesReceived()
-		c.lastPing = time.Now()
+		c.touch()
 
 		// Handle incoming messages
 		c.handleMessage(message)
@@ -441,16 +689,151 @@ func (c *WebSocketClient) handleMessage(message []byte) {
 	case "ping":
 		c.sendPong()
 	case "subscribe":
-		// Handle subscription to specific events
-		log.Printf("Driver %s subscribed to events", c.driverID)
+		c.handleSubscription(message, true)
+	case "unsubscribe":
+		c.handleSubscription(message, false)
+	case "ack":
+		c.handleAck(message)
+	case "resume":
+		c.handleResume(message)
 	case "location_update":
-		// Handle location updates from client
-		log.Printf("Received location update from driver %s", c.driverID)
+		c.enqueueLocationUpdate(locationMessage{data: message})
+	case "location_batch":
+		c.enqueueLocationUpdate(locationMessage{data: message, batch: true})
 	default:
 		log.Printf("Unknown message type: %s", wsMessage.Type)
 	}
 }
 
+// enqueueLocationUpdate passes a location message to the location worker,
+// rejecting it when the client already has too many waiting
+func (c *WebSocketClient) enqueueLocationUpdate(message locationMessage) {
+	select {
+	case c.locationUpdates <- message:
+	default:
+		c.sendError("too many pending location updates")
+	}
+}
+
+// processLocationUpdates handles location messages one at a time, in the
+// order they arrived, until the client is unregistered
+func (c *WebSocketClient) processLocationUpdates() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.locationUpdates:
+			if message.batch {
+				c.handleLocationBatch(message.data)
+			} else {
+				c.handleLocationUpdate(message.data)
+			}
+		}
+	}
+}
+
+func (c *WebSocketClient) handleLocationUpdate(message []byte) {
+	var update struct {
+		Payload models.Location `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &update); err != nil {
+		c.sendError("invalid location payload")
+		return
+	}
+
+	location := update.Payload
+	if err := ValidateLocation(location); err != nil {
+		c.sendError(err.Error())
+		return
+	}
+	if location.Timestamp == 0 {
+		location.Timestamp = time.Now().Unix()
+	}
+
+	processor := c.hub.locationProcessor
+	if processor == nil {
+		c.sendError("location tracking is not available")
+		return
+	}
+
+	// Alerts are pushed to the driver's connections by the processor
+	result, err := processor.ProcessLocation(c.driverID, location)
+	if err != nil {
+		log.Printf("Failed to process location update from driver %s: %v", c.driverID, err)
+		c.sendError("failed to process location update")
+		return
+	}
+
+	c.sendMessage("location_processed", result)
+}
+
+// handleLocationBatch stores positions buffered by the client, for example
+// while it was offline
+func (c *WebSocketClient) handleLocationBatch(message []byte) {
+	var batch struct {
+		Payload struct {
+			Locations []models.Location `json:"locations"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &batch); err != nil {
+		c.sendError("invalid location batch payload")
+		return
+	}
+
+	locations := batch.Payload.Locations
+	if len(locations) == 0 || len(locations) > maxLocationBatchSize {
+		c.sendError("location batch must contain between 1 and 500 locations")
+		return
+	}
+
+	now := time.Now().Unix()
+	for i := range locations {
+		if err := ValidateLocation(locations[i]); err != nil {
+			c.sendError(fmt.Sprintf("location %d: %s", i, err.Error()))
+			return
+		}
+		if locations[i].Timestamp == 0 {
+			locations[i].Timestamp = now
+		}
+	}
+
+	processor := c.hub.locationProcessor
+	if processor == nil {
+		c.sendError("location tracking is not available")
+		return
+	}
+
+	result, err := processor.ProcessLocationBatch(c.driverID, locations)
+	if err != nil {
+		log.Printf("Failed to process location batch from driver %s: %v", c.driverID, err)
+		c.sendError("failed to process location batch")
+		return
+	}
+
+	c.sendMessage("location_processed", result)
+}
+
+func (c *WebSocketClient) sendError(message string) {
+	c.sendMessage("error", map[string]string{"message": message})
+}
+
+func (c *WebSocketClient) sendMessage(messageType string, payload interface{}) {
+	msg, err := json.Marshal(models.WebSocketMessage{
+		Type:      messageType,
+		DriverID:  c.driverID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal WebSocket message: %v", err)
+		return
+	}
+
+	if c.queue(msg) {
+		c.hub.metrics.incrementMessagesSent()
+	}
+}
+
 func (c *WebSocketClient) sendPong() {
 	pongMsg, _ := json.Marshal(models.WebSocketMessage{
 		Type:      "pong",
@@ -458,11 +841,15 @@ func (c *WebSocketClient) sendPong() {
 		Timestamp: time.Now(),
 	})
 
-	select {
-	case c.send <- pongMsg:
-	default:
-		// Channel full, client will be cleaned up
+	c.queue(pongMsg)
+}
+
+func newHubID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("hub-%d", time.Now().UnixNano())
 	}
+	return hex.EncodeToString(buf)
 }
 
 // WebSocketMetrics methods
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OutboxSettings bounds how many driver messages are kept for replay and
+// for how long
+type OutboxSettings struct {
+	MaxMessages int
+	Retention   time.Duration
+}
+
+// outboxEntry is a sent driver message kept until acked or expired
+type outboxEntry struct {
+	id        uint64
+	data      []byte
+	createdAt time.Time
+}
+
+// driverOutbox holds the unacknowledged messages of one driver in ID order
+type driverOutbox struct {
+	lastID  uint64
+	entries []outboxEntry
+	// Highest ID dropped by the size or age limit before it was acked
+	droppedID uint64
+
+	// Held while a message is numbered and delivered, so local clients get
+	// the driver's messages in ID order
+	sendMutex sync.Mutex
+	// Senders waiting on or holding sendMutex; the outbox is not pruned
+	// while there are any
+	senders   int
+	updatedAt time.Time
+}
+
+// ResumeResult reports what was replayed to a reconnecting client
+type ResumeResult struct {
+	Replayed int    `json:"replayed"`
+	LastID   uint64 `json:"last_id"`
+	// Complete is false when messages after the client's last ID have
+	// already expired from the outbox
+	Complete bool `json:"complete"`
+}
+
+// SetOutboxSettings overrides the default outbox limits
+func (h *WebSocketHub) SetOutboxSettings(settings OutboxSettings) {
+	h.outboxMutex.Lock()
+	defer h.outboxMutex.Unlock()
+
+	h.outboxSettings = settings
+}
+
+// Private methods
+
+// nextMessageID returns the next ID for a driver's messages. With a
+// backplane the ID comes from the sequence all replicas share. Otherwise
+// IDs count up by one from the hub's epoch, so they are contiguous within a
+// run and jump, without going backwards, when the service restarts.
+func (h *WebSocketHub) nextMessageID(driverID string) (uint64, error) {
+	if h.backplane != nil {
+		id, err := h.backplane.NextMessageID(driverID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate message ID: %w", err)
+		}
+		return id, nil
+	}
+
+	h.outboxMutex.Lock()
+	defer h.outboxMutex.Unlock()
+
+	outbox := h.outbox(driverID)
+	id := outbox.lastID + 1
+	if id <= h.epoch {
+		id = h.epoch + 1
+	}
+	outbox.lastID = id
+
+	return id, nil
+}
+
+// lockOutbox takes the driver's send lock; release it with unlockOutbox
+func (h *WebSocketHub) lockOutbox(driverID string) *driverOutbox {
+	h.outboxMutex.Lock()
+	outbox := h.outbox(driverID)
+	outbox.senders++
+	h.outboxMutex.Unlock()
+
+	outbox.sendMutex.Lock()
+	return outbox
+}
+
+func (h *WebSocketHub) unlockOutbox(outbox *driverOutbox) {
+	outbox.sendMutex.Unlock()
+
+	h.outboxMutex.Lock()
+	outbox.senders--
+	outbox.updatedAt = time.Now()
+	h.outboxMutex.Unlock()
+}
+
+// outbox returns the driver's outbox; the caller must hold outboxMutex
+func (h *WebSocketHub) outbox(driverID string) *driverOutbox {
+	outbox, ok := h.outboxes[driverID]
+	if !ok {
+		outbox = &driverOutbox{}
+		h.outboxes[driverID] = outbox
+	}
+	return outbox
+}
+
+// storeMessage keeps a sent message for replay; the caller must hold
+// outboxMutex
+func (h *WebSocketHub) storeMessage(driverID string, id uint64, data []byte) {
+	outbox := h.outbox(driverID)
+	if id > outbox.lastID {
+		outbox.lastID = id
+	}
+
+	entry := outboxEntry{id: id, data: data, createdAt: time.Now()}
+
+	// Messages relayed from other replicas may arrive out of order
+	i := len(outbox.entries)
+	for i > 0 && outbox.entries[i-1].id > id {
+		i--
+	}
+	if i > 0 && outbox.entries[i-1].id == id {
+		return
+	}
+	outbox.entries = append(outbox.entries, outboxEntry{})
+	copy(outbox.entries[i+1:], outbox.entries[i:])
+	outbox.entries[i] = entry
+
+	if max := h.outboxSettings.MaxMessages; max > 0 && len(outbox.entries) > max {
+		drop := len(outbox.entries) - max
+		outbox.droppedID = outbox.entries[drop-1].id
+		outbox.entries = outbox.entries[drop:]
+	}
+}
+
+// ackMessages drops a driver's messages up to and including id
+func (h *WebSocketHub) ackMessages(driverID string, id uint64) {
+	h.outboxMutex.Lock()
+	defer h.outboxMutex.Unlock()
+
+	outbox, ok := h.outboxes[driverID]
+	if !ok {
+		return
+	}
+
+	i := 0
+	for i < len(outbox.entries) && outbox.entries[i].id <= id {
+		i++
+	}
+	outbox.entries = outbox.entries[i:]
+}
+
+// replay resends the driver's messages newer than lastID to one client
+func (h *WebSocketHub) replay(client *WebSocketClient, lastID uint64) ResumeResult {
+	// Messages sent meanwhile wait, so they cannot overtake replayed ones
+	outbox := h.lockOutbox(client.driverID)
+	defer h.unlockOutbox(outbox)
+
+	h.outboxMutex.Lock()
+	result := ResumeResult{
+		LastID:   outbox.lastID,
+		Complete: outbox.droppedID <= lastID,
+	}
+	// The outbox does not survive a restart, so messages from an earlier
+	// run may have been lost
+	if h.backplane == nil && lastID > 0 && lastID <= h.epoch {
+		result.Complete = false
+	}
+
+	pending := make([][]byte, 0)
+	for _, entry := range outbox.entries {
+		if entry.id > lastID {
+			pending = append(pending, entry.data)
+		}
+	}
+	h.outboxMutex.Unlock()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return result
+	}
+
+	for _, data := range pending {
+		select {
+		case client.send <- data:
+			h.metrics.incrementMessagesSent()
+			result.Replayed++
+		default:
+			// Client is too slow; it can resume again from its last ack
+			result.Complete = false
+			return result
+		}
+	}
+
+	return result
+}
+
+// pruneOutboxes drops expired messages and empty outboxes
+func (h *WebSocketHub) pruneOutboxes() {
+	h.outboxMutex.Lock()
+	defer h.outboxMutex.Unlock()
+
+	cutoff := time.Now().Add(-h.outboxSettings.Retention)
+
+	for driverID, outbox := range h.outboxes {
+		i := 0
+		for i < len(outbox.entries) && outbox.entries[i].createdAt.Before(cutoff) {
+			outbox.droppedID = outbox.entries[i].id
+			i++
+		}
+		outbox.entries = outbox.entries[i:]
+
+		if len(outbox.entries) == 0 && outbox.senders == 0 && outbox.updatedAt.Before(cutoff) {
+			delete(h.outboxes, driverID)
+		}
+	}
+}
+
+func (c *WebSocketClient) handleAck(message []byte) {
+	var ack struct {
+		Payload struct {
+			ID uint64 `json:"id"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &ack); err != nil || ack.Payload.ID == 0 {
+		c.sendError("ack requires a message id")
+		return
+	}
+
+	c.hub.ackMessages(c.driverID, ack.Payload.ID)
+	c.hub.relay(BackplaneMessage{
+		Kind:      backplaneAck,
+		DriverID:  c.driverID,
+		MessageID: ack.Payload.ID,
+	})
+}
+
+func (c *WebSocketClient) handleResume(message []byte) {
+	var resume struct {
+		Payload struct {
+			LastID uint64 `json:"last_id"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &resume); err != nil {
+		c.sendError("resume requires last_id")
+		return
+	}
+
+	result := c.hub.replay(c, resume.Payload.LastID)
+	c.sendMessage("resumed", result)
+}
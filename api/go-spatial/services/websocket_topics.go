@@ -0,0 +1,324 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-spatial/models"
+)
+
+// Subscription topics:
+//
+//	driver:<driver_id>                      locations and alerts of one driver
+//	geofence:<geofence_id>                  alerts for one geofence
+//	bbox:<min_lng>,<min_lat>,<max_lng>,<max_lat>  locations and alerts inside a region
+//	alerts                                  every geofence and route alert
+const (
+	topicDriverPrefix   = "driver:"
+	topicGeofencePrefix = "geofence:"
+	topicBBoxPrefix     = "bbox:"
+	topicAllAlerts      = "alerts"
+)
+
+// Maximum number of topics a single connection may subscribe to
+const maxSubscriptionsPerClient = 100
+
+// boundingBox is a region subscription in WGS84 degrees
+type boundingBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+func (b boundingBox) contains(location models.Location) bool {
+	return location.Longitude >= b.MinLng && location.Longitude <= b.MaxLng &&
+		location.Latitude >= b.MinLat && location.Latitude <= b.MaxLat
+}
+
+// PublishLocation fans a driver location out to subscribers of the driver
+// and of regions containing it
+func (h *WebSocketHub) PublishLocation(driverID string, location models.Location) error {
+	return h.publish("location_update", driverID, location, location,
+		topicDriverPrefix+driverID)
+}
+
+// PublishGeofenceAlert fans a geofence alert out to subscribers of the
+// driver, the geofence, matching regions and all alerts
+func (h *WebSocketHub) PublishGeofenceAlert(alert models.GeofenceAlert) error {
+	return h.publish("geofence_alert", alert.DriverID, alert, alert.Location,
+		topicDriverPrefix+alert.DriverID,
+		topicGeofencePrefix+alert.GeofenceID,
+		topicAllAlerts)
+}
+
+// PublishRouteDeviation fans a route deviation alert out to subscribers of
+// the driver, matching regions and all alerts
+func (h *WebSocketHub) PublishRouteDeviation(alert models.RouteDeviationAlert) error {
+	return h.publish("route_deviation", alert.DriverID, alert, alert.Location,
+		topicDriverPrefix+alert.DriverID,
+		topicAllAlerts)
+}
+
+// Private methods
+
+// publish sends one message to every client subscribed to any of the topics
+// or to a region containing location; each client receives it once
+func (h *WebSocketHub) publish(messageType, driverID string, payload interface{}, location models.Location, topics ...string) error {
+	msgBytes, err := json.Marshal(models.WebSocketMessage{
+		Type:      messageType,
+		DriverID:  driverID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	h.deliverToSubscribers(topics, location, msgBytes)
+
+	return h.relay(BackplaneMessage{
+		Kind:     backplaneTopic,
+		Topics:   topics,
+		Location: &location,
+		Data:     msgBytes,
+	})
+}
+
+func (h *WebSocketHub) deliverToSubscribers(topics []string, location models.Location, msgBytes []byte) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	recipients := make(map[*WebSocketClient]bool)
+	for _, topic := range topics {
+		for client := range h.topicSubscribers[topic] {
+			recipients[client] = true
+		}
+	}
+	for client, boxes := range h.regionSubscribers {
+		for _, box := range boxes {
+			if box.contains(location) {
+				recipients[client] = true
+				break
+			}
+		}
+	}
+
+	for client := range recipients {
+		if !client.isActive {
+			continue
+		}
+		select {
+		case client.send <- msgBytes:
+			h.metrics.incrementMessagesSent()
+		default:
+			// Slow subscriber; drop the message rather than block the publisher
+			log.Printf("Dropping message for slow subscriber %s", client.driverID)
+		}
+	}
+}
+
+func (h *WebSocketHub) subscribe(client *WebSocketClient, topics []string) error {
+	boxes := make(map[string]boundingBox)
+
+	for _, topic := range topics {
+		if err := client.authorizeTopic(topic); err != nil {
+			return err
+		}
+		if strings.HasPrefix(topic, topicBBoxPrefix) {
+			box, err := parseBoundingBox(strings.TrimPrefix(topic, topicBBoxPrefix))
+			if err != nil {
+				return err
+			}
+			boxes[topic] = box
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return fmt.Errorf("connection is closed")
+	}
+
+	added := 0
+	for _, topic := range topics {
+		if !client.subscriptions[topic] {
+			added++
+		}
+	}
+	if len(client.subscriptions)+added > maxSubscriptionsPerClient {
+		return fmt.Errorf("at most %d subscriptions per connection", maxSubscriptionsPerClient)
+	}
+
+	for _, topic := range topics {
+		if client.subscriptions[topic] {
+			continue
+		}
+		client.subscriptions[topic] = true
+
+		if box, ok := boxes[topic]; ok {
+			h.regionSubscribers[client] = append(h.regionSubscribers[client], box)
+			continue
+		}
+
+		if h.topicSubscribers[topic] == nil {
+			h.topicSubscribers[topic] = make(map[*WebSocketClient]bool)
+		}
+		h.topicSubscribers[topic][client] = true
+	}
+
+	return nil
+}
+
+func (h *WebSocketHub) unsubscribe(client *WebSocketClient, topics []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, topic := range topics {
+		delete(client.subscriptions, topic)
+
+		if subscribers, ok := h.topicSubscribers[topic]; ok {
+			delete(subscribers, client)
+			if len(subscribers) == 0 {
+				delete(h.topicSubscribers, topic)
+			}
+		}
+	}
+
+	h.rebuildRegions(client)
+}
+
+// removeSubscriptions drops every subscription of a client; the caller must
+// hold the hub mutex
+func (h *WebSocketHub) removeSubscriptions(client *WebSocketClient) {
+	for topic := range client.subscriptions {
+		if subscribers, ok := h.topicSubscribers[topic]; ok {
+			delete(subscribers, client)
+			if len(subscribers) == 0 {
+				delete(h.topicSubscribers, topic)
+			}
+		}
+	}
+	delete(h.regionSubscribers, client)
+}
+
+// rebuildRegions recomputes a client's region list from its subscriptions;
+// the caller must hold the hub mutex
+func (h *WebSocketHub) rebuildRegions(client *WebSocketClient) {
+	boxes := make([]boundingBox, 0)
+	for topic := range client.subscriptions {
+		if !strings.HasPrefix(topic, topicBBoxPrefix) {
+			continue
+		}
+		if box, err := parseBoundingBox(strings.TrimPrefix(topic, topicBBoxPrefix)); err == nil {
+			boxes = append(boxes, box)
+		}
+	}
+
+	if len(boxes) == 0 {
+		delete(h.regionSubscribers, client)
+		return
+	}
+	h.regionSubscribers[client] = boxes
+}
+
+// authorizeTopic checks that the client may receive events for a topic.
+// Dispatchers and admins may subscribe to anything; drivers only to their
+// own driver topic.
+func (c *WebSocketClient) authorizeTopic(topic string) error {
+	switch {
+	case strings.HasPrefix(topic, topicDriverPrefix):
+		if strings.TrimPrefix(topic, topicDriverPrefix) == "" {
+			return fmt.Errorf("invalid topic %q", topic)
+		}
+	case strings.HasPrefix(topic, topicGeofencePrefix):
+		if strings.TrimPrefix(topic, topicGeofencePrefix) == "" {
+			return fmt.Errorf("invalid topic %q", topic)
+		}
+	case strings.HasPrefix(topic, topicBBoxPrefix), topic == topicAllAlerts:
+	default:
+		return fmt.Errorf("unknown topic %q", topic)
+	}
+
+	if c.hasRole(models.RoleDispatcher, models.RoleAdmin) {
+		return nil
+	}
+	if topic == topicDriverPrefix+c.driverID {
+		return nil
+	}
+
+	return fmt.Errorf("not allowed to subscribe to %q", topic)
+}
+
+func (c *WebSocketClient) hasRole(roles ...string) bool {
+	for _, have := range c.roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *WebSocketClient) handleSubscription(message []byte, subscribe bool) {
+	var request struct {
+		Payload struct {
+			Topics []string `json:"topics"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &request); err != nil || len(request.Payload.Topics) == 0 {
+		c.sendError("subscription requires a list of topics")
+		return
+	}
+
+	if subscribe {
+		if err := c.hub.subscribe(c, request.Payload.Topics); err != nil {
+			c.sendError(err.Error())
+			return
+		}
+	} else {
+		c.hub.unsubscribe(c, request.Payload.Topics)
+	}
+
+	c.sendMessage("subscriptions", map[string]interface{}{
+		"topics": c.hub.subscriptionsOf(c),
+	})
+}
+
+func (h *WebSocketHub) subscriptionsOf(client *WebSocketClient) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	topics := make([]string, 0, len(client.subscriptions))
+	for topic := range client.subscriptions {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func parseBoundingBox(value string) (boundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return boundingBox{}, fmt.Errorf("bbox must be min_lng,min_lat,max_lng,max_lat")
+	}
+
+	coords := make([]float64, 4)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return boundingBox{}, fmt.Errorf("bbox must be min_lng,min_lat,max_lng,max_lat")
+		}
+		coords[i] = v
+	}
+
+	box := boundingBox{MinLng: coords[0], MinLat: coords[1], MaxLng: coords[2], MaxLat: coords[3]}
+	if box.MinLng < -180 || box.MaxLng > 180 || box.MinLat < -90 || box.MaxLat > 90 ||
+		box.MinLng >= box.MaxLng || box.MinLat >= box.MaxLat {
+		return boundingBox{}, fmt.Errorf("invalid bbox %q", value)
+	}
+
+	return box, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+// probePing is a ping heading north at the given speed in km/h
+func probePing(latitude, kmh float64, at time.Time) models.Location {
+	speed := kmh / 3.6
+	heading := 5.0
+	return models.Location{
+		Latitude:  latitude,
+		Longitude: -74.0005,
+		Speed:     &speed,
+		Heading:   &heading,
+		Timestamp: at.Unix(),
+	}
+}
+
+func TestFleetProbeAverages(t *testing.T) {
+	probes := services.NewFleetProbeAggregator(nil)
+	now := time.Now().Add(-9 * time.Minute)
+
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 40, now), probePing(40.7002, 50, now)})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7003, 45, now)})
+	// A cell seen by a single driver is not reported
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7101, 30, now)})
+	// Parked vans and pings from before the window are ignored
+	probes.AddLocations("driver-3", []models.Location{probePing(40.7001, 0, now), probePing(40.7001, 5, now.Add(-time.Hour))})
+
+	reports := probes.Averages(now)
+	require.Len(t, reports, 1)
+
+	report := reports[0]
+	assert.InDelta(t, 45, report.AverageSpeed, 1e-9)
+	assert.InDelta(t, 40.7002, report.Latitude, 1e-9)
+	assert.Equal(t, 2, report.Properties["drivers"])
+	assert.Equal(t, 3, report.Properties["samples"])
+	require.NotNil(t, report.CongestionLevel)
+	assert.Less(t, *report.CongestionLevel, 0.2)
+
+	// Once the window moves on, slow traffic in the same cell counts as
+	// congestion against the free flow seen earlier
+	later := now.Add(11 * time.Minute)
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 10, time.Now())})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 14, time.Now())})
+
+	reports = probes.Averages(later)
+	require.Len(t, reports, 1)
+	assert.InDelta(t, 12, reports[0].AverageSpeed, 1e-9)
+	assert.InDelta(t, 45, reports[0].FreeFlowSpeed, 5)
+	assert.Greater(t, *reports[0].CongestionLevel, 0.7)
+	assert.Equal(t, report.ExternalID, reports[0].ExternalID)
+}
+
+func TestFleetProbeDirections(t *testing.T) {
+	probes := services.NewFleetProbeAggregator(nil)
+	now := time.Now()
+
+	south := probePing(40.7001, 15, now)
+	heading := 185.0
+	south.Heading = &heading
+
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 50, now), south})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 50, now), south})
+
+	// Each direction of the road is averaged on its own
+	reports := probes.Averages(now)
+	require.Len(t, reports, 2)
+	fast, slow := reports[0].AverageSpeed, reports[1].AverageSpeed
+	if fast < slow {
+		fast, slow = slow, fast
+	}
+	assert.InDelta(t, 50, fast, 1e-9)
+	assert.InDelta(t, 15, slow, 1e-9)
+}
+
+func TestFleetProbeFreeFlowNeedsEnoughDrivers(t *testing.T) {
+	probes := services.NewFleetProbeAggregator(nil)
+	now := time.Now().Add(-9 * time.Minute)
+
+	// A lone driver speeding through a cell does not raise its free flow
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 120, now)})
+	assert.Empty(t, probes.Averages(now))
+
+	later := now.Add(11 * time.Minute)
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 20, time.Now())})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 20, time.Now())})
+
+	// A cell only ever seen congested is measured against the prior speed
+	reports := probes.Averages(later)
+	require.Len(t, reports, 1)
+	assert.InDelta(t, 50, reports[0].FreeFlowSpeed, 1e-9)
+	assert.InDelta(t, 0.6, *reports[0].CongestionLevel, 1e-9)
+}
+
+func TestFleetProbeFreeFlowDecays(t *testing.T) {
+	probes := services.NewFleetProbeAggregator(nil)
+	probes.SetProbeSettings(services.FleetProbeSettings{
+		Window:           10 * time.Minute,
+		MinDrivers:       2,
+		FreeFlowHalfLife: 11 * time.Minute,
+	})
+	now := time.Now().Add(-9 * time.Minute)
+
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 90, now)})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 90, now)})
+	reports := probes.Averages(now)
+	require.Len(t, reports, 1)
+	assert.InDelta(t, 90, reports[0].FreeFlowSpeed, 1e-9)
+
+	// One half-life later the burst has worn halfway back to the prior
+	later := now.Add(11 * time.Minute)
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 30, time.Now())})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 30, time.Now())})
+	reports = probes.Averages(later)
+	require.Len(t, reports, 1)
+	assert.InDelta(t, 70, reports[0].FreeFlowSpeed, 1e-6)
+}
+
+func TestFleetProbeFreeFlowFollowsRoadClass(t *testing.T) {
+	graph, err := services.ReadOSMXML(strings.NewReader(roadTestXML))
+	require.NoError(t, err)
+
+	probes := services.NewFleetProbeAggregator(nil)
+	probes.SetRoadGraph(graph)
+	now := time.Now()
+
+	ping := func(latitude, longitude, kmh float64) models.Location {
+		location := probePing(latitude, kmh, now)
+		location.Longitude = longitude
+		return location
+	}
+
+	// On the residential street free flow starts at its class speed and
+	// cannot be pushed past its limit; on the motorway maxspeed applies
+	probes.AddLocations("driver-1", []models.Location{ping(40.0, -73.99, 80), ping(40.005, -73.99, 130)})
+	probes.AddLocations("driver-2", []models.Location{ping(40.0, -73.99, 80), ping(40.005, -73.99, 130)})
+
+	reports := probes.Averages(now)
+	require.Len(t, reports, 2)
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Latitude < reports[j].Latitude })
+	assert.InDelta(t, 37.5, reports[0].FreeFlowSpeed, 1e-9)
+	assert.InDelta(t, 100, reports[1].FreeFlowSpeed, 1e-9)
+}
+
+func TestFleetProbeClampsFutureTimestamps(t *testing.T) {
+	probes := services.NewFleetProbeAggregator(nil)
+	now := time.Now()
+
+	// Pings stamped ahead of the server clock leave the window on time
+	probes.AddLocations("driver-1", []models.Location{probePing(40.7001, 40, now.Add(4*time.Minute))})
+	probes.AddLocations("driver-2", []models.Location{probePing(40.7002, 40, now.Add(4*time.Minute))})
+	require.Len(t, probes.Averages(now), 1)
+	assert.Empty(t, probes.Averages(now.Add(10*time.Minute+time.Second)))
+}
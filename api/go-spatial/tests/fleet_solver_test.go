@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/services"
+)
+
+// fleetProblem places one depot at node 0 and every stop on its own node
+func fleetProblem(costs [][]float64, vehicles []services.FleetVehicleSpec, demands []int) services.FleetProblem {
+	problem := services.FleetProblem{Vehicles: vehicles}
+	for i := range problem.Vehicles {
+		problem.Vehicles[i].Costs = costs
+		problem.Vehicles[i].Durations = costs
+	}
+	for i, demand := range demands {
+		problem.Stops = append(problem.Stops, services.FleetStopSpec{Node: i + 1, Demand: demand})
+	}
+	return problem
+}
+
+func TestSolveFleetRespectsCapacity(t *testing.T) {
+	costs := randomCosts(25, 11, true)
+	demands := make([]int, len(costs)-1)
+	for i := range demands {
+		demands[i] = 1 + i%4
+	}
+	vehicles := []services.FleetVehicleSpec{{Capacity: 20}, {Capacity: 20}, {Capacity: 25}}
+
+	solution := services.SolveFleet(fleetProblem(costs, vehicles, demands), services.SolverOptions{Seed: 1, MaxIterations: 20})
+
+	assigned := make(map[int]bool)
+	for v, route := range solution.Routes {
+		load := 0
+		for _, stop := range route {
+			assert.False(t, assigned[stop], "stop %d is on two routes", stop)
+			assigned[stop] = true
+			load += demands[stop]
+		}
+		assert.LessOrEqual(t, load, vehicles[v].Capacity)
+	}
+
+	// 60 units of demand fit in 65 units of capacity
+	assert.Empty(t, solution.Unassigned)
+	assert.Len(t, assigned, len(demands))
+}
+
+func TestSolveFleetReportsUnassignedReasons(t *testing.T) {
+	costs := randomCosts(5, 3, true)
+	vehicles := []services.FleetVehicleSpec{{Capacity: 10}}
+
+	// Stop 0 is too big for any vehicle; stops 1..3 share the 10 units
+	solution := services.SolveFleet(fleetProblem(costs, vehicles, []int{11, 5, 5, 5}), services.SolverOptions{Seed: 1})
+
+	require.Len(t, solution.Unassigned, 2)
+	assert.Equal(t, services.UnassignedExceedsCapacity, solution.Unassigned[0])
+	for stop, reason := range solution.Unassigned {
+		if stop != 0 {
+			assert.Equal(t, services.UnassignedNoCapacityLeft, reason)
+		}
+	}
+	assert.Len(t, solution.Routes[0], 2)
+}
+
+func TestSolveFleetRespectsShift(t *testing.T) {
+	// Stops at 10, 20 and 1000 along a line from the depot
+	positions := []float64{0, 10, 20, 1000}
+	costs := make([][]float64, len(positions))
+	for i := range costs {
+		costs[i] = make([]float64, len(positions))
+		for j := range costs[i] {
+			if positions[i] > positions[j] {
+				costs[i][j] = positions[i] - positions[j]
+			} else {
+				costs[i][j] = positions[j] - positions[i]
+			}
+		}
+	}
+	vehicles := []services.FleetVehicleSpec{{Capacity: 10, MaxDuration: 100}}
+
+	solution := services.SolveFleet(fleetProblem(costs, vehicles, []int{1, 1, 1}), services.SolverOptions{Seed: 1})
+
+	assert.ElementsMatch(t, []int{0, 1}, solution.Routes[0])
+	assert.Equal(t, map[int]string{2: services.UnassignedOutsideShift}, solution.Unassigned)
+	assert.InDelta(t, 40.0, solution.Cost, 1e-9)
+}
+
+func TestSolveFleetHonoursTimeBudget(t *testing.T) {
+	// The largest fleet and stop count the handler accepts
+	costs := randomCosts(501, 5, true)
+	demands := make([]int, len(costs)-1)
+	for i := range demands {
+		demands[i] = 1 + i%3
+	}
+	vehicles := make([]services.FleetVehicleSpec, 50)
+	for i := range vehicles {
+		vehicles[i] = services.FleetVehicleSpec{Capacity: 25, MaxDuration: 60000}
+	}
+
+	started := time.Now()
+	solution := services.SolveFleet(fleetProblem(costs, vehicles, demands), services.SolverOptions{Seed: 1, TimeBudget: 100 * time.Millisecond})
+
+	assert.Less(t, time.Since(started), time.Second)
+	assigned := len(solution.Unassigned)
+	for _, route := range solution.Routes {
+		assigned += len(route)
+	}
+	assert.Equal(t, len(demands), assigned)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/geometry"
+)
+
+func TestGeoJSONRoundTrip(t *testing.T) {
+	for wkt, document := range map[string]string{
+		"POINT(-74.00597310486 40.71277599145)":                                            `{"type":"Point","coordinates":[-74.00597310486,40.71277599145]}`,
+		"POINT Z (-74.006 40.7128 12.5)":                                                   `{"type":"Point","coordinates":[-74.006,40.7128,12.5]}`,
+		"MULTIPOINT((-74 40.7),(-73.9 40.8))":                                              `{"type":"MultiPoint","coordinates":[[-74,40.7],[-73.9,40.8]]}`,
+		"LINESTRING(-74 40.7,-73.9 40.8)":                                                  `{"type":"LineString","coordinates":[[-74,40.7],[-73.9,40.8]]}`,
+		"MULTILINESTRING((-74 40.7,-73.9 40.8),(-73 41,-72 42))":                           `{"type":"MultiLineString","coordinates":[[[-74,40.7],[-73.9,40.8]],[[-73,41],[-72,42]]]}`,
+		"POLYGON((0 0,1 0,1 1,0 0))":                                                       `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`,
+		"MULTIPOLYGON(((0 0,1 0,1 1,0 0)),((2 2,3 2,3 3,2 2)))":                            `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[2,2],[3,2],[3,3],[2,2]]]]}`,
+		"GEOMETRYCOLLECTION(POINT(1 2),LINESTRING(0 0,1 1))":                               `{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1,2]},{"type":"LineString","coordinates":[[0,0],[1,1]]}]}`,
+		"MULTIPOINT EMPTY":                                                                 `{"type":"MultiPoint","coordinates":[]}`,
+		"GEOMETRYCOLLECTION(POLYGON((0 0,1 0,1 1,0 0),(0.2 0.1,0.8 0.1,0.8 0.7,0.2 0.1)))": `{"type":"GeometryCollection","geometries":[{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]],[[0.2,0.1],[0.8,0.1],[0.8,0.7],[0.2,0.1]]]}]}`,
+	} {
+		object, err := geometry.ParseGeoJSON([]byte(document))
+		require.NoError(t, err, document)
+
+		g := object.(geometry.Geometry)
+		assert.Equal(t, wkt, geometry.WKT(g))
+
+		encoded, err := json.Marshal(g)
+		require.NoError(t, err)
+		assert.JSONEq(t, document, string(encoded))
+
+		parsed, err := geometry.ParseWKT(wkt)
+		require.NoError(t, err, wkt)
+		assert.Equal(t, g, parsed, wkt)
+	}
+}
+
+func TestGeoJSONFeatures(t *testing.T) {
+	document := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":"depot","geometry":{"type":"Point","coordinates":[-74.0060,40.7128]},"properties":{"name":"Depot"}},
+		{"type":"Feature","id":7,"geometry":null,"properties":null},
+		{"type":"Feature","geometry":{"type":"LineString","coordinates":[[-74.0060,40.7128],[-73.9855,40.7580]]},"properties":{}}
+	]}`
+
+	object, err := geometry.ParseGeoJSON([]byte(document))
+	require.NoError(t, err)
+
+	collection := object.(geometry.FeatureCollection)
+	require.Len(t, collection.Features, 3)
+	assert.Equal(t, "depot", collection.Features[0].ID)
+	assert.Equal(t, "Depot", collection.Features[0].Properties["name"])
+	assert.Nil(t, collection.Features[1].Geometry)
+
+	// Features stand for their geometries, skipping those without one
+	g, err := geometry.AsGeometry(collection)
+	require.NoError(t, err)
+	assert.Equal(t, "GEOMETRYCOLLECTION(POINT(-74.006 40.7128),LINESTRING(-74.006 40.7128,-73.9855 40.758))", geometry.WKT(g))
+
+	encoded, err := json.Marshal(collection)
+	require.NoError(t, err)
+	assert.JSONEq(t, document, string(encoded))
+
+	g, err = geometry.Decode(map[string]interface{}{
+		"type":     "Feature",
+		"geometry": map[string]interface{}{"type": "Point", "coordinates": []interface{}{-74.0060, 40.7128}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, geometry.Point{-74.0060, 40.7128}, g)
+
+	_, err = geometry.Decode(map[string]interface{}{"type": "Feature", "geometry": nil})
+	assert.EqualError(t, err, "feature has no geometry")
+
+	// Surrounding whitespace does not hide a GeoJSON string
+	g, err = geometry.Decode("\n  {\"type\":\"Point\",\"coordinates\":[-74.006,40.7128]}\n")
+	require.NoError(t, err)
+	assert.Equal(t, geometry.Point{-74.006, 40.7128}, g)
+}
+
+func TestGeoJSONPrecision(t *testing.T) {
+	// Coordinates are not rounded to six decimals
+	g, err := geometry.Decode(`{"type":"Point","coordinates":[-74.00597310486123,40.71277599145567]}`)
+	require.NoError(t, err)
+	assert.Equal(t, "POINT(-74.00597310486123 40.71277599145567)", geometry.WKT(g))
+
+	g, err = geometry.Decode("POINT(0.000000001 -0.1234567890123)")
+	require.NoError(t, err)
+	assert.Equal(t, geometry.Point{0.000000001, -0.1234567890123}, g)
+}
+
+func TestGeoJSONErrors(t *testing.T) {
+	for document, message := range map[string]string{
+		`[1,2]`:                                                                  "GeoJSON must be an object",
+		`{"coordinates":[1,2]}`:                                                  "type: type is required",
+		`{"type":"Circle","coordinates":[1,2]}`:                                  `type: unsupported GeoJSON type "Circle"`,
+		`{"type":"Point"}`:                                                       "coordinates: coordinates is required",
+		`{"type":"Point","coordinates":[1]}`:                                     "coordinates: position must have 2 or 3 numbers, got 1",
+		`{"type":"Point","coordinates":[1,"2"]}`:                                 "coordinates[1]: must be a number",
+		`{"type":"Point","coordinates":[200,0]}`:                                 "coordinates: longitude 200 is outside -180 to 180",
+		`{"type":"LineString","coordinates":[[0,0]]}`:                            "coordinates: line string must have at least 2 positions",
+		`{"type":"LineString","coordinates":[[0,0],[1,1,5]]}`:                    "coordinates: positions mix 2 and 3 dimensions",
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`:           "coordinates[0]: linear ring must be closed",
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`:                 "coordinates[0]: linear ring must have at least 4 positions, got 3",
+		`{"type":"Polygon","coordinates":[]}`:                                    "coordinates: polygon must have at least one ring",
+		`{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[]]}`: "coordinates[1]: polygon must have at least one ring",
+		`{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[0,0],[1,0],[1,95],[0,0]]]]}`:              "coordinates[1][0][2]: latitude 95 is outside -90 to 90",
+		`{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[0,0]},{"type":"Point"}]}`:            "geometries[1].coordinates: coordinates is required",
+		`{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[0,91]}}]}`: "features[0].geometry.coordinates: latitude 91 is outside -90 to 90",
+		`{"type":"FeatureCollection","features":[{"type":"Point","coordinates":[0,0]}]}`:                                "features[0]: must be a Feature",
+		`{"type":"Feature","geometry":null,"properties":[]}`:                                                            "properties: properties must be an object or null",
+	} {
+		_, err := geometry.ParseGeoJSON([]byte(document))
+		assert.EqualError(t, err, message, document)
+	}
+}
+
+func TestWKTErrors(t *testing.T) {
+	for text, message := range map[string]string{
+		"POINT(1)":                   "WKT: position must have 2 or 3 numbers, got 1 at offset 6",
+		"POINT(1 2":                  `WKT: expected ")", got end of text at offset 9`,
+		"POINT Z (1 2)":              "WKT: Z position must have 3 numbers, got 2 at offset 9",
+		"POINT M (1 2 3)":            "WKT: measured (M) coordinates are not supported at offset 6",
+		"LINESTRING(0 0,x 1)":        `WKT: invalid number "x" at offset 15`,
+		"CIRCLE(0 0)":                `WKT: unsupported geometry type "CIRCLE" at offset 0`,
+		"POINT(1 2) POINT(3 4)":      `WKT: unexpected "POINT" after geometry at offset 11`,
+		"SRID=3857;POINT(1 2)":       "WKT: SRID 3857 is not supported, coordinates must be WGS 84 (4326)",
+		"POLYGON((0 0,1 0,1 1,0 1))": "coordinates[0]: linear ring must be closed",
+		"MULTIPOINT((0 0),(181 0))":  "coordinates[1]: longitude 181 is outside -180 to 180",
+		"POLYGON EMPTY":              "coordinates: polygon must have at least one ring",
+	} {
+		_, err := geometry.ParseWKT(text)
+		assert.EqualError(t, err, message, text)
+	}
+
+	g, err := geometry.ParseWKT("SRID=4326;multipoint (0 0, 1 1)")
+	require.NoError(t, err)
+	assert.Equal(t, geometry.MultiPoint{{0, 0}, {1, 1}}, g)
+}
+
+func TestWKBRoundTrip(t *testing.T) {
+	for _, wkt := range []string{
+		"POINT(-74.00597310486 40.71277599145)",
+		"POINT Z (-74.006 40.7128 12.5)",
+		"MULTIPOINT((-74 40.7),(-73.9 40.8))",
+		"LINESTRING(-74 40.7,-73.9 40.8)",
+		"MULTILINESTRING((-74 40.7,-73.9 40.8),(-73 41,-72 42))",
+		"POLYGON((0 0,1 0,1 1,0 0),(0.2 0.1,0.8 0.1,0.8 0.7,0.2 0.1))",
+		"MULTIPOLYGON(((0 0,1 0,1 1,0 0)),((2 2,3 2,3 3,2 2)))",
+		"GEOMETRYCOLLECTION(POINT(1 2),LINESTRING(0 0,1 1))",
+		"MULTIPOLYGON EMPTY",
+	} {
+		g, err := geometry.ParseWKT(wkt)
+		require.NoError(t, err, wkt)
+
+		parsed, err := geometry.ParseWKB(geometry.WKB(g))
+		require.NoError(t, err, wkt)
+		assert.Equal(t, wkt, geometry.WKT(parsed))
+	}
+
+	encoded, err := geometry.Encode(geometry.Point{1, 2}, geometry.FormatWKBHex)
+	require.NoError(t, err)
+	assert.Equal(t, "0101000000000000000000F03F0000000000000040", encoded)
+}
+
+func TestParseWKB(t *testing.T) {
+	for text, wkt := range map[string]string{
+		// Big endian ISO WKB
+		"00000000013FF00000000000004000000000000000": "POINT(1 2)",
+		// EWKB with an SRID, as PostGIS writes it
+		"0101000020E6100000000000000000F03F0000000000000040": "POINT(1 2)",
+		// EWKB Z flag and ISO Z code
+		"0101000080000000000000F03F00000000000000400000000000000840": "POINT Z (1 2 3)",
+		"01E9030000000000000000F03F00000000000000400000000000000840": "POINT Z (1 2 3)",
+	} {
+		data, err := hex.DecodeString(text)
+		require.NoError(t, err)
+
+		g, err := geometry.ParseWKB(data)
+		require.NoError(t, err, text)
+		assert.Equal(t, wkt, geometry.WKT(g), text)
+	}
+
+	for text, message := range map[string]string{
+		"0201000000":         "WKB: invalid byte order 2 at offset 0",
+		"010100000000":       "WKB: unexpected end of data at offset 5",
+		"0101000020110F0000": "WKB: SRID 3857 is not supported, coordinates must be WGS 84 (4326)",
+		"01D1070000":         "WKB: measured (M) coordinates are not supported",
+		"0108000000":         "WKB: unsupported geometry type 8 at offset 0",
+		"0104000000FFFFFFFF": "WKB: count 4294967295 exceeds the data at offset 5",
+		"0101000000000000000000F03F000000000000004000": "WKB: 1 trailing bytes",
+	} {
+		data, err := hex.DecodeString(text)
+		require.NoError(t, err)
+
+		_, err = geometry.ParseWKB(data)
+		assert.EqualError(t, err, message, text)
+	}
+}
+
+func TestPolylines(t *testing.T) {
+	// Google's documented example
+	line := geometry.LineString{{-120.2, 38.5}, {-120.95, 40.7}, {-126.453, 43.252}}
+	encoded, err := geometry.Polylines(line)
+	require.NoError(t, err)
+	assert.Equal(t, "_p~iF~ps|U_ulLnnqC_mqNvxq`@", encoded)
+
+	polygon := geometry.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}
+	encoded, err = geometry.Encode(polygon, geometry.FormatPolyline)
+	require.NoError(t, err)
+	assert.Equal(t, []string{geometry.EncodePolyline(polygon[0])}, encoded)
+
+	encoded, err = geometry.Encode(geometry.MultiPolygon{polygon, polygon}, geometry.FormatPolyline)
+	require.NoError(t, err)
+	assert.Len(t, encoded, 2)
+
+	_, err = geometry.Polylines(geometry.GeometryCollection{geometry.Point{1, 2}})
+	assert.EqualError(t, err, "a GeometryCollection cannot be encoded as polylines")
+
+	assert.True(t, geometry.ValidFormat(geometry.FormatWKBHex))
+	assert.False(t, geometry.ValidFormat("kml"))
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+// A residential street runs from node 1 through node 2 to node 3, and a
+// slightly longer one-way motorway from node 1 through node 4 to node 3.
+// Node 5 is only reachable on foot.
+var roadTestNodes = []struct {
+	id       int64
+	lat, lng float64
+}{
+	{1, 40.000, -74.00},
+	{2, 40.000, -73.99},
+	{3, 40.000, -73.98},
+	{4, 40.005, -73.99},
+	{5, 40.020, -73.99},
+}
+
+var roadTestWays = []struct {
+	refs []int64
+	tags map[string]string
+}{
+	{[]int64{1, 2, 3}, map[string]string{"highway": "residential"}},
+	{[]int64{1, 4, 3}, map[string]string{"highway": "motorway", "maxspeed": "100"}},
+	{[]int64{2, 5}, map[string]string{"highway": "footway"}},
+}
+
+const roadTestXML = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6">
+  <node id="1" lat="40.000" lon="-74.00"/>
+  <node id="2" lat="40.000" lon="-73.99"/>
+  <node id="3" lat="40.000" lon="-73.98"/>
+  <node id="4" lat="40.005" lon="-73.99"/>
+  <node id="5" lat="40.020" lon="-73.99"/>
+  <way id="10">
+    <nd ref="1"/><nd ref="2"/><nd ref="3"/>
+    <tag k="highway" v="residential"/>
+  </way>
+  <way id="11">
+    <nd ref="1"/><nd ref="4"/><nd ref="3"/>
+    <tag k="highway" v="motorway"/>
+    <tag k="maxspeed" v="100"/>
+  </way>
+  <way id="12">
+    <nd ref="2"/><nd ref="5"/>
+    <tag k="highway" v="footway"/>
+  </way>
+</osm>`
+
+func TestRoadGraphRoutesAlongFastestRoads(t *testing.T) {
+	graph, err := services.ReadOSMXML(strings.NewReader(roadTestXML))
+	require.NoError(t, err)
+	assertRoadRouting(t, graph)
+}
+
+func TestRoadGraphFromPBF(t *testing.T) {
+	graph, err := services.ReadOSMPBF(bytes.NewReader(roadTestPBF(t)))
+	require.NoError(t, err)
+	assertRoadRouting(t, graph)
+}
+
+func assertRoadRouting(t *testing.T, graph *services.RoadGraph) {
+	t.Helper()
+
+	// The footway and its far end are not part of the graph
+	assert.Equal(t, 4, graph.NodeCount())
+	assert.Equal(t, 6, graph.EdgeCount())
+
+	profile := services.NewRouteService(nil).SpeedProfile("van")
+	west := models.Location{Latitude: 40.0001, Longitude: -74.0001}
+	east := models.Location{Latitude: 40.0001, Longitude: -73.9799}
+
+	// Eastbound takes the motorway despite the longer distance
+	path, err := graph.Route(west, east, profile, services.RoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, path.Geometry, 5)
+	assert.Equal(t, west, path.Geometry[0])
+	assert.InDelta(t, 40.005, path.Geometry[2].Latitude, 1e-6)
+	assert.Equal(t, east, path.Geometry[4])
+	assert.Greater(t, path.Distance, 2000.0)
+
+	// Westbound the motorway is one-way, so the residential street is used
+	back, err := graph.Route(east, west, profile, services.RoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, back.Geometry, 5)
+	assert.InDelta(t, 40.0, back.Geometry[2].Latitude, 1e-6)
+	assert.Less(t, back.Distance, path.Distance)
+	assert.Greater(t, back.Duration, path.Duration)
+
+	// Trucks are slower on the motorway
+	truck, err := graph.Route(west, east, services.NewRouteService(nil).SpeedProfile("truck"), services.RoadOptions{})
+	require.NoError(t, err)
+	assert.Greater(t, truck.Duration, path.Duration)
+
+	_, err = graph.Route(west, models.Location{Latitude: 40.02, Longitude: -73.99}, profile, services.RoadOptions{})
+	assert.True(t, errors.Is(err, services.ErrNoRoadRoute))
+}
+
+// roadTestPBF encodes the test network as a zlib-compressed PBF file using
+// dense nodes
+func roadTestPBF(t *testing.T) []byte {
+	t.Helper()
+
+	var strs []string
+	stringIndex := func(s string) uint64 {
+		for i, existing := range strs {
+			if existing == s {
+				return uint64(i)
+			}
+		}
+		strs = append(strs, s)
+		return uint64(len(strs) - 1)
+	}
+	stringIndex("") // Index 0 is reserved
+
+	var ids, lats, lngs []uint64
+	var lastID, lastLat, lastLng int64
+	for _, node := range roadTestNodes {
+		lat := int64(node.lat * 1e7)
+		lng := int64(node.lng * 1e7)
+		ids = append(ids, zigzagEncode(node.id-lastID))
+		lats = append(lats, zigzagEncode(lat-lastLat))
+		lngs = append(lngs, zigzagEncode(lng-lastLng))
+		lastID, lastLat, lastLng = node.id, lat, lng
+	}
+	dense := concat(
+		protoBytes(1, packedVarints(ids)),
+		protoBytes(8, packedVarints(lats)),
+		protoBytes(9, packedVarints(lngs)),
+	)
+
+	var group []byte
+	group = append(group, protoBytes(2, dense)...)
+	for i, way := range roadTestWays {
+		var keys, values, refs []uint64
+		for key, value := range way.tags {
+			keys = append(keys, stringIndex(key))
+			values = append(values, stringIndex(value))
+		}
+		var last int64
+		for _, ref := range way.refs {
+			refs = append(refs, zigzagEncode(ref-last))
+			last = ref
+		}
+		group = append(group, protoBytes(3, concat(
+			protoVarint(1, uint64(10+i)),
+			protoBytes(2, packedVarints(keys)),
+			protoBytes(3, packedVarints(values)),
+			protoBytes(8, packedVarints(refs)),
+		))...)
+	}
+
+	var table []byte
+	for _, s := range strs {
+		table = append(table, protoBytes(1, []byte(s))...)
+	}
+	block := concat(protoBytes(1, table), protoBytes(2, group))
+
+	header := concat(
+		protoBytes(4, []byte("OsmSchema-V0.6")),
+		protoBytes(4, []byte("DenseNodes")),
+	)
+
+	var file bytes.Buffer
+	writeRoadTestBlob(t, &file, "OSMHeader", header)
+	writeRoadTestBlob(t, &file, "OSMData", block)
+	return file.Bytes()
+}
+
+func writeRoadTestBlob(t *testing.T, file *bytes.Buffer, blobType string, data []byte) {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, err := writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	blob := concat(protoVarint(2, uint64(len(data))), protoBytes(3, compressed.Bytes()))
+	header := concat(protoBytes(1, []byte(blobType)), protoVarint(3, uint64(len(blob))))
+
+	require.NoError(t, binary.Write(file, binary.BigEndian, uint32(len(header))))
+	file.Write(header)
+	file.Write(blob)
+}
+
+func protoVarint(field int, value uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field)<<3), value)
+}
+
+func protoBytes(field int, data []byte) []byte {
+	encoded := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	encoded = binary.AppendUvarint(encoded, uint64(len(data)))
+	return append(encoded, data...)
+}
+
+func packedVarints(values []uint64) []byte {
+	var encoded []byte
+	for _, value := range values {
+		encoded = binary.AppendUvarint(encoded, value)
+	}
+	return encoded
+}
+
+func zigzagEncode(value int64) uint64 {
+	return uint64(value<<1) ^ uint64(value>>63)
+}
+
+func concat(parts ...[]byte) []byte {
+	var joined []byte
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return joined
+}
+
+// Three roads lead from node 1 to node 3: a motorway closed to hazardous
+// goods in the south, a primary road with a toll section and a 3.5 m bridge
+// in the middle, and a residential street limited to 3.5 t in the north
+const restrictedRoadsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6">
+  <node id="1" lat="40.000" lon="-74.00"/>
+  <node id="2" lat="40.000" lon="-73.99"/>
+  <node id="3" lat="40.000" lon="-73.98"/>
+  <node id="4" lat="40.003" lon="-73.99"/>
+  <node id="5" lat="39.997" lon="-73.99"/>
+  <way id="20">
+    <nd ref="1"/><nd ref="5"/><nd ref="3"/>
+    <tag k="highway" v="motorway"/>
+    <tag k="hazmat" v="no"/>
+  </way>
+  <way id="21">
+    <nd ref="1"/><nd ref="2"/>
+    <tag k="highway" v="primary"/>
+    <tag k="toll" v="yes"/>
+  </way>
+  <way id="22">
+    <nd ref="2"/><nd ref="3"/>
+    <tag k="highway" v="primary"/>
+    <tag k="maxheight" v="3.5"/>
+  </way>
+  <way id="23">
+    <nd ref="1"/><nd ref="4"/><nd ref="3"/>
+    <tag k="highway" v="residential"/>
+    <tag k="maxweight" v="3.5 t"/>
+  </way>
+</osm>`
+
+func TestRoadGraphHonoursPreferencesAndRestrictions(t *testing.T) {
+	graph, err := services.ReadOSMXML(strings.NewReader(restrictedRoadsXML))
+	require.NoError(t, err)
+
+	service := services.NewRouteService(nil)
+	west := models.Location{Latitude: 40.0, Longitude: -74.0}
+	east := models.Location{Latitude: 40.0, Longitude: -73.98}
+
+	// via returns the latitude of the road taken between the two ends
+	via := func(vehicleType string, options services.RoadOptions) float64 {
+		path, err := graph.Route(west, east, service.SpeedProfile(vehicleType), options)
+		require.NoError(t, err)
+		require.Len(t, path.Geometry, 5)
+		return path.Geometry[2].Latitude
+	}
+
+	assert.InDelta(t, 39.997, via("van", services.RoadOptions{}), 1e-6)
+	assert.InDelta(t, 40.000, via("van", services.RoadOptions{AvoidHighways: true}), 1e-6)
+	assert.InDelta(t, 40.003, via("van", services.RoadOptions{AvoidHighways: true, AvoidTolls: true}), 1e-6)
+
+	limits, err := services.ParseRestrictions([]string{"hazmat", "height:4"})
+	require.NoError(t, err)
+	assert.InDelta(t, 40.003, via("truck", services.RoadOptions{Limits: limits}), 1e-6)
+
+	// A heavy hazmat truck has only the toll road left
+	restrictions := []string{"hazmat", "weight:18"}
+	limits, err = services.ParseRestrictions(restrictions)
+	require.NoError(t, err)
+	options := services.RoadOptions{AvoidTolls: true, Limits: limits}
+	assert.InDelta(t, 40.000, via("truck", options), 1e-6)
+
+	service.SetRoadGraph(graph)
+	legs, err := service.LegCosts([]models.Location{west, east}, nil, "truck", options, time.Now())
+	require.NoError(t, err)
+	unsatisfied := legs.Unsatisfied([]int{0, 1}, options, restrictions)
+	require.Len(t, unsatisfied, 1)
+	assert.Equal(t, services.PreferenceAvoidTolls, unsatisfied[0].Preference)
+
+	// Too high for the bridge as well
+	limits.Height = 4
+	_, err = graph.Route(west, east, service.SpeedProfile("truck"), services.RoadOptions{Limits: limits})
+	assert.True(t, errors.Is(err, services.ErrNoRoadRoute))
+}
+
+func TestUnsatisfiedPreferencesWithoutRoadNetwork(t *testing.T) {
+	restrictions := []string{"height:4.1"}
+	limits, err := services.ParseRestrictions(restrictions)
+	require.NoError(t, err)
+	options := services.RoadOptions{AvoidTolls: true, Limits: limits}
+
+	stops := []models.Location{
+		{Latitude: 40.0, Longitude: -74.0},
+		{Latitude: 40.0, Longitude: -73.98},
+	}
+	legs, err := services.NewRouteService(nil).LegCosts(stops, nil, "truck", options, time.Now())
+	require.NoError(t, err)
+
+	unsatisfied := legs.Unsatisfied([]int{0, 1}, options, restrictions)
+	require.Len(t, unsatisfied, 2)
+	assert.Equal(t, services.PreferenceAvoidTolls, unsatisfied[0].Preference)
+	assert.Equal(t, "height:4.1", unsatisfied[1].Preference)
+}
+
+func TestParseRestrictions(t *testing.T) {
+	limits, err := services.ParseRestrictions([]string{"Height:4.1", "weight: 18", "hazmat"})
+	require.NoError(t, err)
+	assert.Equal(t, services.VehicleLimits{Height: 4.1, Weight: 18, Hazmat: true}, limits)
+
+	for _, invalid := range []string{"height", "weight:-2", "hazmat:yes", "width:2.5"} {
+		_, err := services.ParseRestrictions([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
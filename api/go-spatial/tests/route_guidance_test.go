@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+func TestEncodePolyline(t *testing.T) {
+	// Example from Google's polyline format documentation
+	points := []models.Location{
+		{Latitude: 38.5, Longitude: -120.2},
+		{Latitude: 40.7, Longitude: -120.95},
+		{Latitude: 43.252, Longitude: -126.453},
+	}
+	assert.Equal(t, "_p~iF~ps|U_ulLnnqC_mqNvxq`@", services.EncodePolyline(points))
+}
+
+// Main Street runs east from node 1 to node 2, where Oak Avenue turns
+// north to node 3 and bends slightly without changing name
+const namedStreetsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6">
+  <node id="1" lat="40.000" lon="-74.000"/>
+  <node id="2" lat="40.000" lon="-73.990"/>
+  <node id="3" lat="40.005" lon="-73.990"/>
+  <node id="4" lat="40.010" lon="-73.989"/>
+  <way id="30">
+    <nd ref="1"/><nd ref="2"/>
+    <tag k="highway" v="secondary"/>
+    <tag k="name" v="Main Street"/>
+  </way>
+  <way id="31">
+    <nd ref="2"/><nd ref="3"/><nd ref="4"/>
+    <tag k="highway" v="residential"/>
+    <tag k="name" v="Oak Avenue"/>
+  </way>
+</osm>`
+
+func TestRoadPathLegManeuvers(t *testing.T) {
+	graph, err := services.ReadOSMXML(strings.NewReader(namedStreetsXML))
+	require.NoError(t, err)
+
+	origin := models.Location{Latitude: 40.0, Longitude: -74.0}
+	destination := models.Location{Latitude: 40.01, Longitude: -73.989}
+	path, err := graph.Route(origin, destination, services.NewRouteService(nil).SpeedProfile("van"), services.RoadOptions{})
+	require.NoError(t, err)
+
+	leg := path.Leg(2)
+	assert.Equal(t, path.Distance, leg.Distance)
+	assert.Equal(t, services.EncodePolyline(path.Geometry), leg.Polyline)
+	assert.Equal(t, "LineString", leg.Geometry.Type)
+	require.Len(t, leg.Geometry.Coordinates, len(path.Geometry))
+	assert.Equal(t, []float64{-74.0, 40.0}, leg.Geometry.Coordinates[0])
+
+	require.Len(t, leg.Maneuvers, 3)
+	depart, turn, arrive := leg.Maneuvers[0], leg.Maneuvers[1], leg.Maneuvers[2]
+
+	assert.Equal(t, "depart", depart.Type)
+	assert.Equal(t, "Head east on Main Street", depart.Instruction)
+	assert.InDelta(t, 853, depart.Distance, 5)
+
+	assert.Equal(t, "turn", turn.Type)
+	assert.Equal(t, "left", turn.Modifier)
+	assert.Equal(t, "Turn left onto Oak Avenue", turn.Instruction)
+	assert.InDelta(t, -73.99, turn.Location.Longitude, 1e-9)
+
+	assert.Equal(t, "arrive", arrive.Type)
+	assert.Equal(t, "Arrive at stop 2", arrive.Instruction)
+	assert.Equal(t, destination, arrive.Location)
+
+	assert.InDelta(t, leg.Duration, depart.Duration+turn.Duration, 1)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/services"
+)
+
+// lineDurations places stops on a line, one travel second per unit apart
+func lineDurations(positions []float64) [][]float64 {
+	matrix := make([][]float64, len(positions))
+	for i := range positions {
+		matrix[i] = make([]float64, len(positions))
+		for j := range positions {
+			matrix[i][j] = math.Abs(positions[i] - positions[j])
+		}
+	}
+	return matrix
+}
+
+func TestScheduleWaitsLatenessAndSlack(t *testing.T) {
+	durations := lineDurations([]float64{0, 100, 200})
+	problem := services.WindowProblem{
+		Costs:     durations,
+		Durations: durations,
+		Windows: []services.StopWindow{
+			services.OpenWindow(0),
+			{Earliest: 150, Latest: 300, Service: 10},
+			{Earliest: 0, Latest: 200, Service: 0},
+		},
+	}
+
+	timings := problem.Schedule([]int{0, 1, 2})
+	require.Len(t, timings, 3)
+
+	// Stop 1 opens at 150, so the vehicle waits 50 s and leaves at 160
+	assert.InDelta(t, 100, timings[1].Arrival, 1e-9)
+	assert.InDelta(t, 50, timings[1].Wait, 1e-9)
+	assert.InDelta(t, 160, timings[1].Departure, 1e-9)
+
+	// Stop 2 is reached at 260, 60 s after its deadline
+	assert.InDelta(t, 260, timings[2].Arrival, 1e-9)
+	assert.InDelta(t, 60, timings[2].Late, 1e-9)
+	assert.Zero(t, timings[2].Slack)
+
+	// Waiting at stop 1 absorbs a later arrival there, up to its slack
+	assert.InDelta(t, 50, timings[1].Slack, 1e-9)
+
+	cost, late := problem.Evaluate([]int{0, 1, 2})
+	assert.InDelta(t, 200, cost, 1e-9)
+	assert.InDelta(t, 60, late, 1e-9)
+}
+
+func TestSolveRouteWithWindowsMeetsDeadlines(t *testing.T) {
+	// The nearest stops come first by distance, but the farthest one closes
+	// before the others could be served
+	durations := lineDurations([]float64{0, 100, 200, 300, 400})
+	windows := []services.StopWindow{
+		services.OpenWindow(0),
+		services.OpenWindow(60),
+		services.OpenWindow(60),
+		services.OpenWindow(60),
+		{Latest: 450},
+	}
+	problem := services.WindowProblem{
+		Costs:        durations,
+		Durations:    durations,
+		Windows:      windows,
+		WaitingCosts: true,
+	}
+
+	plain := services.SolveRoute(durations, services.SolverOptions{Seed: 1, MaxIterations: 20})
+	_, plainLate := problem.Evaluate(append([]int{0}, plain.Order...))
+	require.Greater(t, plainLate, 0.0)
+
+	result := services.SolveRouteWithWindows(problem, services.SolverOptions{Seed: 1, MaxIterations: 20})
+	cost, late := problem.Evaluate(append([]int{0}, result.Order...))
+
+	assert.Zero(t, late)
+	assert.Equal(t, 4, result.Order[0])
+	assert.InDelta(t, cost, result.Cost, 1e-9)
+}
+
+func TestSolveRouteWithWindowsWithoutWindows(t *testing.T) {
+	costs := randomCosts(20, 5, true)
+	windows := make([]services.StopWindow, len(costs))
+	for i := range windows {
+		windows[i] = services.OpenWindow(0)
+	}
+
+	options := services.SolverOptions{Seed: 3, MaxIterations: 30}
+	withWindows := services.SolveRouteWithWindows(services.WindowProblem{
+		Costs:     costs,
+		Durations: costs,
+		Windows:   windows,
+	}, options)
+
+	assert.Equal(t, services.SolveRoute(costs, options).Order, withWindows.Order)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+func randomCosts(n int, seed int64, symmetric bool) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+
+	xs := make([]float64, n)
+	ys := make([]float64, n)
+	for i := range xs {
+		xs[i] = rng.Float64() * 10000
+		ys[i] = rng.Float64() * 10000
+	}
+
+	costs := make([][]float64, n)
+	for i := range costs {
+		costs[i] = make([]float64, n)
+		for j := range costs[i] {
+			if i == j {
+				continue
+			}
+			costs[i][j] = math.Hypot(xs[i]-xs[j], ys[i]-ys[j])
+			if !symmetric && i > j {
+				// Uphill is slower than downhill
+				costs[i][j] *= 1.3
+			}
+		}
+	}
+	return costs
+}
+
+func TestSolveRouteFindsOrderAlongLine(t *testing.T) {
+	// Stops on a line in scrambled order; the best open path from 0 visits
+	// them left to right
+	positions := []float64{0, 7, 2, 9, 4, 1, 8, 3, 6, 5}
+	costs := make([][]float64, len(positions))
+	for i := range costs {
+		costs[i] = make([]float64, len(positions))
+		for j := range costs[i] {
+			costs[i][j] = math.Abs(positions[i] - positions[j])
+		}
+	}
+
+	result := services.SolveRoute(costs, services.SolverOptions{Seed: 1})
+
+	require.Len(t, result.Order, len(positions)-1)
+	assert.InDelta(t, 9.0, result.Cost, 1e-9)
+	for i := 1; i < len(result.Order); i++ {
+		assert.Less(t, positions[result.Order[i-1]], positions[result.Order[i]])
+	}
+}
+
+func TestSolveRouteIsReproducibleUnderSeed(t *testing.T) {
+	costs := randomCosts(30, 7, false)
+	options := services.SolverOptions{Seed: 42, MaxIterations: 100}
+
+	first := services.SolveRoute(costs, options)
+	second := services.SolveRoute(costs, options)
+
+	assert.Equal(t, first.Order, second.Order)
+	assert.Equal(t, first.Cost, second.Cost)
+}
+
+func TestSolveRouteImprovesOnNaiveOrder(t *testing.T) {
+	for _, symmetric := range []bool{true, false} {
+		costs := randomCosts(40, 3, symmetric)
+
+		result := services.SolveRoute(costs, services.SolverOptions{Seed: 1, MaxIterations: 50})
+
+		// Every stop is visited exactly once
+		seen := make(map[int]bool)
+		for _, stop := range result.Order {
+			assert.False(t, seen[stop])
+			assert.True(t, stop > 0 && stop < len(costs))
+			seen[stop] = true
+		}
+		assert.Len(t, seen, len(costs)-1)
+
+		assert.LessOrEqual(t, result.Cost, result.ConstructionCost)
+		assert.Less(t, result.Cost, services.NaiveOrderCost(costs, false))
+	}
+}
+
+func TestObjectivesRankRoutesDifferently(t *testing.T) {
+	// A is 4 km north of the origin, B 5 km south; traffic is crawling
+	// halfway between the origin and A
+	stops := []models.Location{
+		{Latitude: 40.0, Longitude: -74.0},
+		{Latitude: 40.036, Longitude: -74.0},
+		{Latitude: 39.955, Longitude: -74.0},
+	}
+	now := time.Now()
+	traffic := services.NewTrafficConditions([]services.TrafficObservation{
+		{Location: models.Location{Latitude: 40.018, Longitude: -74.0}, Speed: 5},
+	}, nil, now)
+
+	legs, err := services.NewRouteService(nil).LegCosts(stops, traffic, "van", services.RoadOptions{}, now)
+	require.NoError(t, err)
+	options := services.SolverOptions{Seed: 1, MaxIterations: 10}
+
+	assert.Equal(t, []int{1, 2}, services.SolveRoute(legs.Objective(services.OptimizeForDistance), options).Order)
+	assert.Equal(t, []int{2, 1}, services.SolveRoute(legs.Objective(services.OptimizeForTime), options).Order)
+	assert.Equal(t, []int{2, 1}, services.SolveRoute(legs.Objective(services.OptimizeForFuel), options).Order)
+
+	// The jammed leg runs at the observed speed
+	assert.InDelta(t, legs.Distances[0][1]/1000.0/5*3600, legs.Durations[0][1], 1e-6)
+}
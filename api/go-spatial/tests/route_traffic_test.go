@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+// A route of about 2.5 km running north
+var corridorRoute = []models.Location{
+	{Latitude: 40.0, Longitude: -74.0},
+	{Latitude: 40.0112, Longitude: -74.0},
+	{Latitude: 40.0225, Longitude: -74.0},
+}
+
+func TestRouteCorridorTrafficSegments(t *testing.T) {
+	observations := []services.TrafficObservation{
+		// Faster than free flow on the first kilometer
+		{Location: models.Location{Latitude: 40.004, Longitude: -73.999}, Speed: 60, Congestion: 0.1},
+		// Slow traffic on the second kilometer, 200 m off the road
+		{Location: models.Location{Latitude: 40.0135, Longitude: -73.9976}, Speed: 25, Congestion: 0.7},
+		{Location: models.Location{Latitude: 40.0140, Longitude: -74.0}, Speed: 25, Congestion: 0.9},
+		// Outside the corridor
+		{Location: models.Location{Latitude: 40.0135, Longitude: -73.95}, Speed: 5, Congestion: 1},
+	}
+
+	traffic := services.RouteCorridorTraffic(corridorRoute, observations, 500, 50)
+
+	require.Len(t, traffic.Segments, 3)
+	assert.InDelta(t, 1000, traffic.Segments[0].Distance, 1)
+	assert.InDelta(t, 1000, traffic.Segments[1].Distance, 1)
+	assert.InDelta(t, 502, traffic.Segments[2].Distance, 5)
+	assert.Equal(t, corridorRoute[0], traffic.Segments[0].Start)
+	assert.Equal(t, traffic.Segments[0].End, traffic.Segments[1].Start)
+	assert.Equal(t, 3, traffic.DataPoints)
+
+	assert.Equal(t, 1, traffic.Segments[0].DataPoints)
+	assert.Zero(t, traffic.Segments[0].Delay)
+
+	// 1 km at 25 km/h instead of 50 km/h loses 72 seconds
+	second := traffic.Segments[1]
+	assert.Equal(t, 2, second.DataPoints)
+	assert.InDelta(t, 0.8, second.CongestionLevel, 1e-9)
+	assert.InDelta(t, 25, second.AverageSpeed, 1e-9)
+	assert.InDelta(t, 72, second.Delay, 1)
+
+	// Stretches without observations run at free flow
+	assert.Zero(t, traffic.Segments[2].DataPoints)
+	assert.Equal(t, 50.0, traffic.Segments[2].AverageSpeed)
+
+	require.NotNil(t, traffic.WorstSegment)
+	assert.Equal(t, 1, traffic.WorstSegment.Index)
+	assert.Equal(t, second.Delay, traffic.TotalDelay)
+
+	// The summary covers the observed kilometers
+	assert.InDelta(t, 0.45, traffic.CongestionLevel, 0.01)
+	assert.InDelta(t, 2000/(1000/60.0+1000/25.0), traffic.AverageSpeed, 0.1)
+	assert.InDelta(t, 40.01125, traffic.Location.Latitude, 0.0002)
+}
+
+func TestRouteCorridorTrafficWithoutObservations(t *testing.T) {
+	traffic := services.RouteCorridorTraffic(corridorRoute, nil, 1000, 40)
+
+	assert.Len(t, traffic.Segments, 3)
+	assert.Nil(t, traffic.WorstSegment)
+	assert.Zero(t, traffic.TotalDelay)
+	assert.Zero(t, traffic.CongestionLevel)
+	assert.Equal(t, 40.0, traffic.AverageSpeed)
+}
+
+func TestRouteCorridorTrafficShortRoute(t *testing.T) {
+	route := []models.Location{
+		{Latitude: 40.0, Longitude: -74.0},
+		{Latitude: 40.001, Longitude: -74.0},
+	}
+	traffic := services.RouteCorridorTraffic(route, nil, 1000, 50)
+
+	require.Len(t, traffic.Segments, 1)
+	assert.Equal(t, route[1], traffic.Segments[0].End)
+}
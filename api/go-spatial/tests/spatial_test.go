@@ -8,15 +8,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/suite"
 
 	"go-spatial/database"
 	"go-spatial/handlers"
+	"go-spatial/middleware"
 	"go-spatial/models"
 	"go-spatial/services"
 )
@@ -28,6 +31,9 @@ type SpatialTestSuite struct {
 	spatialService  *services.SpatialService
 	geofenceService *services.GeofenceService
 	routeService    *services.RouteService
+	locationHistory *services.LocationHistoryService
+	trafficService  *services.TrafficService
+	token           string
 }
 
 func (suite *SpatialTestSuite) SetupSuite() {
@@ -49,6 +55,9 @@ func (suite *SpatialTestSuite) SetupSuite() {
 	suite.spatialService = services.NewSpatialService(suite.db)
 	suite.geofenceService = services.NewGeofenceService(suite.db)
 	suite.routeService = services.NewRouteService(suite.db)
+	suite.locationHistory = services.NewLocationHistoryService(suite.db)
+	suite.trafficService = services.NewTrafficService(suite.db)
+	tracker := services.NewLocationTracker(services.NewWebSocketHub(), suite.geofenceService, suite.spatialService, suite.routeService, suite.locationHistory)
 
 	// Setup Fiber app
 	suite.app = fiber.New()
@@ -57,9 +66,22 @@ func (suite *SpatialTestSuite) SetupSuite() {
 	spatialHandler := handlers.NewSpatialHandler(suite.spatialService, suite.geofenceService)
 	routeHandler := handlers.NewRouteHandler(suite.routeService, suite.spatialService)
 	geofenceHandler := handlers.NewGeofenceHandler(suite.geofenceService, suite.spatialService)
+	locationHandler := handlers.NewLocationHandler(tracker, suite.locationHistory)
+	trafficHandler := handlers.NewTrafficHandler(suite.trafficService)
+
+	// Requests act as a dispatcher, who may act on any driver
+	verifier, err := middleware.NewTokenVerifier(middleware.JWTConfig{Secret: testJWTSecret})
+	suite.Require().NoError(err)
+	suite.token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"driver_id": "test-driver",
+		"roles":     []string{models.RoleDispatcher},
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testJWTSecret))
+	suite.Require().NoError(err)
 
 	// Setup routes
 	v1 := suite.app.Group("/api/v1")
+	v1.Use(middleware.Authentication(verifier))
 
 	spatial := v1.Group("/spatial")
 	spatial.Post("/analyze", spatialHandler.AnalyzeLocation)
@@ -69,12 +91,27 @@ func (suite *SpatialTestSuite) SetupSuite() {
 
 	routes := v1.Group("/route")
 	routes.Post("/optimize", routeHandler.OptimizeRoute)
+	routes.Post("/fleet/optimize", routeHandler.OptimizeFleet)
+	routes.Post("/matrix", routeHandler.DistanceMatrix)
 	routes.Post("/calculate", routeHandler.CalculateRoute)
+	routes.Get("/analytics", routeHandler.GetRouteAnalytics)
+	routes.Post("/:routeId/trace", routeHandler.RecordRouteTrace)
 
+	v1.Get("/geofences.geojson", geofenceHandler.ExportGeofences)
 	geofences := v1.Group("/geofences")
 	geofences.Get("/", geofenceHandler.ListGeofences)
+	geofences.Get("/:id", geofenceHandler.GetGeofence)
 	geofences.Post("/", geofenceHandler.CreateGeofence)
 	geofences.Post("/check", geofenceHandler.CheckGeofenceEntry)
+	geofences.Get("/activity", geofenceHandler.GetGeofenceActivity)
+
+	locations := v1.Group("/locations")
+	locations.Post("/", locationHandler.RecordLocations)
+	locations.Get("/:driverId/track", locationHandler.GetDriverTrack)
+
+	traffic := v1.Group("/traffic")
+	traffic.Post("/observations", trafficHandler.IngestObservations)
+	traffic.Post("/feeds/:format", trafficHandler.IngestFeed)
 
 	performance := v1.Group("/performance")
 	performance.Get("/metrics", spatialHandler.GetMetrics)
@@ -96,7 +133,7 @@ func (suite *SpatialTestSuite) SetupTest() {
 }
 
 func (suite *SpatialTestSuite) cleanupTestData() {
-	tables := []string{"traffic_data", "points_of_interest", "delivery_locations", "geofences"}
+	tables := []string{"driver_locations", "route_traces", "routes", "geofence_events", "driver_geofence_presence", "traffic_data", "points_of_interest", "delivery_locations", "geofences"}
 	for _, table := range tables {
 		_, err := suite.db.Exec(fmt.Sprintf("DELETE FROM %s", table))
 		suite.Require().NoError(err)
@@ -135,8 +172,7 @@ func (suite *SpatialTestSuite) insertTestData() {
 
 func (suite *SpatialTestSuite) TestHealthCheck() {
 	req := httptest.NewRequest("GET", "/api/v1/performance/health", nil)
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -167,8 +203,7 @@ func (suite *SpatialTestSuite) TestSpatialAnalysisGeofenceCheck() {
 
 	req := httptest.NewRequest("POST", "/api/v1/spatial/analyze", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -205,8 +240,7 @@ func (suite *SpatialTestSuite) TestSpatialAnalysisPerformance() {
 	for i := 0; i < 10; i++ {
 		req := httptest.NewRequest("POST", "/api/v1/spatial/analyze", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer test-token")
-		req.Header.Set("X-Driver-ID", "test-driver")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
 
 		resp, err := suite.app.Test(req, 5000)
 		suite.Require().NoError(err)
@@ -241,8 +275,7 @@ func (suite *SpatialTestSuite) TestBatchSpatialAnalysis() {
 
 	req := httptest.NewRequest("POST", "/api/v1/spatial/batch-analyze", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -291,8 +324,7 @@ func (suite *SpatialTestSuite) TestRouteOptimization() {
 
 	req := httptest.NewRequest("POST", "/api/v1/route/optimize", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 15000)
 	suite.Require().NoError(err)
@@ -307,14 +339,439 @@ func (suite *SpatialTestSuite) TestRouteOptimization() {
 	suite.Contains(optimizedRoute, "total_distance")
 	suite.Contains(optimizedRoute, "total_duration")
 
+	improvement := response["improvement"].(map[string]interface{})
+	suite.Equal("time", improvement["optimize_for"])
+	suite.True(improvement["duration_saved"].(float64) >= 0)
+
 	performance := response["performance"].(map[string]interface{})
 	suite.True(performance["calculation_time"].(float64) < 500) // Should be under 500ms
 }
 
+func (suite *SpatialTestSuite) TestDistanceMatrix() {
+	locations := []models.Location{
+		{Latitude: 40.7128, Longitude: -74.0060},
+		{Latitude: 40.7589, Longitude: -73.9851},
+		{Latitude: 40.7505, Longitude: -73.9707},
+	}
+
+	matrix := func(method string) models.DistanceMatrixResponse {
+		body, err := json.Marshal(models.DistanceMatrixRequest{
+			Origins:     locations,
+			Method:      method,
+			VehicleType: "van",
+		})
+		suite.Require().NoError(err)
+
+		req := httptest.NewRequest("POST", "/api/v1/route/matrix", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := suite.app.Test(req, 15000)
+		suite.Require().NoError(err)
+		suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+		var response models.DistanceMatrixResponse
+		suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+		return response
+	}
+
+	haversine := matrix("haversine")
+	suite.Require().Len(haversine.Distances, 3)
+	suite.Require().Len(haversine.Durations[0], 3)
+	suite.Zero(haversine.Distances[1][1])
+	suite.Greater(haversine.Durations[0][1], 0.0)
+
+	// PostGIS and Vincenty measure on the spheroid and agree closely
+	postgis := matrix("postgis")
+	vincenty := matrix("vincenty")
+	for i := range locations {
+		for j := range locations {
+			suite.InDelta(postgis.Distances[i][j], vincenty.Distances[i][j], 1.0)
+			suite.InDelta(haversine.Distances[i][j], vincenty.Distances[i][j], haversine.Distances[i][j]*0.005)
+		}
+	}
+
+	suite.True(matrix("vincenty").Cached)
+}
+
+func (suite *SpatialTestSuite) TestRouteAnalyticsFromRecordedTrips() {
+	request := models.RouteOptimizationRequest{
+		DriverID: "analytics-driver",
+		Origin:   models.Location{Latitude: 40.7128, Longitude: -74.0060},
+		Destinations: []models.Location{
+			{Latitude: 40.7829, Longitude: -73.9654},
+			{Latitude: 40.7505, Longitude: -73.9707},
+			{Latitude: 40.7589, Longitude: -73.9851},
+		},
+		Vehicle:     models.Vehicle{Type: "van"},
+		Preferences: models.RoutePreferences{OptimizeFor: "distance"},
+	}
+
+	response, err := suite.routeService.OptimizeRoute(request)
+	suite.Require().NoError(err)
+	suite.Require().NotEmpty(response.OptimizedRoute.ID)
+
+	// Drive the route slower than planned
+	start := time.Now().Add(-2 * time.Hour).Unix()
+	trace := make([]models.Location, 0)
+	for i, waypoint := range response.OptimizedRoute.Waypoints {
+		waypoint.Timestamp = start + int64(i)*1800
+		trace = append(trace, waypoint)
+	}
+
+	body, err := json.Marshal(models.RouteTraceRequest{Points: trace})
+	suite.Require().NoError(err)
+
+	req := httptest.NewRequest("POST", "/api/v1/route/"+response.OptimizedRoute.ID+"/trace", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusCreated, resp.StatusCode)
+
+	// Slow traffic was observed along the trace while it was driven
+	for _, point := range trace {
+		_, err := suite.db.Exec(`
+			INSERT INTO traffic_data (location, congestion_level, average_speed, timestamp, source)
+			VALUES (ST_SetSRID(ST_Point($1, $2), 4326), 0.9, 8, $3, 'test')
+		`, point.Longitude, point.Latitude, time.Unix(point.Timestamp, 0))
+		suite.Require().NoError(err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/route/analytics?driver_id=analytics-driver&days=1", nil)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err = suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Analytics models.RouteAnalytics `json:"analytics"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	suite.Require().NoError(err)
+
+	totals := result.Analytics.Totals
+	suite.Equal(1, totals.TotalRoutes)
+	suite.Equal(1, totals.RoutesOptimized)
+	suite.Equal(1, totals.TracedRoutes)
+	suite.True(totals.TotalDistanceKm > 0)
+	suite.True(totals.OptimizationSavings.DistanceSavedKm >= 0)
+	suite.True(totals.TrafficDelayMinutes > 0)
+	suite.Equal(1, totals.DelayedRoutes)
+	suite.True(totals.OverrunMinutes > 0)
+	suite.Require().Len(result.Analytics.ByDriver, 1)
+	suite.Equal("analytics-driver", result.Analytics.ByDriver[0].DriverID)
+}
+
+func (suite *SpatialTestSuite) TestDeviationFollowsRoadGeometry() {
+	// The road turns a corner between two stops
+	_, err := suite.db.Exec(`
+		INSERT INTO routes (driver_id, route_type, waypoints, geometry,
+			total_distance, total_duration, estimated_fuel, naive_distance, naive_duration, naive_fuel)
+		VALUES ('road-driver', 'calculated',
+			'[{"latitude":40.7128,"longitude":-74.0060},{"latitude":40.7228,"longitude":-73.9960}]',
+			ST_GeomFromText('LINESTRING(-74.006 40.7128,-74.006 40.7228,-73.996 40.7228)', 4326),
+			2000, 300, 0.2, 2000, 300, 0.2)
+	`)
+	suite.Require().NoError(err)
+
+	post := func(location models.Location) map[string]interface{} {
+		location.Timestamp = time.Now().Unix()
+		body, err := json.Marshal(models.LocationIngestRequest{
+			DriverID:  "road-driver",
+			Locations: []models.Location{location},
+		})
+		suite.Require().NoError(err)
+
+		req := httptest.NewRequest("POST", "/api/v1/locations/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := suite.app.Test(req, 10000)
+		suite.Require().NoError(err)
+		suite.Require().Equal(http.StatusCreated, resp.StatusCode)
+
+		var response map[string]interface{}
+		suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+		return response
+	}
+
+	// At the corner the driver is on the road, far from the straight line
+	suite.Nil(post(models.Location{Latitude: 40.7228, Longitude: -74.0060})["deviation"])
+
+	// Cutting across is off the road
+	suite.NotNil(post(models.Location{Latitude: 40.7160, Longitude: -74.0010})["deviation"])
+}
+
+func (suite *SpatialTestSuite) TestLiveLocationsRecordRouteTrace() {
+	response, err := suite.routeService.OptimizeRoute(models.RouteOptimizationRequest{
+		DriverID:     "trace-driver",
+		Origin:       models.Location{Latitude: 40.7128, Longitude: -74.0060},
+		Destinations: []models.Location{{Latitude: 40.7180, Longitude: -74.0010}},
+		Vehicle:      models.Vehicle{Type: "van"},
+	})
+	suite.Require().NoError(err)
+
+	now := time.Now().Unix()
+	body, err := json.Marshal(models.LocationIngestRequest{
+		DriverID: "trace-driver",
+		Locations: []models.Location{
+			{Latitude: 40.7130, Longitude: -74.0058, Timestamp: now - 60},
+			{Latitude: 40.7150, Longitude: -74.0040, Timestamp: now},
+		},
+	})
+	suite.Require().NoError(err)
+
+	req := httptest.NewRequest("POST", "/api/v1/locations/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusCreated, resp.StatusCode)
+
+	var points int
+	err = suite.db.QueryRow(`SELECT COUNT(*) FROM route_traces WHERE route_id = $1`, response.OptimizedRoute.ID).Scan(&points)
+	suite.Require().NoError(err)
+	suite.Equal(2, points)
+}
+
+func (suite *SpatialTestSuite) TestDriverLocationTrack() {
+	start := time.Now().Add(-time.Hour).Unix()
+	request := models.LocationIngestRequest{
+		DriverID: "track-driver",
+		Locations: []models.Location{
+			{Latitude: 40.7128, Longitude: -74.0060, Timestamp: start},
+			{Latitude: 40.7150, Longitude: -74.0040, Timestamp: start + 60},
+			{Latitude: 40.7180, Longitude: -74.0010, Timestamp: start + 120},
+		},
+	}
+
+	body, err := json.Marshal(request)
+	suite.Require().NoError(err)
+
+	req := httptest.NewRequest("POST", "/api/v1/locations/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusCreated, resp.StatusCode)
+
+	req = httptest.NewRequest("GET", "/api/v1/locations/track-driver/track?hours=2", nil)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	resp, err = suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var feature struct {
+		Type     string `json:"type"`
+		Geometry struct {
+			Type        string      `json:"type"`
+			Coordinates [][]float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties struct {
+			PointCount     int     `json:"point_count"`
+			DistanceMeters float64 `json:"distance_meters"`
+		} `json:"properties"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&feature)
+	suite.Require().NoError(err)
+
+	suite.Equal("Feature", feature.Type)
+	suite.Equal("LineString", feature.Geometry.Type)
+	suite.Require().Len(feature.Geometry.Coordinates, 3)
+	suite.Equal([]float64{-74.0060, 40.7128}, feature.Geometry.Coordinates[0])
+	suite.Equal(3, feature.Properties.PointCount)
+	suite.True(feature.Properties.DistanceMeters > 0)
+
+	req = httptest.NewRequest("GET", "/api/v1/locations/track-driver/track?hours=2&format=points&limit=2", nil)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+	resp, err = suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var track models.DriverTrack
+	err = json.NewDecoder(resp.Body).Decode(&track)
+	suite.Require().NoError(err)
+	suite.Len(track.Points, 2)
+	suite.True(track.Truncated)
+
+	// Pruning removes everything recorded before the cutoff
+	pruned, err := suite.locationHistory.PruneLocations(time.Unix(start+90, 0))
+	suite.Require().NoError(err)
+	suite.Equal(int64(2), pruned)
+}
+
+func (suite *SpatialTestSuite) TestTrafficIngestion() {
+	observedAt := time.Now().Add(-5 * time.Minute).UTC().Truncate(time.Second)
+	request := models.TrafficIngestRequest{
+		Source: "city-sensors",
+		Observations: []models.TrafficReport{
+			{Latitude: 40.7128, Longitude: -74.0060, AverageSpeed: 20, FreeFlowSpeed: 50, Timestamp: observedAt},
+			{Latitude: 40.7150, Longitude: -74.0040, AverageSpeed: 45, ExternalID: "sensor-7", Timestamp: observedAt},
+			{Latitude: 95, Longitude: -74.0040, AverageSpeed: 45, Timestamp: observedAt},
+		},
+	}
+
+	post := func(path, contentType string, body []byte) (int, models.TrafficIngestResult) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := suite.app.Test(req, 10000)
+		suite.Require().NoError(err)
+
+		var response struct {
+			Result models.TrafficIngestResult `json:"result"`
+		}
+		suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+		return resp.StatusCode, response.Result
+	}
+
+	body, err := json.Marshal(request)
+	suite.Require().NoError(err)
+
+	status, result := post("/api/v1/traffic/observations", "application/json", body)
+	suite.Equal(http.StatusCreated, status)
+	suite.Equal(2, result.Stored)
+	suite.Equal(1, result.Rejected)
+	suite.Len(result.Errors, 1)
+
+	// Resending the batch stores nothing new
+	status, result = post("/api/v1/traffic/observations", "application/json", body)
+	suite.Equal(http.StatusCreated, status)
+	suite.Zero(result.Stored)
+	suite.Equal(2, result.Duplicates)
+
+	var congestion float64
+	err = suite.db.QueryRow(`
+		SELECT congestion_level FROM traffic_data
+		WHERE source = 'city-sensors' AND ST_Y(location) = 40.7128
+	`).Scan(&congestion)
+	suite.Require().NoError(err)
+	suite.InDelta(0.6, congestion, 1e-9)
+
+	csv := "tmc,dir,lat,lon,sp,ff,jf,timestamp\n" +
+		"C104,+,40.7180,-74.0010,12,48,7.5," + observedAt.Format(time.RFC3339) + "\n"
+	status, result = post("/api/v1/traffic/feeds/tmc-csv?source=tmc-city", "text/csv", []byte(csv))
+	suite.Equal(http.StatusCreated, status)
+	suite.Equal(1, result.Stored)
+
+	status, _ = post("/api/v1/traffic/feeds/tmc-csv", "text/csv", []byte("lat,lon\n40.7,-74.0\n"))
+	suite.Equal(http.StatusBadRequest, status)
+
+	// Only the aggregator writes fleet probe speeds
+	status, _ = post("/api/v1/traffic/feeds/tmc-csv?source=fleet_probe", "text/csv", []byte(csv))
+	suite.Equal(http.StatusBadRequest, status)
+
+	// Pruning removes everything observed before the cutoff
+	pruned, err := suite.trafficService.PruneTraffic(observedAt.Add(time.Second))
+	suite.Require().NoError(err)
+	suite.True(pruned >= 3)
+}
+
+func (suite *SpatialTestSuite) TestFleetSkipsEndedShifts() {
+	ended := time.Now().Add(-time.Hour)
+	depot := models.Location{Latitude: 40.7128, Longitude: -74.0060}
+
+	response, err := suite.routeService.OptimizeFleet(models.FleetOptimizationRequest{
+		Vehicles: []models.FleetVehicle{
+			{ID: "van-off", Type: "van", Capacity: 10, Depot: depot, ShiftEnd: &ended},
+			{ID: "van-on", Type: "van", Capacity: 10, Depot: depot},
+		},
+		Stops: []models.FleetStop{
+			{ID: "stop-1", Location: models.Location{Latitude: 40.7505, Longitude: -73.9707}, Demand: 2},
+			{ID: "stop-2", Location: models.Location{Latitude: 40.7589, Longitude: -73.9851}, Demand: 2},
+		},
+	})
+	suite.Require().NoError(err)
+	suite.Require().Len(response.Routes, 2)
+
+	suite.Equal("van-off", response.Routes[0].VehicleID)
+	suite.Empty(response.Routes[0].StopIDs)
+	suite.Contains(response.Routes[0].Excluded, "already ended")
+
+	suite.ElementsMatch([]string{"stop-1", "stop-2"}, response.Routes[1].StopIDs)
+	suite.Empty(response.Unassigned)
+}
+
+func (suite *SpatialTestSuite) TestFleetProbeTraffic() {
+	probes := services.NewFleetProbeAggregator(suite.trafficService)
+	probes.SetProbeSettings(services.FleetProbeSettings{Window: time.Second, MinDrivers: 2})
+
+	ping := func(speed float64, at time.Time) []models.Location {
+		return []models.Location{{Latitude: 40.6500, Longitude: -73.9500, Speed: &speed, Timestamp: at.Unix()}}
+	}
+
+	// Two vans at 50 km/h set the cell's free flow, then crawl at 7 km/h
+	now := time.Now()
+	probes.AddLocations("probe-driver-1", ping(14, now))
+	probes.AddLocations("probe-driver-2", ping(14, now))
+	_, err := probes.Flush(now)
+	suite.Require().NoError(err)
+
+	later := now.Add(2 * time.Second)
+	probes.AddLocations("probe-driver-1", ping(2, later))
+	probes.AddLocations("probe-driver-2", ping(2, later))
+	result, err := probes.Flush(later)
+	suite.Require().NoError(err)
+	suite.Equal(1, result.Stored)
+
+	analysis, err := suite.spatialService.AnalyzeTraffic(models.Location{Latitude: 40.6500, Longitude: -73.9500})
+	suite.Require().NoError(err)
+	suite.Require().NotNil(analysis.TrafficLevel)
+	suite.NotEqual("low", *analysis.TrafficLevel)
+}
+
+func (suite *SpatialTestSuite) TestTrafficAlertIncidents() {
+	monitor := services.NewTrafficAlertMonitor(suite.db, services.NewWebSocketHub())
+	since := time.Now().Add(-time.Second)
+
+	// One driver is parked next to the jam, one is far away and one has an
+	// active route through it
+	now := time.Now()
+	_, err := suite.locationHistory.RecordLocations("alert-driver-near", []models.Location{{Latitude: 40.6410, Longitude: -73.9410, Timestamp: now.Unix()}})
+	suite.Require().NoError(err)
+	_, err = suite.locationHistory.RecordLocations("alert-driver-far", []models.Location{{Latitude: 40.7500, Longitude: -73.9410, Timestamp: now.Unix()}})
+	suite.Require().NoError(err)
+	_, err = suite.db.Exec(`
+		INSERT INTO routes (driver_id, route_type, geometry, total_distance, total_duration,
+			estimated_fuel, naive_distance, naive_duration, naive_fuel)
+		VALUES ('alert-driver-route', 'calculated',
+			ST_GeomFromText('LINESTRING(-73.9600 40.6400, -73.9200 40.6420)', 4326), 3400, 300, 0.3, 3400, 300, 0.3)
+	`)
+	suite.Require().NoError(err)
+
+	jammed, freeFlow := 0.9, 0.1
+	_, err = suite.trafficService.Ingest("city-sensors", []models.TrafficReport{
+		{Latitude: 40.6412, Longitude: -73.9412, AverageSpeed: 5, CongestionLevel: &jammed, Timestamp: now},
+		{Latitude: 40.6413, Longitude: -73.9411, AverageSpeed: 6, CongestionLevel: &jammed, Timestamp: now},
+		{Latitude: 40.7000, Longitude: -73.9000, AverageSpeed: 45, CongestionLevel: &freeFlow, Timestamp: now},
+	})
+	suite.Require().NoError(err)
+
+	incidents, err := monitor.Incidents(since, time.Now())
+	suite.Require().NoError(err)
+	suite.Require().Len(incidents, 1)
+	suite.Equal(2, incidents[0].Observations)
+	suite.InDelta(0.9, incidents[0].CongestionLevel, 1e-9)
+
+	drivers, err := monitor.AffectedDrivers(incidents[0], time.Now())
+	suite.Require().NoError(err)
+	suite.ElementsMatch([]string{"alert-driver-near", "alert-driver-route"}, drivers)
+
+	// Observations are looked at once
+	incidents, err = monitor.Incidents(time.Now(), time.Now().Add(time.Second))
+	suite.Require().NoError(err)
+	suite.Empty(incidents)
+}
+
 func (suite *SpatialTestSuite) TestFindNearbyPOIs() {
 	req := httptest.NewRequest("GET", "/api/v1/spatial/nearby?lat=40.7128&lng=-74.0060&radius=2000&type=all&limit=10", nil)
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -357,8 +814,7 @@ func (suite *SpatialTestSuite) TestGeofenceCreation() {
 
 	req := httptest.NewRequest("POST", "/api/v1/geofences", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -372,6 +828,95 @@ func (suite *SpatialTestSuite) TestGeofenceCreation() {
 	suite.Contains(response, "geofence")
 }
 
+func (suite *SpatialTestSuite) TestGeofenceGeoJSONFeature() {
+	post := func(geometry string) (int, map[string]interface{}) {
+		body := `{"id":"test-depot-geofence","name":"Test Depot","geometry":` + geometry + `}`
+		req := httptest.NewRequest("POST", "/api/v1/geofences", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := suite.app.Test(req, 10000)
+		suite.Require().NoError(err)
+
+		var response map[string]interface{}
+		suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+		return resp.StatusCode, response
+	}
+
+	// A depot split across a road, drawn as a Feature with a MultiPolygon
+	status, _ := post(`{"type":"Feature","properties":{},"geometry":{"type":"MultiPolygon","coordinates":[
+		[[[-74.0300,40.6900],[-74.0290,40.6900],[-74.0290,40.6910],[-74.0300,40.6910],[-74.0300,40.6900]]],
+		[[[-74.0280,40.6900],[-74.0270,40.6900],[-74.0270,40.6910],[-74.0280,40.6910],[-74.0280,40.6900]]]
+	]}}`)
+	suite.Equal(http.StatusCreated, status)
+
+	var wkt string
+	err := suite.db.QueryRow(`SELECT ST_AsText(geometry) FROM geofences WHERE id = 'test-depot-geofence'`).Scan(&wkt)
+	suite.Require().NoError(err)
+	suite.Contains(wkt, "MULTIPOLYGON")
+
+	status, response := post(`{"type":"Polygon","coordinates":[[[-74.03,40.69],[-74.029,40.69],[-74.029,40.691]]]}`)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Contains(response["details"], "coordinates[0]")
+
+	status, response = post(`{"type":"LineString","coordinates":[[-74.03,40.69],[-74.029,40.69]]}`)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Contains(response["details"], "Polygon or MultiPolygon")
+}
+
+func (suite *SpatialTestSuite) TestGeofenceFormats() {
+	get := func(path, accept string) (int, string, map[string]interface{}) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := suite.app.Test(req, 10000)
+		suite.Require().NoError(err)
+
+		var response map[string]interface{}
+		suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+		return resp.StatusCode, resp.Header.Get("Content-Type"), response
+	}
+
+	// Geometries are GeoJSON by default
+	status, _, response := get("/api/v1/geofences/test-geofence-1", "")
+	suite.Equal(http.StatusOK, status)
+	geofence := response["geofence"].(map[string]interface{})
+	suite.Equal("Polygon", geofence["geometry"].(map[string]interface{})["type"])
+
+	_, _, response = get("/api/v1/geofences/test-geofence-1?format=wkt", "")
+	geofence = response["geofence"].(map[string]interface{})
+	suite.Equal("POLYGON((-74.017 40.704,-74.01 40.704,-74.01 40.712,-74.017 40.712,-74.017 40.704))", geofence["geometry"])
+
+	_, _, response = get("/api/v1/geofences?format=wkb-hex", "")
+	for _, value := range response["geofences"].([]interface{}) {
+		suite.Regexp("^0103000000", value.(map[string]interface{})["geometry"])
+	}
+
+	_, _, response = get("/api/v1/geofences/test-geofence-1?format=polyline", "")
+	geofence = response["geofence"].(map[string]interface{})
+	suite.Len(geofence["geometry"], 1)
+
+	status, _, _ = get("/api/v1/geofences?format=kml", "")
+	suite.Equal(http.StatusBadRequest, status)
+
+	// Asking for GeoJSON returns the document itself
+	status, contentType, response := get("/api/v1/geofences/test-geofence-1", "application/geo+json")
+	suite.Equal(http.StatusOK, status)
+	suite.Contains(contentType, "application/geo+json")
+	suite.Equal("Feature", response["type"])
+	suite.Equal("test-geofence-1", response["id"])
+	suite.Equal("Test Downtown Zone", response["properties"].(map[string]interface{})["name"])
+
+	status, contentType, response = get("/api/v1/geofences.geojson?active=true", "")
+	suite.Equal(http.StatusOK, status)
+	suite.Contains(contentType, "application/geo+json")
+	suite.Equal("FeatureCollection", response["type"])
+	suite.Len(response["features"], 2)
+}
+
 func (suite *SpatialTestSuite) TestGeofenceCheck() {
 	request := map[string]interface{}{
 		"driver_id": "test-driver",
@@ -388,8 +933,7 @@ func (suite *SpatialTestSuite) TestGeofenceCheck() {
 
 	req := httptest.NewRequest("POST", "/api/v1/geofences/check", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -406,6 +950,98 @@ func (suite *SpatialTestSuite) TestGeofenceCheck() {
 	suite.True(performance["check_time"].(float64) < 100) // Should be under 100ms
 }
 
+func (suite *SpatialTestSuite) TestGeofenceCheckRejectsFutureTimestamp() {
+	body := fmt.Sprintf(`{"driver_id":"test-driver","location":{"latitude":40.7080,"longitude":-74.0135,"timestamp":%d}}`,
+		time.Now().Add(time.Hour).Unix())
+	req := httptest.NewRequest("POST", "/api/v1/geofences/check", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (suite *SpatialTestSuite) TestGeofenceEntryExitTransitions() {
+	check := func(lat, lng float64) []interface{} {
+		request := map[string]interface{}{
+			"driver_id": "transition-driver",
+			"location": map[string]interface{}{
+				"latitude":  lat,
+				"longitude": lng,
+				"accuracy":  10,
+				"timestamp": time.Now().Unix(),
+			},
+		}
+
+		body, err := json.Marshal(request)
+		suite.Require().NoError(err)
+
+		req := httptest.NewRequest("POST", "/api/v1/geofences/check", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+suite.token)
+
+		resp, err := suite.app.Test(req, 10000)
+		suite.Require().NoError(err)
+		suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+		var response map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		suite.Require().NoError(err)
+
+		return response["alerts"].([]interface{})
+	}
+
+	// Crossing into the downtown zone produces exactly one entry
+	alerts := check(40.7080, -74.0135)
+	suite.Require().Len(alerts, 1)
+	suite.Equal("entry", alerts[0].(map[string]interface{})["alert_type"])
+
+	// Staying inside is not a new transition
+	suite.Empty(check(40.7085, -74.0130))
+
+	// Jitter just outside the boundary stays within the buffer
+	suite.Empty(check(40.7121, -74.0135))
+
+	// Leaving the zone produces exactly one exit
+	alerts = check(40.7300, -74.0135)
+	suite.Require().Len(alerts, 1)
+	suite.Equal("exit", alerts[0].(map[string]interface{})["alert_type"])
+
+	suite.Empty(check(40.7310, -74.0135))
+
+	// Both transitions are recorded in the activity log
+	req := httptest.NewRequest("GET", "/api/v1/geofences/activity?driver_id=transition-driver&limit=1", nil)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var activity map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&activity)
+	suite.Require().NoError(err)
+
+	summary := activity["summary"].(map[string]interface{})
+	suite.Equal(float64(1), summary["entries"])
+	suite.Equal(float64(1), summary["exits"])
+	suite.Equal(float64(1), summary["unique_geofences"])
+
+	events := activity["activity"].([]interface{})
+	suite.Require().Len(events, 1)
+	suite.Equal("exit", events[0].(map[string]interface{})["event_type"])
+	suite.NotNil(activity["next_cursor"])
+}
+
+func (suite *SpatialTestSuite) TestGeofenceActivityInvalidCursor() {
+	req := httptest.NewRequest("GET", "/api/v1/geofences/activity?cursor=not-a-cursor", nil)
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+
+	resp, err := suite.app.Test(req, 10000)
+	suite.Require().NoError(err)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
 func (suite *SpatialTestSuite) TestDistanceCalculation() {
 	request := models.DistanceRequest{
 		Origin: models.Location{
@@ -424,8 +1060,7 @@ func (suite *SpatialTestSuite) TestDistanceCalculation() {
 
 	req := httptest.NewRequest("POST", "/api/v1/spatial/distance", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -443,8 +1078,7 @@ func (suite *SpatialTestSuite) TestDistanceCalculation() {
 
 func (suite *SpatialTestSuite) TestPerformanceMetrics() {
 	req := httptest.NewRequest("GET", "/api/v1/performance/metrics", nil)
-	req.Header.Set("Authorization", "Bearer test-token")
-	req.Header.Set("X-Driver-ID", "test-driver")
+	req.Header.Set("Authorization", "Bearer "+suite.token)
 
 	resp, err := suite.app.Test(req, 10000)
 	suite.Require().NoError(err)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	fasthttpws "github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+func TestTrafficAlertSuppression(t *testing.T) {
+	hub := services.NewWebSocketHub()
+	go hub.Run()
+	url := startWebSocketServer(t, hub)
+
+	conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+driverToken(t, "driver-1", "driver"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	readUntil(t, conn, "connection_established")
+	// The hub confirms each connection with a driver message of its own
+	readUntil(t, conn, "driver_message")
+
+	monitor := services.NewTrafficAlertMonitor(nil, hub)
+	monitor.SetAlertSettings(services.TrafficAlertSettings{Suppression: 30 * time.Minute})
+
+	now := time.Now()
+	incident := services.TrafficIncident{
+		Key:             "8128:-14789",
+		Location:        models.Location{Latitude: 40.6412, Longitude: -73.9412},
+		CongestionLevel: 0.7,
+		AverageSpeed:    12,
+		Observations:    3,
+		Timestamp:       now,
+	}
+
+	assert.Equal(t, 1, monitor.Alert(incident, []string{"driver-1"}, now))
+	message := readUntil(t, conn, "driver_message")
+	payload := message.Payload.(map[string]interface{})
+	assert.Equal(t, "traffic_alert", payload["type"])
+	assert.Equal(t, "medium", payload["severity"])
+
+	// The same incident is not re-sent while suppressed...
+	assert.Zero(t, monitor.Alert(incident, []string{"driver-1"}, now.Add(time.Minute)))
+
+	// ...unless it gets worse
+	incident.CongestionLevel = 0.9
+	assert.Equal(t, 1, monitor.Alert(incident, []string{"driver-1"}, now.Add(2*time.Minute)))
+	assert.Zero(t, monitor.Alert(incident, []string{"driver-1"}, now.Add(3*time.Minute)))
+
+	// A different incident, or the same one after the window, is sent
+	other := incident
+	other.Key = "8129:-14789"
+	assert.Equal(t, 1, monitor.Alert(other, []string{"driver-1"}, now.Add(3*time.Minute)))
+	assert.Equal(t, 1, monitor.Alert(incident, []string{"driver-1"}, now.Add(33*time.Minute)))
+}
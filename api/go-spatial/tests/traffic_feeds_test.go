@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+const datexPublication = `<?xml version="1.0" encoding="UTF-8"?>
+<d2LogicalModel xmlns="http://datex2.eu/schema/2/2_0" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" modelBaseVersion="2">
+  <payloadPublication xsi:type="ElaboratedDataPublication" lang="en">
+    <publicationTime>2024-01-15T08:00:00Z</publicationTime>
+    <elaboratedData>
+      <basicData xsi:type="TrafficSpeed">
+        <measurementOrCalculationTime>2024-01-15T07:59:00Z</measurementOrCalculationTime>
+        <pertinentLocation xsi:type="Point">
+          <pointByCoordinates>
+            <pointCoordinates><latitude>52.0907</latitude><longitude>5.1214</longitude></pointCoordinates>
+          </pointByCoordinates>
+        </pertinentLocation>
+        <averageVehicleSpeed numberOfInputValuesUsed="12"><speed>32.5</speed></averageVehicleSpeed>
+      </basicData>
+    </elaboratedData>
+    <elaboratedData>
+      <basicData xsi:type="TrafficStatus">
+        <measurementOrCalculationTime>2024-01-15T07:59:00Z</measurementOrCalculationTime>
+        <pertinentLocation xsi:type="Point">
+          <pointByCoordinates>
+            <pointCoordinates><latitude>52.0907</latitude><longitude>5.1214</longitude></pointCoordinates>
+          </pointByCoordinates>
+        </pertinentLocation>
+        <trafficStatus><trafficStatusValue>congested</trafficStatusValue></trafficStatus>
+      </basicData>
+    </elaboratedData>
+    <elaboratedData>
+      <basicData xsi:type="TrafficSpeed">
+        <pertinentLocation xsi:type="Point">
+          <locationForDisplay><latitude>52.1</latitude><longitude>5.2</longitude></locationForDisplay>
+        </pertinentLocation>
+        <averageVehicleSpeed><speed>88</speed></averageVehicleSpeed>
+      </basicData>
+    </elaboratedData>
+    <elaboratedData>
+      <basicData xsi:type="TrafficStatus">
+        <pertinentLocation xsi:type="Point">
+          <locationForDisplay><latitude>52.3</latitude><longitude>5.3</longitude></locationForDisplay>
+        </pertinentLocation>
+        <trafficStatus><trafficStatusValue>heavy</trafficStatusValue></trafficStatus>
+      </basicData>
+    </elaboratedData>
+  </payloadPublication>
+</d2LogicalModel>`
+
+func TestParseDATEX2(t *testing.T) {
+	reports, err := services.ParseDATEX2(strings.NewReader(datexPublication))
+	require.NoError(t, err)
+
+	// The status-only point has no speed to store
+	require.Len(t, reports, 2)
+
+	merged := reports[0]
+	assert.Equal(t, 52.0907, merged.Latitude)
+	assert.Equal(t, 5.1214, merged.Longitude)
+	assert.Equal(t, 32.5, merged.AverageSpeed)
+	require.NotNil(t, merged.CongestionLevel)
+	assert.Equal(t, 0.8, *merged.CongestionLevel)
+	assert.True(t, merged.Timestamp.Equal(time.Date(2024, 1, 15, 7, 59, 0, 0, time.UTC)))
+
+	// Records without a measurement time take the publication time
+	assert.Equal(t, 88.0, reports[1].AverageSpeed)
+	assert.Nil(t, reports[1].CongestionLevel)
+	assert.True(t, reports[1].Timestamp.Equal(time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)))
+
+	_, err = services.ParseDATEX2(strings.NewReader("<d2LogicalModel><payloadPublication>"))
+	assert.Error(t, err)
+}
+
+func TestParseTMCCSV(t *testing.T) {
+	feed := "TMC, DIR, LAT, LON, SP, FF, JF, TIMESTAMP\n" +
+		"C104,+,40.718,-74.001,12,48,7.5,2024-01-15T07:59:00Z\n" +
+		"C105,-,40.720,-74.003,40,,,1705305540\n"
+
+	reports, err := services.ParseTMCCSV(strings.NewReader(feed))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+
+	assert.Equal(t, "C104+", reports[0].ExternalID)
+	assert.Equal(t, 12.0, reports[0].AverageSpeed)
+	assert.Equal(t, 48.0, reports[0].FreeFlowSpeed)
+	require.NotNil(t, reports[0].CongestionLevel)
+	assert.Equal(t, 0.75, *reports[0].CongestionLevel)
+
+	assert.Equal(t, "C105-", reports[1].ExternalID)
+	assert.Nil(t, reports[1].CongestionLevel)
+	assert.Equal(t, int64(1705305540), reports[1].Timestamp.Unix())
+
+	_, err = services.ParseTMCCSV(strings.NewReader("lat,lon\n40.7,-74.0\n"))
+	assert.ErrorContains(t, err, "no sp column")
+
+	_, err = services.ParseTMCCSV(strings.NewReader("lat,lon,sp\n40.7,-74.0,fast\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestParseProbeRecords(t *testing.T) {
+	feed := `{"probe_id":"van-12","latitude":40.71,"longitude":-74.0,"speed":31.5,"heading":90,"timestamp":"2024-01-15T07:59:00Z"}
+
+{"probe_id":"van-13","latitude":40.72,"longitude":-74.01,"speed":12,"timestamp":1705305540}
+`
+	reports, err := services.ParseProbeRecords(strings.NewReader(feed))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+
+	assert.Equal(t, "van-12", reports[0].ExternalID)
+	assert.Equal(t, 31.5, reports[0].AverageSpeed)
+	assert.Equal(t, 90.0, reports[0].Properties["heading"])
+	assert.Equal(t, int64(1705305540), reports[1].Timestamp.Unix())
+
+	_, err = services.ParseProbeRecords(strings.NewReader(`{"probe_id":"van-12","latitude":40.71,"longitude":-74.0}`))
+	assert.ErrorContains(t, err, "speed is required")
+}
+
+func TestValidateTrafficReport(t *testing.T) {
+	now := time.Now()
+	valid := models.TrafficReport{Latitude: 40.71, Longitude: -74.0, AverageSpeed: 30, Timestamp: now}
+	assert.NoError(t, services.ValidateTrafficReport(valid, now))
+
+	congestion := 1.5
+	for name, report := range map[string]models.TrafficReport{
+		"latitude":   {Latitude: 91, Longitude: -74.0, AverageSpeed: 30},
+		"null":       {AverageSpeed: 30},
+		"speed":      {Latitude: 40.71, Longitude: -74.0, AverageSpeed: 400},
+		"negative":   {Latitude: 40.71, Longitude: -74.0, AverageSpeed: -1},
+		"congestion": {Latitude: 40.71, Longitude: -74.0, AverageSpeed: 30, CongestionLevel: &congestion},
+		"future":     {Latitude: 40.71, Longitude: -74.0, AverageSpeed: 30, Timestamp: now.Add(time.Hour)},
+		"stale":      {Latitude: 40.71, Longitude: -74.0, AverageSpeed: 30, Timestamp: now.AddDate(0, -3, 0)},
+	} {
+		assert.Error(t, services.ValidateTrafficReport(report, now), name)
+	}
+
+	assert.Error(t, services.ValidateTrafficSource("City Sensors"))
+	assert.NoError(t, services.ValidateTrafficSource("city-sensors"))
+}
+
+func TestUnknownTrafficFeedFormat(t *testing.T) {
+	traffic := services.NewTrafficService(nil)
+	_, err := traffic.IngestFeed("geojson", "city", strings.NewReader("{}"))
+	assert.True(t, errors.Is(err, services.ErrInvalidTrafficFeed))
+
+	// Registered adapters are used for their format
+	traffic.RegisterFeedAdapter("broken", services.TrafficFeedAdapterFunc(func(io.Reader) ([]models.TrafficReport, error) {
+		return nil, errors.New("unreadable")
+	}))
+	_, err = traffic.IngestFeed("broken", "city", strings.NewReader(""))
+	assert.True(t, errors.Is(err, services.ErrInvalidTrafficFeed))
+
+	assert.Error(t, traffic.SetFeeds([]services.TrafficFeed{{Source: "city", Format: "geojson", Location: "feed.json"}}))
+	assert.NoError(t, traffic.SetFeeds([]services.TrafficFeed{{Source: "city", Format: "broken", Location: "feed.json"}}))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+// Two 4 km legs north of the origin with traffic observed halfway along
+// the first
+var trafficStops = []models.Location{
+	{Latitude: 40.0, Longitude: -74.0},
+	{Latitude: 40.036, Longitude: -74.0},
+	{Latitude: 40.072, Longitude: -74.0},
+}
+
+func trafficNear(latitude, speed float64) []services.TrafficObservation {
+	return []services.TrafficObservation{
+		{Location: models.Location{Latitude: latitude, Longitude: -74.0}, Speed: speed},
+	}
+}
+
+func TestHourOfWeek(t *testing.T) {
+	monday := time.Date(2024, 1, 15, 0, 30, 0, 0, time.UTC)
+	assert.Equal(t, 0, services.HourOfWeek(monday))
+	assert.Equal(t, 8, services.HourOfWeek(monday.Add(8*time.Hour)))
+	assert.Equal(t, 167, services.HourOfWeek(monday.Add(-time.Hour)))
+
+	// Hours are counted in UTC
+	newYork := time.FixedZone("EST", -5*3600)
+	assert.Equal(t, 5, services.HourOfWeek(time.Date(2024, 1, 15, 0, 30, 0, 0, newYork)))
+}
+
+func TestLiveTrafficFadesIntoHistory(t *testing.T) {
+	observedAt := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	history := map[int][]services.TrafficObservation{
+		services.HourOfWeek(observedAt):                    trafficNear(40.018, 40),
+		services.HourOfWeek(observedAt.Add(2 * time.Hour)): trafficNear(40.018, 30),
+	}
+	traffic := services.NewTrafficConditions(trafficNear(40.018, 10), history, observedAt)
+
+	legs, err := services.NewRouteService(nil).LegCosts(trafficStops, traffic, "van", services.RoadOptions{}, observedAt)
+	require.NoError(t, err)
+	distance := legs.Distances[0][1] / 1000.0
+
+	speedAt := func(at time.Time) float64 {
+		return distance / (legs.DurationsAt(at)[0][1] / 3600)
+	}
+
+	// Live traffic counts fully when observed, half after 30 minutes and
+	// not at all an hour later
+	assert.InDelta(t, 10, speedAt(observedAt), 1e-6)
+	assert.InDelta(t, 25, speedAt(observedAt.Add(30*time.Minute)), 1e-6)
+	assert.InDelta(t, 30, speedAt(observedAt.Add(2*time.Hour)), 1e-6)
+
+	// Without history for the hour the vehicle's speed profile applies
+	assert.Greater(t, speedAt(observedAt.Add(5*time.Hour)), 30.0)
+}
+
+func TestScheduleUsesTrafficOfDepartureHour(t *testing.T) {
+	// Rush hour crawls along the second leg at 7:00 and clears by 10:00
+	start := time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC)
+	history := map[int][]services.TrafficObservation{
+		services.HourOfWeek(start):                    trafficNear(40.054, 8),
+		services.HourOfWeek(start.Add(3 * time.Hour)): trafficNear(40.054, 45),
+	}
+	traffic := services.NewTrafficConditions(nil, history, start)
+
+	legs, err := services.NewRouteService(nil).LegCosts(trafficStops, traffic, "van", services.RoadOptions{}, start)
+	require.NoError(t, err)
+
+	problem := services.WindowProblem{
+		Costs:     legs.Durations,
+		Durations: legs.Durations,
+		Windows: []services.StopWindow{
+			services.OpenWindow(0),
+			services.OpenWindow(3 * 3600), // leaves stop 1 after 10:00
+			services.OpenWindow(0),
+		},
+	}
+	hours := problem.Hours()
+	assert.GreaterOrEqual(t, hours, 4)
+	problem.HourlyDurations = legs.HourlyDurations(start, hours)
+	require.NotNil(t, problem.HourlyDurations)
+
+	timings := problem.Schedule([]int{0, 1, 2})
+	secondLeg := timings[2].Arrival - timings[1].Departure
+
+	departure := start.Add(time.Duration(timings[1].Departure) * time.Second)
+	assert.InDelta(t, legs.DurationsAt(departure)[1][2], secondLeg, 1e-6)
+	assert.Less(t, secondLeg, legs.Durations[1][2]/4)
+
+	// Without traffic data durations do not vary
+	legs, err = services.NewRouteService(nil).LegCosts(trafficStops, nil, "van", services.RoadOptions{}, start)
+	require.NoError(t, err)
+	assert.Nil(t, legs.HourlyDurations(start, hours))
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	fasthttpws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go-spatial/handlers"
+	"go-spatial/middleware"
+	"go-spatial/models"
+	"go-spatial/services"
+)
+
+// startWebSocketServer serves /ws/spatial the same way main does and returns
+// its base URL
+func startWebSocketServer(t *testing.T, hub *services.WebSocketHub) string {
+	verifier, err := middleware.NewTokenVerifier(middleware.JWTConfig{Secret: testJWTSecret})
+	require.NoError(t, err)
+
+	wsHandler := handlers.NewWebSocketHandler(hub, nil, verifier)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use("/ws", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+	app.Use("/ws", middleware.WebSocketAuthentication(verifier))
+	app.Get("/ws/spatial", websocket.New(wsHandler.HandleConnection, websocket.Config{
+		Subprotocols: []string{"bearer"},
+	}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	return "ws://" + ln.Addr().String() + "/ws/spatial"
+}
+
+func driverToken(t *testing.T, driverID string, roles ...string) string {
+	return signHS256(t, jwt.MapClaims{
+		"driver_id": driverID,
+		"roles":     roles,
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func readWebSocketMessage(t *testing.T, conn *fasthttpws.Conn) models.WebSocketMessage {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	var message models.WebSocketMessage
+	require.NoError(t, json.Unmarshal(data, &message))
+	return message
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	hub := services.NewWebSocketHub()
+	go hub.Run()
+
+	url := startWebSocketServer(t, hub)
+
+	t.Run("query token binds verified driver", func(t *testing.T) {
+		conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+driverToken(t, "driver-1")+"&driver_id=driver-2", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		message := readWebSocketMessage(t, conn)
+		assert.Equal(t, "connection_established", message.Type)
+		assert.Equal(t, "driver-1", message.DriverID)
+	})
+
+	t.Run("subprotocol token", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Sec-WebSocket-Protocol", "bearer, "+driverToken(t, "driver-3"))
+
+		conn, resp, err := fasthttpws.DefaultDialer.Dial(url, header)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"))
+		assert.Equal(t, "driver-3", readWebSocketMessage(t, conn).DriverID)
+	})
+
+	t.Run("first message handshake", func(t *testing.T) {
+		conn, _, err := fasthttpws.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":    "auth",
+			"payload": map[string]string{"token": driverToken(t, "driver-4")},
+		}))
+		assert.Equal(t, "driver-4", readWebSocketMessage(t, conn).DriverID)
+	})
+
+	t.Run("invalid query token is rejected before upgrade", func(t *testing.T) {
+		_, resp, err := fasthttpws.DefaultDialer.Dial(url+"?token=not-a-token", nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("invalid handshake token is closed", func(t *testing.T) {
+		conn, _, err := fasthttpws.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":    "auth",
+			"payload": map[string]string{"token": "forged"},
+		}))
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err = conn.ReadMessage()
+		assert.True(t, fasthttpws.IsCloseError(err, 4401), "expected close code 4401, got %v", err)
+	})
+}
+
+// recordingProcessor stands in for the location tracker
+type recordingProcessor struct {
+	locations chan models.Location
+	hub       *services.WebSocketHub
+}
+
+func (p *recordingProcessor) ProcessLocation(driverID string, location models.Location) (*services.LocationUpdateResult, error) {
+	p.locations <- location
+	if p.hub != nil {
+		p.hub.PublishLocation(driverID, location)
+	}
+	return &services.LocationUpdateResult{GeofenceAlerts: []models.GeofenceAlert{}}, nil
+}
+
+func (p *recordingProcessor) ProcessLocationBatch(driverID string, locations []models.Location) (*services.LocationUpdateResult, error) {
+	for _, location := range locations {
+		p.locations <- location
+	}
+	return &services.LocationUpdateResult{PointsRecorded: len(locations), GeofenceAlerts: []models.GeofenceAlert{}}, nil
+}
+
+func TestWebSocketLocationUpdates(t *testing.T) {
+	processor := &recordingProcessor{locations: make(chan models.Location, 1)}
+
+	hub := services.NewWebSocketHub()
+	hub.SetLocationProcessor(processor)
+	go hub.Run()
+
+	url := startWebSocketServer(t, hub)
+
+	conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+driverToken(t, "driver-1"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "connection_established", readWebSocketMessage(t, conn).Type)
+
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":    "location_update",
+		"payload": map[string]interface{}{"latitude": 40.7128, "longitude": -74.0060, "accuracy": 5},
+	}))
+
+	select {
+	case location := <-processor.locations:
+		assert.Equal(t, 40.7128, location.Latitude)
+		assert.NotZero(t, location.Timestamp)
+	case <-time.After(2 * time.Second):
+		t.Fatal("location update was not processed")
+	}
+
+	// Skip the connection_confirmed message sent by the handler
+	message := readWebSocketMessage(t, conn)
+	for message.Type == "driver_message" {
+		message = readWebSocketMessage(t, conn)
+	}
+	assert.Equal(t, "location_processed", message.Type)
+
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":    "location_update",
+		"payload": map[string]interface{}{"latitude": 123.0, "longitude": -74.0060},
+	}))
+	assert.Equal(t, "error", readWebSocketMessage(t, conn).Type)
+	assert.Empty(t, processor.locations)
+}
+
+func TestValidateLocation(t *testing.T) {
+	speed := -1.0
+	heading := 400.0
+
+	assert.NoError(t, services.ValidateLocation(models.Location{Latitude: 40.7128, Longitude: -74.0060}))
+
+	invalid := map[string]models.Location{
+		"latitude":  {Latitude: 91, Longitude: 10},
+		"longitude": {Latitude: 10, Longitude: 181},
+		"missing":   {},
+		"accuracy":  {Latitude: 10, Longitude: 10, Accuracy: -1},
+		"speed":     {Latitude: 10, Longitude: 10, Speed: &speed},
+		"heading":   {Latitude: 10, Longitude: 10, Heading: &heading},
+		"future":    {Latitude: 10, Longitude: 10, Timestamp: time.Now().Add(time.Hour).Unix()},
+	}
+	for name, location := range invalid {
+		assert.Error(t, services.ValidateLocation(location), name)
+	}
+}
+
+// readUntil skips messages until one of the given type arrives
+func readUntil(t *testing.T, conn *fasthttpws.Conn, messageType string) models.WebSocketMessage {
+	for {
+		message := readWebSocketMessage(t, conn)
+		if message.Type == messageType {
+			return message
+		}
+	}
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	hub := services.NewWebSocketHub()
+	processor := &recordingProcessor{locations: make(chan models.Location, 10), hub: hub}
+	hub.SetLocationProcessor(processor)
+	go hub.Run()
+
+	url := startWebSocketServer(t, hub)
+
+	dial := func(token string) *fasthttpws.Conn {
+		conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+token, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		readUntil(t, conn, "connection_established")
+		return conn
+	}
+
+	subscribe := func(conn *fasthttpws.Conn, topics ...string) models.WebSocketMessage {
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":    "subscribe",
+			"payload": map[string]interface{}{"topics": topics},
+		}))
+		for {
+			message := readWebSocketMessage(t, conn)
+			if message.Type == "subscriptions" || message.Type == "error" {
+				return message
+			}
+		}
+	}
+
+	dispatcher := dial(driverToken(t, "dispatch-1", "dispatcher"))
+	driver := dial(driverToken(t, "driver-1", "driver"))
+	otherDriver := dial(driverToken(t, "driver-2", "driver"))
+
+	// Drivers may only follow themselves
+	assert.Equal(t, "error", subscribe(otherDriver, "driver:driver-1").Type)
+	assert.Equal(t, "error", subscribe(otherDriver, "alerts").Type)
+	assert.Equal(t, "subscriptions", subscribe(otherDriver, "driver:driver-2").Type)
+
+	assert.Equal(t, "error", subscribe(dispatcher, "bbox:1,2,3").Type)
+	assert.Equal(t, "error", subscribe(dispatcher, "weather").Type)
+	assert.Equal(t, "subscriptions", subscribe(dispatcher, "driver:driver-1", "bbox:-75,40,-73,41").Type)
+
+	require.NoError(t, driver.WriteJSON(map[string]interface{}{
+		"type":    "location_update",
+		"payload": map[string]interface{}{"latitude": 40.7128, "longitude": -74.0060},
+	}))
+
+	// Matching both the driver and the region topic delivers one message
+	message := readUntil(t, dispatcher, "location_update")
+	assert.Equal(t, "driver-1", message.DriverID)
+
+	require.NoError(t, dispatcher.WriteJSON(map[string]interface{}{"type": "ping"}))
+	assert.Equal(t, "pong", readWebSocketMessage(t, dispatcher).Type)
+}
+
+func TestWebSocketBackplaneAcrossReplicas(t *testing.T) {
+	backplane := services.NewMemoryBackplane()
+	t.Cleanup(func() { backplane.Close() })
+
+	replicaA := services.NewWebSocketHub()
+	replicaB := services.NewWebSocketHub()
+	require.NoError(t, replicaA.SetBackplane(backplane))
+	require.NoError(t, replicaB.SetBackplane(backplane))
+
+	processor := &recordingProcessor{locations: make(chan models.Location, 10), hub: replicaB}
+	replicaB.SetLocationProcessor(processor)
+
+	go replicaA.Run()
+	go replicaB.Run()
+
+	urlA := startWebSocketServer(t, replicaA)
+	urlB := startWebSocketServer(t, replicaB)
+
+	dispatcher, _, err := fasthttpws.DefaultDialer.Dial(urlA+"?token="+driverToken(t, "dispatch-1", "dispatcher"), nil)
+	require.NoError(t, err)
+	defer dispatcher.Close()
+	readUntil(t, dispatcher, "connection_established")
+
+	driver, _, err := fasthttpws.DefaultDialer.Dial(urlB+"?token="+driverToken(t, "driver-1"), nil)
+	require.NoError(t, err)
+	defer driver.Close()
+	readUntil(t, driver, "connection_established")
+
+	// A message for a driver connected to replica B, sent from replica A
+	require.NoError(t, replicaA.BroadcastToDriver("driver-1", map[string]string{"type": "route_update"}))
+	message := readUntil(t, driver, "driver_message")
+	assert.Equal(t, "driver-1", message.DriverID)
+
+	// Subscriptions on replica A receive locations reported to replica B
+	require.NoError(t, dispatcher.WriteJSON(map[string]interface{}{
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"topics": []string{"driver:driver-1"}},
+	}))
+	readUntil(t, dispatcher, "subscriptions")
+
+	require.NoError(t, driver.WriteJSON(map[string]interface{}{
+		"type":    "location_update",
+		"payload": map[string]interface{}{"latitude": 40.7128, "longitude": -74.0060},
+	}))
+	assert.Equal(t, "driver-1", readUntil(t, dispatcher, "location_update").DriverID)
+
+	// Broadcasts reach clients on both replicas
+	require.NoError(t, replicaB.BroadcastToAll(map[string]string{"type": "notice"}))
+	readUntil(t, dispatcher, "broadcast")
+	readUntil(t, driver, "broadcast")
+}
+
+func TestWebSocketMessageIDsSharedAcrossReplicas(t *testing.T) {
+	backplane := services.NewMemoryBackplane()
+	t.Cleanup(func() { backplane.Close() })
+
+	replicaA := services.NewWebSocketHub()
+	replicaB := services.NewWebSocketHub()
+	require.NoError(t, replicaA.SetBackplane(backplane))
+	require.NoError(t, replicaB.SetBackplane(backplane))
+
+	go replicaA.Run()
+	go replicaB.Run()
+
+	driver, _, err := fasthttpws.DefaultDialer.Dial(startWebSocketServer(t, replicaB)+"?token="+driverToken(t, "driver-1"), nil)
+	require.NoError(t, err)
+	defer driver.Close()
+	readUntil(t, driver, "connection_established")
+
+	// Messages for one driver sent from both replicas draw on one sequence
+	for i := 0; i < 4; i++ {
+		sender := replicaA
+		if i%2 == 1 {
+			sender = replicaB
+		}
+		require.NoError(t, sender.BroadcastToDriver("driver-1", map[string]int{"n": i}))
+	}
+
+	// The connection_confirmed message takes an ID from the same sequence
+	ids := make(map[uint64]bool)
+	for len(ids) < 5 {
+		message := readUntil(t, driver, "driver_message")
+		assert.False(t, ids[message.ID], "duplicate message ID %d", message.ID)
+		assert.LessOrEqual(t, message.ID, uint64(5))
+		ids[message.ID] = true
+	}
+}
+
+func TestWebSocketReplayOnReconnect(t *testing.T) {
+	hub := services.NewWebSocketHub()
+	hub.SetOutboxSettings(services.OutboxSettings{MaxMessages: 4, Retention: time.Minute})
+	go hub.Run()
+
+	url := startWebSocketServer(t, hub)
+	token := driverToken(t, "driver-1")
+
+	conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+token, nil)
+	require.NoError(t, err)
+
+	confirmed := readUntil(t, conn, "driver_message")
+	require.NotZero(t, confirmed.ID)
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":    "ack",
+		"payload": map[string]interface{}{"id": confirmed.ID},
+	}))
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ping"}))
+	readUntil(t, conn, "pong")
+	conn.Close()
+
+	// Sent while the driver is offline
+	require.NoError(t, hub.BroadcastToDriver("driver-1", map[string]string{"type": "route_update"}))
+	require.NoError(t, hub.BroadcastToDriver("driver-1", map[string]string{"type": "geofence_alert"}))
+
+	resume := func(lastID uint64) ([]models.WebSocketMessage, services.ResumeResult) {
+		conn, _, err := fasthttpws.DefaultDialer.Dial(url+"?token="+token, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		readUntil(t, conn, "connection_established")
+
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":    "resume",
+			"payload": map[string]interface{}{"last_id": lastID},
+		}))
+
+		replayed := make([]models.WebSocketMessage, 0)
+		for {
+			message := readWebSocketMessage(t, conn)
+			if message.Type == "driver_message" {
+				replayed = append(replayed, message)
+				continue
+			}
+			if message.Type == "resumed" {
+				data, err := json.Marshal(message.Payload)
+				require.NoError(t, err)
+				var result services.ResumeResult
+				require.NoError(t, json.Unmarshal(data, &result))
+				return replayed, result
+			}
+		}
+	}
+
+	replayed, result := resume(confirmed.ID)
+	assert.True(t, result.Complete)
+
+	// Live connection_confirmed messages may interleave with the replay;
+	// the offline messages must be there, in order and after the ack
+	types := make([]string, 0)
+	lastID := confirmed.ID
+	for _, message := range replayed {
+		assert.Greater(t, message.ID, confirmed.ID)
+		payload := message.Payload.(map[string]interface{})
+		if payload["type"] == "route_update" || payload["type"] == "geofence_alert" {
+			assert.Greater(t, message.ID, lastID)
+			lastID = message.ID
+			types = append(types, payload["type"].(string))
+		}
+	}
+	assert.Equal(t, []string{"route_update", "geofence_alert"}, types)
+	// IDs within a run are contiguous
+	assert.Equal(t, confirmed.ID+2, lastID)
+
+	// Overflowing the outbox makes replay from the old ID incomplete
+	for i := 0; i < 6; i++ {
+		require.NoError(t, hub.BroadcastToDriver("driver-1", map[string]int{"n": i}))
+	}
+	_, result = resume(confirmed.ID)
+	assert.False(t, result.Complete)
+}